@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// PluginRefsFunc returns the tags of other plugins that args refers to.
+// args is the object created by the plugin's NewPluginArgsFunc.
+// It must not have any side effect.
+type PluginRefsFunc func(args any) ([]string, error)
+
+var pluginRefsReg struct {
+	sync.RWMutex
+	m map[string]PluginRefsFunc
+}
+
+// RegPluginRefsFunc registers f for plugin type typ. CheckConfig uses it
+// to verify references between plugins.
+// If the type has been registered. RegPluginRefsFunc will panic.
+func RegPluginRefsFunc(typ string, f PluginRefsFunc) {
+	pluginRefsReg.Lock()
+	defer pluginRefsReg.Unlock()
+
+	if pluginRefsReg.m == nil {
+		pluginRefsReg.m = make(map[string]PluginRefsFunc)
+	}
+	if _, ok := pluginRefsReg.m[typ]; ok {
+		panic(fmt.Sprintf("duplicate plugin refs func [%s]", typ))
+	}
+	pluginRefsReg.m[typ] = f
+}
+
+func getPluginRefsFunc(typ string) PluginRefsFunc {
+	pluginRefsReg.RLock()
+	defer pluginRefsReg.RUnlock()
+	return pluginRefsReg.m[typ]
+}
+
+// CheckConfig loads the config file the same way as the start command
+// and checks every plugin config in it, including the included files.
+// Plugins are not initialized. It only checks that plugin types exist,
+// args can be decoded and referenced tags are defined before the plugins
+// that use them. All problems found are joined in the returned error.
+func CheckConfig(filePath string) error {
+	cfg, _, err := loadConfig(filePath)
+	if err != nil {
+		return fmt.Errorf("fail to load config, %w", err)
+	}
+
+	c := &cfgChecker{tags: make(map[string]struct{})}
+	for tag := range LoadNewPersetPluginFuncs() {
+		c.tags[tag] = struct{}{}
+	}
+	if err := c.checkCfg(cfg, "", 0); err != nil {
+		c.errs = append(c.errs, err)
+	}
+	return errors.Join(c.errs...)
+}
+
+type cfgChecker struct {
+	tags map[string]struct{} // defined tags, including preset plugins
+	errs []error
+}
+
+// checkCfg follows include first, same as Mosdns.loadPluginsFromCfg.
+// It only returns errors that stop the check, e.g. unreadable includes.
+func (c *cfgChecker) checkCfg(cfg *Config, file string, includeDepth int) error {
+	const maxIncludeDepth = 8
+	if includeDepth > maxIncludeDepth {
+		return errors.New("maximum include depth reached")
+	}
+	includeDepth++
+
+	for _, s := range cfg.Include {
+		subCfg, path, err := loadConfig(s)
+		if err != nil {
+			return fmt.Errorf("failed to read config from %s, %w", s, err)
+		}
+		if err := c.checkCfg(subCfg, path, includeDepth); err != nil {
+			return fmt.Errorf("failed to load config from %s, %w", s, err)
+		}
+	}
+
+	for i, pc := range cfg.Plugins {
+		if err := c.checkPlugin(pc); err != nil {
+			if len(file) > 0 {
+				err = fmt.Errorf("%s: plugin #%d %s, %w", file, i, pc.Tag, err)
+			} else {
+				err = fmt.Errorf("plugin #%d %s, %w", i, pc.Tag, err)
+			}
+			c.errs = append(c.errs, err)
+		}
+	}
+	return nil
+}
+
+func (c *cfgChecker) checkPlugin(pc PluginConfig) error {
+	if len(pc.Tag) == 0 {
+		pc.Tag = fmt.Sprintf("anonymouse_%s_%d", pc.Type, len(c.tags))
+	}
+	if _, dup := c.tags[pc.Tag]; dup {
+		return fmt.Errorf("duplicated plugin tag %s", pc.Tag)
+	}
+	// Register the tag even if the config is invalid. So following
+	// plugins won't report confusing missing refs.
+	c.tags[pc.Tag] = struct{}{}
+
+	typeInfo, ok := GetPluginType(pc.Type)
+	if !ok {
+		return fmt.Errorf("plugin type %s not defined", pc.Type)
+	}
+	args, err := decodeArgs(typeInfo, pc.Args)
+	if err != nil {
+		return err
+	}
+
+	refsFunc := getPluginRefsFunc(pc.Type)
+	if refsFunc == nil {
+		return nil
+	}
+	refs, err := refsFunc(args)
+	if err != nil {
+		return fmt.Errorf("invalid args, %w", err)
+	}
+	var errs []error
+	for _, ref := range refs {
+		if _, ok := c.tags[ref]; !ok || ref == pc.Tag {
+			errs = append(errs, fmt.Errorf("referenced plugin %s is not defined before this plugin", ref))
+		}
+	}
+	return errors.Join(errs...)
+}
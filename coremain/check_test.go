@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	RegPluginRefsFunc("_test_plugin", func(args any) ([]string, error) {
+		if s := *args.(*string); len(s) > 0 {
+			return []string{s}, nil
+		}
+		return nil, nil
+	})
+}
+
+func Test_CheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(p, []byte(s), 0644))
+		return p
+	}
+	sub := write("sub.yaml", `
+plugins:
+  - tag: a
+    type: _test_plugin
+`)
+
+	tests := []struct {
+		name    string
+		cfg     string
+		wantErr bool
+	}{
+		{"ok", `
+include: [` + sub + `]
+plugins:
+  - tag: b
+    type: _test_plugin
+    args: a
+`, false},
+		{"ref not defined", `
+plugins:
+  - tag: b
+    type: _test_plugin
+    args: a
+`, true},
+		{"ref defined after", `
+plugins:
+  - tag: b
+    type: _test_plugin
+    args: a
+  - tag: a
+    type: _test_plugin
+`, true},
+		{"self ref", `
+plugins:
+  - tag: a
+    type: _test_plugin
+    args: a
+`, true},
+		{"dup tag", `
+include: [` + sub + `]
+plugins:
+  - tag: a
+    type: _test_plugin
+`, true},
+		{"invalid type", `
+plugins:
+  - tag: a
+    type: _not_exist
+`, true},
+		{"invalid args", `
+plugins:
+  - tag: a
+    type: _test_plugin
+    args: {k: v}
+`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckConfig(write("config.yaml", tt.cfg))
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -28,6 +28,7 @@ type Config struct {
 	Include []string       `yaml:"include"`
 	Plugins []PluginConfig `yaml:"plugins"`
 	API     APIConfig      `yaml:"api"`
+	Tracing TracingConfig  `yaml:"tracing"`
 }
 
 // PluginConfig represents a plugin config
@@ -48,3 +49,15 @@ type PluginConfig struct {
 type APIConfig struct {
 	HTTP string `yaml:"http"`
 }
+
+// TracingConfig configures the OTLP trace exporter.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces url, e.g. "http://127.0.0.1:4318/v1/traces".
+	// Tracing is disabled if it is empty.
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"` // Default is "mosdns".
+
+	// SampleRatio is the ratio of queries that are traced. Default is 1.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
@@ -16,34 +16,64 @@
  * You should have received a copy of the GNU General Public License
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
-
 package coremain
 
 import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
 	"github.com/IrineSistiana/mosdns/v5/mlog"
 	"github.com/IrineSistiana/mosdns/v5/pkg/safe_close"
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"go.uber.org/zap"
-	"io"
-	"net/http"
-	"net/http/pprof"
 )
 
+// Mosdns is a loaded plugin set. A config reload builds a new Mosdns
+// that shares the same core with the running one.
 type Mosdns struct {
 	logger *zap.Logger // non-nil logger.
 
 	// Plugins
-	plugins map[string]any
+	plugins    map[string]any
+	pluginCfgs map[string]PluginConfig
 
+	// Plugin apis and metrics of this plugin set.
+	pluginMux  *chi.Mux
+	metricsReg *prometheus.Registry
+
+	// Only used while this plugin set is being loaded by a reload.
+	prev    *Mosdns
+	reused  map[string]struct{}
+	commits []func()
+
+	core *core
+}
+
+// core holds the states that are shared by all plugin sets
+// and survive config reloads.
+type core struct {
 	httpMux    *chi.Mux
 	metricsReg *prometheus.Registry
 	sc         *safe_close.SafeClose
+
+	// cfgFile is the main config file. Reload reads it again.
+	cfgFile string
+
+	reloadMu sync.Mutex // Held by Reload and shutdown.
+	closed   bool
+	current  atomic.Pointer[Mosdns]
 }
 
 // NewMosdns initializes a mosdns instance and its plugins.
@@ -54,23 +84,23 @@ func NewMosdns(cfg *Config) (*Mosdns, error) {
 		return nil, fmt.Errorf("failed to init logger: %w", err)
 	}
 
-	m := &Mosdns{
-		logger:     lg,
-		plugins:    make(map[string]any),
+	c := &core{
 		httpMux:    chi.NewRouter(),
 		metricsReg: newMetricsReg(),
 		sc:         safe_close.NewSafeClose(),
 	}
-	// This must be called after m.httpMux and m.metricsReg been set.
-	m.initHttpMux()
+	m := newPluginSet(lg, c)
+	c.current.Store(m)
+	// This must be called after c.httpMux and c.metricsReg been set.
+	c.initHttpMux(lg)
 
 	// Start http api server
 	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
 		httpServer := &http.Server{
 			Addr:    httpAddr,
-			Handler: m.httpMux,
+			Handler: c.httpMux,
 		}
-		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		c.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 			defer done()
 			errChan := make(chan error, 1)
 			go func() {
@@ -79,42 +109,65 @@ func NewMosdns(cfg *Config) (*Mosdns, error) {
 			}()
 			select {
 			case err := <-errChan:
-				m.sc.SendCloseSignal(err)
+				c.sc.SendCloseSignal(err)
 			case <-closeSignal:
 				_ = httpServer.Close()
 			}
 		})
 	}
 
+	// Init tracing before plugins, so servers trace from their first query.
+	if len(cfg.Tracing.Endpoint) > 0 {
+		e, err := tracing.NewOTLPExporter(tracing.OTLPOpts{
+			Endpoint:    cfg.Tracing.Endpoint,
+			Headers:     cfg.Tracing.Headers,
+			ServiceName: cfg.Tracing.ServiceName,
+		})
+		if err != nil {
+			c.sc.SendCloseSignal(err)
+			_ = c.sc.WaitClosed()
+			return nil, fmt.Errorf("failed to init tracing: %w", err)
+		}
+		t := tracing.NewTracer(e, tracing.Opts{SampleRatio: cfg.Tracing.SampleRatio, Logger: lg.Named("tracing")})
+		tracing.SetDefault(t)
+		m.logger.Info("tracing enabled", zap.String("endpoint", cfg.Tracing.Endpoint))
+		c.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+			go func() {
+				defer done()
+				<-closeSignal
+				tracing.SetDefault(nil)
+				_ = t.Close()
+			}()
+		})
+	}
+
 	// Load plugins.
 
 	// Close all plugins on signal.
-	// From here, call m.sc.SendCloseSignal() if any plugin failed to load.
-	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+	// From here, call c.sc.SendCloseSignal() if any plugin failed to load.
+	c.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 		go func() {
 			defer done()
 			<-closeSignal
+			c.reloadMu.Lock()
+			defer c.reloadMu.Unlock()
+			c.closed = true
 			m.logger.Info("starting shutdown sequences")
-			for tag, p := range m.plugins {
-				if closer, _ := p.(io.Closer); closer != nil {
-					m.logger.Info("closing plugin", zap.String("tag", tag))
-					_ = closer.Close()
-				}
-			}
+			c.current.Load().closePlugins(nil)
 			m.logger.Info("all plugins were closed")
 		}()
 	})
 
 	// Preset plugins
 	if err := m.loadPresetPlugins(); err != nil {
-		m.sc.SendCloseSignal(err)
-		_ = m.sc.WaitClosed()
+		c.sc.SendCloseSignal(err)
+		_ = c.sc.WaitClosed()
 		return nil, err
 	}
 	// Plugins from config.
 	if err := m.loadPluginsFromCfg(cfg, 0); err != nil {
-		m.sc.SendCloseSignal(err)
-		_ = m.sc.WaitClosed()
+		c.sc.SendCloseSignal(err)
+		_ = c.sc.WaitClosed()
 		return nil, err
 	}
 	m.logger.Info("all plugins are loaded")
@@ -124,22 +177,40 @@ func NewMosdns(cfg *Config) (*Mosdns, error) {
 
 // NewTestMosdnsWithPlugins returns a mosdns instance for testing.
 func NewTestMosdnsWithPlugins(p map[string]any) *Mosdns {
-	return &Mosdns{
-		logger:     mlog.Nop(),
+	c := &core{
 		httpMux:    chi.NewRouter(),
-		plugins:    p,
 		metricsReg: newMetricsReg(),
 		sc:         safe_close.NewSafeClose(),
 	}
+	m := newPluginSet(mlog.Nop(), c)
+	if p != nil {
+		m.plugins = p
+	}
+	c.current.Store(m)
+	return m
+}
+
+func newPluginSet(lg *zap.Logger, c *core) *Mosdns {
+	m := &Mosdns{
+		logger:     lg,
+		plugins:    make(map[string]any),
+		pluginCfgs: make(map[string]PluginConfig),
+		pluginMux:  chi.NewRouter(),
+		metricsReg: prometheus.NewRegistry(),
+		core:       c,
+	}
+	m.pluginMux.NotFound(c.invalidApiReqHelper)
+	m.pluginMux.MethodNotAllowed(c.invalidApiReqHelper)
+	return m
 }
 
 func (m *Mosdns) GetSafeClose() *safe_close.SafeClose {
-	return m.sc
+	return m.core.sc
 }
 
 // CloseWithErr is a shortcut for m.sc.SendCloseSignal
 func (m *Mosdns) CloseWithErr(err error) {
-	m.sc.SendCloseSignal(err)
+	m.core.sc.SendCloseSignal(err)
 }
 
 // Logger returns a non-nil logger.
@@ -147,22 +218,23 @@ func (m *Mosdns) Logger() *zap.Logger {
 	return m.logger
 }
 
-// GetPlugin returns a plugin.
+// GetPlugin returns a plugin of this plugin set.
 func (m *Mosdns) GetPlugin(tag string) any {
 	return m.plugins[tag]
 }
 
-// GetMetricsReg returns a prometheus.Registerer with a prefix of "mosdns_"
+// GetMetricsReg returns a prometheus.Registerer with a prefix of "mosdns_".
+// Metrics registered to it are exported as long as this plugin set is running.
 func (m *Mosdns) GetMetricsReg() prometheus.Registerer {
 	return prometheus.WrapRegistererWithPrefix("mosdns_", m.metricsReg)
 }
 
 func (m *Mosdns) GetAPIRouter() *chi.Mux {
-	return m.httpMux
+	return m.core.httpMux
 }
 
 func (m *Mosdns) RegPluginAPI(tag string, mux *chi.Mux) {
-	m.httpMux.Mount("/plugins/"+tag, mux)
+	m.pluginMux.Mount("/"+tag, mux)
 }
 
 func newMetricsReg() *prometheus.Registry {
@@ -172,13 +244,31 @@ func newMetricsReg() *prometheus.Registry {
 	return reg
 }
 
-// initHttpMux initializes api entries. It MUST be called after m.metricsReg being initialized.
-func (m *Mosdns) initHttpMux() {
+// initHttpMux initializes api entries. It MUST be called after c.metricsReg being initialized.
+func (c *core) initHttpMux(lg *zap.Logger) {
 	// Register metrics.
-	m.httpMux.Method(http.MethodGet, "/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
+	g := prometheus.Gatherers{c.metricsReg, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return c.current.Load().metricsReg.Gather()
+	})}
+	c.httpMux.Method(http.MethodGet, "/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+
+	// Register plugin apis. They are served by the running plugin set.
+	c.httpMux.Mount("/plugins", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.current.Load().pluginMux.ServeHTTP(w, req)
+	}))
+
+	// Reload config.
+	c.httpMux.Post("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := c.current.Load().ReloadFromFile(); err != nil {
+			lg.Error("failed to reload config", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
 
 	// Register pprof.
-	m.httpMux.Route("/debug/pprof", func(r chi.Router) {
+	c.httpMux.Route("/debug/pprof", func(r chi.Router) {
 		r.Get("/*", pprof.Index)
 		r.Get("/cmdline", pprof.Cmdline)
 		r.Get("/profile", pprof.Profile)
@@ -186,22 +276,28 @@ func (m *Mosdns) initHttpMux() {
 		r.Get("/trace", pprof.Trace)
 	})
 
-	// A helper page for invalid request.
-	invalidApiReqHelper := func(w http.ResponseWriter, req *http.Request) {
-		b := new(bytes.Buffer)
-		_, _ = fmt.Fprintf(b, "Invalid request %s %s\n\n", req.Method, req.RequestURI)
-		b.WriteString("Available api urls:\n")
-		_ = chi.Walk(m.httpMux, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+	c.httpMux.NotFound(c.invalidApiReqHelper)
+	c.httpMux.MethodNotAllowed(c.invalidApiReqHelper)
+}
+
+// invalidApiReqHelper is a helper page for invalid request.
+func (c *core) invalidApiReqHelper(w http.ResponseWriter, req *http.Request) {
+	b := new(bytes.Buffer)
+	_, _ = fmt.Fprintf(b, "Invalid request %s %s\n\n", req.Method, req.RequestURI)
+	b.WriteString("Available api urls:\n")
+	walk := func(prefix string) chi.WalkFunc {
+		return func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
 			b.WriteString(method)
 			b.WriteByte(' ')
+			b.WriteString(prefix)
 			b.WriteString(route)
 			b.WriteByte('\n')
 			return nil
-		})
-		_, _ = w.Write(b.Bytes())
+		}
 	}
-	m.httpMux.NotFound(invalidApiReqHelper)
-	m.httpMux.MethodNotAllowed(invalidApiReqHelper)
+	_ = chi.Walk(c.httpMux, walk(""))
+	_ = chi.Walk(c.current.Load().pluginMux, walk("/plugins"))
+	_, _ = w.Write(b.Bytes())
 }
 
 func (m *Mosdns) loadPresetPlugins() error {
@@ -242,3 +338,83 @@ func (m *Mosdns) loadPluginsFromCfg(cfg *Config, includeDepth int) error {
 	}
 	return nil
 }
+
+// reusablePlugin returns the plugin in the previous plugin set that
+// can be carried over as the plugin described by c.
+func (m *Mosdns) reusablePlugin(c PluginConfig) ReusablePlugin {
+	if m.prev == nil {
+		return nil
+	}
+	prevCfg, ok := m.prev.pluginCfgs[c.Tag]
+	if !ok || prevCfg.Type != c.Type || !reflect.DeepEqual(prevCfg.Args, c.Args) {
+		return nil
+	}
+	rp, _ := m.prev.plugins[c.Tag].(ReusablePlugin)
+	return rp
+}
+
+// closePlugins closes all plugins in m except the ones in skip.
+func (m *Mosdns) closePlugins(skip map[string]struct{}) {
+	for tag, p := range m.plugins {
+		if _, ok := skip[tag]; ok {
+			continue
+		}
+		if closer, _ := p.(io.Closer); closer != nil {
+			m.logger.Info("closing plugin", zap.String("tag", tag))
+			_ = closer.Close()
+		}
+	}
+}
+
+// ReloadFromFile reads the main config file again and calls Reload.
+func (m *Mosdns) ReloadFromFile() error {
+	if len(m.core.cfgFile) == 0 {
+		return errors.New("mosdns was not started from a config file")
+	}
+	cfg, _, err := loadConfig(m.core.cfgFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config, %w", err)
+	}
+	return m.Reload(cfg)
+}
+
+// Reload builds a new plugin set from cfg and swaps it with the running
+// one. If any plugin fails to load, the new plugin set is discarded and
+// the running one keeps serving. Plugins that implement ReusablePlugin
+// and have unchanged configs are carried over instead of being rebuilt.
+// Other plugins of the old set are closed after the swap.
+// The "log", "api" and "tracing" sections of cfg are ignored.
+func (m *Mosdns) Reload(cfg *Config) error {
+	c := m.core
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	if c.closed {
+		return errors.New("mosdns is closed")
+	}
+
+	prev := c.current.Load()
+	prev.logger.Info("reloading config")
+	next := newPluginSet(prev.logger, c)
+	next.prev = prev
+	next.reused = make(map[string]struct{})
+
+	err := next.loadPresetPlugins()
+	if err == nil {
+		err = next.loadPluginsFromCfg(cfg, 0)
+	}
+	if err != nil {
+		next.closePlugins(next.reused)
+		prev.logger.Error("reload rejected, keep running the old plugins", zap.Error(err))
+		return err
+	}
+
+	for _, commit := range next.commits {
+		commit()
+	}
+	reused := next.reused
+	next.prev, next.reused, next.commits = nil, nil, nil
+	c.current.Store(next)
+	prev.closePlugins(reused)
+	prev.logger.Info("config reloaded", zap.Int("reused_plugins", len(reused)))
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPlugin struct {
+	args   string
+	closed bool
+
+	reuseBP *BP
+}
+
+func (p *testPlugin) Close() error {
+	p.closed = true
+	return nil
+}
+
+type testReusablePlugin struct {
+	testPlugin
+}
+
+func (p *testReusablePlugin) PrepareReuse(bp *BP) (func(), error) {
+	return func() { p.reuseBP = bp }, nil
+}
+
+func init() {
+	RegNewPluginFunc("_test_plugin", func(bp *BP, args any) (any, error) {
+		s := *args.(*string)
+		if s == "bad" {
+			return nil, errors.New("bad args")
+		}
+		return &testPlugin{args: s}, nil
+	}, func() any { return new(string) })
+	RegNewPluginFunc("_test_reusable_plugin", func(bp *BP, args any) (any, error) {
+		return &testReusablePlugin{testPlugin{args: *args.(*string)}}, nil
+	}, func() any { return new(string) })
+}
+
+func Test_Mosdns_Reload(t *testing.T) {
+	r := require.New(t)
+	cfg := func(args string) *Config {
+		return &Config{Plugins: []PluginConfig{
+			{Tag: "p", Type: "_test_plugin", Args: args},
+			{Tag: "r", Type: "_test_reusable_plugin", Args: "r"},
+		}}
+	}
+
+	m, err := NewMosdns(cfg("1"))
+	r.NoError(err)
+	defer m.CloseWithErr(nil)
+	p1 := m.GetPlugin("p").(*testPlugin)
+	rp := m.GetPlugin("r").(*testReusablePlugin)
+
+	// Failed reload keeps the running plugins.
+	r.Error(m.Reload(cfg("bad")))
+	r.Same(m, m.core.current.Load())
+	r.False(p1.closed)
+	r.Nil(rp.reuseBP)
+
+	// Successful reload swaps plugins and closes the old ones.
+	r.NoError(m.Reload(cfg("2")))
+	next := m.core.current.Load()
+	r.NotSame(m, next)
+	r.True(p1.closed)
+	r.Equal("2", next.GetPlugin("p").(*testPlugin).args)
+
+	// Unchanged reusable plugin is carried over.
+	r.Same(rp, next.GetPlugin("r"))
+	r.False(rp.closed)
+	r.Same(next, rp.reuseBP.M())
+}
@@ -101,13 +101,24 @@ func (m *Mosdns) newPlugin(c PluginConfig) error {
 		return fmt.Errorf("plugin type %s not defined", c.Type)
 	}
 
-	args := typeInfo.NewArgs()
-	if reflect.TypeOf(c.Args) == reflect.TypeOf(args) { // Same type, no need to parse.
-		args = c.Args
-	} else {
-		if err := utils.WeakDecode(c.Args, args); err != nil {
-			return fmt.Errorf("unable to decode plugin args: %w", err)
+	if rp := m.reusablePlugin(c); rp != nil {
+		m.logger.Info("reusing plugin", zap.String("tag", c.Tag), zap.String("type", c.Type))
+		commit, err := rp.PrepareReuse(NewBP(c.Tag, m))
+		if err != nil {
+			return fmt.Errorf("failed to reuse plugin: %w", err)
+		}
+		if commit != nil {
+			m.commits = append(m.commits, commit)
 		}
+		m.reused[c.Tag] = struct{}{}
+		m.plugins[c.Tag] = rp
+		m.pluginCfgs[c.Tag] = c
+		return nil
+	}
+
+	args, err := decodeArgs(typeInfo, c.Args)
+	if err != nil {
+		return err
 	}
 
 	m.logger.Info("loading plugin", zap.String("tag", c.Tag), zap.String("type", c.Type))
@@ -116,9 +127,33 @@ func (m *Mosdns) newPlugin(c PluginConfig) error {
 		return fmt.Errorf("failed to init plugin: %w", err)
 	}
 	m.plugins[c.Tag] = p
+	m.pluginCfgs[c.Tag] = c
 	return nil
 }
 
+// ReusablePlugin is a plugin that can be carried over to the new plugin
+// set on config reload if its type and args are unchanged, e.g. servers
+// that should keep their listeners.
+type ReusablePlugin interface {
+	// PrepareReuse is called with the BP of the new plugin set, at the
+	// position where the plugin is in the new config. It should resolve
+	// everything it needs from bp. The returned commit func (can be nil)
+	// switches the plugin to the new set. It is called only if the whole
+	// new set was successfully loaded.
+	PrepareReuse(bp *BP) (commit func(), err error)
+}
+
+func decodeArgs(typeInfo PluginTypeInfo, in any) (any, error) {
+	args := typeInfo.NewArgs()
+	if reflect.TypeOf(in) == reflect.TypeOf(args) { // Same type, no need to parse.
+		return in, nil
+	}
+	if err := utils.WeakDecode(in, args); err != nil {
+		return nil, fmt.Errorf("unable to decode plugin args: %w", err)
+	}
+	return args, nil
+}
+
 // GetAllPluginTypes returns all plugin types which are configurable.
 func GetAllPluginTypes() []string {
 	pluginTypeRegister.RLock()
@@ -65,10 +65,18 @@ func init() {
 
 			go func() {
 				c := make(chan os.Signal, 1)
-				signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-				sig := <-c
-				m.logger.Warn("signal received", zap.Stringer("signal", sig))
-				m.sc.SendCloseSignal(nil)
+				signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+				for sig := range c {
+					m.logger.Warn("signal received", zap.Stringer("signal", sig))
+					if sig == syscall.SIGHUP {
+						if err := m.ReloadFromFile(); err != nil {
+							m.logger.Error("failed to reload config", zap.Error(err))
+						}
+						continue
+					}
+					m.GetSafeClose().SendCloseSignal(nil)
+					return
+				}
 			}()
 			return m.GetSafeClose().WaitClosed()
 		},
@@ -126,7 +134,12 @@ func NewServer(sf *serverFlags) (*Mosdns, error) {
 	}
 	mlog.L().Info("main config loaded", zap.String("file", fileUsed))
 
-	return NewMosdns(cfg)
+	m, err := NewMosdns(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.core.cfgFile = fileUsed
+	return m, nil
 }
 
 // loadConfig load a config from a file. If filePath is empty, it will
@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+var (
+	ErrDecrypt    = errors.New("failed to decrypt")
+	ErrBadPadding = errors.New("invalid padding")
+)
+
+// GenerateKey generates a x25519 key pair.
+func GenerateKey() (pk, sk [KeySize]byte, err error) {
+	p, s, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return pk, sk, err
+	}
+	return *p, *s, nil
+}
+
+// SharedKey computes the shared key of the construction c.
+func SharedKey(c Construction, sk, pk *[KeySize]byte) ([KeySize]byte, error) {
+	var k [KeySize]byte
+	switch c {
+	case XSalsa20Poly1305:
+		box.Precompute(&k, pk, sk)
+		return k, nil
+	case XChacha20Poly1305:
+		s, err := curve25519.X25519(sk[:], pk[:])
+		if err != nil {
+			return k, err
+		}
+		var zero [16]byte
+		hk, err := chacha20.HChaCha20(s, zero[:])
+		if err != nil {
+			return k, err
+		}
+		copy(k[:], hk)
+		return k, nil
+	default:
+		return k, fmt.Errorf("unsupported construction %d", c)
+	}
+}
+
+// seal appends the authenticated and encrypted msg to out.
+// The layout is tag + ciphertext for both constructions.
+func seal(c Construction, out []byte, nonce *[NonceSize]byte, msg []byte, key *[KeySize]byte) []byte {
+	if c == XSalsa20Poly1305 {
+		return secretbox.Seal(out, msg, nonce, key)
+	}
+
+	// crypto_secretbox_xchacha20poly1305 from libsodium.
+	s, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var block0 [64]byte
+	s.XORKeyStream(block0[:], block0[:])
+	var polyKey [32]byte
+	copy(polyKey[:], block0[:32])
+
+	ret, o := sliceForAppend(out, TagSize+len(msg))
+	ct := o[TagSize:]
+	n := subtle.XORBytes(ct, msg, block0[32:])
+	if len(msg) > n {
+		s.XORKeyStream(ct[n:], msg[n:])
+	}
+	var tag [TagSize]byte
+	poly1305.Sum(&tag, ct, &polyKey)
+	copy(o, tag[:])
+	return ret
+}
+
+// open appends the decrypted box to out.
+func open(c Construction, out []byte, nonce *[NonceSize]byte, b []byte, key *[KeySize]byte) ([]byte, error) {
+	if c == XSalsa20Poly1305 {
+		m, ok := secretbox.Open(out, b, nonce, key)
+		if !ok {
+			return nil, ErrDecrypt
+		}
+		return m, nil
+	}
+
+	if len(b) < TagSize {
+		return nil, ErrDecrypt
+	}
+	s, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var block0 [64]byte
+	s.XORKeyStream(block0[:], block0[:])
+	var polyKey [32]byte
+	copy(polyKey[:], block0[:32])
+
+	var tag [TagSize]byte
+	copy(tag[:], b[:TagSize])
+	ct := b[TagSize:]
+	if !poly1305.Verify(&tag, ct, &polyKey) {
+		return nil, ErrDecrypt
+	}
+	ret, o := sliceForAppend(out, len(ct))
+	n := subtle.XORBytes(o, ct, block0[32:])
+	if len(ct) > n {
+		s.XORKeyStream(o[n:], ct[n:])
+	}
+	return ret, nil
+}
+
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// pad appends ISO/IEC 7816-4 padding to msg so its length is size.
+// size must be greater than len(msg).
+func pad(msg []byte, size int) []byte {
+	b := make([]byte, size)
+	copy(b, msg)
+	b[len(msg)] = 0x80
+	return b
+}
+
+func unpad(b []byte) ([]byte, error) {
+	for i := len(b) - 1; i >= 0; i-- {
+		switch b[i] {
+		case 0:
+			continue
+		case 0x80:
+			return b[:i], nil
+		default:
+			return nil, ErrBadPadding
+		}
+	}
+	return nil, ErrBadPadding
+}
+
+// paddedLen returns the smallest multiple of 64 that can hold msgLen
+// bytes plus the padding mark and is at least minLen.
+func paddedLen(msgLen, minLen int) int {
+	l := (msgLen + 1 + 63) &^ 63
+	if l < minLen {
+		l = (minLen + 63) &^ 63
+	}
+	return l
+}
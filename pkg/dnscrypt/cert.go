@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dnscrypt implements the DNSCrypt v2 protocol primitives that
+// are shared by the client and the server: certificates, the box
+// constructions and the query/response packet formats.
+// See https://dnscrypt.info/protocol.
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Construction is the es-version of a certificate.
+type Construction uint16
+
+const (
+	XSalsa20Poly1305  Construction = 1
+	XChacha20Poly1305 Construction = 2
+)
+
+func (c Construction) String() string {
+	switch c {
+	case XSalsa20Poly1305:
+		return "xsalsa20poly1305"
+	case XChacha20Poly1305:
+		return "xchacha20poly1305"
+	default:
+		return fmt.Sprintf("construction(%d)", uint16(c))
+	}
+}
+
+// ParseConstruction parses the name returned by Construction.String.
+func ParseConstruction(s string) (Construction, error) {
+	switch strings.ToLower(s) {
+	case "", "xsalsa20poly1305":
+		return XSalsa20Poly1305, nil
+	case "xchacha20poly1305":
+		return XChacha20Poly1305, nil
+	default:
+		return 0, fmt.Errorf("unknown construction %s", s)
+	}
+}
+
+const (
+	CertSize        = 124
+	ClientMagicSize = 8
+	KeySize         = 32
+	NonceSize       = 24
+	HalfNonceSize   = NonceSize / 2
+	TagSize         = 16
+
+	// MinUDPQuerySize is the minimum padded size of an udp query.
+	MinUDPQuerySize = 256
+)
+
+var (
+	certMagic = [4]byte{'D', 'N', 'S', 'C'}
+
+	// ServerMagic prefixes all responses from a resolver.
+	ServerMagic = [8]byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+)
+
+var (
+	ErrInvalidCert      = errors.New("invalid dnscrypt certificate")
+	ErrInvalidSignature = errors.New("invalid certificate signature")
+)
+
+// Cert is a resolver short-term certificate.
+type Cert struct {
+	Construction Construction
+	ResolverPk   [KeySize]byte
+	ClientMagic  [ClientMagicSize]byte
+	Serial       uint32
+	NotBefore    time.Time
+	NotAfter     time.Time
+}
+
+// Valid reports whether now is in the cert's validity period.
+func (c *Cert) Valid(now time.Time) bool {
+	return !now.Before(c.NotBefore) && now.Before(c.NotAfter)
+}
+
+// Sign encodes the cert and signs it with the provider's long-term key.
+func (c *Cert) Sign(providerSk ed25519.PrivateKey) []byte {
+	b := make([]byte, CertSize)
+	copy(b[0:4], certMagic[:])
+	binary.BigEndian.PutUint16(b[4:6], uint16(c.Construction))
+	// b[6:8] protocol minor version, always 0.
+	copy(b[72:104], c.ResolverPk[:])
+	copy(b[104:112], c.ClientMagic[:])
+	binary.BigEndian.PutUint32(b[112:116], c.Serial)
+	binary.BigEndian.PutUint32(b[116:120], uint32(c.NotBefore.Unix()))
+	binary.BigEndian.PutUint32(b[120:124], uint32(c.NotAfter.Unix()))
+	copy(b[8:72], ed25519.Sign(providerSk, b[72:]))
+	return b
+}
+
+// ParseCert decodes b and verifies its signature with the provider's
+// long-term public key. It does not check the validity period.
+func ParseCert(b []byte, providerPk ed25519.PublicKey) (*Cert, error) {
+	if len(b) < CertSize || [4]byte(b[0:4]) != certMagic {
+		return nil, ErrInvalidCert
+	}
+	c := new(Cert)
+	c.Construction = Construction(binary.BigEndian.Uint16(b[4:6]))
+	if c.Construction != XSalsa20Poly1305 && c.Construction != XChacha20Poly1305 {
+		return nil, fmt.Errorf("unsupported es-version %d", c.Construction)
+	}
+	if !ed25519.Verify(providerPk, b[72:], b[8:72]) {
+		return nil, ErrInvalidSignature
+	}
+	copy(c.ResolverPk[:], b[72:104])
+	copy(c.ClientMagic[:], b[104:112])
+	c.Serial = binary.BigEndian.Uint32(b[112:116])
+	c.NotBefore = time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	c.NotAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+	return c, nil
+}
+
+// BetterThan reports whether c should be preferred over o. Newer serials
+// win, and on a tie the XChacha20 construction is preferred.
+func (c *Cert) BetterThan(o *Cert) bool {
+	if o == nil {
+		return true
+	}
+	if c.Serial != o.Serial {
+		return c.Serial > o.Serial
+	}
+	return c.Construction > o.Construction
+}
+
+// EncodeTXT escapes the binary cert b to a TXT string in the presentation
+// format that miekg/dns expects.
+func EncodeTXT(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c < ' ' || c > '~' || c == '"' || c == '\\' {
+			fmt.Fprintf(&sb, "\\%03d", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// DecodeTXT joins and unescapes TXT strings in the presentation format.
+func DecodeTXT(ss []string) []byte {
+	var b []byte
+	for _, s := range ss {
+		for i := 0; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) {
+				if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+					b = append(b, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+					i += 3
+					continue
+				}
+				i++
+				c = s[i]
+			}
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CertPrefix is the prefix of provider names of DNSCrypt v2.
+const CertPrefix = "2.dnscrypt-cert."
+
+// CertManager generates and rotates the short-term certs of a provider.
+// Every rotation generates a cert for each supported construction. Old
+// certs are kept until they expire so clients can still use them.
+type CertManager struct {
+	providerName string
+	providerSk   ed25519.PrivateKey
+	validity     time.Duration
+
+	m     sync.RWMutex
+	certs []*resolverCert
+}
+
+type resolverCert struct {
+	cert *Cert
+	sk   [KeySize]byte
+	txt  string
+}
+
+// NewCertManager creates a CertManager with a fresh set of certs.
+// providerName should have the CertPrefix prefix, it is added if missing.
+func NewCertManager(providerName string, providerSk ed25519.PrivateKey, validity time.Duration) (*CertManager, error) {
+	providerName = dns.Fqdn(strings.ToLower(providerName))
+	if !strings.HasPrefix(providerName, CertPrefix) {
+		providerName = CertPrefix + providerName
+	}
+	m := &CertManager{
+		providerName: providerName,
+		providerSk:   providerSk,
+		validity:     validity,
+	}
+	if err := m.Rotate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ProviderName returns the fqdn provider name.
+func (m *CertManager) ProviderName() string {
+	return m.providerName
+}
+
+// Rotate generates new certs and removes the expired ones.
+func (m *CertManager) Rotate() error {
+	now := time.Now()
+	var certs []*resolverCert
+	for _, c := range [...]Construction{XChacha20Poly1305, XSalsa20Poly1305} {
+		pk, sk, err := GenerateKey()
+		if err != nil {
+			return err
+		}
+		cert := &Cert{
+			Construction: c,
+			ResolverPk:   pk,
+			Serial:       uint32(now.Unix()),
+			NotBefore:    now,
+			NotAfter:     now.Add(m.validity),
+		}
+		if _, err := rand.Read(cert.ClientMagic[:]); err != nil {
+			return err
+		}
+		certs = append(certs, &resolverCert{cert: cert, sk: sk, txt: EncodeTXT(cert.Sign(m.providerSk))})
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	for _, c := range m.certs {
+		if c.cert.Valid(now) {
+			certs = append(certs, c)
+		}
+	}
+	m.certs = certs
+	return nil
+}
+
+// Key returns the construction and the resolver secret key of the valid
+// cert that has the client magic.
+func (m *CertManager) Key(magic [ClientMagicSize]byte) (Construction, *[KeySize]byte, bool) {
+	now := time.Now()
+	m.m.RLock()
+	defer m.m.RUnlock()
+	for _, c := range m.certs {
+		if c.cert.ClientMagic == magic && c.cert.Valid(now) {
+			return c.cert.Construction, &c.sk, true
+		}
+	}
+	return 0, nil, false
+}
+
+// CertResponse returns the response to a plain cert query. It returns nil
+// if q is not a cert query of this provider.
+func (m *CertManager) CertResponse(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	if question.Qtype != dns.TypeTXT || question.Qclass != dns.ClassINET || !strings.EqualFold(question.Name, m.providerName) {
+		return nil
+	}
+
+	now := time.Now()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	m.m.RLock()
+	defer m.m.RUnlock()
+	for _, c := range m.certs {
+		if !c.cert.Valid(now) {
+			continue
+		}
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 600},
+			Txt: []string{c.txt},
+		})
+	}
+	return r
+}
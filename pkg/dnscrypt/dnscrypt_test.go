@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCert(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	now := time.Unix(time.Now().Unix(), 0)
+	c := &Cert{
+		Construction: XChacha20Poly1305,
+		ResolverPk:   [KeySize]byte{1, 2, 3},
+		ClientMagic:  [ClientMagicSize]byte{4, 5, 6},
+		Serial:       7,
+		NotBefore:    now,
+		NotAfter:     now.Add(time.Hour),
+	}
+	b := c.Sign(sk)
+	require.Len(t, b, CertSize)
+
+	got, err := ParseCert(DecodeTXT([]string{EncodeTXT(b)}), pk)
+	require.NoError(t, err)
+	require.Equal(t, c, got)
+	require.True(t, got.Valid(now))
+	require.False(t, got.Valid(now.Add(time.Hour)))
+
+	b[CertSize-1]++
+	_, err = ParseCert(b, pk)
+	require.ErrorIs(t, err, ErrInvalidSignature)
+	_, err = ParseCert(b[:CertSize-1], pk)
+	require.ErrorIs(t, err, ErrInvalidCert)
+}
+
+func TestDecodeTXT(t *testing.T) {
+	require.Equal(t, []byte("a\"b\\c\x00\xff"), DecodeTXT([]string{`a\"b\\c\000`, `\255`}))
+}
+
+func TestExchange(t *testing.T) {
+	for _, c := range []Construction{XSalsa20Poly1305, XChacha20Poly1305} {
+		t.Run(c.String(), func(t *testing.T) {
+			rpk, rsk, err := GenerateKey()
+			require.NoError(t, err)
+			cpk, csk, err := GenerateKey()
+			require.NoError(t, err)
+			cert := &Cert{Construction: c, ResolverPk: rpk, ClientMagic: [ClientMagicSize]byte{'m'}}
+
+			clientKey, err := SharedKey(c, &csk, &rpk)
+			require.NoError(t, err)
+
+			for _, size := range []int{12, 100, 255, 1000} {
+				q := bytes.Repeat([]byte{0xab}, size)
+				p, nonce, err := EncryptQuery(cert, &cpk, &clientKey, q, MinUDPQuerySize)
+				require.NoError(t, err)
+				require.GreaterOrEqual(t, len(p), MinUDPQuerySize)
+				require.Zero(t, (len(p)-QueryOverhead)%64)
+
+				magic, ok := ClientMagic(p)
+				require.True(t, ok)
+				require.Equal(t, cert.ClientMagic, magic)
+
+				gotQ, serverKey, gotNonce, err := DecryptQuery(c, &rsk, p)
+				require.NoError(t, err)
+				require.Equal(t, q, gotQ)
+				require.Equal(t, clientKey, serverKey)
+				require.Equal(t, nonce, gotNonce)
+
+				r := bytes.Repeat([]byte{0xcd}, size*2)
+				_, err = EncryptResponse(c, &serverKey, &gotNonce, r, len(r))
+				require.ErrorIs(t, err, ErrResponseTooLarge)
+				rp, err := EncryptResponse(c, &serverKey, &gotNonce, r, 0)
+				require.NoError(t, err)
+
+				gotR, err := DecryptResponse(c, &clientKey, &nonce, rp)
+				require.NoError(t, err)
+				require.Equal(t, r, gotR)
+
+				// Response to another query.
+				otherNonce := nonce
+				otherNonce[0]++
+				_, err = DecryptResponse(c, &clientKey, &otherNonce, rp)
+				require.ErrorIs(t, err, ErrInvalidPacket)
+
+				// Tampered response.
+				rp[len(rp)-1]++
+				_, err = DecryptResponse(c, &clientKey, &nonce, rp)
+				require.ErrorIs(t, err, ErrDecrypt)
+			}
+		})
+	}
+}
+
+func TestUnpad(t *testing.T) {
+	tests := []struct {
+		in      []byte
+		want    []byte
+		wantErr bool
+	}{
+		{[]byte{1, 0x80}, []byte{1}, false},
+		{[]byte{1, 0x80, 0, 0}, []byte{1}, false},
+		{[]byte{0x80}, []byte{}, false},
+		{[]byte{1, 0, 0}, nil, true},
+		{[]byte{1, 0x80, 1}, nil, true},
+		{nil, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := unpad(tt.in)
+		if tt.wantErr {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tt.want, got)
+	}
+}
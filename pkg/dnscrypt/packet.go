@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+const (
+	queryHeaderSize    = ClientMagicSize + KeySize + HalfNonceSize
+	responseHeaderSize = len(ServerMagic) + NonceSize
+
+	// QueryOverhead and ResponseOverhead are the number of bytes that
+	// the encryption adds to a message, excluding padding.
+	QueryOverhead    = queryHeaderSize + TagSize
+	ResponseOverhead = responseHeaderSize + TagSize
+)
+
+var (
+	ErrInvalidPacket    = errors.New("invalid dnscrypt packet")
+	ErrResponseTooLarge = errors.New("response is too large")
+)
+
+// EncryptQuery encrypts the dns query q to a resolver with cert.
+// The padded query will be at least minSize bytes. The returned nonce
+// is needed to open the response.
+func EncryptQuery(cert *Cert, clientPk, sharedKey *[KeySize]byte, q []byte, minSize int) (packet []byte, clientNonce [HalfNonceSize]byte, err error) {
+	if _, err := rand.Read(clientNonce[:]); err != nil {
+		return nil, clientNonce, err
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], clientNonce[:])
+
+	packet = make([]byte, queryHeaderSize, queryHeaderSize+TagSize+paddedLen(len(q), minSize-QueryOverhead))
+	copy(packet, cert.ClientMagic[:])
+	copy(packet[ClientMagicSize:], clientPk[:])
+	copy(packet[ClientMagicSize+KeySize:], clientNonce[:])
+	packet = seal(cert.Construction, packet, &nonce, pad(q, cap(packet)-queryHeaderSize-TagSize), sharedKey)
+	return packet, clientNonce, nil
+}
+
+// DecryptResponse opens a response packet. If clientNonce is not nil,
+// the response nonce must be prefixed with it.
+func DecryptResponse(c Construction, sharedKey *[KeySize]byte, clientNonce *[HalfNonceSize]byte, b []byte) ([]byte, error) {
+	if len(b) < ResponseOverhead || [8]byte(b[:8]) != ServerMagic {
+		return nil, ErrInvalidPacket
+	}
+	nonce := [NonceSize]byte(b[8:responseHeaderSize])
+	if clientNonce != nil && [HalfNonceSize]byte(nonce[:HalfNonceSize]) != *clientNonce {
+		return nil, ErrInvalidPacket
+	}
+	m, err := open(c, nil, &nonce, b[responseHeaderSize:], sharedKey)
+	if err != nil {
+		return nil, err
+	}
+	return unpad(m)
+}
+
+// ClientMagic returns the client magic of a query packet, which
+// identifies the cert the client used.
+func ClientMagic(b []byte) ([ClientMagicSize]byte, bool) {
+	if len(b) < QueryOverhead {
+		return [ClientMagicSize]byte{}, false
+	}
+	return [ClientMagicSize]byte(b[:ClientMagicSize]), true
+}
+
+// ResponseNonce returns the client half of the nonce of a response
+// packet, which identifies the query it answers.
+func ResponseNonce(b []byte) ([HalfNonceSize]byte, bool) {
+	if len(b) < ResponseOverhead || [8]byte(b[:8]) != ServerMagic {
+		return [HalfNonceSize]byte{}, false
+	}
+	return [HalfNonceSize]byte(b[8 : 8+HalfNonceSize]), true
+}
+
+// DecryptQuery opens a query packet with the resolver secret key of the
+// cert that the packet's client magic refers to. The returned key and
+// nonce are needed to encrypt the response.
+func DecryptQuery(c Construction, resolverSk *[KeySize]byte, b []byte) (q []byte, sharedKey [KeySize]byte, clientNonce [HalfNonceSize]byte, err error) {
+	if len(b) < QueryOverhead {
+		return nil, sharedKey, clientNonce, ErrInvalidPacket
+	}
+	clientPk := [KeySize]byte(b[ClientMagicSize : ClientMagicSize+KeySize])
+	clientNonce = [HalfNonceSize]byte(b[ClientMagicSize+KeySize : queryHeaderSize])
+	sharedKey, err = SharedKey(c, resolverSk, &clientPk)
+	if err != nil {
+		return nil, sharedKey, clientNonce, err
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], clientNonce[:])
+	m, err := open(c, nil, &nonce, b[queryHeaderSize:], &sharedKey)
+	if err != nil {
+		return nil, sharedKey, clientNonce, err
+	}
+	q, err = unpad(m)
+	return q, sharedKey, clientNonce, err
+}
+
+// EncryptResponse encrypts the dns response r. If maxSize > 0 and the
+// packet would be larger than maxSize, ErrResponseTooLarge is returned
+// and the caller should send a truncated response instead.
+func EncryptResponse(c Construction, sharedKey *[KeySize]byte, clientNonce *[HalfNonceSize]byte, r []byte, maxSize int) ([]byte, error) {
+	size := paddedLen(len(r), 0)
+	if maxSize > 0 && size+ResponseOverhead > maxSize {
+		return nil, ErrResponseTooLarge
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], clientNonce[:])
+	if _, err := rand.Read(nonce[HalfNonceSize:]); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, responseHeaderSize, responseHeaderSize+TagSize+size)
+	copy(packet, ServerMagic[:])
+	copy(packet[len(ServerMagic):], nonce[:])
+	return seal(c, packet, &nonce, pad(r, size), sharedKey), nil
+}
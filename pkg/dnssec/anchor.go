@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnssec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LoadAnchorsFromFile loads trust anchors from a zone file that contains
+// DS and/or DNSKEY records, e.g. the root.key file used by unbound.
+func LoadAnchorsFromFile(path string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseAnchors(f)
+}
+
+// ParseAnchors parses DS and DNSKEY records from r. Other records are ignored.
+func ParseAnchors(r io.Reader) ([]dns.RR, error) {
+	var anchors []dns.RR
+	zp := dns.NewZoneParser(r, ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			anchors = append(anchors, rr)
+		case *dns.DNSKEY:
+			if rr.Flags&dns.ZONE == 0 {
+				return nil, fmt.Errorf("dnskey %s is not a zone key", rr.Hdr.Name)
+			}
+			anchors = append(anchors, rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, errors.New("no ds or dnskey record found")
+	}
+	return anchors, nil
+}
+
+// groupAnchors groups anchors by their canonical owner names.
+func groupAnchors(anchors []dns.RR) map[string][]dns.RR {
+	m := make(map[string][]dns.RR)
+	for _, rr := range anchors {
+		zone := dns.CanonicalName(rr.Header().Name)
+		m[zone] = append(m[zone], rr)
+	}
+	return m
+}
+
+// matchAnchor reports whether key matches one of the anchors.
+func matchAnchor(key *dns.DNSKEY, anchors []dns.RR) bool {
+	for _, a := range anchors {
+		switch a := a.(type) {
+		case *dns.DS:
+			if matchDS(key, a) {
+				return true
+			}
+		case *dns.DNSKEY:
+			if a.Flags == key.Flags && a.Protocol == key.Protocol &&
+				a.Algorithm == key.Algorithm && a.PublicKey == key.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchDS(key *dns.DNSKEY, ds *dns.DS) bool {
+	if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+		return false
+	}
+	d := key.ToDS(ds.DigestType)
+	return d != nil && strings.EqualFold(d.Digest, ds.Digest)
+}
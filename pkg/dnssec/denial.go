@@ -0,0 +1,246 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnssec
+
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 9276 3.2: validators may treat responses with higher
+// iterations as insecure.
+const maxNSEC3Iterations = 150
+
+// denial holds validated NSEC and NSEC3 records of a response
+// and checks the authenticated denial of existence.
+type denial struct {
+	nsecs  []*dns.NSEC
+	nsec3s []*dns.NSEC3
+
+	// Set if any nsec3 record has an unsupported hash algorithm or
+	// too many iterations. The response can only be insecure.
+	unsupportedNSEC3 bool
+}
+
+func newDenial(sets []*rrset) *denial {
+	d := new(denial)
+	for _, s := range sets {
+		for _, rr := range s.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				d.nsecs = append(d.nsecs, rr)
+			case *dns.NSEC3:
+				if rr.Hash != dns.SHA1 || rr.Iterations > maxNSEC3Iterations {
+					d.unsupportedNSEC3 = true
+					continue
+				}
+				d.nsec3s = append(d.nsec3s, rr)
+			}
+		}
+	}
+	return d
+}
+
+// noData checks the proof that name exists but has no rrset of type t.
+// optOut is set if the proof relies on an opt-out NSEC3 record.
+func (d *denial) noData(name string, t uint16) (ok, optOut bool) {
+	name = dns.CanonicalName(name)
+	if nsec := d.nsecMatch(name); nsec != nil {
+		return noType(nsec.TypeBitMap, t), false
+	}
+	if nsec3 := d.nsec3Match(name); nsec3 != nil {
+		return noType(nsec3.TypeBitMap, t), false
+	}
+
+	// Empty non-terminal, proved by the nsec that covers it.
+	for _, nsec := range d.nsecs {
+		if nsecCovers(nsec, name) && dns.IsSubDomain(name, nsec.NextDomain) && !hidesAncestorOf(nsec, name) {
+			return true, false
+		}
+	}
+
+	// Wildcard no data.
+	if nsec := d.nsecCover(name); nsec != nil {
+		w := d.nsecMatch("*." + nsecClosestEncloser(nsec, name))
+		return w != nil && noType(w.TypeBitMap, t), false
+	}
+	ce, _, cover, ok := d.nsec3ClosestEncloser(name)
+	if !ok {
+		return false, false
+	}
+	optOut = cover.Flags&1 == 1
+	// RFC 5155 8.6: no DS in an opt-out span.
+	if t == dns.TypeDS && optOut {
+		return true, true
+	}
+	w := d.nsec3Match("*." + ce)
+	return w != nil && noType(w.TypeBitMap, t), optOut
+}
+
+// noType reports whether the type bitmap proves that its owner has no
+// rrset of type t.
+func noType(bitmap []uint16, t uint16) bool {
+	if hasType(bitmap, t) || hasType(bitmap, dns.TypeCNAME) {
+		return false
+	}
+	// RFC 6840 4.4: the parent side of a zone cut is only
+	// authoritative for the DS rrset.
+	return t == dns.TypeDS || !isDelegation(bitmap)
+}
+
+// hidesDescendants reports whether the owner of the type bitmap is a
+// zone cut or a DNAME, so its nsec records cannot prove anything about
+// names below it. RFC 6840 4.4.
+func hidesDescendants(bitmap []uint16) bool {
+	return isDelegation(bitmap) || hasType(bitmap, dns.TypeDNAME)
+}
+
+// hidesAncestorOf reports whether the owner of nsec is an ancestor of
+// name that hides its descendants.
+func hidesAncestorOf(nsec *dns.NSEC, name string) bool {
+	return dns.IsSubDomain(dns.CanonicalName(nsec.Hdr.Name), name) && hidesDescendants(nsec.TypeBitMap)
+}
+
+func isDelegation(bitmap []uint16) bool {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+}
+
+// nxDomain checks the proof that name and the wildcard that
+// could match it do not exist.
+func (d *denial) nxDomain(name string) (ok, optOut bool) {
+	name = dns.CanonicalName(name)
+	if nsec := d.nsecCover(name); nsec != nil {
+		if dns.IsSubDomain(name, nsec.NextDomain) { // empty non-terminal, name exists.
+			return false, false
+		}
+		w := "*." + nsecClosestEncloser(nsec, name)
+		return d.nsecMatch(w) == nil && d.nsecCover(w) != nil, false
+	}
+	ce, _, cover, ok := d.nsec3ClosestEncloser(name)
+	if !ok {
+		return false, false
+	}
+	return d.nsec3Cover("*."+ce) != nil, cover.Flags&1 == 1
+}
+
+// noCloserMatch checks the proof that nextCloser does not exist, which
+// is required for wildcard expansions. RFC 4035 5.3.4, RFC 5155 8.8.
+func (d *denial) noCloserMatch(name, nextCloser string) (ok, optOut bool) {
+	if d.nsecCover(dns.CanonicalName(name)) != nil {
+		return true, false
+	}
+	if cover := d.nsec3Cover(dns.CanonicalName(nextCloser)); cover != nil {
+		return true, cover.Flags&1 == 1
+	}
+	return false, false
+}
+
+func (d *denial) nsecMatch(name string) *dns.NSEC {
+	for _, nsec := range d.nsecs {
+		if dns.CanonicalName(nsec.Hdr.Name) == name {
+			return nsec
+		}
+	}
+	return nil
+}
+
+// nsecCover returns the nsec that covers name. Nsec records whose
+// owner is an ancestor of name that hides its descendants are ignored.
+func (d *denial) nsecCover(name string) *dns.NSEC {
+	for _, nsec := range d.nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		if hidesAncestorOf(nsec, name) {
+			continue
+		}
+		return nsec
+	}
+	return nil
+}
+
+func (d *denial) nsec3Match(name string) *dns.NSEC3 {
+	for _, nsec3 := range d.nsec3s {
+		if nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+func (d *denial) nsec3Cover(name string) *dns.NSEC3 {
+	for _, nsec3 := range d.nsec3s {
+		if nsec3.Cover(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// nsec3ClosestEncloser finds the closest encloser proof of name. RFC 5155 8.3.
+// The closest encloser ce must be matched by an nsec3 record, and the next
+// closer name must be covered by cover.
+func (d *denial) nsec3ClosestEncloser(name string) (ce, nextCloser string, cover *dns.NSEC3, ok bool) {
+	if len(d.nsec3s) == 0 {
+		return "", "", nil, false
+	}
+	nextCloser = name
+	for sname := parentName(name); ; sname = parentName(sname) {
+		if m := d.nsec3Match(sname); m != nil {
+			if hidesDescendants(m.TypeBitMap) {
+				return "", "", nil, false
+			}
+			cover = d.nsec3Cover(nextCloser)
+			return sname, nextCloser, cover, cover != nil
+		}
+		if sname == "." {
+			return "", "", nil, false
+		}
+		nextCloser = sname
+	}
+}
+
+// nsecCovers reports whether name is strictly between the owner
+// and the next name of nsec, in canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCmp(owner, name) >= 0 {
+		return false
+	}
+	if canonicalCmp(next, owner) <= 0 { // The last nsec of the zone. Next is the apex.
+		return dns.IsSubDomain(next, name)
+	}
+	return canonicalCmp(name, next) < 0
+}
+
+// nsecClosestEncloser returns the closest encloser of name, proved by
+// nsec that covers it. RFC 4035 5.4.
+func nsecClosestEncloser(nsec *dns.NSEC, name string) string {
+	n := max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+	if n == 0 {
+		return "."
+	}
+	idx := dns.Split(name)
+	return name[idx[len(idx)-n]:]
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	return slices.Contains(bitmap, t)
+}
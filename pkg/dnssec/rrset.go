@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnssec
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rrset is a set of records that have the same name, type and class,
+// with the RRSIGs that cover it.
+type rrset struct {
+	name string // canonical name
+	typ  uint16
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// groupRRsets groups rrs into rrsets, in the order they appear.
+// OPT records and RRSIGs that cover nothing in rrs are dropped.
+func groupRRsets(rrs []dns.RR) []*rrset {
+	type setKey struct {
+		name  string
+		typ   uint16
+		class uint16
+	}
+	var sets []*rrset
+	m := make(map[setKey]*rrset)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT || h.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		k := setKey{name: dns.CanonicalName(h.Name), typ: h.Rrtype, class: h.Class}
+		s := m[k]
+		if s == nil {
+			s = &rrset{name: k.name, typ: k.typ}
+			m[k] = s
+			sets = append(sets, s)
+		}
+		s.rrs = append(s.rrs, rr)
+	}
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		k := setKey{name: dns.CanonicalName(sig.Hdr.Name), typ: sig.TypeCovered, class: sig.Hdr.Class}
+		if s := m[k]; s != nil {
+			s.sigs = append(s.sigs, sig)
+		}
+	}
+	return sets
+}
+
+func findRRset(sets []*rrset, name string, typ uint16) *rrset {
+	name = dns.CanonicalName(name)
+	for _, s := range sets {
+		if s.name == name && s.typ == typ {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *rrset) minTTL() uint32 {
+	ttl := ^uint32(0)
+	for _, rr := range s.rrs {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	for _, sig := range s.sigs {
+		ttl = min(ttl, sig.Hdr.Ttl, sig.OrigTtl)
+	}
+	return ttl
+}
+
+// verifyWithKeys verifies s with one of the sigs that made by keys.
+// It returns the sig that verified s, or nil.
+func (s *rrset) verifyWithKeys(keys []*dns.DNSKEY, now time.Time) *dns.RRSIG {
+	for _, sig := range s.sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, s.rrs); err == nil {
+				return sig
+			}
+		}
+	}
+	return nil
+}
+
+// isWildcardExpansion reports whether the rrset verified by sig
+// was synthesized from a wildcard.
+func isWildcardExpansion(s *rrset, sig *dns.RRSIG) bool {
+	return int(sig.Labels) < dns.CountLabel(s.name)
+}
+
+// wildcardSource returns the source of synthesis (the wildcard name)
+// and the next closer name of a wildcard expansion.
+func wildcardSource(name string, labels uint8) (wildcard, nextCloser string) {
+	idx := dns.Split(name)
+	n := len(idx) - int(labels) // number of labels replaced by the wildcard.
+	ce := name[idx[n]:]
+	return "*." + ce, name[idx[n-1]:]
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+func supportedDigest(t uint8) bool {
+	switch t {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+// canonicalCmp compares a and b in canonical DNS name order. RFC 4034 6.1.
+func canonicalCmp(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// parentName returns the parent of name. The parent of root is root.
+func parentName(name string) string {
+	if name == "." {
+		return "."
+	}
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
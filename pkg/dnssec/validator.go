@@ -0,0 +1,635 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnssec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// Result is the security status of a response. RFC 4035 4.3.
+type Result int
+
+const (
+	Indeterminate Result = iota
+	Insecure
+	Secure
+	Bogus
+)
+
+func (r Result) String() string {
+	switch r {
+	case Indeterminate:
+		return "indeterminate"
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	default:
+		return fmt.Sprintf("result(%d)", int(r))
+	}
+}
+
+// ErrBogus is wrapped by the errors returned by Validator
+// if the response failed the validation.
+var ErrBogus = errors.New("dnssec bogus")
+
+func bogusErr(format string, a ...any) error {
+	return fmt.Errorf("%w, %s", ErrBogus, fmt.Sprintf(format, a...))
+}
+
+// ExchangeFunc sends q and returns its response. Validator uses it to
+// fetch DS and DNSKEY records. q always has the DO and CD bits set.
+type ExchangeFunc func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+const (
+	defaultCacheSize = 1024
+	minCacheTTL      = time.Minute
+	maxCacheTTL      = time.Hour
+
+	// Limits the depth of the chain of trust and the number of
+	// zone cuts that Validator walks through.
+	maxChainDepth = 16
+)
+
+type Opts struct {
+	// Anchors are DS or DNSKEY records of trust anchors. Required.
+	Anchors []dns.RR
+
+	// CacheSize is the size of the validated DNSKEY cache.
+	// Default is 1024.
+	CacheSize int
+}
+
+// Validator validates responses by building the chain of trust
+// from trust anchors. RFC 4035 5.
+type Validator struct {
+	anchors map[string][]dns.RR
+	zones   *cache.Cache[key, *zoneEntry]
+	sf      singleflight.Group
+}
+
+type key string
+
+var seed = maphash.MakeSeed()
+
+func (k key) Sum() uint64 {
+	return maphash.String(seed, string(k))
+}
+
+type zoneKind uint8
+
+const (
+	secureZone   zoneKind = iota // Zone apex with validated keys.
+	insecureZone                 // Zone that is not covered by the chain of trust.
+	notZoneCut                   // Name that is proved not to be a zone cut.
+)
+
+type zoneEntry struct {
+	kind zoneKind
+	keys []*dns.DNSKEY // for secureZone
+}
+
+func NewValidator(opts Opts) (*Validator, error) {
+	if len(opts.Anchors) == 0 {
+		return nil, errors.New("no trust anchor")
+	}
+	size := opts.CacheSize
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	return &Validator{
+		anchors: groupAnchors(opts.Anchors),
+		zones:   cache.New[key, *zoneEntry](cache.Opts{Size: size}),
+	}, nil
+}
+
+func (v *Validator) Close() error {
+	return v.zones.Close()
+}
+
+// Validate validates resp, the response of its question.
+// Responses other than NOERROR and NXDOMAIN are Indeterminate.
+// If the result is Bogus, the returned error describes the reason.
+// Other errors, e.g. failed to fetch DNSKEY, come with Indeterminate.
+func (v *Validator) Validate(ctx context.Context, resp *dns.Msg, exchange ExchangeFunc) (Result, error) {
+	if len(resp.Question) != 1 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return Indeterminate, nil
+	}
+	c := &chain{v: v, exchange: exchange, now: time.Now()}
+	r, err := c.validateMsg(ctx, resp)
+	if err != nil && errors.Is(err, ErrBogus) {
+		return Bogus, err
+	}
+	return r, err
+}
+
+// chain holds the states of one Validate call.
+type chain struct {
+	v        *Validator
+	exchange ExchangeFunc
+	now      time.Time
+	depth    int
+}
+
+func (c *chain) validateMsg(ctx context.Context, resp *dns.Msg) (Result, error) {
+	q := resp.Question[0]
+	answer := groupRRsets(resp.Answer)
+	auth := groupRRsets(resp.Ns)
+
+	result := Secure
+	merge := func(r Result) {
+		result = min(result, r) // Insecure < Secure
+	}
+
+	// Positive answers, including CNAME/DNAME chains.
+	var wildcards []*rrset
+	var wildcardSigs []*dns.RRSIG
+	for _, s := range answer {
+		// CNAMEs synthesized from a DNAME are not signed. RFC 6672 5.3.1.
+		if s.typ == dns.TypeCNAME && len(s.sigs) == 0 && hasDNAMEFor(answer, s.name) {
+			continue
+		}
+		r, sig, err := c.verifyRRset(ctx, s)
+		if err != nil {
+			return Indeterminate, err
+		}
+		merge(r)
+		if sig != nil && isWildcardExpansion(s, sig) {
+			wildcards = append(wildcards, s)
+			wildcardSigs = append(wildcardSigs, sig)
+		}
+	}
+
+	// Follow the CNAME chain to the name that the final answer is about.
+	target := dns.CanonicalName(q.Name)
+	for range maxChainDepth {
+		s := findRRset(answer, target, dns.TypeCNAME)
+		if s == nil || q.Qtype == dns.TypeCNAME {
+			break
+		}
+		target = dns.CanonicalName(s.rrs[0].(*dns.CNAME).Target)
+	}
+	negative := resp.Rcode == dns.RcodeNameError || findRRset(answer, target, q.Qtype) == nil
+	if !negative && len(wildcards) == 0 {
+		return result, nil
+	}
+
+	// Negative answers and wildcard expansions require proofs
+	// in the authority section.
+	var proofSets []*rrset
+	for _, s := range auth {
+		switch s.typ {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		r, _, err := c.verifyRRset(ctx, s)
+		if err != nil {
+			return Indeterminate, err
+		}
+		merge(r)
+		if r == Secure {
+			proofSets = append(proofSets, s)
+		}
+	}
+	if negative && len(proofSets) == 0 && result == Secure {
+		// No signed authority records at all. Check if the name is in an insecure zone.
+		r, err := c.securityOf(ctx, target)
+		if err != nil {
+			return Indeterminate, err
+		}
+		if r == Secure {
+			return Bogus, bogusErr("missing denial of existence for %s", target)
+		}
+		return r, nil
+	}
+	if result != Secure {
+		return result, nil
+	}
+
+	d := newDenial(proofSets)
+	for i, s := range wildcards {
+		_, nextCloser := wildcardSource(s.name, wildcardSigs[i].Labels)
+		ok, optOut := d.noCloserMatch(s.name, nextCloser)
+		if !ok {
+			if d.unsupportedNSEC3 {
+				return Insecure, nil
+			}
+			return Bogus, bogusErr("missing proof for wildcard expansion %s", s.name)
+		}
+		if optOut {
+			merge(Insecure)
+		}
+	}
+	if negative {
+		var ok, optOut bool
+		if resp.Rcode == dns.RcodeNameError {
+			ok, optOut = d.nxDomain(target)
+		} else {
+			ok, optOut = d.noData(target, q.Qtype)
+		}
+		if !ok {
+			if d.unsupportedNSEC3 {
+				return Insecure, nil
+			}
+			return Bogus, bogusErr("invalid denial of existence for %s %s", target, dns.TypeToString[q.Qtype])
+		}
+		if optOut {
+			merge(Insecure)
+		}
+	}
+	return result, nil
+}
+
+func hasDNAMEFor(sets []*rrset, name string) bool {
+	for _, s := range sets {
+		if s.typ == dns.TypeDNAME && dns.IsSubDomain(s.name, name) && s.name != name {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyRRset verifies s. If s is secure, it also returns the sig that verified it.
+func (c *chain) verifyRRset(ctx context.Context, s *rrset) (Result, *dns.RRSIG, error) {
+	if len(s.sigs) == 0 {
+		r, err := c.securityOf(ctx, s.name)
+		if err != nil {
+			return Indeterminate, nil, err
+		}
+		if r == Secure {
+			return Bogus, nil, bogusErr("missing signature for %s %s", s.name, dns.TypeToString[s.typ])
+		}
+		return r, nil, nil
+	}
+
+	signer := dns.CanonicalName(s.sigs[0].SignerName)
+	for _, sig := range s.sigs[1:] {
+		if dns.CanonicalName(sig.SignerName) != signer {
+			return Bogus, nil, bogusErr("rrset %s %s has multiple signers", s.name, dns.TypeToString[s.typ])
+		}
+	}
+	if !dns.IsSubDomain(signer, s.name) {
+		return Bogus, nil, bogusErr("signer %s is not a parent of %s", signer, s.name)
+	}
+	// DS records are signed by the parent zone.
+	if s.typ == dns.TypeDS && signer == s.name && s.name != "." {
+		return Bogus, nil, bogusErr("ds of %s is signed by itself", s.name)
+	}
+
+	// RFC 4035 5.3.1: The signer must be the zone that contains the rrset.
+	// We can't afford to find all zone cuts here, but the known ones must not
+	// be between the signer and the owner.
+	from := s.name
+	if s.typ == dns.TypeDS {
+		from = parentName(s.name)
+	}
+	for z := from; z != signer && z != "."; z = parentName(z) {
+		if ze, _, ok := c.v.zones.Get(key(z)); ok && ze.kind != notZoneCut {
+			return Bogus, nil, bogusErr("%s %s is signed by %s, but it is in zone %s", s.name, dns.TypeToString[s.typ], signer, z)
+		}
+	}
+
+	ze, err := c.zoneKeys(ctx, signer)
+	if err != nil {
+		return Indeterminate, nil, err
+	}
+	if ze.kind == insecureZone {
+		return Insecure, nil, nil
+	}
+	if sig := s.verifyWithKeys(ze.keys, c.now); sig != nil {
+		return Secure, sig, nil
+	}
+	return Bogus, nil, bogusErr("failed to verify %s %s with keys of %s", s.name, dns.TypeToString[s.typ], signer)
+}
+
+// closestAnchor returns the closest trust anchor zone that encloses name.
+func (c *chain) closestAnchor(name string) (string, bool) {
+	for z := name; ; z = parentName(z) {
+		if _, ok := c.v.anchors[z]; ok {
+			return z, true
+		}
+		if z == "." {
+			return "", false
+		}
+	}
+}
+
+// zoneKeys returns the validated keys of zone, or an insecureZone entry.
+func (c *chain) zoneKeys(ctx context.Context, zone string) (*zoneEntry, error) {
+	if ze, _, ok := c.v.zones.Get(key(zone)); ok && ze.kind != notZoneCut {
+		return ze, nil
+	}
+	if c.depth >= maxChainDepth {
+		return nil, errors.New("chain of trust is too long")
+	}
+	c.depth++
+	defer func() { c.depth-- }()
+
+	// Note: the singleflight key is shared by concurrent chains. Each chain has
+	// its own depth, so a loop can still be detected by the first caller.
+	v, err, _ := c.v.sf.Do(zone, func() (any, error) {
+		ze, ttl, err := c.lookupZoneKeys(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+		c.v.zones.Store(key(zone), ze, c.now.Add(clampTTL(ttl)))
+		return ze, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*zoneEntry), nil
+}
+
+func (c *chain) lookupZoneKeys(ctx context.Context, zone string) (*zoneEntry, uint32, error) {
+	anchorZone, ok := c.closestAnchor(zone)
+	if !ok {
+		return &zoneEntry{kind: insecureZone}, uint32(maxCacheTTL.Seconds()), nil
+	}
+
+	var dsRRs []dns.RR
+	var dsTTL uint32
+	if anchorZone == zone {
+		dsRRs = c.v.anchors[zone]
+		dsTTL = uint32(maxCacheTTL.Seconds())
+	} else {
+		st, err := c.dsState(ctx, zone)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch st.kind {
+		case dsSecure:
+			dsRRs, dsTTL = st.ds.rrs, st.ttl
+		case dsInsecure:
+			return &zoneEntry{kind: insecureZone}, st.ttl, nil
+		default:
+			return nil, 0, bogusErr("%s is used as a signer but is not a zone cut", zone)
+		}
+
+		// RFC 4035 5.2: If none of the DS records uses a supported
+		// algorithm, the zone is insecure.
+		supported := false
+		for _, rr := range dsRRs {
+			ds := rr.(*dns.DS)
+			if supportedAlgorithm(ds.Algorithm) && supportedDigest(ds.DigestType) {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return &zoneEntry{kind: insecureZone}, dsTTL, nil
+		}
+	}
+
+	resp, err := c.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	keySet := findRRset(groupRRsets(resp.Answer), zone, dns.TypeDNSKEY)
+	if keySet == nil {
+		return nil, 0, bogusErr("no dnskey for %s", zone)
+	}
+
+	var keys, sepKeys []*dns.DNSKEY
+	for _, rr := range keySet.rrs {
+		k := rr.(*dns.DNSKEY)
+		if k.Protocol != 3 || k.Flags&dns.ZONE == 0 || !supportedAlgorithm(k.Algorithm) {
+			continue
+		}
+		keys = append(keys, k)
+		if matchAnchor(k, dsRRs) {
+			sepKeys = append(sepKeys, k)
+		}
+	}
+	if len(sepKeys) == 0 {
+		return nil, 0, bogusErr("no dnskey of %s matches its ds", zone)
+	}
+	if keySet.verifyWithKeys(sepKeys, c.now) == nil {
+		return nil, 0, bogusErr("failed to verify dnskey of %s", zone)
+	}
+	return &zoneEntry{kind: secureZone, keys: keys}, min(dsTTL, keySet.minTTL()), nil
+}
+
+type dsKind uint8
+
+const (
+	dsSecure       dsKind = iota // Validated DS rrset.
+	dsInsecure                   // Insecure parent, or proved insecure delegation.
+	dsNotZoneCut                 // Proved the name is not a zone cut.
+	dsNameNotExist               // Proved the name does not exist.
+)
+
+type dsResult struct {
+	kind dsKind
+	ds   *rrset
+	ttl  uint32
+}
+
+// dsState queries the DS of name and checks the proofs.
+func (c *chain) dsState(ctx context.Context, name string) (dsResult, error) {
+	resp, err := c.query(ctx, name, dns.TypeDS)
+	if err != nil {
+		return dsResult{}, err
+	}
+
+	// Records in DS responses must be signed by zones above name. A
+	// signer at or below name would make zoneKeys wait on the lookup of
+	// name itself, which is in progress on this goroutine.
+	for _, s := range append(groupRRsets(resp.Answer), groupRRsets(resp.Ns)...) {
+		if len(s.sigs) == 0 || name == "." {
+			continue
+		}
+		if signer := dns.CanonicalName(s.sigs[0].SignerName); dns.IsSubDomain(name, signer) {
+			return dsResult{}, bogusErr("ds response of %s is signed by %s", name, signer)
+		}
+	}
+
+	if resp.Rcode == dns.RcodeSuccess {
+		answer := groupRRsets(resp.Answer)
+		if s := findRRset(answer, name, dns.TypeDS); s != nil {
+			r, _, err := c.verifyRRset(ctx, s)
+			if err != nil {
+				return dsResult{}, err
+			}
+			if r == Insecure {
+				return dsResult{kind: dsInsecure, ttl: s.minTTL()}, nil
+			}
+			return dsResult{kind: dsSecure, ds: s, ttl: s.minTTL()}, nil
+		}
+		// A CNAME can't coexist with a zone cut.
+		if s := findRRset(answer, name, dns.TypeCNAME); s != nil {
+			r, _, err := c.verifyRRset(ctx, s)
+			if err != nil {
+				return dsResult{}, err
+			}
+			if r == Insecure {
+				return dsResult{kind: dsInsecure, ttl: s.minTTL()}, nil
+			}
+			return dsResult{kind: dsNotZoneCut, ttl: s.minTTL()}, nil
+		}
+	}
+
+	// Negative response, signed by the parent side.
+	var proofSets []*rrset
+	ttl := uint32(maxCacheTTL.Seconds())
+	for _, s := range groupRRsets(resp.Ns) {
+		switch s.typ {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		r, _, err := c.verifyRRset(ctx, s)
+		if err != nil {
+			return dsResult{}, err
+		}
+		if r == Insecure {
+			return dsResult{kind: dsInsecure, ttl: s.minTTL()}, nil
+		}
+		proofSets = append(proofSets, s)
+		ttl = min(ttl, s.minTTL())
+	}
+	if len(proofSets) == 0 {
+		// Unsigned. Possible if the parent is insecure.
+		if r, err := c.securityOf(ctx, parentName(name)); err != nil || r != Secure {
+			return dsResult{kind: dsInsecure, ttl: ttl}, err
+		}
+		return dsResult{}, bogusErr("missing signed denial of ds for %s", name)
+	}
+
+	d := newDenial(proofSets)
+	if resp.Rcode == dns.RcodeNameError {
+		if ok, _ := d.nxDomain(name); ok {
+			return dsResult{kind: dsNameNotExist, ttl: ttl}, nil
+		}
+		return dsResult{}, bogusErr("invalid denial of existence for %s", name)
+	}
+
+	// RFC 4035 5.2: NSEC(3) with NS bit but without DS bit proves an insecure delegation.
+	var bitmap []uint16
+	if nsec := d.nsecMatch(name); nsec != nil {
+		bitmap = nsec.TypeBitMap
+	} else if nsec3 := d.nsec3Match(name); nsec3 != nil {
+		bitmap = nsec3.TypeBitMap
+	}
+	if bitmap != nil {
+		switch {
+		case hasType(bitmap, dns.TypeDS):
+			return dsResult{}, bogusErr("denial of ds for %s has ds bit", name)
+		case hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA):
+			return dsResult{kind: dsInsecure, ttl: ttl}, nil
+		default:
+			return dsResult{kind: dsNotZoneCut, ttl: ttl}, nil
+		}
+	}
+	ok, optOut := d.noData(name, dns.TypeDS)
+	switch {
+	case ok && optOut:
+		return dsResult{kind: dsInsecure, ttl: ttl}, nil
+	case ok:
+		return dsResult{kind: dsNotZoneCut, ttl: ttl}, nil
+	case d.unsupportedNSEC3:
+		return dsResult{kind: dsInsecure, ttl: ttl}, nil
+	default:
+		return dsResult{}, bogusErr("invalid denial of ds for %s", name)
+	}
+}
+
+// securityOf finds out whether name is in a secure zone, by walking
+// zone cuts from the closest trust anchor. It is used for unsigned
+// records, which are only acceptable in insecure zones.
+func (c *chain) securityOf(ctx context.Context, name string) (Result, error) {
+	name = dns.CanonicalName(name)
+	zone, ok := c.closestAnchor(name)
+	if !ok {
+		return Insecure, nil
+	}
+	ze, err := c.zoneKeys(ctx, zone)
+	if err != nil {
+		return Indeterminate, err
+	}
+	if ze.kind == insecureZone {
+		return Insecure, nil
+	}
+
+	labels := dns.Split(name)
+	walked := 0
+	for i := len(labels) - dns.CountLabel(zone) - 1; i >= 0; i-- {
+		child := name[labels[i]:]
+
+		ze, _, ok := c.v.zones.Get(key(child))
+		if !ok {
+			if walked++; walked > maxChainDepth {
+				return Indeterminate, errors.New("too many labels to walk")
+			}
+			st, err := c.dsState(ctx, child)
+			if err != nil {
+				return Indeterminate, err
+			}
+			exp := c.now.Add(clampTTL(st.ttl))
+			switch st.kind {
+			case dsSecure:
+				if ze, err = c.zoneKeys(ctx, child); err != nil {
+					return Indeterminate, err
+				}
+			case dsInsecure:
+				ze = &zoneEntry{kind: insecureZone}
+				c.v.zones.Store(key(child), ze, exp)
+			case dsNotZoneCut:
+				ze = &zoneEntry{kind: notZoneCut}
+				c.v.zones.Store(key(child), ze, exp)
+			case dsNameNotExist:
+				return Secure, nil
+			}
+		}
+		if ze.kind == insecureZone {
+			return Insecure, nil
+		}
+	}
+	return Secure, nil
+}
+
+func (c *chain) query(ctx context.Context, name string, t uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, t)
+	q.CheckingDisabled = true
+	q.SetEdns0(dns.DefaultMsgSize, true)
+	resp, err := c.exchange(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s %s, %w", name, dns.TypeToString[t], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("failed to query %s %s, rcode %s", name, dns.TypeToString[t], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+func clampTTL(ttl uint32) time.Duration {
+	return min(max(time.Duration(ttl)*time.Second, minCacheTTL), maxCacheTTL)
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := k.Generate(256)
+	require.NoError(t, err)
+	return &testZone{name: name, key: k, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrs with their RRSIG. rrs must be one rrset.
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	h := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		Algorithm:  z.key.Algorithm,
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+	}
+	require.NoError(t, sig.Sign(z.priv, rrs))
+	return append(rrs, sig)
+}
+
+func (z *testZone) ds() *dns.DS {
+	ds := z.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	return ds
+}
+
+func rr(t *testing.T, s string) dns.RR {
+	t.Helper()
+	r, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return r
+}
+
+func msg(q string, qt uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(q, qt)
+	m.Response = true
+	m.Rcode = rcode
+	m.Answer = answer
+	m.Ns = ns
+	return m
+}
+
+// testUpstream serves prepared responses by "name type".
+type testUpstream map[string]*dns.Msg
+
+func (u testUpstream) set(m *dns.Msg) {
+	u[m.Question[0].Name+" "+dns.TypeToString[m.Question[0].Qtype]] = m
+}
+
+func (u testUpstream) exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if !q.CheckingDisabled || q.IsEdns0() == nil || !q.IsEdns0().Do() {
+		return nil, errors.New("chain query without cd or do bit")
+	}
+	m, ok := u[q.Question[0].Name+" "+dns.TypeToString[q.Question[0].Qtype]]
+	if !ok {
+		return nil, errors.New("unexpected query " + q.Question[0].String())
+	}
+	return m.Copy(), nil
+}
+
+func Test_Validator(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+
+	u := make(testUpstream)
+	rootSOA := rr(t, ". 3600 IN SOA a.root. b.root. 1 3600 600 86400 300")
+	exampleSOA := rr(t, "example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 300")
+	u.set(msg(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.sign(t, root.key), nil))
+	u.set(msg("example.", dns.TypeDS, dns.RcodeSuccess, root.sign(t, example.ds()), nil))
+	u.set(msg("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.sign(t, example.key), nil))
+
+	// insecure. is an insecure delegation.
+	u.set(msg("insecure.", dns.TypeDS, dns.RcodeSuccess, nil, append(
+		root.sign(t, rootSOA),
+		root.sign(t, rr(t, "insecure. 300 IN NSEC zzz. NS RRSIG NSEC"))...,
+	)))
+	// host.insecure. is not a zone cut. A recursive resolver answers
+	// its DS query with the unsigned SOA of insecure.
+	u.set(msg("host.insecure.", dns.TypeDS, dns.RcodeSuccess, nil, []dns.RR{
+		rr(t, "insecure. 300 IN SOA ns.insecure. admin.insecure. 1 3600 600 86400 300"),
+	}))
+
+	// NSEC chain of example.: example. -> *.wild.example. -> www.example. -> example.
+	nsecApex := example.sign(t, rr(t, "example. 300 IN NSEC *.wild.example. NS SOA RRSIG NSEC DNSKEY"))
+	nsecWild := example.sign(t, rr(t, "*.wild.example. 300 IN NSEC www.example. A RRSIG NSEC"))
+	nsecWww := example.sign(t, rr(t, "www.example. 300 IN NSEC example. A RRSIG NSEC"))
+
+	// Parent side nsec of the zone cut sub.example. and a DNAME at
+	// dname.example. They prove nothing about the names below them and
+	// the types other than DS of the zone cut. RFC 6840 4.4.
+	nsecCut := example.sign(t, rr(t, "sub.example. 300 IN NSEC www.example. NS RRSIG NSEC"))
+	nsecDNAME := example.sign(t, rr(t, "dname.example. 300 IN NSEC www.example. DNAME RRSIG NSEC"))
+
+	// www.example. is not a zone cut.
+	u.set(msg("www.example.", dns.TypeDS, dns.RcodeSuccess, nil, append(example.sign(t, exampleSOA), nsecWww...)))
+
+	// nsec3. uses NSEC3 with two names: the apex and www.nsec3.
+	zone3 := newTestZone(t, "nsec3.")
+	u.set(msg("nsec3.", dns.TypeDS, dns.RcodeSuccess, root.sign(t, zone3.ds()), nil))
+	u.set(msg("nsec3.", dns.TypeDNSKEY, dns.RcodeSuccess, zone3.sign(t, zone3.key), nil))
+	h1 := dns.HashName("nsec3.", dns.SHA1, 1, "ab")
+	h2 := dns.HashName("www.nsec3.", dns.SHA1, 1, "ab")
+	bits1, bits2 := "NS SOA RRSIG DNSKEY NSEC3PARAM", "A RRSIG"
+	if h1 > h2 {
+		h1, h2, bits1, bits2 = h2, h1, bits2, bits1
+	}
+	nsec3s := append(
+		zone3.sign(t, rr(t, strings.ToLower(h1)+".nsec3. 300 IN NSEC3 1 0 1 ab "+h2+" "+bits1)),
+		zone3.sign(t, rr(t, strings.ToLower(h2)+".nsec3. 300 IN NSEC3 1 0 1 ab "+h1+" "+bits2))...,
+	)
+	zone3SOA := zone3.sign(t, rr(t, "nsec3. 3600 IN SOA ns.nsec3. admin.nsec3. 1 3600 600 86400 300"))
+
+	v, err := NewValidator(Opts{Anchors: []dns.RR{root.ds()}})
+	require.NoError(t, err)
+	defer v.Close()
+
+	wwwA := rr(t, "www.example. 300 IN A 192.0.2.1")
+	wildA := example.sign(t, rr(t, "*.wild.example. 300 IN A 192.0.2.2"))
+	for _, r := range wildA {
+		r.Header().Name = "a.wild.example."
+	}
+
+	tests := []struct {
+		name string
+		resp *dns.Msg
+		want Result
+	}{
+		{"secure", msg("www.example.", dns.TypeA, dns.RcodeSuccess, example.sign(t, wwwA), nil), Secure},
+		{"tampered", func() *dns.Msg {
+			m := msg("www.example.", dns.TypeA, dns.RcodeSuccess, example.sign(t, dns.Copy(wwwA)), nil)
+			m.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.99")
+			return m
+		}(), Bogus},
+		{"stripped sig", msg("www.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{wwwA}, nil), Bogus},
+		{"signed by wrong zone", msg("www.example.", dns.TypeA, dns.RcodeSuccess, root.sign(t, dns.Copy(wwwA)), nil), Bogus},
+		{"insecure delegation", msg("host.insecure.", dns.TypeA, dns.RcodeSuccess, []dns.RR{rr(t, "host.insecure. 300 IN A 192.0.2.3")}, nil), Insecure},
+		{"nodata", msg("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil, append(example.sign(t, exampleSOA), nsecWww...)), Secure},
+		{"nodata type exists", msg("www.example.", dns.TypeA, dns.RcodeSuccess, nil, append(example.sign(t, exampleSOA), nsecWww...)), Bogus},
+		{"nxdomain", msg("nx.example.", dns.TypeA, dns.RcodeNameError, nil, append(example.sign(t, exampleSOA), nsecApex...)), Secure},
+		{"nxdomain without proof", msg("nx.example.", dns.TypeA, dns.RcodeNameError, nil, example.sign(t, exampleSOA)), Bogus},
+		{"nxdomain wrong proof", msg("nx.example.", dns.TypeA, dns.RcodeNameError, nil, append(example.sign(t, exampleSOA), nsecWww...)), Bogus},
+		{"nodata from parent side of zone cut", msg("sub.example.", dns.TypeA, dns.RcodeSuccess, nil, append(example.sign(t, exampleSOA), nsecCut...)), Bogus},
+		{"nxdomain below zone cut", msg("a.sub.example.", dns.TypeA, dns.RcodeNameError, nil, append(example.sign(t, exampleSOA), nsecCut...)), Bogus},
+		{"nxdomain below dname", msg("a.dname.example.", dns.TypeA, dns.RcodeNameError, nil, append(example.sign(t, exampleSOA), nsecDNAME...)), Bogus},
+		{"nodata at dname owner", msg("dname.example.", dns.TypeA, dns.RcodeSuccess, nil, append(example.sign(t, exampleSOA), nsecDNAME...)), Secure},
+		{"wildcard", msg("a.wild.example.", dns.TypeA, dns.RcodeSuccess, wildA, nsecWild), Secure},
+		{"wildcard without proof", msg("a.wild.example.", dns.TypeA, dns.RcodeSuccess, wildA, nil), Bogus},
+		{"nsec3 nxdomain", msg("nx.nsec3.", dns.TypeA, dns.RcodeNameError, nil, append(zone3SOA, nsec3s...)), Secure},
+		{"nsec3 nodata", msg("www.nsec3.", dns.TypeAAAA, dns.RcodeSuccess, nil, append(zone3SOA, nsec3s...)), Secure},
+		{"nsec3 nxdomain for existing name", msg("www.nsec3.", dns.TypeA, dns.RcodeNameError, nil, append(zone3SOA, nsec3s...)), Bogus},
+		{"servfail", msg("www.example.", dns.TypeA, dns.RcodeServerFailure, nil, nil), Indeterminate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.Validate(context.Background(), tt.resp, u.exchange)
+			if tt.want == Bogus {
+				require.ErrorIs(t, err, ErrBogus)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_Validator_dsSignedByChild(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	child := newTestZone(t, "child.example.")
+	grandchild := newTestZone(t, "a.child.example.")
+
+	u := make(testUpstream)
+	u.set(msg(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.sign(t, root.key), nil))
+	u.set(msg("example.", dns.TypeDS, dns.RcodeSuccess, root.sign(t, example.ds()), nil))
+	u.set(msg("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.sign(t, example.key), nil))
+	// The ds responses of child.example. and a.child.example. are signed
+	// by the zone below, which would make the lookups of the two zones
+	// wait on each other.
+	u.set(msg("child.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		grandchild.sign(t, rr(t, "a.child.example. 3600 IN SOA ns.a.child.example. admin.a.child.example. 1 3600 600 86400 300"))))
+	u.set(msg("a.child.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		child.sign(t, rr(t, "child.example. 3600 IN SOA ns.child.example. admin.child.example. 1 3600 600 86400 300"))))
+
+	v, err := NewValidator(Opts{Anchors: []dns.RR{root.ds()}})
+	require.NoError(t, err)
+	defer v.Close()
+
+	resp := msg("www.child.example.", dns.TypeA, dns.RcodeSuccess, child.sign(t, rr(t, "www.child.example. 300 IN A 192.0.2.1")), nil)
+	type result struct {
+		r   Result
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, err := v.Validate(context.Background(), resp, u.exchange)
+		done <- result{r, err}
+	}()
+	select {
+	case res := <-done:
+		require.ErrorIs(t, res.err, ErrBogus)
+		require.Equal(t, Bogus, res.r)
+	case <-time.After(5 * time.Second):
+		t.Fatal("validation hangs")
+	}
+}
+
+func Test_ParseAnchors(t *testing.T) {
+	anchors, err := ParseAnchors(strings.NewReader(`
+. 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. 172800 IN NS a.root-servers.net.
+`))
+	require.NoError(t, err)
+	require.Len(t, anchors, 1)
+
+	_, err = ParseAnchors(strings.NewReader(`. 172800 IN NS a.root-servers.net.`))
+	require.Error(t, err)
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dnsstamp parses and encodes DNS stamps (sdns://).
+// See https://dnscrypt.info/stamps-specifications.
+package dnsstamp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Proto uint8
+
+const (
+	ProtoPlain    Proto = 0x00
+	ProtoDNSCrypt Proto = 0x01
+	ProtoDoH      Proto = 0x02
+	ProtoDoT      Proto = 0x03
+	ProtoDoQ      Proto = 0x04
+)
+
+func (p Proto) String() string {
+	switch p {
+	case ProtoPlain:
+		return "plain"
+	case ProtoDNSCrypt:
+		return "dnscrypt"
+	case ProtoDoH:
+		return "doh"
+	case ProtoDoT:
+		return "dot"
+	case ProtoDoQ:
+		return "doq"
+	default:
+		return fmt.Sprintf("proto(%d)", uint8(p))
+	}
+}
+
+// Props are the informal properties of a server.
+type Props uint64
+
+const (
+	PropDNSSEC   Props = 1 << 0
+	PropNoLog    Props = 1 << 1
+	PropNoFilter Props = 1 << 2
+)
+
+const scheme = "sdns://"
+
+var errShortStamp = errors.New("stamp is too short")
+
+// Stamp is a decoded DNS stamp.
+type Stamp struct {
+	Proto Proto
+	Props Props
+
+	// Addr is the server ip with an optional port. It may be empty for
+	// DoH, DoT and DoQ stamps, in which case Hostname should be resolved.
+	Addr string
+
+	// ProviderPk and ProviderName are for DNSCrypt only.
+	// ProviderPk is the ed25519 public key of the provider.
+	// ProviderName is the name of the provider including the
+	// "2.dnscrypt-cert." prefix.
+	ProviderPk   []byte
+	ProviderName string
+
+	// Hashes are the SHA256 digests of the TBS certificates in the server's
+	// certificate chain. For DoH, DoT and DoQ.
+	Hashes [][]byte
+	// Hostname is the TLS server name with an optional port.
+	Hostname string
+	// Path is the DoH path.
+	Path string
+}
+
+// Parse parses a sdns:// stamp.
+func Parse(s string) (*Stamp, error) {
+	if !strings.HasPrefix(s, scheme) {
+		return nil, fmt.Errorf("stamp must start with %s", scheme)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[len(scheme):], "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 payload, %w", err)
+	}
+	if len(b) < 9 {
+		return nil, errShortStamp
+	}
+
+	st := &Stamp{Proto: Proto(b[0]), Props: Props(binary.LittleEndian.Uint64(b[1:9]))}
+	r := reader(b[9:])
+	switch st.Proto {
+	case ProtoPlain:
+		st.Addr, err = r.lpString()
+	case ProtoDNSCrypt:
+		if st.Addr, err = r.lpString(); err != nil {
+			break
+		}
+		if st.ProviderPk, err = r.lp(); err != nil {
+			break
+		}
+		if len(st.ProviderPk) != 32 {
+			err = fmt.Errorf("invalid provider public key length %d", len(st.ProviderPk))
+			break
+		}
+		if st.ProviderName, err = r.lpString(); err != nil {
+			break
+		}
+		if len(st.ProviderName) == 0 {
+			err = errors.New("empty provider name")
+		}
+	case ProtoDoH, ProtoDoT, ProtoDoQ:
+		if st.Addr, err = r.lpString(); err != nil {
+			break
+		}
+		if st.Hashes, err = r.vlp(); err != nil {
+			break
+		}
+		if st.Hostname, err = r.lpString(); err != nil {
+			break
+		}
+		if len(st.Hostname) == 0 {
+			err = errors.New("empty hostname")
+			break
+		}
+		if st.Proto == ProtoDoH {
+			st.Path, err = r.lpString()
+		}
+	default:
+		return nil, fmt.Errorf("unsupported stamp protocol %d", b[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s stamp, %w", st.Proto, err)
+	}
+	for _, h := range st.Hashes {
+		if len(h) != 0 && len(h) != 32 {
+			return nil, fmt.Errorf("invalid cert hash length %d", len(h))
+		}
+	}
+	return st, nil
+}
+
+// String encodes s as a sdns:// stamp.
+func (s *Stamp) String() string {
+	b := make([]byte, 9, 128)
+	b[0] = byte(s.Proto)
+	binary.LittleEndian.PutUint64(b[1:9], uint64(s.Props))
+	b = appendLP(b, []byte(s.Addr))
+	switch s.Proto {
+	case ProtoDNSCrypt:
+		b = appendLP(b, s.ProviderPk)
+		b = appendLP(b, []byte(s.ProviderName))
+	case ProtoDoH, ProtoDoT, ProtoDoQ:
+		if len(s.Hashes) == 0 {
+			b = append(b, 0)
+		}
+		for i, h := range s.Hashes {
+			l := byte(len(h))
+			if i < len(s.Hashes)-1 {
+				l |= 0x80
+			}
+			b = append(b, l)
+			b = append(b, h...)
+		}
+		b = appendLP(b, []byte(s.Hostname))
+		if s.Proto == ProtoDoH {
+			b = appendLP(b, []byte(s.Path))
+		}
+	}
+	return scheme + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func appendLP(b, s []byte) []byte {
+	b = append(b, byte(len(s)))
+	return append(b, s...)
+}
+
+type reader []byte
+
+func (r *reader) lp() ([]byte, error) {
+	if len(*r) < 1 {
+		return nil, errShortStamp
+	}
+	l := int((*r)[0])
+	if len(*r) < 1+l {
+		return nil, errShortStamp
+	}
+	v := (*r)[1 : 1+l]
+	*r = (*r)[1+l:]
+	return v, nil
+}
+
+func (r *reader) lpString() (string, error) {
+	b, err := r.lp()
+	return string(b), err
+}
+
+// vlp reads a set of length-prefixed items. The high bit of the
+// length byte is set if more items follow.
+func (r *reader) vlp() ([][]byte, error) {
+	var vs [][]byte
+	for {
+		if len(*r) < 1 {
+			return nil, errShortStamp
+		}
+		l := (*r)[0]
+		more := l&0x80 != 0
+		l &^= 0x80
+		if len(*r) < 1+int(l) {
+			return nil, errShortStamp
+		}
+		if l > 0 {
+			vs = append(vs, (*r)[1:1+int(l)])
+		}
+		*r = (*r)[1+int(l):]
+		if !more {
+			return vs, nil
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsstamp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	s, err := Parse("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5")
+	require.NoError(t, err)
+	require.Equal(t, &Stamp{
+		Proto:    ProtoDoH,
+		Props:    PropDNSSEC | PropNoLog | PropNoFilter,
+		Addr:     "1.0.0.1",
+		Hostname: "dns.cloudflare.com",
+		Path:     "/dns-query",
+	}, s)
+
+	for _, bad := range []string{
+		"https://dns.cloudflare.com",
+		"sdns://!!",
+		"sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ",
+		"sdns://BwAAAAAAAAAA",
+	} {
+		_, err := Parse(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	pk := make([]byte, 32)
+	pk[0] = 1
+	for _, s := range []*Stamp{
+		{Proto: ProtoPlain, Addr: "8.8.8.8"},
+		{Proto: ProtoDNSCrypt, Props: PropDNSSEC, Addr: "[2001:db8::1]:8443", ProviderPk: pk, ProviderName: "2.dnscrypt-cert.example.com"},
+		{Proto: ProtoDoH, Addr: "1.1.1.1", Hashes: [][]byte{pk, pk}, Hostname: "example.com:8443", Path: "/dns-query"},
+		{Proto: ProtoDoT, Hostname: "dot.example.com"},
+		{Proto: ProtoDoQ, Addr: "9.9.9.9", Hashes: [][]byte{pk}, Hostname: "doq.example.com"},
+	} {
+		got, err := Parse(s.String())
+		require.NoError(t, err)
+		require.Equal(t, s, got)
+	}
+}
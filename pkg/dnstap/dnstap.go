@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dnstap encodes dnstap (https://dnstap.info) messages and
+// writes them as Frame Streams.
+package dnstap
+
+import (
+	"net/netip"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ContentType is the Frame Streams content type of dnstap.
+const ContentType = "protobuf:dnstap.Dnstap"
+
+// MessageType is the type of Message.
+type MessageType int32
+
+const (
+	MessageClientQuery       MessageType = 5
+	MessageClientResponse    MessageType = 6
+	MessageForwarderQuery    MessageType = 7
+	MessageForwarderResponse MessageType = 8
+)
+
+// SocketProtocol is the transport protocol of a Message.
+type SocketProtocol int32
+
+const (
+	ProtocolUDP SocketProtocol = 1
+	ProtocolTCP SocketProtocol = 2
+	ProtocolDOT SocketProtocol = 3
+	ProtocolDOH SocketProtocol = 4
+	ProtocolDOQ SocketProtocol = 7
+)
+
+const (
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+
+	dnstapTypeMessage = 1
+)
+
+// Message is a dnstap.Message. Zero fields are omitted.
+type Message struct {
+	Type           MessageType
+	SocketProtocol SocketProtocol
+
+	QueryAddress    netip.Addr
+	QueryPort       uint16
+	ResponseAddress netip.Addr
+	ResponsePort    uint16
+
+	QueryTime       time.Time
+	QueryMessage    []byte
+	ResponseTime    time.Time
+	ResponseMessage []byte
+}
+
+// AppendDnstap appends the dnstap.Dnstap that wraps m to b.
+func AppendDnstap(b []byte, identity, version string, m *Message) []byte {
+	if len(identity) > 0 {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, identity)
+	}
+	if len(version) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, version)
+	}
+	b = protowire.AppendTag(b, 14, protowire.BytesType)
+	b = protowire.AppendBytes(b, appendMessage(nil, m))
+	b = protowire.AppendTag(b, 15, protowire.VarintType)
+	b = protowire.AppendVarint(b, dnstapTypeMessage)
+	return b
+}
+
+func appendMessage(b []byte, m *Message) []byte {
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Type))
+
+	family := m.QueryAddress
+	if !family.IsValid() {
+		family = m.ResponseAddress
+	}
+	if family.IsValid() {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		if family.Unmap().Is4() {
+			b = protowire.AppendVarint(b, socketFamilyINET)
+		} else {
+			b = protowire.AppendVarint(b, socketFamilyINET6)
+		}
+	}
+	if m.SocketProtocol != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.SocketProtocol))
+	}
+	b = appendAddr(b, 4, m.QueryAddress)
+	b = appendAddr(b, 5, m.ResponseAddress)
+	if m.QueryPort != 0 {
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.QueryPort))
+	}
+	if m.ResponsePort != 0 {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.ResponsePort))
+	}
+	b = appendTime(b, 8, 9, m.QueryTime)
+	if m.QueryMessage != nil {
+		b = protowire.AppendTag(b, 10, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.QueryMessage)
+	}
+	b = appendTime(b, 12, 13, m.ResponseTime)
+	if m.ResponseMessage != nil {
+		b = protowire.AppendTag(b, 14, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.ResponseMessage)
+	}
+	return b
+}
+
+// appendAddr appends addr in network byte order. IPv4-mapped addresses
+// are appended as 4 bytes, as their socket family is INET.
+func appendAddr(b []byte, num protowire.Number, addr netip.Addr) []byte {
+	if !addr.IsValid() {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, addr.Unmap().AsSlice())
+}
+
+func appendTime(b []byte, secNum, nsecNum protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = protowire.AppendTag(b, secNum, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.Unix()))
+	b = protowire.AppendTag(b, nsecNum, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+}
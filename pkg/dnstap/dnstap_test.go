@@ -0,0 +1,172 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeFields decodes the top level fields of b. Varint and fixed32
+// values are returned as uint64, bytes as []byte.
+func decodeFields(t *testing.T, b []byte) map[protowire.Number]any {
+	t.Helper()
+	m := make(map[protowire.Number]any)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			require.GreaterOrEqual(t, n, 0)
+			m[num] = v
+			b = b[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			require.GreaterOrEqual(t, n, 0)
+			m[num] = uint64(v)
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			require.GreaterOrEqual(t, n, 0)
+			m[num] = v
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+	return m
+}
+
+func Test_AppendDnstap(t *testing.T) {
+	qt := time.Unix(1700000000, 123)
+	rt := time.Unix(1700000001, 456)
+	b := AppendDnstap(nil, "ns1", "mosdns", &Message{
+		Type:            MessageForwarderResponse,
+		SocketProtocol:  ProtocolDOT,
+		ResponseAddress: netip.MustParseAddr("::ffff:8.8.8.8"),
+		ResponsePort:    853,
+		QueryTime:       qt,
+		QueryMessage:    []byte("q"),
+		ResponseTime:    rt,
+		ResponseMessage: []byte("r"),
+	})
+
+	d := decodeFields(t, b)
+	require.Equal(t, []byte("ns1"), d[1])
+	require.Equal(t, []byte("mosdns"), d[2])
+	require.Equal(t, uint64(dnstapTypeMessage), d[15])
+
+	m := decodeFields(t, d[14].([]byte))
+	require.Equal(t, uint64(MessageForwarderResponse), m[1])
+	require.Equal(t, uint64(socketFamilyINET), m[2])
+	require.Equal(t, uint64(ProtocolDOT), m[3])
+	require.NotContains(t, m, protowire.Number(4))
+	require.Equal(t, []byte{8, 8, 8, 8}, m[5])
+	require.Equal(t, uint64(853), m[7])
+	require.Equal(t, uint64(1700000000), m[8])
+	require.Equal(t, uint64(123), m[9])
+	require.Equal(t, []byte("q"), m[10])
+	require.Equal(t, uint64(1700000001), m[12])
+	require.Equal(t, uint64(456), m[13])
+	require.Equal(t, []byte("r"), m[14])
+}
+
+func Test_FrameStream_unidirectional(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, false)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteFrame([]byte("frame1")))
+	require.NoError(t, w.WriteFrame([]byte("frame2")))
+	require.Error(t, w.WriteFrame(nil))
+	require.NoError(t, w.Close())
+
+	r, err := NewReader(buf, false)
+	require.NoError(t, err)
+	for _, want := range []string{"frame1", "frame2"} {
+		b, err := r.ReadFrame()
+		require.NoError(t, err)
+		require.Equal(t, want, string(b))
+	}
+	_, err = r.ReadFrame()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func Test_FrameStream_bidirectional(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	type result struct {
+		frames []string
+		err    error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() { resC <- res }()
+		r, err := NewReader(c2, true)
+		if err != nil {
+			res.err = err
+			return
+		}
+		for {
+			b, err := r.ReadFrame()
+			if err != nil {
+				if err != io.EOF {
+					res.err = err
+				}
+				return
+			}
+			res.frames = append(res.frames, string(b))
+		}
+	}()
+
+	w, err := NewWriter(c1, true)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteFrame([]byte("frame1")))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Close()) // Waits for FINISH.
+
+	res := <-resC
+	require.NoError(t, res.err)
+	require.Equal(t, []string{"frame1"}, res.frames)
+}
+
+func Test_NewWriter_rejected(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		_, _, _ = readControl(c2) // READY
+		_ = writeControlTo(c2, controlFinish, false)
+	}()
+	_, err := NewWriter(c1, true)
+	require.Error(t, err)
+}
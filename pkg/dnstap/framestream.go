@@ -0,0 +1,285 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame Streams control frame types.
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	controlFieldContentType = 0x01
+
+	maxControlFrameSize = 512
+	maxDataFrameSize    = 1 << 20
+)
+
+// Writer writes data frames of a Frame Streams. It is not
+// concurrency safe.
+type Writer struct {
+	bw *bufio.Writer
+	r  io.Reader // Nil if the stream is unidirectional.
+}
+
+// NewWriter starts a Frame Streams with the ContentType on w.
+// If bidirectional is set, w must also be an io.Reader, and the
+// READY/ACCEPT handshake is done before the START frame.
+func NewWriter(w io.Writer, bidirectional bool) (*Writer, error) {
+	fw := &Writer{bw: bufio.NewWriter(w)}
+	if bidirectional {
+		r, ok := w.(io.Reader)
+		if !ok {
+			return nil, errors.New("bidirectional stream needs an io.Reader")
+		}
+		fw.r = r
+		if err := fw.writeControl(controlReady, true); err != nil {
+			return nil, err
+		}
+		if err := fw.bw.Flush(); err != nil {
+			return nil, err
+		}
+		typ, contentTypes, err := readControl(r)
+		if err != nil {
+			return nil, err
+		}
+		if typ != controlAccept {
+			return nil, fmt.Errorf("unexpected control frame type %d, want ACCEPT", typ)
+		}
+		if !hasContentType(contentTypes) {
+			return nil, fmt.Errorf("receiver does not accept content type %s", ContentType)
+		}
+	}
+	if err := fw.writeControl(controlStart, true); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// WriteFrame writes b as a data frame. Frames are buffered until
+// Flush is called.
+func (w *Writer) WriteFrame(b []byte) error {
+	if len(b) == 0 {
+		return errors.New("empty data frame") // A zero length is a control frame escape.
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	if _, err := w.bw.Write(l[:]); err != nil {
+		return err
+	}
+	_, err := w.bw.Write(b)
+	return err
+}
+
+// Flush writes the buffered frames to the underlying writer.
+func (w *Writer) Flush() error {
+	return w.bw.Flush()
+}
+
+// Close writes the STOP frame and flushes. If the stream is
+// bidirectional, it waits for the FINISH frame.
+// It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.writeControl(controlStop, false); err != nil {
+		return err
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	if w.r != nil {
+		typ, _, err := readControl(w.r)
+		if err != nil {
+			return err
+		}
+		if typ != controlFinish {
+			return fmt.Errorf("unexpected control frame type %d, want FINISH", typ)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeControl(typ uint32, withContentType bool) error {
+	return writeControlTo(w.bw, typ, withContentType)
+}
+
+func writeControlTo(w io.Writer, typ uint32, withContentType bool) error {
+	b := make([]byte, 0, 32)
+	b = binary.BigEndian.AppendUint32(b, 0) // escape
+	l := 4
+	if withContentType {
+		l += 8 + len(ContentType)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(l))
+	b = binary.BigEndian.AppendUint32(b, typ)
+	if withContentType {
+		b = binary.BigEndian.AppendUint32(b, controlFieldContentType)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(ContentType)))
+		b = append(b, ContentType...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readControl reads a control frame from r and returns its type and
+// content types.
+func readControl(r io.Reader) (uint32, []string, error) {
+	var escape [4]byte
+	if _, err := io.ReadFull(r, escape[:]); err != nil {
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint32(escape[:]) != 0 {
+		return 0, nil, errors.New("not a control frame")
+	}
+	return readControlBody(r)
+}
+
+// readControlBody reads a control frame after its escape.
+func readControlBody(r io.Reader) (uint32, []string, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	l := binary.BigEndian.Uint32(h[:])
+	if l < 4 || l > maxControlFrameSize {
+		return 0, nil, fmt.Errorf("invalid control frame length %d", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	typ := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	var contentTypes []string
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return 0, nil, errors.New("invalid control field")
+		}
+		fieldType := binary.BigEndian.Uint32(b)
+		fieldLen := binary.BigEndian.Uint32(b[4:])
+		b = b[8:]
+		if uint32(len(b)) < fieldLen {
+			return 0, nil, errors.New("invalid control field length")
+		}
+		if fieldType == controlFieldContentType {
+			contentTypes = append(contentTypes, string(b[:fieldLen]))
+		}
+		b = b[fieldLen:]
+	}
+	return typ, contentTypes, nil
+}
+
+func hasContentType(s []string) bool {
+	// No content type means the receiver accepts any type.
+	if len(s) == 0 {
+		return true
+	}
+	for _, t := range s {
+		if t == ContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// Reader reads data frames of a Frame Streams. It is the receiving
+// side of Writer.
+type Reader struct {
+	br *bufio.Reader
+	w  io.Writer // Nil if the stream is unidirectional.
+}
+
+// NewReader reads the start of a Frame Streams from r.
+// If bidirectional is set, r must also be an io.Writer.
+func NewReader(r io.Reader, bidirectional bool) (*Reader, error) {
+	fr := &Reader{br: bufio.NewReader(r)}
+	if bidirectional {
+		w, ok := r.(io.Writer)
+		if !ok {
+			return nil, errors.New("bidirectional stream needs an io.Writer")
+		}
+		fr.w = w
+		typ, contentTypes, err := readControl(fr.br)
+		if err != nil {
+			return nil, err
+		}
+		if typ != controlReady {
+			return nil, fmt.Errorf("unexpected control frame type %d, want READY", typ)
+		}
+		if !hasContentType(contentTypes) {
+			return nil, fmt.Errorf("sender does not support content type %s", ContentType)
+		}
+		if err := writeControlTo(w, controlAccept, true); err != nil {
+			return nil, err
+		}
+	}
+	typ, contentTypes, err := readControl(fr.br)
+	if err != nil {
+		return nil, err
+	}
+	if typ != controlStart {
+		return nil, fmt.Errorf("unexpected control frame type %d, want START", typ)
+	}
+	if !hasContentType(contentTypes) {
+		return nil, fmt.Errorf("unsupported content type %v", contentTypes)
+	}
+	return fr, nil
+}
+
+// ReadFrame reads the next data frame. It returns io.EOF after the
+// STOP frame.
+func (r *Reader) ReadFrame() ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r.br, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 {
+		typ, _, err := readControlBody(r.br)
+		if err != nil {
+			return nil, err
+		}
+		if typ != controlStop {
+			return nil, fmt.Errorf("unexpected control frame type %d", typ)
+		}
+		if r.w != nil {
+			if err := writeControlTo(r.w, controlFinish, false); err != nil {
+				return nil, err
+			}
+		}
+		return nil, io.EOF
+	}
+	if n > maxDataFrameSize {
+		return nil, fmt.Errorf("data frame is too large, %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.br, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -158,3 +158,21 @@ func FakeSOA(name string) *dns.SOA {
 		Minttl:  86400,
 	}
 }
+
+// QtypeLabel returns the name of qtype for metrics labels. Unknown
+// types are "other", so clients can't blow up the label cardinality.
+func QtypeLabel(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return "other"
+}
+
+// RcodeLabel returns the name of rcode for metrics labels. Unknown
+// rcodes are "other".
+func RcodeLabel(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return "other"
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package geodata
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+type testDomain struct {
+	typ   uint64
+	value string
+	attrs []string
+}
+
+func makeGeoSite(sites map[string][]testDomain) []byte {
+	var list []byte
+	for code, domains := range sites {
+		var site []byte
+		site = appendBytesField(site, fieldCountryCode, []byte(code))
+		for _, d := range domains {
+			var db []byte
+			db = appendVarintField(db, fieldDomainType, d.typ)
+			db = appendBytesField(db, fieldDomainValue, []byte(d.value))
+			for _, a := range d.attrs {
+				var ab []byte
+				ab = appendBytesField(ab, fieldAttrKey, []byte(a))
+				ab = appendVarintField(ab, 2, 1) // bool_value
+				db = appendBytesField(db, fieldDomainAttr, ab)
+			}
+			site = appendBytesField(site, fieldSiteDomain, db)
+		}
+		list = appendBytesField(list, fieldListEntry, site)
+	}
+	return list
+}
+
+func Test_LoadGeoSite(t *testing.T) {
+	b := makeGeoSite(map[string][]testDomain{
+		"CN": {
+			{typ: domainTypeDomain, value: "example.cn"},
+			{typ: domainTypeFull, value: "www.example.com"},
+		},
+		"CATEGORY-ADS-ALL": {
+			{typ: domainTypeDomain, value: "ads.example", attrs: []string{"ads"}},
+			{typ: domainTypePlain, value: "tracker"},
+			{typ: domainTypeRegex, value: `^ad[0-9]+\.example$`, attrs: []string{"ads", "cn"}},
+		},
+	})
+
+	m := domain.NewDomainMixMatcher()
+	require.NoError(t, LoadGeoSite(m, b, "geosite:cn", "category-ads-all@ads@!cn"))
+	for _, d := range []string{"example.cn", "a.example.cn", "www.example.com", "a.ads.example"} {
+		_, ok := m.Match(d)
+		require.True(t, ok, d)
+	}
+	for _, d := range []string{"example.com", "tracker.example", "ad1.example"} {
+		_, ok := m.Match(d)
+		require.False(t, ok, d)
+	}
+
+	m = domain.NewDomainMixMatcher()
+	require.NoError(t, LoadGeoSite(m, b, "category-ads-all"))
+	for _, d := range []string{"a.ads.example", "tracker.example", "ad1.example"} {
+		_, ok := m.Match(d)
+		require.True(t, ok, d)
+	}
+
+	require.Error(t, LoadGeoSite(domain.NewDomainMixMatcher(), b, "us"))
+	require.Error(t, LoadGeoSite(domain.NewDomainMixMatcher(), b, "cn@"))
+	require.Error(t, LoadGeoSite(domain.NewDomainMixMatcher(), []byte{0xff}, "cn"))
+}
+
+func Test_LoadGeoIP(t *testing.T) {
+	cidr := func(s string) []byte {
+		p := netip.MustParsePrefix(s)
+		var b []byte
+		b = appendBytesField(b, fieldCidrIP, p.Addr().AsSlice())
+		return appendVarintField(b, fieldCidrPrefix, uint64(p.Bits()))
+	}
+	var list []byte
+	for code, cidrs := range map[string][]string{
+		"CN":      {"1.0.0.0/24", "2001:db8::/32"},
+		"US":      {"3.0.0.0/8"},
+		"PRIVATE": {"10.0.0.0/8"},
+	} {
+		var e []byte
+		e = appendBytesField(e, fieldCountryCode, []byte(code))
+		for _, c := range cidrs {
+			e = appendBytesField(e, fieldIPCidr, cidr(c))
+		}
+		list = appendBytesField(list, fieldListEntry, e)
+	}
+
+	l := netlist.NewList()
+	require.NoError(t, LoadGeoIP(l, list, "cn", "geoip:private"))
+	l.Sort()
+	for _, s := range []string{"1.0.0.1", "2001:db8::1", "10.1.1.1"} {
+		require.True(t, l.Match(netip.MustParseAddr(s)), s)
+	}
+	require.False(t, l.Match(netip.MustParseAddr("3.0.0.1")))
+	require.Error(t, LoadGeoIP(netlist.NewList(), list, "jp"))
+}
+
+// mmdbWriter builds a small ipv6 mmdb for tests.
+type mmdbNode struct {
+	rec [2]any // *mmdbNode, int (data offset) or nil
+}
+
+func mmdbInsert(root *mmdbNode, p netip.Prefix, off int) {
+	ip := p.Addr().As16()
+	bits := p.Bits()
+	if p.Addr().Is4() {
+		ip = [16]byte{}
+		copy(ip[12:], p.Addr().AsSlice())
+		bits += 96
+	}
+	n := root
+	for d := 0; d < bits; d++ {
+		bit := ip[d/8] >> (7 - d%8) & 1
+		if d == bits-1 {
+			n.rec[bit] = off
+			return
+		}
+		next, ok := n.rec[bit].(*mmdbNode)
+		if !ok {
+			next = new(mmdbNode)
+			n.rec[bit] = next
+		}
+		n = next
+	}
+}
+
+func encodeMMDBString(s string) []byte {
+	return append([]byte{mmdbString<<5 | byte(len(s))}, s...)
+}
+
+func encodeMMDBMap(n int) []byte {
+	return []byte{mmdbMap<<5 | byte(n)}
+}
+
+func encodeMMDBUint(typ byte, v uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	return append([]byte{typ<<5 | 4}, b...)
+}
+
+func makeMMDB(t *testing.T, recordSize int) []byte {
+	var data []byte
+	countryMap := func(key, code string) []byte {
+		var b []byte
+		b = append(b, encodeMMDBMap(1)...)
+		b = append(b, encodeMMDBString(key)...)
+		b = append(b, encodeMMDBMap(1)...)
+		b = append(b, encodeMMDBString("iso_code")...)
+		return append(b, encodeMMDBString(code)...)
+	}
+	cnOff := len(data)
+	data = append(data, countryMap("country", "CN")...)
+	usOff := len(data)
+	data = append(data, countryMap("registered_country", "US")...)
+	ptrOff := len(data)
+	data = append(data, mmdbPointer<<5|byte(cnOff>>8), byte(cnOff))
+
+	root := new(mmdbNode)
+	mmdbInsert(root, netip.MustParsePrefix("1.0.0.0/24"), cnOff)
+	mmdbInsert(root, netip.MustParsePrefix("2.0.0.0/8"), ptrOff)
+	mmdbInsert(root, netip.MustParsePrefix("3.0.0.0/8"), usOff)
+	mmdbInsert(root, netip.MustParsePrefix("2001:db8::/32"), cnOff)
+
+	// Alias 2002::/16 to the ipv4 subtree.
+	ipv4 := root
+	for i := 0; i < 96; i++ {
+		ipv4 = ipv4.rec[0].(*mmdbNode)
+	}
+	alias := root
+	ip := netip.MustParseAddr("2002::").As16()
+	for d := 0; d < 16; d++ {
+		bit := ip[d/8] >> (7 - d%8) & 1
+		if d == 15 {
+			alias.rec[bit] = ipv4
+			break
+		}
+		next, ok := alias.rec[bit].(*mmdbNode)
+		if !ok {
+			next = new(mmdbNode)
+			alias.rec[bit] = next
+		}
+		alias = next
+	}
+
+	// Number the nodes.
+	index := make(map[*mmdbNode]int)
+	nodes := []*mmdbNode{root}
+	index[root] = 0
+	for i := 0; i < len(nodes); i++ {
+		for _, r := range nodes[i].rec {
+			if n, ok := r.(*mmdbNode); ok {
+				if _, ok := index[n]; !ok {
+					index[n] = len(nodes)
+					nodes = append(nodes, n)
+				}
+			}
+		}
+	}
+	nodeCount := len(nodes)
+	recordValue := func(r any) uint32 {
+		switch v := r.(type) {
+		case *mmdbNode:
+			return uint32(index[v])
+		case int:
+			return uint32(nodeCount + 16 + v)
+		default:
+			return uint32(nodeCount)
+		}
+	}
+
+	var b []byte
+	for _, n := range nodes {
+		l, r := recordValue(n.rec[0]), recordValue(n.rec[1])
+		switch recordSize {
+		case 24:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			b = binary.BigEndian.AppendUint32(b, l)
+			b = binary.BigEndian.AppendUint32(b, r)
+		default:
+			t.Fatalf("invalid record size %d", recordSize)
+		}
+	}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+	b = append(b, encodeMMDBMap(3)...)
+	b = append(b, encodeMMDBString("node_count")...)
+	b = append(b, encodeMMDBUint(mmdbUint32, uint32(nodeCount))...)
+	b = append(b, encodeMMDBString("record_size")...)
+	b = append(b, encodeMMDBUint(mmdbUint16, uint32(recordSize))...)
+	b = append(b, encodeMMDBString("ip_version")...)
+	b = append(b, encodeMMDBUint(mmdbUint16, 6)...)
+	return b
+}
+
+func Test_LoadMMDB(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		b := makeMMDB(t, recordSize)
+		require.True(t, IsMMDB(b))
+
+		l := netlist.NewList()
+		require.NoError(t, LoadMMDB(l, b, "cn"), recordSize)
+		l.Sort()
+		for _, s := range []string{"1.0.0.1", "2.1.2.3", "2001:db8::1"} {
+			require.True(t, l.Match(netip.MustParseAddr(s)), s)
+		}
+		for _, s := range []string{"1.0.1.1", "3.0.0.1", "2002:100:1::1"} {
+			require.False(t, l.Match(netip.MustParseAddr(s)), s)
+		}
+
+		l = netlist.NewList()
+		require.NoError(t, LoadMMDB(l, b, "US"))
+		l.Sort()
+		require.True(t, l.Match(netip.MustParseAddr("3.0.0.1")))
+
+		require.Error(t, LoadMMDB(netlist.NewList(), b, "jp"))
+	}
+	require.Error(t, LoadMMDB(netlist.NewList(), []byte("not a mmdb"), "cn"))
+}
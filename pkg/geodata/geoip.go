@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package geodata
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// LoadGeoIP appends the cidrs of the given codes (e.g. "cn", "private")
+// in geoip.dat data b to l. A leading "geoip:" of codes is allowed.
+// Caller must call l.Sort() after loading.
+func LoadGeoIP(l *netlist.List, b []byte, codes ...string) error {
+	want := make(map[string]bool)
+	for _, c := range codes {
+		c = strings.ToLower(strings.TrimPrefix(c, "geoip:"))
+		if len(c) == 0 {
+			return errors.New("empty code")
+		}
+		want[c] = false
+	}
+
+	err := rangeEntries(b, func(code string, entry []byte) error {
+		if _, ok := want[code]; !ok {
+			return nil
+		}
+		want[code] = true
+		return rangeFields(entry, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+			switch {
+			case num == fieldIPReverseMatch && typ == protowire.VarintType && n != 0:
+				return fmt.Errorf("geoip code %s: reverse_match is not supported", code)
+			case num == fieldIPCidr && typ == protowire.BytesType:
+				p, err := parseCidr(v)
+				if err != nil {
+					return fmt.Errorf("geoip code %s: %w", code, err)
+				}
+				l.Append(p)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for code, found := range want {
+		if !found {
+			return fmt.Errorf("geoip code %s not found", code)
+		}
+	}
+	return nil
+}
+
+func parseCidr(b []byte) (netip.Prefix, error) {
+	var ip []byte
+	var bits uint64
+	err := rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == fieldCidrIP && typ == protowire.BytesType:
+			ip = v
+		case num == fieldCidrPrefix && typ == protowire.VarintType:
+			bits = n
+		}
+		return nil
+	})
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("invalid ip length %d", len(ip))
+	}
+	p := netip.PrefixFrom(addr, int(bits))
+	if !p.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix %s/%d", addr, bits)
+	}
+	return p.Masked(), nil
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package geodata loads v2ray geosite.dat/geoip.dat and MaxMind
+// mmdb files into matchers.
+package geodata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// v2ray routercommon.proto field numbers.
+const (
+	fieldListEntry = 1 // GeoSiteList.entry, GeoIPList.entry
+
+	fieldCountryCode = 1 // GeoSite.country_code, GeoIP.country_code
+	fieldSiteDomain  = 2 // GeoSite.domain
+
+	fieldDomainType  = 1
+	fieldDomainValue = 2
+	fieldDomainAttr  = 3
+
+	fieldAttrKey = 1
+
+	fieldIPCidr         = 2 // GeoIP.cidr
+	fieldIPReverseMatch = 3 // GeoIP.reverse_match
+	fieldCidrIP         = 1
+	fieldCidrPrefix     = 2
+)
+
+// v2ray Domain.Type
+const (
+	domainTypePlain  = 0
+	domainTypeRegex  = 1
+	domainTypeDomain = 2
+	domainTypeFull   = 3
+)
+
+type siteSelector struct {
+	code    string
+	attrs   []string // must have
+	noAttrs []string // must not have
+}
+
+// parseSiteSelector parses "cn", "category-ads-all@ads", "google@!cn" etc.
+// A leading "geosite:" is allowed.
+func parseSiteSelector(s string) (siteSelector, error) {
+	s = strings.TrimPrefix(s, "geosite:")
+	ss := strings.Split(s, "@")
+	sel := siteSelector{code: strings.ToLower(ss[0])}
+	if len(sel.code) == 0 {
+		return sel, errors.New("empty code")
+	}
+	for _, a := range ss[1:] {
+		if len(a) == 0 || a == "!" {
+			return sel, fmt.Errorf("empty attribute in %s", s)
+		}
+		if na, ok := strings.CutPrefix(a, "!"); ok {
+			sel.noAttrs = append(sel.noAttrs, na)
+		} else {
+			sel.attrs = append(sel.attrs, a)
+		}
+	}
+	return sel, nil
+}
+
+func (sel siteSelector) match(attrs []string) bool {
+	has := func(a string) bool {
+		for _, v := range attrs {
+			if strings.EqualFold(v, a) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, a := range sel.attrs {
+		if !has(a) {
+			return false
+		}
+	}
+	for _, a := range sel.noAttrs {
+		if has(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadGeoSite adds the domains of the given codes in geosite.dat data b to m.
+// m must accept typed patterns, like domain.MixMatcher.
+// A code can have attribute filters, e.g. "category-ads-all@ads" only
+// selects domains that have the "ads" attribute, and "google@!cn" only
+// selects domains that don't have the "cn" attribute.
+func LoadGeoSite(m domain.WriteableMatcher[struct{}], b []byte, codes ...string) error {
+	sels := make(map[string][]siteSelector)
+	for _, c := range codes {
+		sel, err := parseSiteSelector(c)
+		if err != nil {
+			return err
+		}
+		sels[sel.code] = append(sels[sel.code], sel)
+	}
+
+	found := make(map[string]bool)
+	err := rangeEntries(b, func(code string, entry []byte) error {
+		ss := sels[code]
+		if len(ss) == 0 {
+			return nil
+		}
+		found[code] = true
+		return rangeFields(entry, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+			if num != fieldSiteDomain || typ != protowire.BytesType {
+				return nil
+			}
+			pattern, attrs, err := parseDomain(v)
+			if err != nil {
+				return err
+			}
+			for _, sel := range ss {
+				if sel.match(attrs) {
+					return m.Add(pattern, struct{}{})
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for code := range sels {
+		if !found[code] {
+			return fmt.Errorf("geosite code %s not found", code)
+		}
+	}
+	return nil
+}
+
+// parseDomain parses a v2ray Domain message to a typed pattern.
+func parseDomain(b []byte) (pattern string, attrs []string, err error) {
+	var typ uint64
+	var value string
+	err = rangeFields(b, func(num protowire.Number, wt protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == fieldDomainType && wt == protowire.VarintType:
+			typ = n
+		case num == fieldDomainValue && wt == protowire.BytesType:
+			value = string(v)
+		case num == fieldDomainAttr && wt == protowire.BytesType:
+			return rangeFields(v, func(num protowire.Number, wt protowire.Type, v []byte, _ uint64) error {
+				if num == fieldAttrKey && wt == protowire.BytesType {
+					attrs = append(attrs, string(v))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	switch typ {
+	case domainTypePlain:
+		pattern = domain.MatcherKeyword + ":" + value
+	case domainTypeRegex:
+		pattern = domain.MatcherRegexp + ":" + value
+	case domainTypeDomain:
+		pattern = domain.MatcherDomain + ":" + value
+	case domainTypeFull:
+		pattern = domain.MatcherFull + ":" + value
+	default:
+		return "", nil, fmt.Errorf("unknown domain type %d", typ)
+	}
+	return pattern, attrs, nil
+}
+
+// rangeEntries calls f with the lower-cased country code and the
+// raw message of each entry in a GeoSiteList or GeoIPList.
+func rangeEntries(b []byte, f func(code string, entry []byte) error) error {
+	return rangeFields(b, func(num protowire.Number, typ protowire.Type, entry []byte, _ uint64) error {
+		if num != fieldListEntry || typ != protowire.BytesType {
+			return nil
+		}
+		var code string
+		err := rangeFields(entry, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+			if num == fieldCountryCode && typ == protowire.BytesType {
+				code = strings.ToLower(string(v))
+				return errStop
+			}
+			return nil
+		})
+		if err != nil && err != errStop {
+			return err
+		}
+		return f(code, entry)
+	})
+}
+
+var errStop = errors.New("stop")
+
+// rangeFields calls f for each field in protobuf message b. v is the
+// value of bytes fields, n is the value of varint and fixed fields.
+func rangeFields(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return fmt.Errorf("invalid protobuf data, %w", protowire.ParseError(l))
+		}
+		b = b[l:]
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var n32 uint32
+			n32, l = protowire.ConsumeFixed32(b)
+			n = uint64(n32)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return fmt.Errorf("invalid protobuf data, %w", protowire.ParseError(l))
+		}
+		b = b[l:]
+		if err := f(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package geodata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+)
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// IsMMDB reports whether b looks like a MaxMind DB file.
+func IsMMDB(b []byte) bool {
+	return bytes.LastIndex(b, mmdbMetadataMarker) >= 0
+}
+
+// LoadMMDB appends the networks of the given ISO country codes (e.g. "cn")
+// in MaxMind DB data b (e.g. GeoLite2-Country.mmdb) to l.
+// The country of a network is its "country.iso_code", or its
+// "registered_country.iso_code" if it has no country.
+// Caller must call l.Sort() after loading.
+func LoadMMDB(l *netlist.List, b []byte, codes ...string) error {
+	want := make(map[string]bool)
+	for _, c := range codes {
+		c = strings.ToLower(strings.TrimPrefix(c, "geoip:"))
+		if len(c) == 0 {
+			return errors.New("empty code")
+		}
+		want[c] = false
+	}
+
+	db, err := openMMDB(b)
+	if err != nil {
+		return err
+	}
+
+	// Decoded countries of data offsets.
+	countries := make(map[uint]string)
+	err = db.rangeNetworks(func(p netip.Prefix, off uint) error {
+		c, ok := countries[off]
+		if !ok {
+			v, _, err := db.decode(off)
+			if err != nil {
+				return fmt.Errorf("failed to decode data at %d, %w", off, err)
+			}
+			c = strings.ToLower(mmdbCountry(v))
+			countries[off] = c
+		}
+		if _, ok := want[c]; ok {
+			want[c] = true
+			l.Append(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for code, found := range want {
+		if !found {
+			return fmt.Errorf("country %s not found", code)
+		}
+	}
+	return nil
+}
+
+func mmdbCountry(v any) string {
+	m, _ := v.(map[string]any)
+	for _, k := range [...]string{"country", "registered_country"} {
+		c, _ := m[k].(map[string]any)
+		if code, _ := c["iso_code"].(string); len(code) > 0 {
+			return code
+		}
+	}
+	return ""
+}
+
+// mmdb is a MaxMind DB. See https://maxmind.github.io/MaxMind-DB/
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+func openMMDB(b []byte) (*mmdb, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a mmdb file, metadata not found")
+	}
+	metaDecoder := &mmdb{data: b[i+len(mmdbMetadataMarker):]}
+	v, _, err := metaDecoder.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode metadata, %w", err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+	getUint := func(k string) uint {
+		n, _ := meta[k].(uint64)
+		return uint(n)
+	}
+	db := &mmdb{
+		nodeCount:  getUint("node_count"),
+		recordSize: getUint("record_size"),
+		ipVersion:  getUint("ip_version"),
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("invalid search tree size")
+	}
+	db.tree = b[:treeSize]
+	db.data = b[treeSize+16 : i]
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node n.
+func (db *mmdb) record(n uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[n*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[n*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[n*8+bit*4:]))
+	}
+}
+
+// rangeNetworks calls f for each network that has data. off is the
+// offset of the data in the data section.
+func (db *mmdb) rangeNetworks(f func(p netip.Prefix, off uint) error) error {
+	type item struct {
+		node  uint
+		depth int
+		ip    [16]byte
+	}
+
+	maxDepth := 128
+	ipv4Start, ipv4Depth := uint(0), 0
+	if db.ipVersion == 4 {
+		maxDepth = 32
+	} else {
+		// IPv4 addresses are in ::/96. Some databases also have aliases
+		// of it (e.g. ::ffff:0:0/96), which are skipped.
+		for ipv4Depth < 96 && ipv4Start < db.nodeCount {
+			ipv4Start = db.record(ipv4Start, 0)
+			ipv4Depth++
+		}
+	}
+
+	emit := func(ip [16]byte, depth int, off uint) error {
+		var p netip.Prefix
+		switch {
+		case db.ipVersion == 4:
+			p = netip.PrefixFrom(netip.AddrFrom4([4]byte(ip[:4])), depth)
+		case depth >= 96 && [12]byte(ip[:12]) == [12]byte{}:
+			p = netip.PrefixFrom(netip.AddrFrom4([4]byte(ip[12:])), depth-96)
+		default:
+			p = netip.PrefixFrom(netip.AddrFrom16(ip), depth)
+		}
+		return f(p, off)
+	}
+
+	stack := []item{{}}
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if it.depth >= maxDepth {
+			return errors.New("invalid search tree, too deep")
+		}
+		for bit := uint(0); bit < 2; bit++ {
+			ip := it.ip
+			if bit == 1 {
+				ip[it.depth/8] |= 0x80 >> (it.depth % 8)
+			}
+			depth := it.depth + 1
+			r := db.record(it.node, bit)
+			switch {
+			case r < db.nodeCount:
+				if r == ipv4Start && db.ipVersion == 6 && !(depth == ipv4Depth && ip == [16]byte{}) {
+					continue // alias
+				}
+				stack = append(stack, item{node: r, depth: depth, ip: ip})
+			case r == db.nodeCount: // empty
+			default:
+				off := r - db.nodeCount - 16
+				if err := emit(ip, depth, off); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// mmdb data types
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEnd       = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+var errMMDBData = errors.New("invalid data")
+
+// decode decodes the value at off in the data section. It returns the
+// value and the offset after it. Maps are map[string]any, arrays are
+// []any, unsigned integers are uint64, uint128 are []byte.
+func (db *mmdb) decode(off uint) (any, uint, error) {
+	return db.decodeDepth(off, 0)
+}
+
+func (db *mmdb) decodeDepth(off uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data is too deep")
+	}
+	d := db.data
+	if off >= uint(len(d)) {
+		return nil, 0, errMMDBData
+	}
+	ctrl := d[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		ss := uint(ctrl>>3) & 0x3
+		if off+ss+1 > uint(len(d)) {
+			return nil, 0, errMMDBData
+		}
+		var p uint
+		switch ss {
+		case 0:
+			p = uint(ctrl&0x7)<<8 | uint(d[off])
+		case 1:
+			p = (uint(ctrl&0x7)<<16 | uint(d[off])<<8 | uint(d[off+1])) + 2048
+		case 2:
+			p = (uint(ctrl&0x7)<<24 | uint(d[off])<<16 | uint(d[off+1])<<8 | uint(d[off+2])) + 526336
+		case 3:
+			p = uint(binary.BigEndian.Uint32(d[off:]))
+		}
+		v, _, err := db.decodeDepth(p, depth+1)
+		return v, off + ss + 1, err
+	}
+	if typ == mmdbExtended {
+		if off >= uint(len(d)) {
+			return nil, 0, errMMDBData
+		}
+		typ = 7 + uint(d[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(d)) {
+			return nil, 0, errMMDBData
+		}
+		var v uint
+		for _, c := range d[off : off+n] {
+			v = v<<8 | uint(c)
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + v
+		off += n
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := db.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, next, err := db.decodeDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[ks] = v
+			off = next
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := db.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	case mmdbContainer, mmdbEnd:
+		return nil, off, nil
+	}
+
+	if off+size > uint(len(d)) {
+		return nil, 0, errMMDBData
+	}
+	b := d[off : off+size]
+	off += size
+	switch typ {
+	case mmdbString:
+		return string(b), off, nil
+	case mmdbBytes, mmdbUint128:
+		return b, off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		if size > 8 {
+			return nil, 0, errMMDBData
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == mmdbInt32 {
+			return int64(int32(uint32(v))), off, nil
+		}
+		return v, off, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d", typ)
+	}
+}
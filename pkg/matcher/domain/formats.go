@@ -0,0 +1,327 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+// ListFormat is the format of a domain list.
+type ListFormat string
+
+const (
+	// FormatMosdns is mosdns's own "domain:", "full:", "keyword:" and
+	// "regexp:" rules. Domains without a type are "domain:" rules.
+	FormatMosdns ListFormat = "mosdns"
+	// FormatPlain is one domain per line. Each domain matches itself
+	// and its subdomains. A leading "*." is ignored.
+	FormatPlain ListFormat = "plain"
+	// FormatHosts is the hosts file format, e.g. "0.0.0.0 ads.example".
+	// Each host name matches itself only. Addresses are ignored.
+	FormatHosts ListFormat = "hosts"
+	// FormatAdblock is Adblock Plus/AdGuard domain rules, e.g. "||example.com^".
+	// Exception rules ("@@") are allow rules. Rules with $important take
+	// precedence over the rules without it. Rules that can not be applied
+	// to domains (cosmetic rules, url rules, rules with options other
+	// than $important) are ignored. Hosts lines are also accepted.
+	FormatAdblock ListFormat = "adblock"
+	// FormatDnsmasq is dnsmasq "address=/example.com/", "server=/example.com/..."
+	// and "local=/example.com/" lines. Each domain matches itself
+	// and its subdomains.
+	FormatDnsmasq ListFormat = "dnsmasq"
+)
+
+// ParseListFormat parses s to a ListFormat. An empty s is FormatMosdns.
+func ParseListFormat(s string) (ListFormat, error) {
+	switch f := ListFormat(s); f {
+	case "":
+		return FormatMosdns, nil
+	case FormatMosdns, FormatPlain, FormatHosts, FormatAdblock, FormatDnsmasq:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown list format [%s]", s)
+	}
+}
+
+// ListMatchers are the matchers that the rules of a list are added to.
+// They must accept typed patterns (e.g. "full:example.com"), like MixMatcher.
+type ListMatchers struct {
+	// Block is required.
+	Block WriteableMatcher[struct{}]
+	// Allow is for allow rules. If nil, allow rules are errors.
+	Allow WriteableMatcher[struct{}]
+	// Important is for block rules that take precedence over Allow.
+	// If nil, they are added to Block.
+	Important WriteableMatcher[struct{}]
+	// ImportantAllow is for allow rules that take precedence over
+	// Important. If nil, they are added to Allow.
+	ImportantAllow WriteableMatcher[struct{}]
+}
+
+type ruleKind uint8
+
+const (
+	ruleBlock ruleKind = iota
+	ruleAllow
+	ruleImportant
+	ruleImportantAllow
+)
+
+func (lm ListMatchers) dst(k ruleKind) WriteableMatcher[struct{}] {
+	switch k {
+	case ruleImportant:
+		if lm.Important != nil {
+			return lm.Important
+		}
+		return lm.Block
+	case ruleImportantAllow:
+		if lm.ImportantAllow != nil {
+			return lm.ImportantAllow
+		}
+		return lm.Allow
+	case ruleAllow:
+		return lm.Allow
+	default:
+		return lm.Block
+	}
+}
+
+// LoadListFromTextReader loads a list in format f from r to lm.
+// Lists are usually maintained by third parties and may have lines that
+// mosdns does not understand. Except for FormatMosdns, invalid lines are
+// skipped instead of failing the whole list. It returns the number of
+// skipped lines.
+func LoadListFromTextReader(lm ListMatchers, r io.Reader, f ListFormat) (skipped int, err error) {
+	var parseLine func(s string) (patterns []string, kind ruleKind, err error)
+	switch f {
+	case FormatMosdns, "":
+		return 0, LoadFromTextReader(lm.Block, r, nil)
+	case FormatPlain:
+		parseLine = parsePlainLine
+	case FormatHosts:
+		parseLine = parseHostsLine
+	case FormatAdblock:
+		parseLine = parseAdblockLine
+	case FormatDnsmasq:
+		parseLine = parseDnsmasqLine
+	default:
+		return 0, fmt.Errorf("unknown list format [%s]", f)
+	}
+
+	lineCounter := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineCounter++
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 {
+			continue
+		}
+		patterns, kind, err := parseLine(s)
+		if err != nil {
+			skipped++
+			continue
+		}
+		dst := lm.dst(kind)
+		if dst == nil {
+			return skipped, fmt.Errorf("line %d: allow rule is not supported", lineCounter)
+		}
+		for _, p := range patterns {
+			if err := dst.Add(p, struct{}{}); err != nil {
+				skipped++
+				break
+			}
+		}
+	}
+	return skipped, scanner.Err()
+}
+
+var errNotDomain = errors.New("not a valid domain")
+
+func parsePlainLine(s string) ([]string, ruleKind, error) {
+	s = strings.TrimSpace(utils.RemoveComment(s, "#"))
+	if len(s) == 0 {
+		return nil, ruleBlock, nil
+	}
+	s = strings.TrimPrefix(s, "*.")
+	if !isDomain(s) {
+		return nil, ruleBlock, errNotDomain
+	}
+	return []string{MatcherDomain + ":" + s}, ruleBlock, nil
+}
+
+// localHostNames are the names that are usually at the head of
+// hosts files. They are not the things that users want to match.
+var localHostNames = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+}
+
+func parseHostsLine(s string) ([]string, ruleKind, error) {
+	fs := strings.Fields(utils.RemoveComment(s, "#"))
+	if len(fs) == 0 {
+		return nil, ruleBlock, nil
+	}
+	if len(fs) < 2 {
+		return nil, ruleBlock, errors.New("missing host name")
+	}
+	if _, err := netip.ParseAddr(fs[0]); err != nil {
+		return nil, ruleBlock, fmt.Errorf("invalid address, %w", err)
+	}
+	var patterns []string
+	for _, name := range fs[1:] {
+		if _, ok := localHostNames[strings.ToLower(name)]; ok {
+			continue
+		}
+		if _, err := netip.ParseAddr(name); err == nil {
+			continue // e.g. "0.0.0.0 0.0.0.0"
+		}
+		if !isDomain(name) {
+			return nil, ruleBlock, fmt.Errorf("invalid host name [%s]", name)
+		}
+		patterns = append(patterns, MatcherFull+":"+name)
+	}
+	return patterns, ruleBlock, nil
+}
+
+func parseAdblockLine(s string) ([]string, ruleKind, error) {
+	switch s[0] {
+	case '!', '[', '#':
+		return nil, ruleBlock, nil // comments and headers
+	}
+	if fs := strings.Fields(s); len(fs) > 1 {
+		if _, err := netip.ParseAddr(fs[0]); err == nil {
+			return parseHostsLine(s)
+		}
+		return nil, ruleBlock, nil
+	}
+	if strings.Contains(s, "#") {
+		return nil, ruleBlock, nil // cosmetic rules
+	}
+
+	s, isAllow := strings.CutPrefix(s, "@@")
+	if len(s) == 0 {
+		return nil, ruleBlock, nil
+	}
+	important := false
+	optStart := 0
+	if s[0] == '/' {
+		optStart = strings.LastIndexByte(s, '/') // Regexps may have '$'.
+	}
+	if i := strings.IndexByte(s[optStart:], '$'); i >= 0 {
+		for _, opt := range strings.Split(s[optStart+i+1:], ",") {
+			if opt != "important" {
+				return nil, ruleBlock, nil
+			}
+			important = true
+		}
+		s = s[:optStart+i]
+	}
+	kind := ruleBlock
+	switch {
+	case isAllow && important:
+		kind = ruleImportantAllow
+	case isAllow:
+		kind = ruleAllow
+	case important:
+		kind = ruleImportant
+	}
+
+	if len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/' {
+		return []string{MatcherRegexp + ":" + s[1:len(s)-1]}, kind, nil
+	}
+
+	typ := MatcherFull
+	if d, ok := strings.CutPrefix(s, "||"); ok {
+		typ = MatcherDomain
+		s = strings.TrimPrefix(d, "*.")
+	} else if d, ok := strings.CutPrefix(s, "|"); ok {
+		s = d
+	}
+	s = strings.TrimSuffix(s, "|")
+	s = strings.TrimSuffix(s, "^")
+	if !isDomain(s) {
+		return nil, ruleBlock, nil // url rules, wildcards etc.
+	}
+	return []string{typ + ":" + s}, kind, nil
+}
+
+func parseDnsmasqLine(s string) ([]string, ruleKind, error) {
+	if s[0] == '#' {
+		return nil, ruleBlock, nil
+	}
+	opt, v, _ := strings.Cut(s, "=")
+	switch opt {
+	case "address", "server", "local":
+	default:
+		return nil, ruleBlock, fmt.Errorf("unsupported option [%s]", opt)
+	}
+	if !strings.HasPrefix(v, "/") {
+		return nil, ruleBlock, errors.New("missing domain")
+	}
+	ss := strings.Split(v[1:], "/")
+	if len(ss) < 2 {
+		return nil, ruleBlock, errors.New("missing '/' after domains")
+	}
+	var patterns []string
+	for _, d := range ss[:len(ss)-1] {
+		if !isDomain(d) {
+			return nil, ruleBlock, fmt.Errorf("invalid domain [%s]", d)
+		}
+		patterns = append(patterns, MatcherDomain+":"+d)
+	}
+	return patterns, ruleBlock, nil
+}
+
+// isDomain reports whether s is a domain (fqdn or not) that only has
+// letters, digits, '-' and '_'.
+func isDomain(s string) bool {
+	s = TrimDot(s)
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadListFromTextReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    ListFormat
+		list      string
+		match     []string
+		noMatch   []string
+		allowed   []string
+		important []string
+		skipped   int
+	}{
+		{
+			name:    "plain",
+			format:  FormatPlain,
+			list:    "# comment\nexample.com\n*.example.net # comment\n",
+			match:   []string{"example.com.", "a.example.com", "a.example.net"},
+			noMatch: []string{"example.org"},
+		},
+		{
+			name:    "plain with prefix",
+			format:  FormatPlain,
+			list:    "full:example.com\nexample.net\n",
+			match:   []string{"example.net"},
+			noMatch: []string{"example.com"},
+			skipped: 1,
+		},
+		{
+			name:    "hosts",
+			format:  FormatHosts,
+			list:    "127.0.0.1 localhost\n::1 localhost ip6-localhost\n0.0.0.0 0.0.0.0\n0.0.0.0 ads.example a.ads.example # comment\n",
+			match:   []string{"ads.example", "a.ads.example"},
+			noMatch: []string{"localhost", "b.ads.example"},
+		},
+		{
+			name:    "hosts invalid lines",
+			format:  FormatHosts,
+			list:    "ads.example\n0.0.0.0 bad/name.example\n0.0.0.0 ok.example\n",
+			match:   []string{"ok.example"},
+			noMatch: []string{"ads.example"},
+			skipped: 2,
+		},
+		{
+			name:   "adblock",
+			format: FormatAdblock,
+			list: "[Adblock Plus 2.0]\n! comment\n" +
+				"||ads.example^\n" +
+				"||tracker.example^$important\n" +
+				"|exact.example^\n" +
+				"bare.example\n" +
+				"/^ad[0-9]+\\.example$/\n" +
+				"/^track[0-9]+\\.example$/$important\n" +
+				"@@\n" +
+				"@@||ok.ads.example^\n" +
+				"||third.example^$third-party\n" +
+				"||url.example/path\n" +
+				"example.com##.banner\n" +
+				"0.0.0.0 hosts.example\n" +
+				"0.0.0.0 bad/name.example\n" +
+				"/(/\n",
+			match:     []string{"ads.example", "a.ads.example", "exact.example", "bare.example", "ad12.example", "hosts.example"},
+			noMatch:   []string{"a.exact.example", "a.bare.example", "third.example", "url.example", "example.com", "tracker.example"},
+			allowed:   []string{"ok.ads.example", "a.ok.ads.example"},
+			important: []string{"tracker.example", "a.tracker.example", "track1.example"},
+			skipped:   2,
+		},
+		{
+			name:    "dnsmasq",
+			format:  FormatDnsmasq,
+			list:    "# comment\naddress=/ads.example/\naddress=/a.example/b.example/0.0.0.0\nserver=/c.example/114.114.114.114\n",
+			match:   []string{"ads.example", "x.ads.example", "a.example", "b.example", "c.example"},
+			noMatch: []string{"example"},
+		},
+		{
+			name:    "dnsmasq unsupported option",
+			format:  FormatDnsmasq,
+			list:    "cache-size=1000\naddress=/ads.example/\n",
+			match:   []string{"ads.example"},
+			skipped: 1,
+		},
+		{
+			name:   "mosdns",
+			format: FormatMosdns,
+			list:   "full:example.com\nexample.net\n",
+			match:  []string{"example.com", "a.example.net"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewDomainMixMatcher()
+			allow := NewDomainMixMatcher()
+			important := NewDomainMixMatcher()
+			lm := ListMatchers{Block: m, Allow: allow, Important: important}
+			skipped, err := LoadListFromTextReader(lm, strings.NewReader(tt.list), tt.format)
+			if err != nil {
+				t.Fatalf("LoadListFromTextReader() error = %v", err)
+			}
+			if skipped != tt.skipped {
+				t.Fatalf("LoadListFromTextReader() skipped = %d, want %d", skipped, tt.skipped)
+			}
+			assert := assertFunc[struct{}](t, m)
+			for _, d := range tt.match {
+				assert(d, true, struct{}{})
+			}
+			for _, d := range tt.noMatch {
+				assert(d, false, struct{}{})
+			}
+			assertAllow := assertFunc[struct{}](t, allow)
+			for _, d := range tt.allowed {
+				assertAllow(d, true, struct{}{})
+			}
+			if len(tt.allowed) == 0 && allow.Len() != 0 {
+				t.Fatalf("unexpected allow rules")
+			}
+			assertImportant := assertFunc[struct{}](t, important)
+			for _, d := range tt.important {
+				assertImportant(d, true, struct{}{})
+			}
+			if len(tt.important) == 0 && important.Len() != 0 {
+				t.Fatalf("unexpected important rules")
+			}
+		})
+	}
+
+	// Allow rules without an allow matcher.
+	_, err := LoadListFromTextReader(ListMatchers{Block: NewDomainMixMatcher()}, strings.NewReader("@@||example.com^\n"), FormatAdblock)
+	if err == nil {
+		t.Fatal("want an error")
+	}
+
+	// Without the important matchers, important rules are normal rules.
+	m, allow := NewDomainMixMatcher(), NewDomainMixMatcher()
+	list := "||a.example^$important\n@@||b.example^$important\n"
+	if _, err := LoadListFromTextReader(ListMatchers{Block: m, Allow: allow}, strings.NewReader(list), FormatAdblock); err != nil {
+		t.Fatal(err)
+	}
+	assertFunc[struct{}](t, m)("a.example", true, struct{}{})
+	assertFunc[struct{}](t, allow)("b.example", true, struct{}{})
+}
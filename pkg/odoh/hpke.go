@@ -0,0 +1,182 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// A minimal HPKE (RFC 9180) implementation of the base mode with the only
+// suite that ODoH requires: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and
+// AES-128-GCM.
+
+const (
+	kemX25519HKDFSHA256 uint16 = 0x0020
+	kdfHKDFSHA256       uint16 = 0x0001
+	aeadAES128GCM       uint16 = 0x0001
+
+	nSecret = 32 // Nsecret of the KEM
+	nEnc    = 32 // Nenc of the KEM
+	nH      = 32 // Nh of the KDF
+	nK      = 16 // Nk of the AEAD
+	nN      = 12 // Nn of the AEAD
+)
+
+var (
+	kemSuiteID  = binary.BigEndian.AppendUint16([]byte("KEM"), kemX25519HKDFSHA256)
+	hpkeSuiteID = binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(
+		binary.BigEndian.AppendUint16([]byte("HPKE"), kemX25519HKDFSHA256), kdfHKDFSHA256), aeadAES128GCM)
+
+	errOpen = errors.New("hpke: message authentication failed")
+)
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	b := make([]byte, 0, 7+len(suiteID)+len(label)+len(ikm))
+	b = append(b, "HPKE-v1"...)
+	b = append(b, suiteID...)
+	b = append(b, label...)
+	b = append(b, ikm...)
+	prk, err := hkdf.Extract(sha256.New, b, salt)
+	if err != nil {
+		panic(err) // Extract never fails with sha256.
+	}
+	return prk
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, l int) []byte {
+	b := make([]byte, 0, 2+7+len(suiteID)+len(label)+len(info))
+	b = binary.BigEndian.AppendUint16(b, uint16(l))
+	b = append(b, "HPKE-v1"...)
+	b = append(b, suiteID...)
+	b = append(b, label...)
+	b = append(b, info...)
+	k, err := hkdf.Expand(sha256.New, prk, string(b), l)
+	if err != nil {
+		panic(err) // l is always small.
+	}
+	return k
+}
+
+func extractAndExpand(dh, kemContext []byte) []byte {
+	prk := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID, prk, "shared_secret", kemContext, nSecret)
+}
+
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	seq            uint64
+}
+
+func newHpkeContext(sharedSecret, info []byte) (*hpkeContext, error) {
+	pskIDHash := labeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	ksc := make([]byte, 0, 1+len(pskIDHash)+len(infoHash))
+	ksc = append(ksc, 0) // mode_base
+	ksc = append(ksc, pskIDHash...)
+	ksc = append(ksc, infoHash...)
+
+	secret := labeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	key := labeledExpand(hpkeSuiteID, secret, "key", ksc, nK)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      labeledExpand(hpkeSuiteID, secret, "base_nonce", ksc, nN),
+		exporterSecret: labeledExpand(hpkeSuiteID, secret, "exp", ksc, nH),
+	}, nil
+}
+
+// setupBaseS is the sender side setup. skE is the ephemeral key, a
+// random one is generated if it is nil.
+func setupBaseS(pkR *ecdh.PublicKey, info []byte, skE *ecdh.PrivateKey) (enc []byte, c *hpkeContext, err error) {
+	if skE == nil {
+		skE, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc = skE.PublicKey().Bytes()
+	kemContext := append(append(make([]byte, 0, 2*nEnc), enc...), pkR.Bytes()...)
+	c, err = newHpkeContext(extractAndExpand(dh, kemContext), info)
+	return enc, c, err
+}
+
+// setupBaseR is the receiver side setup.
+func setupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append(make([]byte, 0, 2*nEnc), enc...), skR.PublicKey().Bytes()...)
+	return newHpkeContext(extractAndExpand(dh, kemContext), info)
+}
+
+func (c *hpkeContext) nonce() []byte {
+	n := make([]byte, nN)
+	copy(n, c.baseNonce)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i := range seq {
+		n[nN-8+i] ^= seq[i]
+	}
+	return n
+}
+
+func (c *hpkeContext) seal(aad, pt []byte) []byte {
+	ct := c.aead.Seal(nil, c.nonce(), pt, aad)
+	c.seq++
+	return ct
+}
+
+func (c *hpkeContext) open(aad, ct []byte) ([]byte, error) {
+	pt, err := c.aead.Open(nil, c.nonce(), ct, aad)
+	if err != nil {
+		return nil, errOpen
+	}
+	c.seq++
+	return pt, nil
+}
+
+func (c *hpkeContext) export(exporterContext []byte, l int) []byte {
+	return labeledExpand(hpkeSuiteID, c.exporterSecret, "sec", exporterContext, l)
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package odoh implements Oblivious DNS over HTTPS (RFC 9230) messages.
+package odoh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// ContentType is the media type of ODoH messages.
+	ContentType = "application/oblivious-dns-message"
+	// ConfigsPath is the well-known path of a target's configs.
+	ConfigsPath = "/.well-known/odohconfigs"
+
+	configVersion = 0x0001
+
+	msgTypeQuery    = 0x01
+	msgTypeResponse = 0x02
+
+	// Plaintext messages are padded to a multiple of paddingBlock.
+	paddingBlock = 128
+)
+
+var (
+	ErrUnknownKey     = errors.New("odoh: unknown key id")
+	ErrInvalidMessage = errors.New("odoh: invalid message")
+	ErrNoConfig       = errors.New("odoh: no supported config")
+)
+
+// Config is an ObliviousDoHConfigContents of the supported suite.
+type Config struct {
+	PublicKey *ecdh.PublicKey
+}
+
+func (c *Config) contents() []byte {
+	pk := c.PublicKey.Bytes()
+	b := make([]byte, 0, 8+len(pk))
+	b = binary.BigEndian.AppendUint16(b, kemX25519HKDFSHA256)
+	b = binary.BigEndian.AppendUint16(b, kdfHKDFSHA256)
+	b = binary.BigEndian.AppendUint16(b, aeadAES128GCM)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(pk)))
+	return append(b, pk...)
+}
+
+// KeyID returns the key id of the config.
+func (c *Config) KeyID() []byte {
+	prk, err := hkdf.Extract(sha256.New, c.contents(), nil)
+	if err != nil {
+		panic(err)
+	}
+	id, err := hkdf.Expand(sha256.New, prk, "odoh key id", nH)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// MarshalConfigs encodes configs as ObliviousDoHConfigs.
+func MarshalConfigs(cs ...*Config) []byte {
+	var body []byte
+	for _, c := range cs {
+		contents := c.contents()
+		body = binary.BigEndian.AppendUint16(body, configVersion)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(contents)))
+		body = append(body, contents...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(body))), body...)
+}
+
+// ParseConfigs decodes ObliviousDoHConfigs. Configs with unsupported
+// versions or suites are skipped. It returns ErrNoConfig if there is no
+// supported config.
+func ParseConfigs(b []byte) ([]*Config, error) {
+	r := reader(b)
+	body, ok := r.vec16()
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+	var cs []*Config
+	for len(body) > 0 {
+		version, ok1 := body.u16()
+		contents, ok2 := body.vec16()
+		if !ok1 || !ok2 {
+			return nil, ErrInvalidMessage
+		}
+		if version != configVersion {
+			continue
+		}
+		kem, ok1 := contents.u16()
+		kdf, ok2 := contents.u16()
+		aead, ok3 := contents.u16()
+		pk, ok4 := contents.vec16()
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			return nil, ErrInvalidMessage
+		}
+		if kem != kemX25519HKDFSHA256 || kdf != kdfHKDFSHA256 || aead != aeadAES128GCM {
+			continue
+		}
+		k, err := ecdh.X25519().NewPublicKey(pk)
+		if err != nil {
+			return nil, fmt.Errorf("odoh: invalid public key, %w", err)
+		}
+		cs = append(cs, &Config{PublicKey: k})
+	}
+	if len(cs) == 0 {
+		return nil, ErrNoConfig
+	}
+	return cs, nil
+}
+
+// QueryContext keeps the state to decrypt the response of a query.
+type QueryContext struct {
+	hc    *hpkeContext
+	plain []byte
+}
+
+// EncryptQuery encrypts the dns query q to the target of c.
+func (c *Config) EncryptQuery(q []byte) ([]byte, *QueryContext, error) {
+	keyID := c.KeyID()
+	enc, hc, err := setupBaseS(c.PublicKey, []byte("odoh query"), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain := marshalPlaintext(q)
+	ct := hc.seal(aad(msgTypeQuery, keyID), plain)
+	return marshalMessage(msgTypeQuery, keyID, append(enc, ct...)), &QueryContext{hc: hc, plain: plain}, nil
+}
+
+// DecryptResponse decrypts the response message b.
+func (qc *QueryContext) DecryptResponse(b []byte) ([]byte, error) {
+	typ, nonce, ct, err := parseMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	if typ != msgTypeResponse {
+		return nil, ErrInvalidMessage
+	}
+	aead, aeadNonce, err := responseAEAD(qc.hc, qc.plain, nonce)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, aeadNonce, ct, aad(msgTypeResponse, nonce))
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	return parsePlaintext(plain)
+}
+
+// KeyPair is the key of a target.
+type KeyPair struct {
+	Config
+	sk    *ecdh.PrivateKey
+	keyID []byte
+}
+
+// NewKeyPair creates a KeyPair from a x25519 private key.
+func NewKeyPair(sk []byte) (*KeyPair, error) {
+	k, err := ecdh.X25519().NewPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	kp := &KeyPair{Config: Config{PublicKey: k.PublicKey()}, sk: k}
+	kp.keyID = kp.KeyID()
+	return kp, nil
+}
+
+// GenerateKeyPair generates a new KeyPair.
+func GenerateKeyPair() (*KeyPair, error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyPair(k.Bytes())
+}
+
+// PrivateKey returns the x25519 private key.
+func (kp *KeyPair) PrivateKey() []byte {
+	return kp.sk.Bytes()
+}
+
+// Configs returns the ObliviousDoHConfigs that should be served at ConfigsPath.
+func (kp *KeyPair) Configs() []byte {
+	return MarshalConfigs(&kp.Config)
+}
+
+// ResponseContext keeps the state to encrypt the response of a query.
+type ResponseContext struct {
+	hc    *hpkeContext
+	plain []byte
+}
+
+// DecryptQuery decrypts the query message b. It returns ErrUnknownKey if
+// the query was encrypted to another key.
+func (kp *KeyPair) DecryptQuery(b []byte) ([]byte, *ResponseContext, error) {
+	typ, keyID, ct, err := parseMessage(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if typ != msgTypeQuery || len(ct) < nEnc {
+		return nil, nil, ErrInvalidMessage
+	}
+	if !bytes.Equal(keyID, kp.keyID) {
+		return nil, nil, ErrUnknownKey
+	}
+	hc, err := setupBaseR(ct[:nEnc], kp.sk, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, ErrInvalidMessage
+	}
+	plain, err := hc.open(aad(msgTypeQuery, keyID), ct[nEnc:])
+	if err != nil {
+		return nil, nil, ErrInvalidMessage
+	}
+	q, err := parsePlaintext(plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return q, &ResponseContext{hc: hc, plain: plain}, nil
+}
+
+// EncryptResponse encrypts the dns response r.
+func (rc *ResponseContext) EncryptResponse(r []byte) ([]byte, error) {
+	nonce := make([]byte, max(nN, nK))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, aeadNonce, err := responseAEAD(rc.hc, rc.plain, nonce)
+	if err != nil {
+		return nil, err
+	}
+	ct := aead.Seal(nil, aeadNonce, marshalPlaintext(r), aad(msgTypeResponse, nonce))
+	return marshalMessage(msgTypeResponse, nonce, ct), nil
+}
+
+// responseAEAD derives the response key and nonce. See RFC 9230 6.4.
+func responseAEAD(hc *hpkeContext, queryPlain, respNonce []byte) (cipher.AEAD, []byte, error) {
+	secret := hc.export([]byte("odoh response"), nK)
+	salt := make([]byte, 0, len(queryPlain)+2+len(respNonce))
+	salt = append(salt, queryPlain...)
+	salt = binary.BigEndian.AppendUint16(salt, uint16(len(respNonce)))
+	salt = append(salt, respNonce...)
+	prk, err := hkdf.Extract(sha256.New, secret, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := hkdf.Expand(sha256.New, prk, "odoh key", nK)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "odoh nonce", nN)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+func aad(typ byte, keyID []byte) []byte {
+	b := make([]byte, 0, 3+len(keyID))
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(keyID)))
+	return append(b, keyID...)
+}
+
+func marshalMessage(typ byte, keyID, encrypted []byte) []byte {
+	b := make([]byte, 0, 5+len(keyID)+len(encrypted))
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(keyID)))
+	b = append(b, keyID...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(encrypted)))
+	return append(b, encrypted...)
+}
+
+func parseMessage(b []byte) (typ byte, keyID, encrypted []byte, err error) {
+	r := reader(b)
+	if len(r) < 1 {
+		return 0, nil, nil, ErrInvalidMessage
+	}
+	typ = r[0]
+	r = r[1:]
+	keyID, ok1 := r.vec16()
+	encrypted, ok2 := r.vec16()
+	if !ok1 || !ok2 || len(r) != 0 || len(encrypted) == 0 {
+		return 0, nil, nil, ErrInvalidMessage
+	}
+	return typ, keyID, encrypted, nil
+}
+
+// marshalPlaintext encodes an ObliviousDoHMessagePlaintext with zero padding.
+func marshalPlaintext(m []byte) []byte {
+	l := 4 + len(m)
+	padLen := (paddingBlock - l%paddingBlock) % paddingBlock
+	b := make([]byte, 0, l+padLen)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m)))
+	b = append(b, m...)
+	b = binary.BigEndian.AppendUint16(b, uint16(padLen))
+	return append(b, make([]byte, padLen)...)
+}
+
+func parsePlaintext(b []byte) ([]byte, error) {
+	r := reader(b)
+	m, ok1 := r.vec16()
+	padding, ok2 := r.vec16()
+	if !ok1 || !ok2 || len(r) != 0 || len(m) == 0 {
+		return nil, ErrInvalidMessage
+	}
+	for _, c := range padding {
+		if c != 0 {
+			return nil, ErrInvalidMessage
+		}
+	}
+	return m, nil
+}
+
+type reader []byte
+
+func (r *reader) u16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *reader) vec16() (reader, bool) {
+	l, ok := r.u16()
+	if !ok || len(*r) < int(l) {
+		return nil, false
+	}
+	v := (*r)[:l]
+	*r = (*r)[l:]
+	return v, true
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RFC 9180 A.1.1, DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM, base mode.
+func TestHpkeVector(t *testing.T) {
+	skE, err := ecdh.X25519().NewPrivateKey(mustHex("52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+	require.NoError(t, err)
+	skR, err := ecdh.X25519().NewPrivateKey(mustHex("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	require.NoError(t, err)
+	info := mustHex("4f6465206f6e2061204772656369616e2055726e")
+
+	enc, s, err := setupBaseS(skR.PublicKey(), info, skE)
+	require.NoError(t, err)
+	require.Equal(t, mustHex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"), enc)
+	require.Equal(t, mustHex("56d890e5accaaf011cff4b7d"), s.baseNonce)
+	require.Equal(t, mustHex("45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"), s.exporterSecret)
+
+	pt := mustHex("4265617574792069732074727574682c20747275746820626561757479")
+	ct := s.seal(mustHex("436f756e742d30"), pt)
+	require.Equal(t, mustHex("f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"), ct)
+
+	r, err := setupBaseR(enc, skR, info)
+	require.NoError(t, err)
+	got, err := r.open(mustHex("436f756e742d30"), ct)
+	require.NoError(t, err)
+	require.Equal(t, pt, got)
+	_, err = r.open(mustHex("436f756e742d31"), ct)
+	require.Error(t, err)
+}
+
+func TestConfigs(t *testing.T) {
+	kp, err := GenerateKeyPair()
+	require.NoError(t, err)
+	b := kp.Configs()
+
+	// Append a config with an unknown version, which should be skipped.
+	unknown := []byte{0xff, 0xff, 0x00, 0x01, 0x00}
+	b = append(b, unknown...)
+	b[0], b[1] = byte((len(b)-2)>>8), byte(len(b)-2)
+
+	cs, err := ParseConfigs(b)
+	require.NoError(t, err)
+	require.Len(t, cs, 1)
+	require.True(t, cs[0].PublicKey.Equal(kp.PublicKey))
+	require.Equal(t, kp.keyID, cs[0].KeyID())
+
+	_, err = ParseConfigs([]byte{0x00, 0x05, 0xff, 0xff, 0x00, 0x01, 0x00})
+	require.ErrorIs(t, err, ErrNoConfig)
+	_, err = ParseConfigs([]byte{0x00, 0x05, 0x00})
+	require.ErrorIs(t, err, ErrInvalidMessage)
+}
+
+func TestExchange(t *testing.T) {
+	kp, err := GenerateKeyPair()
+	require.NoError(t, err)
+	kp2, err := NewKeyPair(kp.PrivateKey())
+	require.NoError(t, err)
+	cs, err := ParseConfigs(kp.Configs())
+	require.NoError(t, err)
+
+	for _, size := range []int{12, 124, 125, 1000} {
+		q := make([]byte, size)
+		q[0] = 1
+		msg, qc, err := cs[0].EncryptQuery(q)
+		require.NoError(t, err)
+
+		gotQ, rc, err := kp2.DecryptQuery(msg)
+		require.NoError(t, err)
+		require.Equal(t, q, gotQ)
+
+		r := append([]byte{2}, q...)
+		rmsg, err := rc.EncryptResponse(r)
+		require.NoError(t, err)
+		gotR, err := qc.DecryptResponse(rmsg)
+		require.NoError(t, err)
+		require.Equal(t, r, gotR)
+
+		rmsg[len(rmsg)-1]++
+		_, err = qc.DecryptResponse(rmsg)
+		require.ErrorIs(t, err, ErrInvalidMessage)
+
+		// A response can't be used as a query.
+		_, _, err = kp.DecryptQuery(rmsg)
+		require.Error(t, err)
+	}
+
+	other, err := GenerateKeyPair()
+	require.NoError(t, err)
+	msg, _, err := other.EncryptQuery([]byte("query"))
+	require.NoError(t, err)
+	_, _, err = kp.DecryptQuery(msg)
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
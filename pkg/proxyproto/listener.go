@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+)
+
+const defaultHeaderTimeout = time.Second * 5
+
+// Listener accepts connections that may start with a PROXY protocol header.
+// Headers are only read from connections from trusted sources. The header
+// is optional. Connections without a header keep their own address.
+type Listener struct {
+	net.Listener
+
+	// Trusted matches the addresses of the proxies. Required.
+	Trusted netlist.Matcher
+
+	// HeaderTimeout is the timeout to read the header.
+	// Default is 5s.
+	HeaderTimeout time.Duration
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ta, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.Trusted.Match(ta.AddrPort().Addr()) {
+		return c, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultHeaderTimeout
+	}
+	return newConn(c, timeout), nil
+}
+
+// Conn reads the header on the first call of Read or RemoteAddr.
+type Conn struct {
+	net.Conn
+	headerTimeout time.Duration
+
+	headerOnce sync.Once
+	br         *bufio.Reader // nil once the buffer is drained
+	remoteAddr net.Addr
+	headerErr  error
+
+	dlMu         sync.Mutex
+	readDeadline time.Time // deadline set by the caller
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func newConn(c net.Conn, headerTimeout time.Duration) *Conn {
+	return &Conn{
+		Conn:          c,
+		headerTimeout: headerTimeout,
+		br:            bufio.NewReaderSize(c, 256),
+		remoteAddr:    c.RemoteAddr(),
+	}
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+	src, err := ReadHeader(c.br)
+	c.dlMu.Lock()
+	c.Conn.SetReadDeadline(c.readDeadline)
+	c.dlMu.Unlock()
+
+	switch {
+	case err == nil:
+		if src.IsValid() {
+			c.remoteAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src.Addr().Unmap(), src.Port()))
+		}
+	case errors.Is(err, ErrNoHeader):
+	default:
+		c.headerErr = err
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.headerOnce.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(b)
+		}
+		c.br = nil
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client address from the header. If there is no
+// header, the address of the connection is returned.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.headerOnce.Do(c.readHeader)
+	return c.remoteAddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.dlMu.Lock()
+	defer c.dlMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.dlMu.Lock()
+	defer c.dlMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
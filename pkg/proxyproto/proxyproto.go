@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package proxyproto implements the server side of the PROXY protocol
+// v1 and v2 (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt).
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	v1MaxLen = 107
+
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamInet  = 0x1
+	v2FamInet6 = 0x2
+)
+
+var (
+	ErrNoHeader      = errors.New("no proxy protocol header")
+	errInvalidHeader = errors.New("invalid proxy protocol header")
+)
+
+// ReadHeader reads a v1 or v2 PROXY protocol header from r.
+// If r does not start with a header, ErrNoHeader is returned and
+// nothing is consumed.
+// The returned src is the address of the original client. It is invalid
+// if the header does not carry one (e.g. a v2 LOCAL command or a v1
+// UNKNOWN protocol), in which case the connection address should be used.
+func ReadHeader(r *bufio.Reader) (src netip.AddrPort, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	switch b[0] {
+	case v1Prefix[0]:
+		if !hasPrefix(r, v1Prefix) {
+			return netip.AddrPort{}, ErrNoHeader
+		}
+		return readV1(r)
+	case v2Signature[0]:
+		if !hasPrefix(r, v2Signature) {
+			return netip.AddrPort{}, ErrNoHeader
+		}
+		return readV2(r)
+	default:
+		return netip.AddrPort{}, ErrNoHeader
+	}
+}
+
+func hasPrefix(r *bufio.Reader, p []byte) bool {
+	b, _ := r.Peek(len(p))
+	return bytes.Equal(b, p)
+}
+
+// readV1 reads a v1 header. e.g. "PROXY TCP4 1.2.3.4 5.6.7.8 1111 53\r\n"
+func readV1(r *bufio.Reader) (netip.AddrPort, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLen {
+			return netip.AddrPort{}, fmt.Errorf("%w, v1 header is too long", errInvalidHeader)
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("%w, v1 header does not end with crlf", errInvalidHeader)
+	}
+
+	f := strings.Split(s, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if len(f) != 6 {
+		return netip.AddrPort{}, fmt.Errorf("%w, invalid v1 header %q", errInvalidHeader, s)
+	}
+	addr, err := netip.ParseAddr(f[2])
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w, invalid source address, %w", errInvalidHeader, err)
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w, invalid source port, %w", errInvalidHeader, err)
+	}
+	switch {
+	case f[1] == "TCP4" && addr.Is4():
+	case f[1] == "TCP6" && addr.Is6():
+	default:
+		return netip.AddrPort{}, fmt.Errorf("%w, invalid v1 protocol %s for address %s", errInvalidHeader, f[1], addr)
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// readV2 reads a v2 binary header.
+func readV2(r *bufio.Reader) (netip.AddrPort, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if ver := h[12] >> 4; ver != 2 {
+		return netip.AddrPort{}, fmt.Errorf("%w, invalid v2 version %d", errInvalidHeader, ver)
+	}
+	cmd := h[12] & 0x0f
+	fam := h[13] >> 4
+	l := int(binary.BigEndian.Uint16(h[14:]))
+
+	switch cmd {
+	case v2CmdLocal:
+		// Health checks etc. from the proxy itself.
+		_, err := r.Discard(l)
+		return netip.AddrPort{}, err
+	case v2CmdProxy:
+	default:
+		return netip.AddrPort{}, fmt.Errorf("%w, invalid v2 command %d", errInvalidHeader, cmd)
+	}
+
+	var addrLen int
+	switch fam {
+	case v2FamInet:
+		addrLen = 12
+	case v2FamInet6:
+		addrLen = 36
+	default:
+		// AF_UNSPEC or AF_UNIX. Address is not used.
+		_, err := r.Discard(l)
+		return netip.AddrPort{}, err
+	}
+	if l < addrLen {
+		return netip.AddrPort{}, fmt.Errorf("%w, v2 address block is too short", errInvalidHeader)
+	}
+
+	b := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if _, err := r.Discard(l - addrLen); err != nil { // TLVs
+		return netip.AddrPort{}, err
+	}
+	var src netip.Addr
+	var port uint16
+	if fam == v2FamInet {
+		src = netip.AddrFrom4([4]byte(b[:4]))
+		port = binary.BigEndian.Uint16(b[8:])
+	} else {
+		src = netip.AddrFrom16([16]byte(b[:16]))
+		port = binary.BigEndian.Uint16(b[32:])
+	}
+	return netip.AddrPortFrom(src, port), nil
+}
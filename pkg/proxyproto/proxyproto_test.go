@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/stretchr/testify/require"
+)
+
+func v2Header(cmd, fam byte, addr []byte, tlv int) string {
+	b := append([]byte(nil), v2Signature...)
+	b = append(b, 0x20|cmd, fam<<4|0x1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addr)+tlv))
+	b = append(b, addr...)
+	b = append(b, make([]byte, tlv)...)
+	return string(b)
+}
+
+func TestReadHeader(t *testing.T) {
+	inet := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0x57, 0, 53}
+	inet6 := make([]byte, 36)
+	copy(inet6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	binary.BigEndian.PutUint16(inet6[32:], 1111)
+
+	tests := []struct {
+		name    string
+		in      string
+		wantSrc string // empty means invalid
+		wantErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 1.2.3.4 5.6.7.8 1111 53\r\n", "1.2.3.4:1111", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 1111 53\r\n", "[2001:db8::1]:1111", false},
+		{"v1 unknown", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 5.6.7.8 1111 53\r\n", "", true},
+		{"v1 no crlf", "PROXY TCP4 1.2.3.4 5.6.7.8 1111 53\n", "", true},
+		{"v1 too long", "PROXY " + strings.Repeat("a", 200) + "\r\n", "", true},
+		{"v1 invalid port", "PROXY TCP4 1.2.3.4 5.6.7.8 99999 53\r\n", "", true},
+		{"v2 inet", v2Header(v2CmdProxy, v2FamInet, inet, 0), "1.2.3.4:1111", false},
+		{"v2 inet with tlv", v2Header(v2CmdProxy, v2FamInet, inet, 7), "1.2.3.4:1111", false},
+		{"v2 inet6", v2Header(v2CmdProxy, v2FamInet6, inet6, 0), "[2001:db8::1]:1111", false},
+		{"v2 local", v2Header(v2CmdLocal, 0, nil, 0), "", false},
+		{"v2 unix", v2Header(v2CmdProxy, 3, make([]byte, 216), 0), "", false},
+		{"v2 short addr", v2Header(v2CmdProxy, v2FamInet6, inet, 0), "", true},
+		{"v2 invalid cmd", v2Header(0x5, v2FamInet, inet, 0), "", true},
+		{"v2 truncated", v2Header(v2CmdProxy, v2FamInet, inet, 0)[:20], "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in + "payload"))
+			src, err := ReadHeader(r)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if len(tt.wantSrc) == 0 {
+				require.False(t, src.IsValid())
+			} else {
+				require.Equal(t, tt.wantSrc, src.String())
+			}
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, "payload", string(rest))
+		})
+	}
+
+	// No header, nothing is consumed.
+	for _, s := range []string{"\x00\x1cpayload", "PROXpayload", "\r\n\r\npayload"} {
+		r := bufio.NewReader(strings.NewReader(s))
+		_, err := ReadHeader(r)
+		require.ErrorIs(t, err, ErrNoHeader)
+		rest, _ := io.ReadAll(r)
+		require.Equal(t, s, string(rest))
+	}
+}
+
+func TestListener(t *testing.T) {
+	r := require.New(t)
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer tl.Close()
+
+	test := func(trusted string, in string, wantAddr string, wantPayload string) {
+		t.Helper()
+		trustedList := netlist.NewList()
+		r.NoError(netlist.LoadFromText(trustedList, trusted))
+		trustedList.Sort()
+		l := &Listener{Listener: tl, Trusted: trustedList}
+
+		go func() {
+			c, err := net.Dial("tcp", tl.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			c.Write([]byte(in))
+			io.Copy(io.Discard, c)
+		}()
+
+		c, err := l.Accept()
+		r.NoError(err)
+		defer c.Close()
+		deadline := time.Now().Add(time.Second * 5)
+		c.SetReadDeadline(deadline)
+		if len(wantAddr) == 0 {
+			raw := c
+			if pc, ok := c.(*Conn); ok {
+				raw = pc.Conn
+			}
+			wantAddr = raw.RemoteAddr().String()
+		}
+		r.Equal(wantAddr, c.RemoteAddr().String())
+		r.IsType(&net.TCPAddr{}, c.RemoteAddr())
+		b := make([]byte, len(wantPayload))
+		_, err = io.ReadFull(c, b)
+		r.NoError(err)
+		r.Equal(wantPayload, string(b))
+		if pc, ok := c.(*Conn); ok {
+			r.Equal(deadline, pc.readDeadline)
+		}
+	}
+
+	hdr := "PROXY TCP4 1.2.3.4 5.6.7.8 1111 53\r\n"
+	test("127.0.0.0/8", hdr+"payload", "1.2.3.4:1111", "payload")
+	// Header is optional.
+	test("127.0.0.0/8", "payload", "", "payload")
+	// Headers from untrusted sources are not parsed.
+	test("10.0.0.0/8", hdr+"payload", "", hdr+"payload")
+}
@@ -48,6 +48,7 @@ type Context struct {
 	resp        *dns.Msg
 	respOpt     *dns.OPT // nil if clientOpt == nil
 	upstreamOpt *dns.OPT // may be nil
+	dropped     bool
 
 	// lazy init.
 	kv    map[uint32]any
@@ -127,6 +128,7 @@ func (ctx *Context) ClientOpt() *dns.OPT {
 // If m is nil. It removes existing response.
 func (ctx *Context) SetResponse(m *dns.Msg) {
 	ctx.resp = m
+	ctx.dropped = false
 	if m == nil {
 		ctx.upstreamOpt = nil
 	} else {
@@ -134,6 +136,18 @@ func (ctx *Context) SetResponse(m *dns.Msg) {
 	}
 }
 
+// Drop removes existing response and tells the server not to reply
+// to the client. It is canceled by a later SetResponse.
+func (ctx *Context) Drop() {
+	ctx.SetResponse(nil)
+	ctx.dropped = true
+}
+
+// Dropped reports whether the query was dropped by Drop.
+func (ctx *Context) Dropped() bool {
+	return ctx.dropped
+}
+
 // R returns the response that will be sent to client. It might be nil.
 // Note: R does not have EDNS0. Caller MUST NOT add a dns.OPT into R.
 // Use RespOpt() instead.
@@ -188,6 +202,7 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 		d.respOpt = dns.Copy(ctx.respOpt).(*dns.OPT)
 	}
 	d.upstreamOpt = ctx.upstreamOpt
+	d.dropped = ctx.dropped
 
 	d.kv = copyMap(ctx.kv)
 	d.marks = copyMap(ctx.marks)
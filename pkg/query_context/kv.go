@@ -19,7 +19,10 @@
 
 package query_context
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+	"time"
+)
 
 var kId atomic.Uint32
 
@@ -33,3 +36,42 @@ func RegKey() uint32 {
 	}
 	return i
 }
+
+// Keys of the values that plugins store for query logs.
+var (
+	// KeyUpstream is the name (string) of the upstream that answered
+	// the query. Stored by forward.
+	KeyUpstream = RegKey()
+	// KeyCacheHit is true (bool) if the response was from the cache.
+	// Stored by cache.
+	KeyCacheHit = RegKey()
+	// KeyMatchedRule is the rule (string) that matched the query most
+	// recently. Stored by sequence and rpz.
+	KeyMatchedRule = RegKey()
+)
+
+// KeyUpstreamObserver is an UpstreamObserver that forward reports its
+// upstream exchanges to. Stored by dnstap.
+var KeyUpstreamObserver = RegKey()
+
+// UpstreamExchange is a single try of a query with an upstream.
+// Query and Response are only valid during the
+// UpstreamObserver.ObserveUpstream call.
+type UpstreamExchange struct {
+	Upstream string // Tag or address of the upstream.
+	Addr     string // Address of the upstream. e.g. "tls://8.8.8.8:853".
+	DialAddr string // Optional.
+
+	Query     []byte
+	QueryTime time.Time
+
+	// Response is nil if the exchange failed.
+	Response     []byte
+	ResponseTime time.Time
+}
+
+// UpstreamObserver observes the exchanges with upstreams. ObserveUpstream
+// may be called concurrently and must not block.
+type UpstreamObserver interface {
+	ObserveUpstream(e *UpstreamExchange)
+}
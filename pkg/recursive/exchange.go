@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/miekg/dns"
+)
+
+const (
+	ednsUDPSize = 1232
+)
+
+var errMismatchedResp = errors.New("response does not match the query")
+
+// exchange sends a non-recursive query to the nameserver at addr.
+// If do is set, the query has the DO bit and asks for DNSSEC records.
+// It retries over TCP if the UDP response is truncated.
+func (r *Resolver) exchange(ctx context.Context, addr netip.Addr, qname string, qtype uint16, do bool) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(qname, qtype)
+	q.RecursionDesired = false
+	q.SetEdns0(ednsUDPSize, do)
+
+	ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	defer cancel()
+
+	serverAddr := netip.AddrPortFrom(addr, r.opts.Port).String()
+	resp, err := exchangeUDP(ctx, serverAddr, q)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		resp, err = exchangeTCP(ctx, serverAddr, q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retry over tcp, %w", err)
+		}
+	}
+	return resp, nil
+}
+
+func exchangeUDP(ctx context.Context, addr string, q *dns.Msg) (*dns.Msg, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	if _, err := dnsutils.WriteMsgToUDP(c, q); err != nil {
+		return nil, err
+	}
+	for {
+		resp, _, err := dnsutils.ReadMsgFromUDP(c, ednsUDPSize)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, err
+		}
+		// Ignore (possibly spoofed) responses to other queries.
+		if matchResp(q, resp) {
+			return resp, nil
+		}
+	}
+}
+
+func exchangeTCP(ctx context.Context, addr string, q *dns.Msg) (*dns.Msg, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	if _, err := dnsutils.WriteMsgToTCP(c, q); err != nil {
+		return nil, err
+	}
+	resp, _, err := dnsutils.ReadMsgFromTCP(c)
+	if err != nil {
+		return nil, err
+	}
+	if !matchResp(q, resp) {
+		return nil, errMismatchedResp
+	}
+	return resp, nil
+}
+
+func matchResp(q, resp *dns.Msg) bool {
+	if resp.Id != q.Id || !resp.Response || len(resp.Question) != 1 {
+		return false
+	}
+	rq, qq := resp.Question[0], q.Question[0]
+	return rq.Qtype == qq.Qtype && rq.Qclass == qq.Qclass && dns.CanonicalName(rq.Name) == dns.CanonicalName(qq.Name)
+}
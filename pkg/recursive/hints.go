@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultRootHints are the IPv4 and IPv6 addresses of the IANA root servers.
+var DefaultRootHints = []netip.Addr{
+	netip.MustParseAddr("198.41.0.4"),     // a.root-servers.net
+	netip.MustParseAddr("170.247.170.2"),  // b.root-servers.net
+	netip.MustParseAddr("192.33.4.12"),    // c.root-servers.net
+	netip.MustParseAddr("199.7.91.13"),    // d.root-servers.net
+	netip.MustParseAddr("192.203.230.10"), // e.root-servers.net
+	netip.MustParseAddr("192.5.5.241"),    // f.root-servers.net
+	netip.MustParseAddr("192.112.36.4"),   // g.root-servers.net
+	netip.MustParseAddr("198.97.190.53"),  // h.root-servers.net
+	netip.MustParseAddr("192.36.148.17"),  // i.root-servers.net
+	netip.MustParseAddr("192.58.128.30"),  // j.root-servers.net
+	netip.MustParseAddr("193.0.14.129"),   // k.root-servers.net
+	netip.MustParseAddr("199.7.83.42"),    // l.root-servers.net
+	netip.MustParseAddr("202.12.27.33"),   // m.root-servers.net
+	netip.MustParseAddr("2001:503:ba3e::2:30"),
+	netip.MustParseAddr("2801:1b8:10::b"),
+	netip.MustParseAddr("2001:500:2::c"),
+	netip.MustParseAddr("2001:500:2d::d"),
+	netip.MustParseAddr("2001:500:a8::e"),
+	netip.MustParseAddr("2001:500:2f::f"),
+	netip.MustParseAddr("2001:500:12::d0d"),
+	netip.MustParseAddr("2001:500:1::53"),
+	netip.MustParseAddr("2001:7fe::53"),
+	netip.MustParseAddr("2001:503:c27::2:30"),
+	netip.MustParseAddr("2001:7fd::1"),
+	netip.MustParseAddr("2001:500:9f::42"),
+	netip.MustParseAddr("2001:dc3::35"),
+}
+
+// LoadRootHintsFromFile loads root server addresses from a root hints
+// file, e.g. https://www.internic.net/domain/named.root.
+func LoadRootHintsFromFile(path string) ([]netip.Addr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRootHints(f, path)
+}
+
+// ParseRootHints parses root server addresses from a root hints file
+// in zone file format. Only A and AAAA records of the names that
+// the root NS records point to are used.
+func ParseRootHints(r io.Reader, file string) ([]netip.Addr, error) {
+	nsNames := make(map[string]struct{})
+	var glue []dns.RR
+	zp := dns.NewZoneParser(r, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			if rr.Hdr.Name == "." {
+				nsNames[dns.CanonicalName(rr.Ns)] = struct{}{}
+			}
+		case *dns.A, *dns.AAAA:
+			glue = append(glue, rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	for _, rr := range glue {
+		if _, ok := nsNames[dns.CanonicalName(rr.Header().Name)]; !ok {
+			continue
+		}
+		if addr, ok := addrOf(rr); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no root server address found")
+	}
+	return addrs, nil
+}
+
+func addrOf(rr dns.RR) (netip.Addr, bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		addr, ok := netip.AddrFromSlice(rr.A.To4())
+		return addr, ok
+	case *dns.AAAA:
+		addr, ok := netip.AddrFromSlice(rr.AAAA.To16())
+		return addr, ok
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,530 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPort      = 53
+	defaultTimeout   = time.Second * 2
+	defaultCacheSize = 4096
+
+	maxReferrals     = 32 // Max referrals to follow for one name.
+	maxCNAMEs        = 8  // Max CNAME hops for one query.
+	maxDepth         = 4  // Max nested lookups for glueless nameservers.
+	maxQueries       = 96 // Max queries sent to nameservers for one query.
+	maxMinimiseCount = 10 // RFC 9156 MAX_MINIMISE_COUNT.
+	maxServerTries   = 6  // Max nameservers tried for one step.
+
+	minCacheTTL = time.Second * 5
+	maxCacheTTL = time.Hour * 24
+)
+
+var (
+	ErrTooManyQueries = errors.New("too many queries")
+	ErrTooManyCNAMEs  = errors.New("cname chain is too long")
+	ErrNoServer       = errors.New("no reachable nameserver")
+)
+
+type Opts struct {
+	// RootHints are the addresses of root servers.
+	// Default is DefaultRootHints.
+	RootHints []netip.Addr
+
+	// Port is the port of nameservers. Default is 53.
+	Port uint16
+
+	// Timeout is the timeout of each query to a nameserver.
+	// Default is 2s.
+	Timeout time.Duration
+
+	// CacheSize is the size of the delegation cache. Default is 4096.
+	CacheSize int
+
+	// DisableQNAMEMinimisation disables RFC 9156 QNAME minimisation.
+	DisableQNAMEMinimisation bool
+
+	// IPv6 allows sending queries to IPv6 nameservers.
+	IPv6 bool
+
+	Logger *zap.Logger
+}
+
+// Resolver is an iterative resolver that resolves names from the root
+// servers. It follows referrals, resolves glueless nameservers and
+// chases CNAMEs. Delegations and nameserver addresses are cached.
+// It does not cache final answers.
+type Resolver struct {
+	opts        Opts
+	root        *delegation
+	delegations *cache.Cache[key, *delegation]
+	nsAddrs     *cache.Cache[key, []netip.Addr]
+}
+
+type key string
+
+var seed = maphash.MakeSeed()
+
+func (k key) Sum() uint64 {
+	return maphash.String(seed, string(k))
+}
+
+// delegation is a zone and its nameservers.
+type delegation struct {
+	zone    string
+	servers []nameserver
+}
+
+type nameserver struct {
+	name  string       // May be empty for root hints.
+	addrs []netip.Addr // Glue. May be empty.
+}
+
+func NewResolver(opts Opts) *Resolver {
+	if len(opts.RootHints) == 0 {
+		opts.RootHints = DefaultRootHints
+	}
+	if opts.Port == 0 {
+		opts.Port = defaultPort
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	root := &delegation{zone: "."}
+	for _, addr := range opts.RootHints {
+		root.servers = append(root.servers, nameserver{addrs: []netip.Addr{addr}})
+	}
+	return &Resolver{
+		opts:        opts,
+		root:        root,
+		delegations: cache.New[key, *delegation](cache.Opts{Size: opts.CacheSize}),
+		nsAddrs:     cache.New[key, []netip.Addr](cache.Opts{Size: opts.CacheSize}),
+	}
+}
+
+func (r *Resolver) Close() error {
+	r.delegations.Close()
+	r.nsAddrs.Close()
+	return nil
+}
+
+// Resolve resolves the question of q. The returned msg is a reply to q
+// with RA set. Only the answer and authority sections are filled.
+// If q has the DO bit, nameservers are asked for DNSSEC records and
+// the signatures are kept in the reply.
+func (r *Resolver) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, errors.New("query must have exactly one question")
+	}
+	question := q.Question[0]
+	t := &task{r: r}
+	if opt := q.IsEdns0(); opt != nil {
+		t.do = opt.Do()
+	}
+	res, err := t.resolve(ctx, dns.CanonicalName(question.Name), question.Qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.RecursionAvailable = true
+	resp.Rcode = res.Rcode
+	resp.Answer = res.Answer
+	resp.Ns = res.Ns
+	return resp, nil
+}
+
+// task holds the state of one Resolve call.
+type task struct {
+	r       *Resolver
+	do      bool // Set the DO bit in queries to nameservers.
+	queries int
+}
+
+// resolve resolves name and follows CNAMEs across zones.
+func (t *task) resolve(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	var chain []dns.RR
+	target := name
+	for hops := 0; ; hops++ {
+		res, err := t.lookup(ctx, target, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+		ans, next := followCNAME(res.Answer, target, qtype)
+		chain = append(chain, ans...)
+		if res.Rcode != dns.RcodeSuccess || len(next) == 0 {
+			res.Answer = chain
+			return res, nil
+		}
+		if hops >= maxCNAMEs || cnameLoop(chain, next) {
+			return nil, ErrTooManyCNAMEs
+		}
+		target = next
+	}
+}
+
+// followCNAME picks the records answering name and their signatures from
+// rrs, following the CNAME chain within rrs. If the chain ends at a name
+// that has no record in rrs, that name is returned as next.
+func followCNAME(rrs []dns.RR, name string, qtype uint16) (ans []dns.RR, next string) {
+	cur := name
+	for hops := 0; hops <= maxCNAMEs; hops++ {
+		var cname string
+		var found bool
+		for _, rr := range rrs {
+			h := rr.Header()
+			if dns.CanonicalName(h.Name) != cur {
+				continue
+			}
+			switch {
+			case h.Rrtype == qtype || qtype == dns.TypeANY:
+				ans = append(ans, rr)
+				found = true
+			case h.Rrtype == dns.TypeCNAME:
+				ans = append(ans, rr)
+				cname = dns.CanonicalName(rr.(*dns.CNAME).Target)
+			case h.Rrtype == dns.TypeRRSIG:
+				if c := rr.(*dns.RRSIG).TypeCovered; c == qtype || c == dns.TypeCNAME || qtype == dns.TypeANY {
+					ans = append(ans, rr)
+				}
+			}
+		}
+		if found || cur == name && len(cname) == 0 {
+			return ans, ""
+		}
+		if len(cname) == 0 {
+			return ans, cur
+		}
+		cur = cname
+	}
+	return ans, cur
+}
+
+func cnameLoop(chain []dns.RR, name string) bool {
+	for _, rr := range chain {
+		if rr.Header().Rrtype == dns.TypeCNAME && dns.CanonicalName(rr.Header().Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup resolves name from the closest known delegation without
+// following CNAMEs to other zones.
+func (t *task) lookup(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	d := t.r.closestDelegation(name)
+	minimise := !t.r.opts.DisableQNAMEMinimisation
+	minimised := 0
+	known := d.zone // The longest name that we know exists in d.zone.
+	for i := 0; i < maxReferrals; i++ {
+		qname, qt := name, qtype
+		if minimise && minimised < maxMinimiseCount {
+			if n := nextName(known, name); n != name {
+				// RFC 9156 2.1 recommends type A for minimised queries.
+				qname, qt = n, dns.TypeA
+			}
+		}
+
+		res, ref, err := t.queryZone(ctx, d, qname, qt, depth)
+		if err != nil {
+			return nil, err
+		}
+		if ref != nil {
+			t.r.storeDelegation(ref, res)
+			d = ref
+			known = ref.zone
+			continue
+		}
+		if qname != name {
+			minimised++
+			if res.Rcode == dns.RcodeNameError {
+				// Some servers return NXDOMAIN for empty non-terminals.
+				// Fall back to the full name. RFC 9156 2.3.
+				minimise = false
+			}
+			known = qname
+			continue
+		}
+		res.Answer = inBailiwick(res.Answer, d.zone)
+		res.Ns = inBailiwick(res.Ns, d.zone)
+		return res, nil
+	}
+	return nil, fmt.Errorf("too many referrals for %s", name)
+}
+
+// nextName returns the name that has one more label than known
+// and is an ancestor of (or equal to) name.
+func nextName(known, name string) string {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(known) + 1
+	if n >= len(labels) {
+		return name
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+func inBailiwick(rrs []dns.RR, zone string) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// queryZone sends the query to nameservers of d until one of them
+// gives an answer or a referral to a child zone.
+func (t *task) queryZone(ctx context.Context, d *delegation, qname string, qtype uint16, depth int) (*dns.Msg, *delegation, error) {
+	servers := make([]nameserver, len(d.servers))
+	copy(servers, d.servers)
+	rand.Shuffle(len(servers), func(i, j int) { servers[i], servers[j] = servers[j], servers[i] })
+
+	// Try nameservers with known addresses first.
+	var glueless []nameserver
+	tries := 0
+	var lastErr error
+	try := func(addrs []netip.Addr) (*dns.Msg, *delegation, bool) {
+		for _, addr := range addrs {
+			if tries >= maxServerTries || ctx.Err() != nil {
+				return nil, nil, false
+			}
+			if t.queries >= maxQueries {
+				lastErr = ErrTooManyQueries
+				return nil, nil, false
+			}
+			tries++
+			t.queries++
+			res, err := t.r.exchange(ctx, addr, qname, qtype, t.do)
+			if err != nil {
+				t.r.opts.Logger.Debug("nameserver query failed", zap.String("zone", d.zone), zap.Stringer("addr", addr), zap.String("qname", qname), zap.Error(err))
+				lastErr = err
+				continue
+			}
+			if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+				lastErr = fmt.Errorf("nameserver %s returned %s", addr, dns.RcodeToString[res.Rcode])
+				continue
+			}
+			if ref := referral(res, d.zone, qname); ref != nil {
+				return res, ref, true
+			}
+			if !res.Authoritative && len(res.Answer) == 0 {
+				lastErr = fmt.Errorf("lame response from nameserver %s for zone %s", addr, d.zone)
+				continue
+			}
+			return res, nil, true
+		}
+		return nil, nil, false
+	}
+	for _, ns := range servers {
+		addrs := t.r.usableAddrs(ns.addrs)
+		if len(addrs) == 0 {
+			if cached, _, ok := t.r.nsAddrs.Get(key(ns.name)); ok {
+				addrs = cached
+			}
+		}
+		if len(addrs) == 0 {
+			glueless = append(glueless, ns)
+			continue
+		}
+		if res, ref, ok := try(addrs); ok {
+			return res, ref, nil
+		}
+	}
+	for _, ns := range glueless {
+		if tries >= maxServerTries || t.queries >= maxQueries || ctx.Err() != nil {
+			break
+		}
+		addrs, err := t.resolveNS(ctx, d, ns.name, depth)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if res, ref, ok := try(addrs); ok {
+			return res, ref, nil
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if lastErr == nil {
+		lastErr = ErrNoServer
+	}
+	return nil, nil, fmt.Errorf("failed to query zone %s for %s: %w", d.zone, qname, lastErr)
+}
+
+// resolveNS resolves the addresses of a glueless nameserver.
+func (t *task) resolveNS(ctx context.Context, d *delegation, name string, depth int) ([]netip.Addr, error) {
+	if len(name) == 0 {
+		return nil, ErrNoServer
+	}
+	// Without glue, a nameserver inside the zone that it serves
+	// cannot be resolved.
+	if dns.IsSubDomain(d.zone, name) {
+		return nil, fmt.Errorf("nameserver %s of zone %s has no glue", name, d.zone)
+	}
+	if depth >= maxDepth {
+		return nil, fmt.Errorf("too deep to resolve nameserver %s", name)
+	}
+
+	qtypes := []uint16{dns.TypeA}
+	if t.r.opts.IPv6 {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+	var addrs []netip.Addr
+	var ttl uint32
+	var lastErr error
+	for _, qt := range qtypes {
+		res, err := t.resolve(ctx, name, qt, depth+1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range res.Answer {
+			if addr, ok := addrOf(rr); ok {
+				addrs = append(addrs, addr)
+				if ttl == 0 || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("nameserver %s has no address", name)
+		}
+		return nil, lastErr
+	}
+	t.r.nsAddrs.Store(key(name), addrs, time.Now().Add(clampTTL(ttl)))
+	return addrs, nil
+}
+
+func (r *Resolver) usableAddrs(addrs []netip.Addr) []netip.Addr {
+	if r.opts.IPv6 {
+		return addrs
+	}
+	var out []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is4() || addr.Is4In6() {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// referral returns the delegation in res if res is a referral
+// from zone to one of its descendants that contains qname.
+func referral(res *dns.Msg, zone, qname string) *delegation {
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 {
+		return nil
+	}
+	var child string
+	var nsNames []string
+	for _, rr := range res.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+		if len(child) == 0 {
+			child = owner
+		}
+		if owner == child {
+			nsNames = append(nsNames, dns.CanonicalName(ns.Ns))
+		}
+	}
+	if len(child) == 0 {
+		return nil
+	}
+
+	d := &delegation{zone: child}
+	for _, name := range nsNames {
+		ns := nameserver{name: name}
+		for _, rr := range res.Extra {
+			// Only accept glue that the parent zone is authoritative for.
+			owner := dns.CanonicalName(rr.Header().Name)
+			if owner != name || !dns.IsSubDomain(zone, owner) {
+				continue
+			}
+			if addr, ok := addrOf(rr); ok {
+				ns.addrs = append(ns.addrs, addr)
+			}
+		}
+		d.servers = append(d.servers, ns)
+	}
+	return d
+}
+
+func (r *Resolver) storeDelegation(d *delegation, res *dns.Msg) {
+	var ttl uint32
+	for _, rr := range res.Ns {
+		if rr.Header().Rrtype == dns.TypeNS && (ttl == 0 || rr.Header().Ttl < ttl) {
+			ttl = rr.Header().Ttl
+		}
+	}
+	r.delegations.Store(key(d.zone), d, time.Now().Add(clampTTL(ttl)))
+}
+
+// closestDelegation returns the cached delegation that is the closest
+// ancestor of name, or the root.
+func (r *Resolver) closestDelegation(name string) *delegation {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if d, _, ok := r.delegations.Get(key(name[off:])); ok {
+			return d
+		}
+	}
+	return r.root
+}
+
+func clampTTL(ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d < minCacheTTL {
+		return minCacheTTL
+	}
+	if d > maxCacheTTL {
+		return maxCacheTTL
+	}
+	return d
+}
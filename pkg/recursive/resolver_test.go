@@ -0,0 +1,307 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer is a minimal authoritative server for one or more zones.
+type fakeServer struct {
+	zones map[string][]dns.RR
+
+	mu      sync.Mutex
+	queries []dns.Question
+}
+
+func newFakeServer(t *testing.T, zones map[string][]string) *fakeServer {
+	s := &fakeServer{zones: make(map[string][]dns.RR)}
+	for origin, records := range zones {
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			require.NoError(t, err)
+			s.zones[origin] = append(s.zones[origin], rr)
+		}
+	}
+	return s
+}
+
+func (s *fakeServer) Handle(_ context.Context, q *dns.Msg, _ server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	s.mu.Lock()
+	s.queries = append(s.queries, q.Question[0])
+	s.mu.Unlock()
+	b, err := packMsgPayload(s.reply(q))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (s *fakeServer) queried() []dns.Question {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]dns.Question(nil), s.queries...)
+}
+
+func (s *fakeServer) reply(q *dns.Msg) *dns.Msg {
+	qname, qtype := q.Question[0].Name, q.Question[0].Qtype
+	r := new(dns.Msg)
+	r.SetReply(q)
+
+	var origin string
+	for o := range s.zones {
+		if dns.IsSubDomain(o, qname) && (len(origin) == 0 || dns.CountLabel(o) > dns.CountLabel(origin)) {
+			origin = o
+		}
+	}
+	rrs := s.zones[origin]
+	if len(rrs) == 0 {
+		r.Rcode = dns.RcodeRefused
+		return r
+	}
+
+	// Delegation to a child zone.
+	for _, rr := range rrs {
+		owner := rr.Header().Name
+		if rr.Header().Rrtype == dns.TypeNS && owner != origin && dns.IsSubDomain(owner, qname) {
+			for _, rr := range rrs {
+				if rr.Header().Name == owner && rr.Header().Rrtype == dns.TypeNS {
+					r.Ns = append(r.Ns, rr)
+					r.Extra = append(r.Extra, s.glue(rr.(*dns.NS).Ns)...)
+				}
+			}
+			return r
+		}
+	}
+
+	r.Authoritative = true
+	exists := false
+	for name := qname; ; {
+		var cname string
+		for _, rr := range rrs {
+			owner := rr.Header().Name
+			if owner == name || strings.HasSuffix(owner, "."+name) {
+				exists = true
+			}
+			if owner != name {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				r.Answer = append(r.Answer, rr)
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				r.Answer = append(r.Answer, rr)
+				cname = c.Target
+			}
+		}
+		if len(cname) == 0 || !dns.IsSubDomain(origin, cname) {
+			break
+		}
+		name = cname
+	}
+	if len(r.Answer) == 0 {
+		if !exists {
+			r.Rcode = dns.RcodeNameError
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				r.Ns = append(r.Ns, rr)
+			}
+		}
+	}
+	return r
+}
+
+func (s *fakeServer) glue(name string) []dns.RR {
+	var out []dns.RR
+	for _, rrs := range s.zones {
+		for _, rr := range rrs {
+			if rr.Header().Name == name && rr.Header().Rrtype == dns.TypeA {
+				out = append(out, rr)
+			}
+		}
+	}
+	return out
+}
+
+// serveFakeServers starts servers on 127.0.0.1, 127.0.0.2... with the
+// same port, and returns the port.
+func serveFakeServers(t *testing.T, servers ...*fakeServer) uint16 {
+	var port uint16
+	for i, s := range servers {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, byte(i + 1)}), port)
+		c, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+		if port == 0 {
+			port = c.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+		}
+		go server.ServeUDP(c, s, server.UDPServerOpts{})
+	}
+	return port
+}
+
+func Test_Resolver(t *testing.T) {
+	root := newFakeServer(t, map[string][]string{".": {
+		". 86400 IN SOA a.root. admin.root. 1 1800 900 604800 86400",
+		"com. 86400 IN NS ns.com.",
+		"ns.com. 86400 IN A 127.0.0.2",
+		"net. 86400 IN NS ns.net.",
+		"ns.net. 86400 IN A 127.0.0.3",
+	}})
+	com := newFakeServer(t, map[string][]string{"com.": {
+		"com. 86400 IN SOA ns.com. admin.com. 1 1800 900 604800 86400",
+		"example.com. 86400 IN NS ns1.example.com.",
+		"ns1.example.com. 86400 IN A 127.0.0.4",
+		"glueless.com. 86400 IN NS ns.other.net.",
+	}})
+	net := newFakeServer(t, map[string][]string{"net.": {
+		"net. 86400 IN SOA ns.net. admin.net. 1 1800 900 604800 86400",
+		"other.net. 86400 IN NS ns.other.net.",
+		"ns.other.net. 86400 IN A 127.0.0.5",
+	}})
+	example := newFakeServer(t, map[string][]string{"example.com.": {
+		"example.com. 3600 IN SOA ns1.example.com. admin.example.com. 1 1800 900 604800 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"ns1.example.com. 3600 IN A 127.0.0.4",
+		"www.example.com. 300 IN A 192.0.2.1",
+		"alias.example.com. 300 IN CNAME www.other.net.",
+		"in-zone.example.com. 300 IN CNAME www.example.com.",
+		"a.b.c.d.example.com. 300 IN A 192.0.2.9",
+	}})
+	other := newFakeServer(t, map[string][]string{
+		"other.net.": {
+			"other.net. 3600 IN SOA ns.other.net. admin.other.net. 1 1800 900 604800 300",
+			"ns.other.net. 3600 IN A 127.0.0.5",
+			"www.other.net. 300 IN A 192.0.2.2",
+		},
+		"glueless.com.": {
+			"glueless.com. 3600 IN SOA ns.other.net. admin.glueless.com. 1 1800 900 604800 300",
+			"www.glueless.com. 300 IN A 192.0.2.3",
+		},
+	})
+	port := serveFakeServers(t, root, com, net, example, other)
+
+	newResolver := func(opts Opts) *Resolver {
+		opts.RootHints = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+		opts.Port = port
+		opts.Timeout = time.Second
+		r := NewResolver(opts)
+		t.Cleanup(func() { r.Close() })
+		return r
+	}
+	resolve := func(r *Resolver, name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		resp, err := r.Resolve(context.Background(), q)
+		require.NoError(t, err)
+		require.True(t, resp.RecursionAvailable)
+		return resp
+	}
+	answers := func(m *dns.Msg) []string {
+		var s []string
+		for _, rr := range m.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				s = append(s, rr.A.String())
+			case *dns.CNAME:
+				s = append(s, rr.Target)
+			}
+		}
+		return s
+	}
+	names := func(qs []dns.Question) []string {
+		var s []string
+		for _, q := range qs {
+			s = append(s, q.Name)
+		}
+		return s
+	}
+
+	r := newResolver(Opts{})
+	resp := resolve(r, "www.example.com.", dns.TypeA)
+	require.Equal(t, []string{"192.0.2.1"}, answers(resp))
+	// QNAME minimisation: the root and the TLD only see one more label.
+	require.Equal(t, []string{"com."}, names(root.queried()))
+	require.Equal(t, []string{"example.com."}, names(com.queried()))
+
+	// Cached delegation: the root and the TLD are not queried again.
+	resp = resolve(r, "nx.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, resp.Rcode)
+	require.Len(t, resp.Ns, 1)
+	require.Equal(t, dns.TypeSOA, resp.Ns[0].Header().Rrtype)
+	require.Len(t, root.queried(), 1)
+	require.Len(t, com.queried(), 1)
+
+	resp = resolve(r, "www.example.com.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Empty(t, resp.Answer)
+
+	// Empty non-terminals.
+	resp = resolve(r, "a.b.c.d.example.com.", dns.TypeA)
+	require.Equal(t, []string{"192.0.2.9"}, answers(resp))
+
+	// CNAME chains, in zone and across zones.
+	resp = resolve(r, "in-zone.example.com.", dns.TypeA)
+	require.Equal(t, []string{"www.example.com.", "192.0.2.1"}, answers(resp))
+	resp = resolve(r, "alias.example.com.", dns.TypeA)
+	require.Equal(t, []string{"www.other.net.", "192.0.2.2"}, answers(resp))
+	require.Equal(t, "alias.example.com.", resp.Question[0].Name)
+
+	// Glueless delegation.
+	resp = resolve(r, "www.glueless.com.", dns.TypeA)
+	require.Equal(t, []string{"192.0.2.3"}, answers(resp))
+
+	// Without QNAME minimisation, the full name is sent to the root.
+	r = newResolver(Opts{DisableQNAMEMinimisation: true})
+	resolve(r, "www.other.net.", dns.TypeA)
+	require.Contains(t, names(root.queried()), "www.other.net.")
+}
+
+func Test_ParseRootHints(t *testing.T) {
+	hints := `
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+OTHER.NET.               3600000      A     192.0.2.1
+`
+	addrs, err := ParseRootHints(strings.NewReader(hints), "")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{
+		netip.MustParseAddr("198.41.0.4"),
+		netip.MustParseAddr("2001:503:ba3e::2:30"),
+		netip.MustParseAddr("170.247.170.2"),
+	}, addrs)
+
+	_, err = ParseRootHints(strings.NewReader(""), "")
+	require.Error(t, err)
+}
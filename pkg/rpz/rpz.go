@@ -0,0 +1,514 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package rpz implements DNS response policy zones.
+// https://datatracker.ietf.org/doc/draft-vixie-dnsop-dns-rpz/
+package rpz
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Trigger is the type of the policy trigger.
+// Triggers are listed in order of precedence.
+type Trigger uint8
+
+const (
+	TriggerClientIP Trigger = iota + 1
+	TriggerQName
+	TriggerIP
+	TriggerNSDName
+	TriggerNSIP
+)
+
+var triggerNames = map[Trigger]string{
+	TriggerClientIP: "CLIENT-IP",
+	TriggerQName:    "QNAME",
+	TriggerIP:       "IP",
+	TriggerNSDName:  "NSDNAME",
+	TriggerNSIP:     "NSIP",
+}
+
+func (t Trigger) String() string {
+	if s, ok := triggerNames[t]; ok {
+		return s
+	}
+	return "trigger(" + strconv.Itoa(int(t)) + ")"
+}
+
+// Action is the policy action.
+type Action uint8
+
+const (
+	ActionNXDomain Action = iota + 1
+	ActionNoData
+	ActionPassthru
+	ActionDrop
+	ActionTCPOnly
+	ActionLocalData
+)
+
+var actionNames = map[Action]string{
+	ActionNXDomain:  "NXDOMAIN",
+	ActionNoData:    "NODATA",
+	ActionPassthru:  "PASSTHRU",
+	ActionDrop:      "DROP",
+	ActionTCPOnly:   "TCP-ONLY",
+	ActionLocalData: "LOCAL-DATA",
+}
+
+func (a Action) String() string {
+	if s, ok := actionNames[a]; ok {
+		return s
+	}
+	return "action(" + strconv.Itoa(int(a)) + ")"
+}
+
+// Special CNAME targets of the actions.
+const (
+	targetNXDomain = "."
+	targetNoData   = "*."
+	targetPassthru = "rpz-passthru."
+	targetDrop     = "rpz-drop."
+	targetTCPOnly  = "rpz-tcp-only."
+)
+
+// Label suffixes of the triggers.
+const (
+	labelIP       = ".rpz-ip"
+	labelClientIP = ".rpz-client-ip"
+	labelNSIP     = ".rpz-nsip"
+	labelNSDName  = ".rpz-nsdname"
+)
+
+// Rule is a policy rule.
+type Rule struct {
+	Trigger Trigger
+	Action  Action
+
+	// Owner is the owner name of the rule in the policy zone.
+	Owner string
+
+	// Data is the local data of ActionLocalData.
+	Data []dns.RR
+}
+
+// Zone is a compiled policy zone.
+type Zone struct {
+	name string
+	soa  *dns.SOA
+
+	clientIP ipTable
+	qname    nameTable
+	ip       ipTable
+	nsdname  nameTable
+	nsip     ipTable
+}
+
+// NewZone compiles rrs of the policy zone with soa. Records that
+// are not valid policy rules are ignored and returned as invalid.
+func NewZone(soa *dns.SOA, rrs []dns.RR) (z *Zone, invalid []dns.RR) {
+	name := dns.CanonicalName(soa.Hdr.Name)
+	z = &Zone{name: name, soa: soa}
+
+	nodes := make(map[string][]dns.RR)
+	var owners []string
+	for _, rr := range rrs {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if owner == name || !dns.IsSubDomain(name, owner) {
+			continue // Apex SOA, NS etc.
+		}
+		if _, ok := nodes[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		nodes[owner] = append(nodes[owner], rr)
+	}
+	for _, owner := range owners {
+		if err := z.add(owner, nodes[owner]); err != nil {
+			invalid = append(invalid, nodes[owner]...)
+		}
+	}
+	return z, invalid
+}
+
+// Name returns the name of the policy zone.
+func (z *Zone) Name() string {
+	return z.name
+}
+
+// Len returns the number of rules.
+func (z *Zone) Len() int {
+	return z.clientIP.len() + z.qname.len() + z.ip.len() + z.nsdname.len() + z.nsip.len()
+}
+
+func (z *Zone) add(owner string, rrs []dns.RR) error {
+	rel := strings.TrimSuffix(owner, "."+z.name)
+	if z.name == "." {
+		rel = strings.TrimSuffix(owner, ".")
+	}
+	rule := &Rule{Owner: owner}
+	if err := parseAction(rule, rel, rrs); err != nil {
+		return err
+	}
+
+	switch {
+	case strings.HasSuffix(rel, labelClientIP):
+		rule.Trigger = TriggerClientIP
+		return z.clientIP.addLabels(strings.TrimSuffix(rel, labelClientIP), rule)
+	case strings.HasSuffix(rel, labelIP):
+		rule.Trigger = TriggerIP
+		return z.ip.addLabels(strings.TrimSuffix(rel, labelIP), rule)
+	case strings.HasSuffix(rel, labelNSIP):
+		rule.Trigger = TriggerNSIP
+		return z.nsip.addLabels(strings.TrimSuffix(rel, labelNSIP), rule)
+	case strings.HasSuffix(rel, labelNSDName):
+		rule.Trigger = TriggerNSDName
+		z.nsdname.add(strings.TrimSuffix(rel, labelNSDName), rule)
+		return nil
+	default:
+		rule.Trigger = TriggerQName
+		z.qname.add(rel, rule)
+		return nil
+	}
+}
+
+func parseAction(rule *Rule, rel string, rrs []dns.RR) error {
+	if len(rrs) == 1 {
+		if cname, ok := rrs[0].(*dns.CNAME); ok {
+			switch target := dns.CanonicalName(cname.Target); target {
+			case targetNXDomain:
+				rule.Action = ActionNXDomain
+			case targetNoData:
+				rule.Action = ActionNoData
+			case targetPassthru, rel + ".":
+				// A CNAME to the trigger itself is the legacy PASSTHRU.
+				rule.Action = ActionPassthru
+			case targetDrop:
+				rule.Action = ActionDrop
+			case targetTCPOnly:
+				rule.Action = ActionTCPOnly
+			}
+			if rule.Action != 0 {
+				return nil
+			}
+		}
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeCNAME && len(rrs) > 1 {
+			return errors.New("cname and other data")
+		}
+	}
+	rule.Action = ActionLocalData
+	rule.Data = rrs
+	return nil
+}
+
+// HasResponseTriggers reports whether MatchResponse may match, i.e. the
+// zone has QNAME (for CNAME targets), IP, NSDNAME or NSIP triggers.
+func (z *Zone) HasResponseTriggers() bool {
+	return z.qname.len()+z.ip.len()+z.nsdname.len()+z.nsip.len() > 0
+}
+
+// MatchQuery returns the rule of the highest precedence that matches
+// the query before resolution.
+func (z *Zone) MatchQuery(qname string, client netip.Addr) *Rule {
+	if client.IsValid() {
+		if r := z.clientIP.match(client); r != nil {
+			return r
+		}
+	}
+	return z.qname.match(dns.CanonicalName(qname))
+}
+
+// MatchResponse returns the rule of the highest precedence that matches
+// the response. CNAME targets in the answer are checked as QNAME triggers.
+// NSDNAME and NSIP triggers are checked against the NS records and
+// their glue in the response.
+func (z *Zone) MatchResponse(r *dns.Msg) *Rule {
+	for _, rr := range r.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if rule := z.qname.match(dns.CanonicalName(cname.Target)); rule != nil {
+				return rule
+			}
+		}
+	}
+	if z.ip.len() > 0 {
+		for _, rr := range r.Answer {
+			if addr, ok := rrAddr(rr); ok {
+				if rule := z.ip.match(addr); rule != nil {
+					return rule
+				}
+			}
+		}
+	}
+	if z.nsdname.len() == 0 && z.nsip.len() == 0 {
+		return nil
+	}
+	var nsNames []string
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			if ns, ok := rr.(*dns.NS); ok {
+				nsNames = append(nsNames, dns.CanonicalName(ns.Ns))
+			}
+		}
+	}
+	for _, name := range nsNames {
+		if rule := z.nsdname.match(name); rule != nil {
+			return rule
+		}
+	}
+	if z.nsip.len() > 0 {
+		for _, rr := range r.Extra {
+			if !slices.Contains(nsNames, dns.CanonicalName(rr.Header().Name)) {
+				continue
+			}
+			if addr, ok := rrAddr(rr); ok {
+				if rule := z.nsip.match(addr); rule != nil {
+					return rule
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func rrAddr(rr dns.RR) (netip.Addr, bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		addr, ok := netip.AddrFromSlice(rr.A.To4())
+		return addr, ok
+	case *dns.AAAA:
+		addr, ok := netip.AddrFromSlice(rr.AAAA)
+		return addr.Unmap(), ok
+	}
+	return netip.Addr{}, false
+}
+
+// Reply builds the response to q by rule, which must be an
+// ActionNXDomain, ActionNoData or ActionLocalData rule.
+// If the local data is a CNAME, the CNAME is answered and its
+// target is returned. The caller should resolve the target and
+// append the result.
+func (z *Zone) Reply(q *dns.Msg, rule *Rule) (r *dns.Msg, cnameTarget string) {
+	r = new(dns.Msg)
+	r.SetReply(q)
+	question := q.Question[0]
+
+	switch rule.Action {
+	case ActionNXDomain:
+		r.Rcode = dns.RcodeNameError
+		r.Ns = append(r.Ns, z.negativeSOA())
+		return r, ""
+	case ActionNoData:
+		r.Ns = append(r.Ns, z.negativeSOA())
+		return r, ""
+	}
+
+	for _, rr := range rule.Data {
+		if question.Qtype == dns.TypeANY || rr.Header().Rrtype == question.Qtype {
+			r.Answer = append(r.Answer, withName(rr, question.Name))
+		}
+	}
+	if len(r.Answer) > 0 {
+		return r, ""
+	}
+	for _, rr := range rule.Data {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			target := cname.Target
+			if strings.HasPrefix(target, "*.") {
+				// Wildcard CNAME, e.g. "*.walled-garden.example." for
+				// "a.com." is "a.com.walled-garden.example.".
+				target = dns.Fqdn(question.Name) + target[2:]
+			}
+			cname = withName(cname, question.Name).(*dns.CNAME)
+			cname.Target = target
+			r.Answer = append(r.Answer, cname)
+			return r, target
+		}
+	}
+	r.Ns = append(r.Ns, z.negativeSOA())
+	return r, ""
+}
+
+func withName(rr dns.RR, name string) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = name
+	return rr
+}
+
+// negativeSOA returns the SOA of the policy zone for negative answers.
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// nameTable matches domain names and wildcards.
+type nameTable struct {
+	exact    map[string]*Rule
+	wildcard map[string]*Rule // key is the parent of "*".
+}
+
+func (t *nameTable) len() int {
+	return len(t.exact) + len(t.wildcard)
+}
+
+// add adds a relative name, e.g. "example.com" or "*.example.com".
+func (t *nameTable) add(rel string, rule *Rule) {
+	if t.exact == nil {
+		t.exact = make(map[string]*Rule)
+		t.wildcard = make(map[string]*Rule)
+	}
+	if rel == "*" {
+		t.wildcard["."] = rule
+		return
+	}
+	if parent, ok := strings.CutPrefix(rel, "*."); ok {
+		t.wildcard[parent+"."] = rule
+		return
+	}
+	t.exact[rel+"."] = rule
+}
+
+// match returns the rule of the exact name, or of the closest wildcard.
+// name must be canonical.
+func (t *nameTable) match(name string) *Rule {
+	if t.len() == 0 {
+		return nil
+	}
+	if r := t.exact[name]; r != nil {
+		return r
+	}
+	if name == "." {
+		return nil
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if r := t.wildcard[name[off:]]; r != nil {
+			return r
+		}
+	}
+	return t.wildcard["."]
+}
+
+// ipTable matches addresses by the longest prefix.
+type ipTable struct {
+	m    map[netip.Prefix]*Rule
+	bits []int // Prefix lengths in m, in descending order.
+}
+
+func (t *ipTable) len() int {
+	return len(t.m)
+}
+
+// addLabels adds a prefix in the reversed label form, e.g.
+// "24.0.2.0.192" for 192.0.2.0/24 and "64.zz.db8.2001" for 2001:db8::/64.
+func (t *ipTable) addLabels(s string, rule *Rule) error {
+	p, err := parsePrefixLabels(s)
+	if err != nil {
+		return err
+	}
+	if t.m == nil {
+		t.m = make(map[netip.Prefix]*Rule)
+	}
+	t.m[p] = rule
+	if !slices.Contains(t.bits, p.Bits()) {
+		t.bits = append(t.bits, p.Bits())
+		slices.SortFunc(t.bits, func(a, b int) int { return b - a })
+	}
+	return nil
+}
+
+func (t *ipTable) match(addr netip.Addr) *Rule {
+	if len(t.m) == 0 {
+		return nil
+	}
+	addr = addr.Unmap()
+	for _, bits := range t.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if r := t.m[p]; r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+func parsePrefixLabels(s string) (netip.Prefix, error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return netip.Prefix{}, fmt.Errorf("invalid ip trigger %s", s)
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix length %s", labels[0])
+	}
+	labels = labels[1:]
+	slices.Reverse(labels)
+
+	var addr netip.Addr
+	if len(labels) == 4 && !slices.Contains(labels, "zz") {
+		addr, err = netip.ParseAddr(strings.Join(labels, "."))
+	} else {
+		// "zz" is the "::".
+		var groups []string
+		for i, l := range labels {
+			if l != "zz" {
+				groups = append(groups, l)
+				continue
+			}
+			groups = append(groups, "")
+			if i == 0 {
+				groups = append(groups, "")
+			}
+			if i == len(labels)-1 {
+				groups = append(groups, "")
+			}
+		}
+		v6 := strings.Join(groups, ":")
+		addr, err = netip.ParseAddr(v6)
+		if err == nil && !addr.Is6() {
+			err = errors.New("not an ipv6 address")
+		}
+	}
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid ip trigger %s, %w", s, err)
+	}
+	p, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid ip trigger %s, %w", s, err)
+	}
+	if p.Addr() != addr {
+		return netip.Prefix{}, fmt.Errorf("invalid ip trigger %s, host bits are set", s)
+	}
+	return p, nil
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const testZone = `
+$ORIGIN rpz.test.
+$TTL 300
+@ SOA ns.rpz.test. admin.rpz.test. 1 3600 600 86400 60
+@ NS ns.rpz.test.
+
+nx.example.com       CNAME .
+*.nx.example.com     CNAME .
+nodata.example.com   CNAME *.
+ok.nx.example.com    CNAME rpz-passthru.
+legacy.nx.example.com CNAME legacy.nx.example.com.
+drop.example.com     CNAME rpz-drop.
+tcp.example.com      CNAME rpz-tcp-only.
+local.example.com    A    192.0.2.1
+local.example.com    AAAA 2001:db8::1
+cname.example.com    CNAME safe.example.net.
+wild.example.com     CNAME *.garden.example.net.
+
+32.1.2.0.192.rpz-client-ip    CNAME rpz-drop.
+24.0.2.0.192.rpz-client-ip    CNAME rpz-passthru.
+24.0.113.0.203.rpz-ip         CNAME .
+32.9.113.0.203.rpz-ip         A 192.0.2.80
+128.1.zz.db8.2001.rpz-ip      CNAME *.
+ns.evil.com.rpz-nsdname       CNAME .
+*.evil.net.rpz-nsdname        CNAME .
+32.10.100.51.198.rpz-nsip     CNAME .
+
+invalid.rpz-ip                CNAME .
+33.1.2.0.192.rpz-ip           CNAME .
+24.1.2.0.192.rpz-ip           CNAME .
+both.example.com     CNAME a.example.com.
+both.example.com     A    192.0.2.1
+`
+
+func newTestZone(t *testing.T) *Zone {
+	rrs, err := zone_file.ReadRecords(strings.NewReader(testZone))
+	require.NoError(t, err)
+	zs, others := zone_file.NewZones(rrs)
+	require.Empty(t, others)
+	zones := zs.All()
+	require.Len(t, zones, 1)
+	z, invalid := NewZone(zones[0].SOA(), zones[0].Records())
+	require.Len(t, invalid, 5)
+	require.Equal(t, "rpz.test.", z.Name())
+	return z
+}
+
+func TestZone_MatchQuery(t *testing.T) {
+	z := newTestZone(t)
+	tests := []struct {
+		qname   string
+		client  string
+		trigger Trigger
+		action  Action
+	}{
+		{"nx.example.com.", "", TriggerQName, ActionNXDomain},
+		{"NX.Example.com.", "", TriggerQName, ActionNXDomain},
+		{"a.b.nx.example.com.", "", TriggerQName, ActionNXDomain},
+		{"ok.nx.example.com.", "", TriggerQName, ActionPassthru},
+		{"legacy.nx.example.com.", "", TriggerQName, ActionPassthru},
+		{"nodata.example.com.", "", TriggerQName, ActionNoData},
+		{"drop.example.com.", "", TriggerQName, ActionDrop},
+		{"tcp.example.com.", "", TriggerQName, ActionTCPOnly},
+		{"local.example.com.", "", TriggerQName, ActionLocalData},
+		{"example.com.", "", 0, 0},
+		{"a.nodata.example.com.", "", 0, 0},
+		{"example.com.", "192.0.2.1", TriggerClientIP, ActionDrop},
+		{"nx.example.com.", "192.0.2.2", TriggerClientIP, ActionPassthru},
+		{"nx.example.com.", "::ffff:192.0.2.2", TriggerClientIP, ActionPassthru},
+		{"nx.example.com.", "192.0.3.1", TriggerQName, ActionNXDomain},
+	}
+	for _, tt := range tests {
+		var client netip.Addr
+		if len(tt.client) > 0 {
+			client = netip.MustParseAddr(tt.client)
+		}
+		rule := z.MatchQuery(tt.qname, client)
+		if tt.trigger == 0 {
+			require.Nil(t, rule, tt.qname)
+			continue
+		}
+		require.NotNil(t, rule, tt.qname)
+		require.Equal(t, tt.trigger, rule.Trigger, tt.qname)
+		require.Equal(t, tt.action, rule.Action, tt.qname)
+	}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
+
+func TestZone_MatchResponse(t *testing.T) {
+	z := newTestZone(t)
+	tests := []struct {
+		name    string
+		answer  []string
+		ns      []string
+		extra   []string
+		trigger Trigger
+		action  Action
+	}{
+		{"ip", []string{"a.com. A 203.0.113.1"}, nil, nil, TriggerIP, ActionNXDomain},
+		{"longest prefix", []string{"a.com. A 203.0.113.9"}, nil, nil, TriggerIP, ActionLocalData},
+		{"ipv6", []string{"a.com. AAAA 2001:db8::1"}, nil, nil, TriggerIP, ActionNoData},
+		{"no match", []string{"a.com. A 198.51.100.1"}, nil, nil, 0, 0},
+		{"cname target", []string{"a.com. CNAME x.nx.example.com.", "x.nx.example.com. A 198.51.100.1"}, nil, nil, TriggerQName, ActionNXDomain},
+		{"nsdname", nil, []string{"a.com. NS ns.evil.com."}, nil, TriggerNSDName, ActionNXDomain},
+		{"nsdname wildcard", nil, []string{"a.com. NS ns1.evil.net."}, nil, TriggerNSDName, ActionNXDomain},
+		{"nsip", nil, []string{"a.com. NS ns.a.com."}, []string{"ns.a.com. A 198.51.100.10"}, TriggerNSIP, ActionNXDomain},
+		{"nsip not glue", nil, nil, []string{"ns.a.com. A 198.51.100.10"}, 0, 0},
+		{"ip over nsdname", []string{"a.com. A 203.0.113.1"}, []string{"a.com. NS ns.evil.com."}, nil, TriggerIP, ActionNXDomain},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		for _, s := range tt.answer {
+			r.Answer = append(r.Answer, mustRR(t, s))
+		}
+		for _, s := range tt.ns {
+			r.Ns = append(r.Ns, mustRR(t, s))
+		}
+		for _, s := range tt.extra {
+			r.Extra = append(r.Extra, mustRR(t, s))
+		}
+		rule := z.MatchResponse(r)
+		if tt.trigger == 0 {
+			require.Nil(t, rule, tt.name)
+			continue
+		}
+		require.NotNil(t, rule, tt.name)
+		require.Equal(t, tt.trigger, rule.Trigger, tt.name)
+		require.Equal(t, tt.action, rule.Action, tt.name)
+	}
+}
+
+func TestZone_Reply(t *testing.T) {
+	z := newTestZone(t)
+	reply := func(qname string, qtype uint16) (*dns.Msg, string) {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion(qname, qtype)
+		rule := z.MatchQuery(qname, netip.Addr{})
+		require.NotNil(t, rule)
+		return z.Reply(q, rule)
+	}
+
+	r, target := reply("nx.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, r.Rcode)
+	require.Empty(t, target)
+	require.Len(t, r.Ns, 1)
+	require.EqualValues(t, 60, r.Ns[0].Header().Ttl)
+
+	r, _ = reply("nodata.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, r.Rcode)
+	require.Empty(t, r.Answer)
+	require.Len(t, r.Ns, 1)
+
+	r, _ = reply("Local.example.com.", dns.TypeA)
+	require.Len(t, r.Answer, 1)
+	require.Equal(t, "Local.example.com.", r.Answer[0].Header().Name)
+	require.True(t, r.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.1")))
+
+	r, _ = reply("local.example.com.", dns.TypeMX)
+	require.Empty(t, r.Answer)
+	require.Len(t, r.Ns, 1)
+
+	r, target = reply("cname.example.com.", dns.TypeA)
+	require.Equal(t, "safe.example.net.", target)
+	require.Len(t, r.Answer, 1)
+	require.Equal(t, "cname.example.com.", r.Answer[0].Header().Name)
+
+	r, target = reply("wild.example.com.", dns.TypeA)
+	require.Equal(t, "wild.example.com.garden.example.net.", target)
+	require.Equal(t, target, r.Answer[0].(*dns.CNAME).Target)
+}
+
+func Test_parsePrefixLabels(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"32.1.2.0.192", "192.0.2.1/32", false},
+		{"8.0.0.0.10", "10.0.0.0/8", false},
+		{"128.1.zz.db8.2001", "2001:db8::1/128", false},
+		{"128.1.zz", "::1/128", false},
+		{"32.zz.db8.2001", "2001:db8::/32", false},
+		{"0.zz", "::/0", false},
+		{"48.0.0.1.0.db8.2001", "", true}, // host bits set
+		{"33.1.2.0.192", "", true},
+		{"32.1.2.0", "", true},
+		{"a.1.2.0.192", "", true},
+	}
+	for _, tt := range tests {
+		p, err := parsePrefixLabels(tt.in)
+		if tt.wantErr {
+			require.Error(t, err, tt.in)
+			continue
+		}
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.want, p.String(), tt.in)
+	}
+}
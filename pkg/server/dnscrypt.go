@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// ServeDNSCryptUDP starts a DNSCrypt server at c. Encrypted queries are
+// decrypted with the certs in cm and passed to h. Plain queries are only
+// answered if they are cert queries.
+// It returns if c had a read error. It always returns a non-nil error.
+func ServeDNSCryptUDP(c *net.UDPConn, h Handler, cm *dnscrypt.CertManager, opts UDPServerOpts) error {
+	return serveUDP(c, dnscryptHandler(h, cm), opts)
+}
+
+// ServeDNSCryptTCP starts a DNSCrypt server at l. See ServeDNSCryptUDP.
+// It returns if l had an Accept() error. It always returns a non-nil error.
+func ServeDNSCryptTCP(l net.Listener, h Handler, cm *dnscrypt.CertManager, opts TCPServerOpts) error {
+	return serveTCP(l, dnscryptHandler(h, cm), opts)
+}
+
+// dnscryptHandler decrypts queries with the certs in cm, passes them to h
+// and encrypts the responses.
+func dnscryptHandler(h Handler, cm *dnscrypt.CertManager) packetHandler {
+	return func(ctx context.Context, b []byte, meta QueryMeta, logger *zap.Logger) *[]byte {
+		r := handleDNSCrypt(ctx, h, cm, b, meta, logger)
+		if r == nil {
+			return nil
+		}
+		if meta.FromUDP {
+			out := pool.GetBuf(len(r))
+			copy(*out, r)
+			return out
+		}
+		if len(r) > dns.MaxMsgSize {
+			logger.Warn("dnscrypt response is too large", zap.Int("size", len(r)))
+			return nil
+		}
+		out := pool.GetBuf(2 + len(r))
+		binary.BigEndian.PutUint16(*out, uint16(len(r)))
+		copy((*out)[2:], r)
+		return out
+	}
+}
+
+// handleDNSCrypt handles a packet from a client and returns the packet
+// that should be sent back. It returns nil if there is no response.
+func handleDNSCrypt(ctx context.Context, h Handler, cm *dnscrypt.CertManager, b []byte, meta QueryMeta, logger *zap.Logger) []byte {
+	if magic, ok := dnscrypt.ClientMagic(b); ok {
+		if c, sk, ok := cm.Key(magic); ok {
+			return handleEncryptedQuery(ctx, h, c, sk, b, meta, logger)
+		}
+	}
+
+	// Plain queries are for certs only.
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		return nil
+	}
+	r := cm.CertResponse(q)
+	if r == nil {
+		return nil
+	}
+	if meta.FromUDP {
+		r.Truncate(udpSize(q))
+	}
+	rb, err := r.Pack()
+	if err != nil {
+		logger.Error("failed to pack cert response", zap.Error(err))
+		return nil
+	}
+	return rb
+}
+
+func handleEncryptedQuery(ctx context.Context, h Handler, c dnscrypt.Construction, sk *[dnscrypt.KeySize]byte, b []byte, meta QueryMeta, logger *zap.Logger) []byte {
+	qb, key, nonce, err := dnscrypt.DecryptQuery(c, sk, b)
+	if err != nil {
+		logger.Debug("invalid dnscrypt query", zap.Stringer("from", meta.ClientAddr), zap.Error(err))
+		return nil
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(qb); err != nil {
+		logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", qb), zap.Stringer("from", meta.ClientAddr))
+		return nil
+	}
+
+	payload := h.Handle(ctx, q, meta, pool.PackBuffer)
+	if payload == nil {
+		return nil
+	}
+	defer pool.ReleaseBuf(payload)
+
+	// Udp responses must not be larger than the query.
+	maxSize := 0
+	if meta.FromUDP {
+		maxSize = len(b)
+	}
+	r, err := dnscrypt.EncryptResponse(c, &key, &nonce, *payload, maxSize)
+	if errors.Is(err, dnscrypt.ErrResponseTooLarge) {
+		tc := new(dns.Msg)
+		tc.SetReply(q)
+		tc.Truncated = true
+		tb, err := tc.Pack()
+		if err != nil {
+			return nil
+		}
+		r, err = dnscrypt.EncryptResponse(c, &key, &nonce, tb, 0)
+		if err != nil {
+			return nil
+		}
+		return r
+	}
+	if err != nil {
+		logger.Error("failed to encrypt response", zap.Error(err))
+		return nil
+	}
+	return r
+}
+
+func udpSize(q *dns.Msg) int {
+	if opt := q.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsstamp"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSCrypt(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	cm, err := dnscrypt.NewCertManager("example.com", sk, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, "2.dnscrypt-cert.example.com.", cm.ProviderName())
+
+	var bigMsg atomic.Bool
+	h := testHandler(func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if bigMsg.Load() {
+			for i := 0; i < 30; i++ {
+				r.Answer = append(r.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(10, 0, 0, byte(i)),
+				})
+			}
+		}
+		return r
+	})
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer uc.Close()
+	l, err := net.Listen("tcp", uc.LocalAddr().String())
+	require.NoError(t, err)
+	defer l.Close()
+	go ServeDNSCryptUDP(uc, h, cm, UDPServerOpts{})
+	go ServeDNSCryptTCP(l, h, cm, TCPServerOpts{})
+
+	stamp := &dnsstamp.Stamp{
+		Proto:        dnsstamp.ProtoDNSCrypt,
+		Addr:         uc.LocalAddr().String(),
+		ProviderPk:   pk,
+		ProviderName: cm.ProviderName(),
+	}
+	u, err := upstream.NewUpstream(stamp.String(), upstream.Opt{})
+	require.NoError(t, err)
+	defer u.Close()
+
+	exchange := func() *dns.Msg {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		b, err := q.Pack()
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		rb, err := u.ExchangeContext(ctx, b)
+		require.NoError(t, err)
+		r := new(dns.Msg)
+		require.NoError(t, r.Unpack(*rb))
+		require.Equal(t, q.Id, r.Id)
+		return r
+	}
+
+	r := exchange()
+	require.Empty(t, r.Answer)
+
+	// Large responses are truncated on udp and the client falls back to tcp.
+	bigMsg.Store(true)
+	r = exchange()
+	require.False(t, r.Truncated)
+	require.Len(t, r.Answer, 30)
+	bigMsg.Store(false)
+
+	// Connections with the previous certs still work after rotation.
+	require.NoError(t, cm.Rotate())
+	exchange()
+
+	// Cert queries.
+	q := new(dns.Msg)
+	q.SetQuestion(cm.ProviderName(), dns.TypeTXT)
+	c := &dns.Client{Net: "tcp"}
+	resp, _, err := c.Exchange(q, uc.LocalAddr().String())
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 4)
+	for _, rr := range resp.Answer {
+		_, err := dnscrypt.ParseCert(dnscrypt.DecodeTXT(rr.(*dns.TXT).Txt), pk)
+		require.NoError(t, err)
+	}
+	c = &dns.Client{Net: "udp"}
+	resp, _, err = c.Exchange(q, uc.LocalAddr().String())
+	require.NoError(t, err)
+	require.True(t, resp.Truncated, "cert response without edns0 should be truncated on udp")
+}
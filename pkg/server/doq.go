@@ -41,6 +41,9 @@ const (
 type DoQServerOpts struct {
 	Logger      *zap.Logger
 	IdleTimeout time.Duration
+
+	// ConnObserver observes accepted connections. Optional.
+	ConnObserver ConnObserver
 }
 
 // ServeDoQ starts a server at l. It returns if l had an Accept() error.
@@ -65,9 +68,15 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 
 		// handle connection
 		connCtx, cancelConn := context.WithCancelCause(listenerCtx)
+		if co := opts.ConnObserver; co != nil {
+			co.ConnOpened()
+		}
 		go func() {
 			defer c.CloseWithError(0, "")
 			defer cancelConn(errConnectionCtxCanceled)
+			if co := opts.ConnObserver; co != nil {
+				defer co.ConnClosed()
+			}
 
 			var clientAddr netip.Addr
 			ta, ok := c.RemoteAddr().(*net.UDPAddr)
@@ -104,9 +113,11 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 					if err != nil {
 						return
 					}
+					tlsState := c.ConnectionState().TLS
 					queryMeta := QueryMeta{
-						ClientAddr: clientAddr,
-						ServerName: c.ConnectionState().TLS.ServerName,
+						ClientAddr:        clientAddr,
+						ServerName:        tlsState.ServerName,
+						ClientCertSubject: ClientCertSubject(&tlsState),
 					}
 
 					resp := h.Handle(connCtx, req, queryMeta, pool.PackTCPBuffer)
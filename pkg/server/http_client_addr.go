@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// readClientAddr returns the client address of req. remote is the address
+// of the peer.
+// If the peer is trusted, the client address is read from the src ip header.
+// The header is walked from right to left, the first address that is
+// not trusted is the client.
+func (h *HttpHandler) readClientAddr(req *http.Request, remote netip.Addr) (netip.Addr, error) {
+	header := h.srcIPHeader
+	if len(header) == 0 {
+		return remote, nil
+	}
+	// Peers on unix sockets are always trusted.
+	if h.trustedProxies != nil && remote.IsValid() && !h.trustedProxies.Match(remote) {
+		return remote, nil
+	}
+	values := req.Header.Values(header)
+	if len(values) == 0 {
+		return remote, nil
+	}
+
+	var hops []string
+	var err error
+	if http.CanonicalHeaderKey(header) == "Forwarded" {
+		hops, err = readForwardedHops(values)
+	} else {
+		hops = readXFFHops(values)
+	}
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(hops) == 0 {
+		return remote, nil
+	}
+
+	if h.trustedProxies == nil {
+		// No trusted proxies configured. Trust the header from
+		// everyone. Use the first address.
+		return parseHopAddr(hops[0])
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		if len(hops[i]) == 0 {
+			// Unknown or obfuscated hop. The address reported
+			// by the last trusted hop is used.
+			break
+		}
+		addr, err := parseHopAddr(hops[i])
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		client = addr
+		if !h.trustedProxies.Match(addr) {
+			break
+		}
+	}
+	return client, nil
+}
+
+// readXFFHops splits X-Forwarded-For like headers.
+// e.g. "client, proxy1, proxy2".
+func readXFFHops(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				hops = append(hops, s)
+			}
+		}
+	}
+	return hops
+}
+
+// readForwardedHops reads the "for" parameters of RFC 7239 Forwarded
+// headers. e.g. `for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"`.
+// Unknown ("unknown"), obfuscated ("_hidden") and missing nodes are
+// returned as empty strings.
+func readForwardedHops(values []string) ([]string, error) {
+	var hops []string
+	for _, v := range values {
+		elems, err := splitQuoted(v, ',')
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range elems {
+			if len(strings.TrimSpace(elem)) == 0 {
+				continue
+			}
+			pairs, err := splitQuoted(elem, ';')
+			if err != nil {
+				return nil, err
+			}
+			var node string
+			for _, pair := range pairs {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(k, "for") {
+					continue
+				}
+				if strings.HasPrefix(v, `"`) {
+					if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+						return nil, fmt.Errorf("invalid quoted string %s", v)
+					}
+					v = strings.ReplaceAll(v[1:len(v)-1], `\`, "")
+				}
+				node = v
+			}
+			if strings.EqualFold(node, "unknown") || strings.HasPrefix(node, "_") {
+				node = ""
+			}
+			hops = append(hops, node)
+		}
+	}
+	return hops, nil
+}
+
+// splitQuoted splits s by sep that is not in a quoted string.
+func splitQuoted(s string, sep byte) ([]string, error) {
+	var ss []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && inQuote:
+			i++
+		case c == '"':
+			inQuote = !inQuote
+		case c == sep && !inQuote:
+			ss = append(ss, s[start:i])
+			start = i + 1
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quoted string")
+	}
+	return append(ss, s[start:]), nil
+}
+
+// parseHopAddr parses an ip, an ip:port or a [ipv6]:port (and [ipv6]).
+func parseHopAddr(s string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), nil
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		if addr, err := netip.ParseAddr(s[1 : len(s)-1]); err == nil {
+			return addr.Unmap(), nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("invalid address %s", s)
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HttpHandler_readClientAddr(t *testing.T) {
+	trusted := netlist.NewList()
+	for _, s := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		require.NoError(t, netlist.LoadFromText(trusted, s))
+	}
+	trusted.Sort()
+
+	tests := []struct {
+		name    string
+		header  string
+		trusted bool // use the trusted list
+		remote  string
+		values  []string
+		want    string
+		wantErr bool
+	}{
+		{"no header", "X-Forwarded-For", true, "10.0.0.1", nil, "10.0.0.1", false},
+		{"untrusted peer", "X-Forwarded-For", true, "1.1.1.1", []string{"2.2.2.2"}, "1.1.1.1", false},
+		{"xff", "X-Forwarded-For", true, "10.0.0.1", []string{"3.3.3.3, 2.2.2.2, 10.0.0.2"}, "2.2.2.2", false},
+		{"xff multi headers", "X-Forwarded-For", true, "10.0.0.1", []string{"3.3.3.3", "2.2.2.2, 10.0.0.2"}, "2.2.2.2", false},
+		{"xff all trusted", "X-Forwarded-For", true, "10.0.0.1", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3", false},
+		{"xff with port", "X-Forwarded-For", true, "10.0.0.1", []string{"[2001:db9::1]:53, 10.0.0.2:1234"}, "2001:db9::1", false},
+		{"xff invalid left of client", "X-Forwarded-For", true, "10.0.0.1", []string{"invalid, 2.2.2.2"}, "2.2.2.2", false},
+		{"xff invalid", "X-Forwarded-For", true, "10.0.0.1", []string{"2.2.2.2, invalid"}, "", true},
+		{"xff no trusted list", "X-Forwarded-For", false, "1.1.1.1", []string{"3.3.3.3, 2.2.2.2"}, "3.3.3.3", false},
+		{"x-real-ip", "X-Real-IP", true, "10.0.0.1", []string{"2.2.2.2"}, "2.2.2.2", false},
+		{"forwarded", "Forwarded", true, "10.0.0.1", []string{`for=3.3.3.3, for="[2001:db9::1]:4711";proto=https, for=10.0.0.2;by=10.0.0.1`}, "2001:db9::1", false},
+		{"forwarded case", "forwarded", true, "10.0.0.1", []string{`For=2.2.2.2;Proto=http`}, "2.2.2.2", false},
+		{"forwarded quoted", "Forwarded", true, "10.0.0.1", []string{`for="2.2.2.2";by="a,b;c"`}, "2.2.2.2", false},
+		{"forwarded unknown", "Forwarded", true, "10.0.0.1", []string{`for=unknown, for=10.0.0.2`}, "10.0.0.2", false},
+		{"forwarded obfuscated", "Forwarded", true, "10.0.0.1", []string{`for=_hidden`}, "10.0.0.1", false},
+		{"forwarded unterminated", "Forwarded", true, "10.0.0.1", []string{`for="2.2.2.2`}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := HttpHandlerOpts{GetSrcIPFromHeader: tt.header}
+			if tt.trusted {
+				opts.TrustedProxies = trusted
+			}
+			h := NewHttpHandler(nil, opts)
+			req := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			for _, v := range tt.values {
+				req.Header.Add(tt.header, v)
+			}
+			got, err := h.readClientAddr(req, netip.MustParseAddr(tt.remote))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got.String())
+		})
+	}
+}
@@ -26,8 +26,9 @@ import (
 	"io"
 	"net/http"
 	"net/netip"
-	"strings"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -35,18 +36,31 @@ import (
 
 type HttpHandlerOpts struct {
 	// GetSrcIPFromHeader specifies the header that contain client source address.
-	// e.g. "X-Forwarded-For".
+	// e.g. "X-Forwarded-For". "Forwarded" is parsed as RFC 7239.
 	GetSrcIPFromHeader string
 
+	// TrustedProxies matches the addresses of trusted proxies. If set, the
+	// src ip header is only read from trusted peers, and the client address
+	// is the rightmost address in the header that is not trusted.
+	// If nil, the first address in the header from any peer is used.
+	TrustedProxies netlist.Matcher
+
+	// ODoHKey enables Oblivious DoH (RFC 9230) target support. Requests
+	// with the "application/oblivious-dns-message" content type are
+	// decrypted with it.
+	ODoHKey *odoh.KeyPair
+
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
 }
 
 type HttpHandler struct {
-	dnsHandler  Handler
-	logger      *zap.Logger
-	srcIPHeader string
+	dnsHandler     Handler
+	logger         *zap.Logger
+	srcIPHeader    string
+	trustedProxies netlist.Matcher
+	odohKey        *odoh.KeyPair
 }
 
 var _ http.Handler = (*HttpHandler)(nil)
@@ -55,6 +69,8 @@ func NewHttpHandler(h Handler, opts HttpHandlerOpts) *HttpHandler {
 	hh := new(HttpHandler)
 	hh.dnsHandler = h
 	hh.srcIPHeader = opts.GetSrcIPFromHeader
+	hh.trustedProxies = opts.TrustedProxies
+	hh.odohKey = opts.ODoHKey
 	hh.logger = opts.Logger
 	if hh.logger == nil {
 		hh.logger = nopLogger
@@ -71,23 +87,28 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Just ignore it.
 	// https://github.com/IrineSistiana/mosdns/issues/830
 	addrPort, _ := netip.ParseAddrPort(req.RemoteAddr)
-	clientAddr := addrPort.Addr()
 
 	// read remote addr from header
-	if header := h.srcIPHeader; len(header) != 0 {
-		if xff := req.Header.Get(header); len(xff) != 0 {
-			addr, err := readClientAddrFromXFF(xff)
-			if err != nil {
-				h.warnErr(req, "failed to get client ip from header", fmt.Errorf("failed to prase header %s: %s, %s", header, xff, err))
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			clientAddr = addr
-		}
+	clientAddr, err := h.readClientAddr(req, addrPort.Addr())
+	if err != nil {
+		h.warnErr(req, "failed to get client ip from header", fmt.Errorf("failed to prase header %s, %w", h.srcIPHeader, err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if h.odohKey != nil && req.Method == http.MethodPost && req.Header.Get("Content-Type") == odoh.ContentType {
+		h.serveODoH(w, req, clientAddr)
+		return
 	}
 
 	// read msg
-	q, err := ReadMsgFromReq(req)
+	jsonReq := isJsonReq(req)
+	var q *dns.Msg
+	if jsonReq {
+		q, err = ReadMsgFromJsonReq(req)
+	} else {
+		q, err = ReadMsgFromReq(req)
+	}
 	if err != nil {
 		h.warnErr(req, "invalid request", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -102,6 +123,11 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	if tlsStat := req.TLS; tlsStat != nil {
 		queryMeta.ServerName = tlsStat.ServerName
+		queryMeta.ClientCertSubject = ClientCertSubject(tlsStat)
+	}
+	if jsonReq {
+		h.serveJson(w, req, q, queryMeta)
+		return
 	}
 	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, pool.PackBuffer)
 	if resp == nil {
@@ -116,11 +142,30 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func readClientAddrFromXFF(s string) (netip.Addr, error) {
-	if i := strings.IndexRune(s, ','); i > 0 {
-		return netip.ParseAddr(s[:i])
+func (h *HttpHandler) serveJson(w http.ResponseWriter, req *http.Request, q *dns.Msg, queryMeta QueryMeta) {
+	var r *dns.Msg
+	packAndKeep := func(m *dns.Msg) (*[]byte, error) {
+		r = m
+		return pool.PackBuffer(m)
+	}
+	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, packAndKeep)
+	if resp == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pool.ReleaseBuf(resp)
+
+	b, err := MarshalMsgToJson(r)
+	if err != nil {
+		h.warnErr(req, "failed to marshal json response", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType(req))
+	if _, err := w.Write(b); err != nil {
+		h.warnErr(req, "failed to write response", err)
+		return
 	}
-	return netip.ParseAddr(s)
 }
 
 var errInvalidMediaType = errors.New("missing or invalid media type header")
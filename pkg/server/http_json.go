@@ -0,0 +1,178 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// JSON api, a.k.a. application/dns-json.
+// See https://developers.google.com/speed/public-dns/docs/doh/json
+// and https://developers.cloudflare.com/1.1.1.1/encryption/dns-over-https/make-api-requests/dns-json/
+
+const (
+	mimeDnsJson = "application/dns-json"
+	mimeJson    = "application/json"
+)
+
+type jsonMsg struct {
+	Status     int            `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []jsonQuestion `json:"Question"`
+	Answer     []jsonRR       `json:"Answer,omitempty"`
+	Authority  []jsonRR       `json:"Authority,omitempty"`
+	Additional []jsonRR       `json:"Additional,omitempty"`
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// isJsonReq reports whether req is a JSON api request.
+// That is a GET request that has a "name" parameter or accepts application/dns-json.
+func isJsonReq(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	return req.Header.Get("Accept") == mimeDnsJson || req.URL.Query().Has("name")
+}
+
+// ReadMsgFromJsonReq reads a query from a JSON api request.
+// Supported parameters are "name", "type", "do" and "cd".
+func ReadMsgFromJsonReq(req *http.Request) (*dns.Msg, error) {
+	if req.Method != http.MethodGet {
+		return nil, fmt.Errorf("unsupported method: %s", req.Method)
+	}
+	params := req.URL.Query()
+
+	name := params.Get("name")
+	if len(name) == 0 {
+		return nil, errors.New("no name parameter")
+	}
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid name %s", name)
+	}
+
+	qtype := dns.TypeA
+	if s := params.Get("type"); len(s) > 0 {
+		if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if t, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+			qtype = t
+		} else {
+			return nil, fmt.Errorf("invalid type %s", s)
+		}
+	}
+
+	do, err := parseJsonBoolParam(params.Get("do"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid do parameter, %w", err)
+	}
+	cd, err := parseJsonBoolParam(params.Get("cd"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cd parameter, %w", err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.CheckingDisabled = cd
+	if do {
+		q.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return q, nil
+}
+
+// parseJsonBoolParam parses "", "0", "1", "false" and "true".
+func parseJsonBoolParam(s string) (bool, error) {
+	switch s {
+	case "", "0", "false":
+		return false, nil
+	case "1", "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid bool value %s", s)
+	}
+}
+
+// jsonContentType returns the content type of the JSON response.
+// Cloudflare style clients use "accept: application/dns-json".
+func jsonContentType(req *http.Request) string {
+	if req.Header.Get("Accept") == mimeDnsJson {
+		return mimeDnsJson
+	}
+	return mimeJson
+}
+
+// MarshalMsgToJson converts m to the JSON api format.
+// OPT records are omitted.
+func MarshalMsgToJson(m *dns.Msg) ([]byte, error) {
+	jm := jsonMsg{
+		Status:     m.Rcode,
+		TC:         m.Truncated,
+		RD:         m.RecursionDesired,
+		RA:         m.RecursionAvailable,
+		AD:         m.AuthenticatedData,
+		CD:         m.CheckingDisabled,
+		Question:   make([]jsonQuestion, 0, len(m.Question)),
+		Answer:     toJsonRRs(m.Answer),
+		Authority:  toJsonRRs(m.Ns),
+		Additional: toJsonRRs(m.Extra),
+	}
+	for _, q := range m.Question {
+		jm.Question = append(jm.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	return json.Marshal(jm)
+}
+
+func toJsonRRs(rrs []dns.RR) []jsonRR {
+	var s []jsonRR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		s = append(s, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return s
+}
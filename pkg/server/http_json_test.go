@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type testHandler func(q *dns.Msg) *dns.Msg
+
+func (f testHandler) Handle(_ context.Context, q *dns.Msg, _ QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	b, err := packMsgPayload(f(q))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func Test_HttpHandler_Json(t *testing.T) {
+	r := require.New(t)
+	var gotQ *dns.Msg
+	h := NewHttpHandler(testHandler(func(q *dns.Msg) *dns.Msg {
+		gotQ = q
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.AuthenticatedData = true
+		resp.Answer = append(resp.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300},
+			AAAA: net.ParseIP("2001:db8::1"),
+		})
+		resp.SetEdns0(1232, true)
+		return resp
+	}), HttpHandlerOpts{})
+
+	req := httptest.NewRequest(http.MethodGet, "/dns-query?name=example.com&type=AAAA&do=1&cd=true", nil)
+	req.Header.Set("Accept", "application/dns-json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal("application/dns-json", w.Header().Get("Content-Type"))
+
+	r.Equal("example.com.", gotQ.Question[0].Name)
+	r.Equal(dns.TypeAAAA, gotQ.Question[0].Qtype)
+	r.True(gotQ.CheckingDisabled)
+	r.True(gotQ.IsEdns0().Do())
+
+	var jm jsonMsg
+	r.NoError(json.Unmarshal(w.Body.Bytes(), &jm))
+	r.Equal(dns.RcodeSuccess, jm.Status)
+	r.True(jm.AD)
+	r.Equal([]jsonQuestion{{Name: "example.com.", Type: dns.TypeAAAA}}, jm.Question)
+	r.Equal([]jsonRR{{Name: "example.com.", Type: dns.TypeAAAA, TTL: 300, Data: "2001:db8::1"}}, jm.Answer)
+	r.Empty(jm.Additional) // OPT is omitted
+
+	// Google style request without accept header.
+	req = httptest.NewRequest(http.MethodGet, "/resolve?name=example.com", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal("application/json", w.Header().Get("Content-Type"))
+	r.Equal(dns.TypeA, gotQ.Question[0].Qtype)
+
+	for _, s := range []string{"type=NOTATYPE", "do=2", "cd=yes"} {
+		req = httptest.NewRequest(http.MethodGet, "/resolve?name=example.com&"+s, nil)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		r.Equal(http.StatusBadRequest, w.Code, s)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+// NewODoHConfigsHandler returns a handler that serves the configs of kp.
+// It should be registered at odoh.ConfigsPath.
+func NewODoHConfigsHandler(kp *odoh.KeyPair) http.Handler {
+	configs := kp.Configs()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write(configs)
+	})
+}
+
+// serveODoH serves an ODoH query. clientAddr is usually the relay's address.
+func (h *HttpHandler) serveODoH(w http.ResponseWriter, req *http.Request, clientAddr netip.Addr) {
+	buf := bufPool.Get()
+	defer bufPool.Release(buf)
+	if _, err := buf.ReadFrom(io.LimitReader(req.Body, dns.MaxMsgSize*2)); err != nil {
+		h.warnErr(req, "failed to read request body", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b, rc, err := h.odohKey.DecryptQuery(buf.Bytes())
+	if err != nil {
+		h.warnErr(req, "invalid odoh query", err)
+		if errors.Is(err, odoh.ErrUnknownKey) {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		h.warnErr(req, "invalid request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	queryMeta := QueryMeta{ClientAddr: clientAddr}
+	if u := req.URL; u != nil {
+		queryMeta.UrlPath = u.Path
+	}
+	if tlsStat := req.TLS; tlsStat != nil {
+		queryMeta.ServerName = tlsStat.ServerName
+		queryMeta.ClientCertSubject = ClientCertSubject(tlsStat)
+	}
+	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, pool.PackBuffer)
+	if resp == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer pool.ReleaseBuf(resp)
+
+	r, err := rc.EncryptResponse(*resp)
+	if err != nil {
+		h.warnErr(req, "failed to encrypt response", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", odoh.ContentType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	if _, err := w.Write(r); err != nil {
+		h.warnErr(req, "failed to write response", err)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestODoH(t *testing.T) {
+	h := testHandler(func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{"odoh"},
+		})
+		return r
+	})
+
+	type target struct {
+		configs http.Handler
+		dns     http.Handler
+	}
+	var current atomic.Pointer[target]
+	setKey := func() {
+		kp, err := odoh.GenerateKeyPair()
+		require.NoError(t, err)
+		current.Store(&target{
+			configs: NewODoHConfigsHandler(kp),
+			dns:     NewHttpHandler(h, HttpHandlerOpts{ODoHKey: kp}),
+		})
+	}
+	setKey()
+	targetServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tg := current.Load()
+		switch req.URL.Path {
+		case odoh.ConfigsPath:
+			tg.configs.ServeHTTP(w, req)
+		case "/dns-query":
+			tg.dns.ServeHTTP(w, req)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer targetServer.Close()
+
+	var relayed atomic.Int32
+	targetClient := targetServer.Client()
+	relayServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		relayed.Add(1)
+		if req.Header.Get("Content-Type") != odoh.ContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		u := url.URL{Scheme: "https", Host: req.URL.Query().Get("targethost"), Path: req.URL.Query().Get("targetpath")}
+		body, _ := io.ReadAll(req.Body)
+		resp, err := targetClient.Post(u.String(), odoh.ContentType, bytes.NewReader(body))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer relayServer.Close()
+
+	targetHost := strings.TrimPrefix(targetServer.URL, "https://")
+	addr := "odoh://" + targetHost + "/dns-query?relay=" + url.QueryEscape(relayServer.URL+"/proxy")
+	u, err := upstream.NewUpstream(addr, upstream.Opt{TLSConfig: &tls.Config{InsecureSkipVerify: true}})
+	require.NoError(t, err)
+	defer u.Close()
+
+	exchange := func() (*dns.Msg, error) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeTXT)
+		q.Id = 1234
+		b, err := q.Pack()
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		rb, err := u.ExchangeContext(ctx, b)
+		if err != nil {
+			return nil, err
+		}
+		r := new(dns.Msg)
+		require.NoError(t, r.Unpack(*rb))
+		return r, nil
+	}
+
+	r, err := exchange()
+	require.NoError(t, err)
+	require.Equal(t, uint16(1234), r.Id)
+	require.Equal(t, []string{"odoh"}, r.Answer[0].(*dns.TXT).Txt)
+	require.Equal(t, int32(1), relayed.Load())
+
+	// The target rotates its key. The first query is rejected and the
+	// client refetches the config.
+	setKey()
+	_, err = exchange()
+	require.Error(t, err)
+	_, err = exchange()
+	require.NoError(t, err)
+	require.Equal(t, int32(3), relayed.Load())
+
+	// Plain DoH queries are still served.
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	b, _ := q.Pack()
+	resp, err := targetClient.Post(targetServer.URL+"/dns-query", "application/dns-message", bytes.NewReader(b))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
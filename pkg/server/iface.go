@@ -19,6 +19,13 @@ type Handler interface {
 	Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) (respPayload *[]byte)
 }
 
+// ConnObserver observes the connections of a server. Methods must be
+// concurrency safe.
+type ConnObserver interface {
+	ConnOpened()
+	ConnClosed()
+}
+
 type QueryMeta struct {
 	FromUDP bool
 
@@ -26,4 +33,8 @@ type QueryMeta struct {
 	ClientAddr netip.Addr
 	ServerName string
 	UrlPath    string
+
+	// ClientCertSubject is the subject of the verified tls client
+	// certificate. e.g. "CN=client,O=example".
+	ClientCertSubject string
 }
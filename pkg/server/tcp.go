@@ -43,11 +43,18 @@ type TCPServerOpts struct {
 
 	// Default is defaultTCPIdleTimeout.
 	IdleTimeout time.Duration
+
+	// ConnObserver observes accepted connections. Optional.
+	ConnObserver ConnObserver
 }
 
 // ServeTCP starts a server at l. It returns if l had an Accept() error.
 // It always returns a non-nil error.
 func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
+	return serveTCP(l, plainHandler(h), opts)
+}
+
+func serveTCP(l net.Listener, h packetHandler, opts TCPServerOpts) error {
 	logger := opts.Logger
 	if logger == nil {
 		logger = nopLogger
@@ -71,9 +78,15 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 
 		// handle connection
 		tcpConnCtx, cancelConn := context.WithCancelCause(listenerCtx)
+		if co := opts.ConnObserver; co != nil {
+			co.ConnOpened()
+		}
 		go func() {
 			defer c.Close()
 			defer cancelConn(errConnectionCtxCanceled)
+			if co := opts.ConnObserver; co != nil {
+				defer co.ConnClosed()
+			}
 
 			firstRead := true
 			for {
@@ -83,25 +96,28 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 				} else {
 					c.SetReadDeadline(time.Now().Add(idleTimeout))
 				}
-				req, _, err := dnsutils.ReadMsgFromTCP(c)
+				b, err := dnsutils.ReadRawMsgFromTCP(c)
 				if err != nil {
 					return // read err, close the connection
 				}
 
-				// Try to get server name from tls conn.
-				var serverName string
+				// Try to get server name and client cert from tls conn.
+				var serverName, clientCertSubject string
 				if tlsConn, ok := c.(*tls.Conn); ok {
-					serverName = tlsConn.ConnectionState().ServerName
+					cs := tlsConn.ConnectionState()
+					serverName = cs.ServerName
+					clientCertSubject = ClientCertSubject(&cs)
 				}
 
 				// handle query
 				go func() {
+					defer pool.ReleaseBuf(b)
 					var clientAddr netip.Addr
 					ta, ok := c.RemoteAddr().(*net.TCPAddr)
 					if ok {
 						clientAddr = ta.AddrPort().Addr()
 					}
-					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName}, pool.PackTCPBuffer)
+					r := h(tcpConnCtx, *b, QueryMeta{ClientAddr: clientAddr, ServerName: serverName, ClientCertSubject: clientCertSubject}, logger)
 					if r == nil {
 						c.Close() // abort the connection
 						return
@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type countingConnObserver struct {
+	opened, closed atomic.Int64
+}
+
+func (o *countingConnObserver) ConnOpened() { o.opened.Add(1) }
+func (o *countingConnObserver) ConnClosed() { o.closed.Add(1) }
+
+func TestServeTCP_ConnObserver(t *testing.T) {
+	h := testHandler(func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		return r
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	o := new(countingConnObserver)
+	go ServeTCP(l, h, TCPServerOpts{ConnObserver: o})
+
+	c, err := dns.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	require.NoError(t, c.WriteMsg(q))
+	_, err = c.ReadMsg()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, o.opened.Load())
+	require.EqualValues(t, 0, o.closed.Load())
+
+	require.NoError(t, c.Close())
+	require.Eventually(t, func() bool { return o.closed.Load() == 1 }, time.Second, time.Millisecond*10)
+}
@@ -21,6 +21,12 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 )
 
 func LoadCert(tlsCfg *tls.Config, cert, key string) error {
@@ -31,3 +37,115 @@ func LoadCert(tlsCfg *tls.Config, cert, key string) error {
 	tlsCfg.Certificates = []tls.Certificate{c}
 	return nil
 }
+
+// CertKeyPair is a pair of PEM encoded certificate and key files.
+type CertKeyPair struct {
+	Cert string
+	Key  string
+}
+
+// CertStore holds server certificates and an optional client CA pool.
+// Both can be replaced by Load while the listeners are running.
+type CertStore struct {
+	certs     atomic.Pointer[[]tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+// Load reads certificates from pairs and, if clientCA is not empty, the
+// client CA pool. The store is only updated if all files are loaded.
+func (s *CertStore) Load(pairs []CertKeyPair, clientCA string) error {
+	if len(pairs) == 0 {
+		return errors.New("no certificate")
+	}
+	certs := make([]tls.Certificate, 0, len(pairs))
+	for _, p := range pairs {
+		c, err := tls.LoadX509KeyPair(p.Cert, p.Key)
+		if err != nil {
+			return fmt.Errorf("failed to load cert %s, %w", p.Cert, err)
+		}
+		certs = append(certs, c)
+	}
+
+	var pool *x509.CertPool
+	if len(clientCA) > 0 {
+		var err error
+		pool, err = utils.LoadCertPool([]string{clientCA})
+		if err != nil {
+			return fmt.Errorf("failed to load client ca, %w", err)
+		}
+	}
+
+	s.certs.Store(&certs)
+	if pool != nil {
+		s.clientCAs.Store(pool)
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. The first certificate
+// that supports the client hello (e.g. matches its SNI) is selected. If none
+// matches, the first certificate is returned.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p := s.certs.Load()
+	if p == nil || len(*p) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	certs := *p
+	if len(certs) > 1 {
+		for i := range certs {
+			if hello.SupportsCertificate(&certs[i]) == nil {
+				return &certs[i], nil
+			}
+		}
+	}
+	return &certs[0], nil
+}
+
+// VerifyClientCert verifies the client certificate chain in cs against the
+// client CA pool. Connections without a client certificate are accepted.
+// It is a noop if the store has no client CA.
+func (s *CertStore) VerifyClientCert(cs tls.ConnectionState) error {
+	pool := s.clientCAs.Load()
+	if pool == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// TLSConfig returns a tls.Config that serves certificates from s.
+// If the store has a client CA, client certificates are requested and
+// verified. requireClientCert specifies whether a client certificate
+// is mandatory.
+func (s *CertStore) TLSConfig(requireClientCert bool) *tls.Config {
+	tc := &tls.Config{
+		GetCertificate: s.GetCertificate,
+	}
+	if s.clientCAs.Load() != nil {
+		// Chains are verified by VerifyClientCert so that
+		// the CA pool can be reloaded.
+		tc.ClientAuth = tls.RequestClientCert
+		if requireClientCert {
+			tc.ClientAuth = tls.RequireAnyClientCert
+		}
+		tc.VerifyConnection = s.VerifyClientCert
+	}
+	return tc
+}
+
+// ClientCertSubject returns the subject of the client certificate in cs.
+// It returns an empty string if the client did not send a certificate.
+func ClientCertSubject(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	return cs.PeerCertificates[0].Subject.String()
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type metaHandler func(q *dns.Msg, meta QueryMeta) *dns.Msg
+
+func (f metaHandler) Handle(_ context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	b, err := packMsgPayload(f(q, meta))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a pem encoded cert and key signed by ca.
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames []string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"mosdns"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+}
+
+func (ca *testCA) clientCert(t *testing.T, cn string) tls.Certificate {
+	certPEM, keyPEM := ca.issue(t, cn, nil, x509.ExtKeyUsageClientAuth)
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return c
+}
+
+func writeFile(t *testing.T, name string, b []byte) string {
+	require.NoError(t, os.WriteFile(name, b, 0600))
+	return name
+}
+
+func TestCertStore(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	ca := newTestCA(t)
+
+	var pairs []CertKeyPair
+	for _, name := range []string{"a.test", "b.test"} {
+		certPEM, keyPEM := ca.issue(t, name, []string{name}, x509.ExtKeyUsageServerAuth)
+		pairs = append(pairs, CertKeyPair{
+			Cert: writeFile(t, filepath.Join(dir, name+".crt"), certPEM),
+			Key:  writeFile(t, filepath.Join(dir, name+".key"), keyPEM),
+		})
+	}
+	clientCA := writeFile(t, filepath.Join(dir, "ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+
+	store := new(CertStore)
+	r.Error(store.Load(nil, ""))
+	r.NoError(store.Load(pairs, clientCA))
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", store.TLSConfig(true))
+	r.NoError(err)
+	defer l.Close()
+	metaChan := make(chan QueryMeta, 1)
+	h := metaHandler(func(q *dns.Msg, meta QueryMeta) *dns.Msg {
+		metaChan <- meta
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		return resp
+	})
+	go ServeTCP(l, h, TCPServerOpts{})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	exchange := func(serverName string, clientCert *tls.Certificate) (*x509.Certificate, QueryMeta, error) {
+		t.Helper()
+		tc := &tls.Config{ServerName: serverName, RootCAs: roots}
+		if clientCert != nil {
+			tc.Certificates = []tls.Certificate{*clientCert}
+		}
+		c, err := tls.Dial("tcp", l.Addr().String(), tc)
+		if err != nil {
+			return nil, QueryMeta{}, err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second * 5))
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if _, err := dnsutils.WriteMsgToTCP(c, q); err != nil {
+			return nil, QueryMeta{}, err
+		}
+		if _, _, err := dnsutils.ReadMsgFromTCP(c); err != nil {
+			return nil, QueryMeta{}, err
+		}
+		return c.ConnectionState().PeerCertificates[0], <-metaChan, nil
+	}
+
+	// Certificates are selected by sni.
+	clientCert := ca.clientCert(t, "client")
+	for _, name := range []string{"a.test", "b.test"} {
+		leaf, meta, err := exchange(name, &clientCert)
+		r.NoError(err)
+		r.Equal(name, leaf.Subject.CommonName)
+		r.Equal(name, meta.ServerName)
+		r.Equal("CN=client,O=mosdns", meta.ClientCertSubject)
+	}
+
+	// Client cert is required and must be signed by the client ca.
+	_, _, err = exchange("a.test", nil)
+	r.Error(err)
+	otherCert := newTestCA(t).clientCert(t, "other")
+	_, _, err = exchange("a.test", &otherCert)
+	r.Error(err)
+
+	// Reload.
+	certPEM, keyPEM := ca.issue(t, "a.test.new", []string{"a.test"}, x509.ExtKeyUsageServerAuth)
+	writeFile(t, pairs[0].Cert, certPEM)
+	writeFile(t, pairs[0].Key, keyPEM)
+	r.NoError(store.Load(pairs, clientCA))
+	leaf, _, err := exchange("a.test", &clientCert)
+	r.NoError(err)
+	r.Equal("a.test.new", leaf.Subject.CommonName)
+
+	// A failed reload keeps the old certificates.
+	writeFile(t, pairs[0].Key, []byte("invalid"))
+	r.Error(store.Load(pairs, clientCA))
+	leaf, _, err = exchange("a.test", &clientCert)
+	r.NoError(err)
+	r.Equal("a.test.new", leaf.Subject.CommonName)
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -33,10 +34,34 @@ type UDPServerOpts struct {
 	Logger *zap.Logger
 }
 
+// packetHandler handles the query packet b and returns the response.
+// If meta.FromUDP is false, the response must have the two byte length
+// prefix. It returns nil if there is no response.
+type packetHandler func(ctx context.Context, b []byte, meta QueryMeta, logger *zap.Logger) *[]byte
+
+// plainHandler unpacks plain dns queries and passes them to h.
+func plainHandler(h Handler) packetHandler {
+	return func(ctx context.Context, b []byte, meta QueryMeta, logger *zap.Logger) *[]byte {
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil {
+			logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", b), zap.Stringer("from", meta.ClientAddr))
+			return nil
+		}
+		if meta.FromUDP {
+			return h.Handle(ctx, q, meta, pool.PackBuffer)
+		}
+		return h.Handle(ctx, q, meta, pool.PackTCPBuffer)
+	}
+}
+
 // ServeUDP starts a server at c. It returns if c had a read error.
 // It always returns a non-nil error.
 // h is required. logger is optional.
 func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
+	return serveUDP(c, plainHandler(h), opts)
+}
+
+func serveUDP(c *net.UDPConn, h packetHandler, opts UDPServerOpts) error {
 	logger := opts.Logger
 	if logger == nil {
 		logger = nopLogger
@@ -71,11 +96,11 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 			continue
 		}
 
-		q := new(dns.Msg)
-		if err := q.Unpack((*rb)[:n]); err != nil {
-			logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", (*rb)[:n]), zap.Stringer("from", remoteAddr))
+		if n < dnsutils.DnsHeaderLen {
 			continue
 		}
+		b := pool.GetBuf(n)
+		copy(*b, *rb)
 
 		var dstIpFromCm net.IP
 		if oobReader != nil {
@@ -88,7 +113,8 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 
 		// handle query
 		go func() {
-			payload := h.Handle(listenerCtx, q, QueryMeta{ClientAddr: remoteAddr.Addr(), FromUDP: true}, pool.PackBuffer)
+			defer pool.ReleaseBuf(b)
+			payload := h(listenerCtx, *b, QueryMeta{ClientAddr: remoteAddr.Addr(), FromUDP: true}, logger)
 			if payload == nil {
 				return
 			}
@@ -21,14 +21,18 @@ package server_handler
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -60,6 +64,10 @@ type EntryHandlerOpts struct {
 	// QueryTimeout limits the timeout value of each query.
 	// Default is defaultQueryTimeout.
 	QueryTimeout time.Duration
+
+	// MetricsLabels are the const labels of the handler metrics. They
+	// should identify the handler, e.g. the server tag and the protocol.
+	MetricsLabels prometheus.Labels
 }
 
 func (opts *EntryHandlerOpts) init() {
@@ -70,40 +78,88 @@ func (opts *EntryHandlerOpts) init() {
 }
 
 type EntryHandler struct {
-	opts EntryHandlerOpts
+	opts    EntryHandlerOpts
+	entry   atomic.Pointer[sequence.Executable]
+	metrics *handlerMetrics
 }
 
 var _ server.Handler = (*EntryHandler)(nil)
 
 func NewEntryHandler(opts EntryHandlerOpts) *EntryHandler {
 	opts.init()
-	return &EntryHandler{opts: opts}
+	h := &EntryHandler{opts: opts, metrics: newHandlerMetrics(opts.MetricsLabels)}
+	h.entry.Store(&opts.Entry)
+	return h
+}
+
+// RegMetricsTo registers the handler metrics to r.
+func (h *EntryHandler) RegMetricsTo(r prometheus.Registerer) error {
+	for _, collector := range h.metrics.collectors() {
+		if err := r.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetEntry replaces the entry. Queries that are being handled
+// keep using the old one. It is concurrent safe.
+func (h *EntryHandler) SetEntry(e sequence.Executable) {
+	h.entry.Store(&e)
 }
 
 // ServeDNS implements server.Handler.
 // If entry returns an error, a SERVFAIL response will be returned.
 // If entry returns without a response, a REFUSED response will be returned.
+// If entry drops the query, no response will be returned.
 func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
 	// basic query check.
-	if q.Response || len(q.Question) != 1 || len(q.Answer)+len(q.Ns) > 0 || len(q.Extra) > 1 {
+	if q.Response || len(q.Question) != 1 {
+		return nil
+	}
+	// NOTIFY may carry the SOA in the answer section (RFC 1996 3.7)
+	// and OPT+TSIG in the additional section.
+	if q.Opcode != dns.OpcodeNotify && (len(q.Answer)+len(q.Ns) > 0 || len(q.Extra) > 1) {
 		return nil
 	}
 
-	ddl := time.Now().Add(h.opts.QueryTimeout)
+	h.metrics.inflight.Inc()
+	defer h.metrics.inflight.Dec()
+	start := time.Now()
+
+	ddl := start.Add(h.opts.QueryTimeout)
 	ctx, cancel := context.WithDeadline(ctx, ddl)
 	defer cancel()
 
+	ctx, span := tracing.StartRoot(ctx, "query")
+	defer span.End()
+	if span != nil {
+		span.SetAttributes(
+			tracing.String("dns.question.name", q.Question[0].Name),
+			tracing.String("dns.question.type", dnsutils.QtypeLabel(q.Question[0].Qtype)),
+			tracing.String("client.address", serverMeta.ClientAddr.String()),
+		)
+		for k, v := range h.opts.MetricsLabels {
+			span.SetAttributes(tracing.String("server."+k, v))
+		}
+	}
+
 	qCtx := query_context.NewContext(q)
 	qCtx.ServerMeta = serverMeta
 
 	// exec entry
-	err := h.opts.Entry.Exec(ctx, qCtx)
+	err := (*h.entry.Load()).Exec(ctx, qCtx)
 	var resp *dns.Msg
 	if err != nil {
 		h.opts.Logger.Warn("entry err", qCtx.InfoField(), zap.Error(err))
+		span.SetError(err)
 		resp = new(dns.Msg)
 		resp.SetReply(q)
 		resp.Rcode = dns.RcodeServerFailure
+	} else if qCtx.Dropped() {
+		h.metrics.droppedTotal.Inc()
+		span.SetAttributes(tracing.Bool("dns.dropped", true))
+		return nil
 	} else {
 		resp = qCtx.R()
 	}
@@ -131,6 +187,15 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		h.opts.Logger.Error("internal err: failed to pack resp msg", qCtx.InfoField(), zap.Error(err))
 		return nil
 	}
+	if span != nil {
+		span.SetAttributes(tracing.String("dns.response.code", dnsutils.RcodeLabel(resp.Rcode)))
+	}
+	h.metrics.queryTotal.WithLabelValues(dnsutils.QtypeLabel(q.Question[0].Qtype), dnsutils.RcodeLabel(resp.Rcode)).Inc()
+	if resp.Truncated {
+		h.metrics.truncatedTotal.Inc()
+	}
+	h.metrics.responseSize.Observe(float64(len(*payload)))
+	h.metrics.responseLatency.Observe(float64(time.Since(start).Milliseconds()))
 	return payload
 }
 
@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EntryHandler_metrics(t *testing.T) {
+	entry := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		q := qCtx.Q()
+		switch q.Question[0].Name {
+		case "drop.":
+			qCtx.Drop()
+		case "big.":
+			r := new(dns.Msg)
+			r.SetReply(q)
+			for i := 0; i < 100; i++ {
+				r.Answer = append(r.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.IPv4(192, 0, 2, byte(i)),
+				})
+			}
+			qCtx.SetResponse(r)
+		default:
+			r := new(dns.Msg)
+			r.SetRcode(q, dns.RcodeNameError)
+			qCtx.SetResponse(r)
+		}
+		return nil
+	})
+	h := NewEntryHandler(EntryHandlerOpts{Entry: entry, MetricsLabels: prometheus.Labels{"tag": "test"}})
+	reg := prometheus.NewRegistry()
+	require.NoError(t, h.RegMetricsTo(reg))
+
+	query := func(name string, qtype uint16) *[]byte {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		return h.Handle(context.Background(), q, server.QueryMeta{FromUDP: true}, pool.PackBuffer)
+	}
+	require.NotNil(t, query("example.", dns.TypeA))
+	require.NotNil(t, query("example.", 65000)) // unknown qtype
+	require.Nil(t, query("drop.", dns.TypeA))
+	require.NotNil(t, query("big.", dns.TypeA))
+
+	m := h.metrics
+	require.Equal(t, 1.0, testutil.ToFloat64(m.queryTotal.WithLabelValues("A", "NXDOMAIN")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.queryTotal.WithLabelValues("other", "NXDOMAIN")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.queryTotal.WithLabelValues("A", "NOERROR")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.droppedTotal))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.truncatedTotal))
+	require.Equal(t, 0.0, testutil.ToFloat64(m.inflight))
+	require.Equal(t, 3+5, testutil.CollectAndCount(reg)) // 3 query_total series and 5 others
+}
+
+func Test_EntryHandler_tracing(t *testing.T) {
+	e := tracing.NewInMemoryExporter()
+	tracer := tracing.NewTracer(e, tracing.Opts{Sync: true})
+	tracing.SetDefault(tracer)
+	defer tracing.SetDefault(nil)
+
+	chain := sequence.NewChainWalker([]*sequence.ChainNode{{
+		Name: "main#0: reply",
+		E: sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+			r := new(dns.Msg)
+			r.SetRcode(qCtx.Q(), dns.RcodeNameError)
+			qCtx.SetResponse(r)
+			return nil
+		}),
+	}}, nil)
+	entry := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		return chain.ExecNext(ctx, qCtx)
+	})
+	h := NewEntryHandler(EntryHandlerOpts{Entry: entry, MetricsLabels: prometheus.Labels{"tag": "test"}})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	require.NotNil(t, h.Handle(context.Background(), q, server.QueryMeta{}, pool.PackBuffer))
+	require.NoError(t, tracer.Close())
+
+	spans := e.Spans()
+	require.Len(t, spans, 2)
+	node, root := spans[0], spans[1]
+	require.Equal(t, "query", root.Name)
+	require.Contains(t, root.Attributes, tracing.String("dns.question.name", "example."))
+	require.Contains(t, root.Attributes, tracing.String("dns.response.code", "NXDOMAIN"))
+	require.Contains(t, root.Attributes, tracing.String("server.tag", "test"))
+	require.Equal(t, "sequence.node", node.Name)
+	require.Equal(t, root.SpanID, node.ParentSpanID)
+	require.Contains(t, node.Attributes, tracing.String("sequence.node", "main#0: reply"))
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type handlerMetrics struct {
+	queryTotal      *prometheus.CounterVec // labels: qtype, rcode
+	droppedTotal    prometheus.Counter
+	truncatedTotal  prometheus.Counter
+	inflight        prometheus.Gauge
+	responseSize    prometheus.Histogram
+	responseLatency prometheus.Histogram
+}
+
+func newHandlerMetrics(lb prometheus.Labels) *handlerMetrics {
+	return &handlerMetrics{
+		queryTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "query_total",
+			Help:        "The total number of queries that were responded, by qtype and rcode",
+			ConstLabels: lb,
+		}, []string{"qtype", "rcode"}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "dropped_total",
+			Help:        "The total number of queries that were dropped without a response",
+			ConstLabels: lb,
+		}),
+		truncatedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "truncated_total",
+			Help:        "The total number of responses with the TC bit",
+			ConstLabels: lb,
+		}),
+		inflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "inflight",
+			Help:        "The number of queries that are currently being processed",
+			ConstLabels: lb,
+		}),
+		responseSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "response_size_bytes",
+			Help:        "The size of response payloads in bytes",
+			Buckets:     []float64{64, 128, 256, 512, 1232, 1472, 2048, 4096, 8192, 16384, 65535},
+			ConstLabels: lb,
+		}),
+		responseLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "response_latency_millisecond",
+			Help:        "The response latency in millisecond",
+			Buckets:     []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
+			ConstLabels: lb,
+		}),
+	}
+}
+
+func (m *handlerMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.queryTotal, m.droppedTotal, m.truncatedTotal, m.inflight, m.responseSize, m.responseLatency}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const instrumentationScope = "github.com/IrineSistiana/mosdns"
+
+type OTLPOpts struct {
+	// Endpoint is the OTLP/HTTP traces url, e.g.
+	// "http://127.0.0.1:4318/v1/traces". Required.
+	Endpoint string
+	// Headers are added to the export requests, e.g. for authentication.
+	Headers map[string]string
+	// ServiceName is the "service.name" resource attribute.
+	// Default is "mosdns".
+	ServiceName string
+	// Client is the http client. Default is http.DefaultClient.
+	Client *http.Client
+}
+
+// OTLPExporter exports spans to an OTLP/HTTP collector with the JSON
+// encoding.
+type OTLPExporter struct {
+	opts OTLPOpts
+}
+
+var _ Exporter = (*OTLPExporter)(nil)
+
+func NewOTLPExporter(opts OTLPOpts) (*OTLPExporter, error) {
+	if len(opts.Endpoint) == 0 {
+		return nil, errors.New("missing endpoint")
+	}
+	if len(opts.ServiceName) == 0 {
+		opts.ServiceName = "mosdns"
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	return &OTLPExporter{opts: opts}, nil
+}
+
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	b, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.opts.Endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("bad http status code %d with body [%s]", resp.StatusCode, body)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown(context.Context) error { return nil }
+
+// The types below are the OTLP JSON encoding of
+// opentelemetry.proto.collector.trace.v1.ExportTraceServiceRequest.
+// Ids are hex strings and 64-bit integers are decimal strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *OTLPExporter) request(spans []SpanData) *otlpRequest {
+	ss := make([]otlpSpan, 0, len(spans))
+	for _, d := range spans {
+		s := otlpSpan{
+			TraceID:           d.TraceID.String(),
+			SpanID:            d.SpanID.String(),
+			Name:              d.Name,
+			Kind:              d.Kind,
+			StartTimeUnixNano: strconv.FormatInt(d.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(d.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(d.Attributes),
+			Status:            otlpStatus{Code: d.StatusCode, Message: d.StatusMessage},
+		}
+		if d.ParentSpanID.IsValid() {
+			s.ParentSpanID = d.ParentSpanID.String()
+		}
+		ss = append(ss, s)
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{String("service.name", e.opts.ServiceName)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: instrumentationScope}, Spans: ss}},
+	}}}
+}
+
+func otlpAttributes(attrs []Attribute) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch x := a.Value.(type) {
+		case string:
+			v.StringValue = &x
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &x
+		case float64:
+			v.DoubleValue = &x
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: a.Key, Value: v})
+	}
+	return out
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tracing
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultQueueSize    = 4096
+	defaultBatchSize    = 512
+	defaultBatchTimeout = 5 * time.Second
+	exportTimeout       = 10 * time.Second
+)
+
+// Exporter exports finished spans.
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+type Opts struct {
+	// SampleRatio is the ratio of root spans that are sampled.
+	// Values <= 0 or > 1 mean 1, all roots are sampled.
+	SampleRatio float64
+
+	// Sync exports every span when it ends, instead of in batches.
+	// It is meant for tests.
+	Sync bool
+
+	// QueueSize is the max number of spans that are waiting to be
+	// exported. Spans are dropped if the queue is full. Default is 4096.
+	QueueSize int
+	// BatchSize is the max number of spans in an export. Default is 512.
+	BatchSize int
+	// BatchTimeout is the max delay of an export. Default is 5s.
+	BatchTimeout time.Duration
+
+	// Logger is used to log export errors. Default is a nop logger.
+	Logger *zap.Logger
+}
+
+// Tracer creates spans and exports them with an Exporter.
+type Tracer struct {
+	e    Exporter
+	opts Opts
+
+	ch      chan SpanData // Nil if opts.Sync.
+	dropped atomic.Uint64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+func NewTracer(e Exporter, opts Opts) *Tracer {
+	if opts.SampleRatio <= 0 || opts.SampleRatio > 1 {
+		opts.SampleRatio = 1
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.BatchTimeout <= 0 {
+		opts.BatchTimeout = defaultBatchTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	t := &Tracer{
+		e:      e,
+		opts:   opts,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if opts.Sync {
+		close(t.done)
+	} else {
+		t.ch = make(chan SpanData, opts.QueueSize)
+		go t.exportLoop()
+	}
+	return t
+}
+
+// StartRoot starts a root span of a new trace, if it is sampled.
+// Otherwise, it returns ctx and a nil span.
+func (t *Tracer) StartRoot(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	if t.opts.SampleRatio < 1 && rand.Float64() >= t.opts.SampleRatio {
+		return ctx, nil
+	}
+	s := t.newSpan(name, SpanKindServer, newTraceID(), SpanID{}, attrs)
+	return ContextWithSpan(ctx, s), s
+}
+
+func (t *Tracer) newSpan(name string, kind SpanKind, traceID TraceID, parent SpanID, attrs []Attribute) *Span {
+	return &Span{
+		t: t,
+		data: SpanData{
+			Name:         name,
+			Kind:         kind,
+			TraceID:      traceID,
+			SpanID:       newSpanID(),
+			ParentSpanID: parent,
+			Start:        time.Now(),
+			Attributes:   attrs,
+		},
+	}
+}
+
+func (t *Tracer) export(d SpanData) {
+	if t.ch == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		if err := t.e.ExportSpans(ctx, []SpanData{d}); err != nil {
+			t.opts.Logger.Warn("failed to export spans", zap.Error(err))
+		}
+		return
+	}
+	select {
+	case t.ch <- d:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.opts.BatchTimeout)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, t.opts.BatchSize)
+	var lastDropped uint64
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		if err := t.e.ExportSpans(ctx, batch); err != nil {
+			t.opts.Logger.Warn("failed to export spans", zap.Int("spans", len(batch)), zap.Error(err))
+		}
+		batch = make([]SpanData, 0, t.opts.BatchSize)
+	}
+	for {
+		select {
+		case d := <-t.ch:
+			batch = append(batch, d)
+			if len(batch) >= t.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			if n := t.dropped.Load(); n != lastDropped {
+				t.opts.Logger.Warn("span queue is full, spans were dropped", zap.Uint64("total", n))
+				lastDropped = n
+			}
+		case <-t.closed:
+			for {
+				select {
+				case d := <-t.ch:
+					batch = append(batch, d)
+					if len(batch) >= t.opts.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close exports the queued spans and shuts down the exporter.
+// Spans that end after Close are dropped.
+func (t *Tracer) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	<-t.done
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	return t.e.Shutdown(ctx)
+}
+
+// InMemoryExporter keeps the exported spans in memory. It is meant
+// for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+var _ Exporter = (*InMemoryExporter)(nil)
+
+func NewInMemoryExporter() *InMemoryExporter {
+	return new(InMemoryExporter)
+}
+
+func (e *InMemoryExporter) ExportSpans(_ context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *InMemoryExporter) Shutdown(context.Context) error { return nil }
+
+// Spans returns a copy of the exported spans.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Reset removes all exported spans.
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
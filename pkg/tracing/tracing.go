@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package tracing is a minimal tracer that follows the OpenTelemetry
+// span model. Spans are exported in batches to an Exporter, e.g. an
+// OTLP/HTTP collector.
+//
+// Tracing is opt-in: Start only creates spans under a sampled root
+// span, so code paths can be instrumented unconditionally. Methods of
+// a nil *Span are no-ops.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanKind is the OpenTelemetry span kind.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// StatusCode is the OpenTelemetry span status code.
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a span attribute. Value is a string, int64, bool
+// or float64.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(k, v string) Attribute { return Attribute{Key: k, Value: v} }
+
+func Int(k string, v int) Attribute { return Attribute{Key: k, Value: int64(v)} }
+
+func Bool(k string, v bool) Attribute { return Attribute{Key: k, Value: v} }
+
+func Float64(k string, v float64) Attribute { return Attribute{Key: k, Value: v} }
+
+// SpanData is a finished span.
+type SpanData struct {
+	Name         string
+	Kind         SpanKind
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID // Zero for root spans.
+
+	Start time.Time
+	End   time.Time
+
+	Attributes    []Attribute
+	StatusCode    StatusCode
+	StatusMessage string
+}
+
+// Span is a span that is being recorded. It is concurrency safe.
+type Span struct {
+	t *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SetAttributes adds attrs to s.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.data.Attributes = append(s.data.Attributes, attrs...)
+	}
+}
+
+// SetError sets the status of s to error if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.data.StatusCode = StatusError
+		s.data.StatusMessage = err.Error()
+	}
+}
+
+// End finishes s and queues it for export. Later calls are no-ops.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	d := s.data
+	s.mu.Unlock()
+	s.t.export(d)
+}
+
+// TraceID returns the trace id of s.
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.data.TraceID
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx that carries s.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a child span of the span in ctx and returns a ctx
+// that carries it. If ctx has no span, it returns ctx and a nil span.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.t.newSpan(name, SpanKindInternal, parent.data.TraceID, parent.data.SpanID, attrs)
+	return ContextWithSpan(ctx, s), s
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+// SetDefault sets the Tracer that StartRoot uses. A nil t disables
+// tracing.
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+// StartRoot starts a root span with the default Tracer. If tracing is
+// disabled or the trace is not sampled, it returns ctx and a nil span.
+func StartRoot(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	t := defaultTracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	return t.StartRoot(ctx, name, attrs...)
+}
+
+func newTraceID() (id TraceID) {
+	for id == (TraceID{}) {
+		binary.BigEndian.PutUint64(id[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(id[8:], rand.Uint64())
+	}
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	for id == (SpanID{}) {
+		binary.BigEndian.PutUint64(id[:], rand.Uint64())
+	}
+	return id
+}
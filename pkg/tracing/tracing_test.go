@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Start(t *testing.T) {
+	// No root span, no child span.
+	ctx, s := Start(context.Background(), "child")
+	require.Nil(t, s)
+	require.Nil(t, SpanFromContext(ctx))
+	s.SetAttributes(String("k", "v")) // no-op
+	s.SetError(errors.New("err"))
+	s.End()
+
+	e := NewInMemoryExporter()
+	tr := NewTracer(e, Opts{Sync: true})
+	ctx, root := tr.StartRoot(context.Background(), "root", String("qname", "example."))
+	require.NotNil(t, root)
+	_, child := Start(ctx, "child")
+	child.SetAttributes(Int("try", 1), Bool("reused", true))
+	child.SetError(errors.New("timeout"))
+	child.End()
+	child.End() // no-op
+	root.End()
+	require.NoError(t, tr.Close())
+
+	spans := e.Spans()
+	require.Len(t, spans, 2)
+	c, r := spans[0], spans[1]
+	require.Equal(t, "child", c.Name)
+	require.Equal(t, SpanKindInternal, c.Kind)
+	require.Equal(t, r.TraceID, c.TraceID)
+	require.Equal(t, r.SpanID, c.ParentSpanID)
+	require.Equal(t, []Attribute{{"try", int64(1)}, {"reused", true}}, c.Attributes)
+	require.Equal(t, StatusError, c.StatusCode)
+	require.Equal(t, "timeout", c.StatusMessage)
+	require.False(t, c.End.Before(c.Start))
+
+	require.Equal(t, "root", r.Name)
+	require.Equal(t, SpanKindServer, r.Kind)
+	require.False(t, r.ParentSpanID.IsValid())
+}
+
+func Test_StartRoot_default(t *testing.T) {
+	_, s := StartRoot(context.Background(), "root")
+	require.Nil(t, s)
+
+	e := NewInMemoryExporter()
+	tr := NewTracer(e, Opts{})
+	SetDefault(tr)
+	defer SetDefault(nil)
+	for i := 0; i < 1000; i++ {
+		_, s := StartRoot(context.Background(), "root")
+		s.End()
+	}
+	require.NoError(t, tr.Close()) // Flushes the batch.
+	require.Len(t, e.Spans(), 1000)
+}
+
+func Test_Tracer_sampling(t *testing.T) {
+	tr := NewTracer(NewInMemoryExporter(), Opts{Sync: true, SampleRatio: 0.01})
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if _, s := tr.StartRoot(context.Background(), "root"); s != nil {
+			sampled++
+		}
+	}
+	require.Greater(t, sampled, 0)
+	require.Less(t, sampled, 500)
+}
+
+func Test_OTLPExporter(t *testing.T) {
+	var got map[string]any
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	e, err := NewOTLPExporter(OTLPOpts{Endpoint: srv.URL + "/v1/traces", Headers: map[string]string{"Authorization": "Bearer x"}})
+	require.NoError(t, err)
+	tr := NewTracer(e, Opts{Sync: true})
+	ctx, root := tr.StartRoot(context.Background(), "root", Int("n", 1))
+	_, child := Start(ctx, "child")
+	child.End()
+	require.NoError(t, tr.Close())
+	require.Equal(t, "Bearer x", auth)
+
+	rs := got["resourceSpans"].([]any)[0].(map[string]any)
+	attr := rs["resource"].(map[string]any)["attributes"].([]any)[0].(map[string]any)
+	require.Equal(t, "service.name", attr["key"])
+	require.Equal(t, "mosdns", attr["value"].(map[string]any)["stringValue"])
+	span := rs["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)[0].(map[string]any)
+	require.Equal(t, "child", span["name"])
+	require.Equal(t, root.TraceID().String(), span["traceId"])
+	require.Len(t, span["spanId"], 16)
+	require.Len(t, span["parentSpanId"], 16)
+
+	_, err = NewOTLPExporter(OTLPOpts{})
+	require.Error(t, err)
+}
@@ -0,0 +1,352 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsstamp"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	// Certs are refetched periodically to pick up rotated certs before
+	// the current one expires.
+	dnscryptCertRefreshInterval = time.Hour
+
+	// Udp queries are padded to dnscrypt.MinUDPQuerySize first. The size
+	// grows on every truncated response, up to dnscryptMaxUDPQuerySize.
+	dnscryptMaxUDPQuerySize = 1252
+	dnscryptMaxPacketSize   = 4096
+
+	// A conn remembers the client nonces of this many recent queries,
+	// twice the number of queries that can be in flight on it.
+	dnscryptMaxPendingNonces = 8192
+)
+
+var errDnscryptCertExpired = errors.New("dnscrypt cert expired")
+
+// dnscryptResolver holds the state that is shared by all connections
+// to a DNSCrypt server.
+type dnscryptResolver struct {
+	addr         string // ip:port
+	providerName string
+	providerPk   ed25519.PublicKey
+	dialer       *net.Dialer
+	logger       *zap.Logger
+
+	udpQuerySize atomic.Int32
+
+	m         sync.Mutex
+	cert      *dnscrypt.Cert
+	fetchedAt time.Time
+}
+
+func newDnscryptUpstream(s *dnsstamp.Stamp, addr string, dialer *net.Dialer, opt Opt) Upstream {
+	r := &dnscryptResolver{
+		addr:         addr,
+		providerName: dns.Fqdn(s.ProviderName),
+		providerPk:   ed25519.PublicKey(s.ProviderPk),
+		dialer:       dialer,
+		logger:       opt.Logger,
+	}
+	r.udpQuerySize.Store(dnscrypt.MinUDPQuerySize)
+
+	const maxConcurrentQueryPreConn = 4096
+	dialUdpPipeline := func(ctx context.Context) (transport.DnsConn, error) {
+		c, err := r.dial(ctx, "udp", opt.EventObserver)
+		if err != nil {
+			return nil, err
+		}
+		to := transport.TraditionalDnsConnOpts{
+			WithLengthHeader:   false,
+			IdleTimeout:        time.Minute * 5,
+			MaxConcurrentQuery: maxConcurrentQueryPreConn,
+		}
+		return transport.NewDnsConn(to, c), nil
+	}
+	dialTcpNetConn := func(ctx context.Context) (transport.NetConn, error) {
+		return r.dial(ctx, "tcp", opt.EventObserver)
+	}
+	return &udpWithFallback{
+		u: transport.NewPipelineTransport(transport.PipelineOpts{
+			DialContext:                    dialUdpPipeline,
+			MaxConcurrentQueryWhileDialing: maxConcurrentQueryPreConn,
+			Logger:                         opt.Logger,
+		}),
+		t: transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialTcpNetConn}),
+	}
+}
+
+// getCert returns a valid cert of the server. It refetches the cert if
+// the cached one is expired or too old.
+func (r *dnscryptResolver) getCert(ctx context.Context) (*dnscrypt.Cert, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	now := time.Now()
+	if r.cert != nil && r.cert.Valid(now) && now.Sub(r.fetchedAt) < dnscryptCertRefreshInterval {
+		return r.cert, nil
+	}
+	cert, err := r.fetchCert(ctx, now)
+	if err != nil {
+		if r.cert != nil && r.cert.Valid(now) {
+			r.logger.Warn("failed to refresh dnscrypt cert, keep using the current one", zap.String("provider", r.providerName), zap.Error(err))
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("failed to fetch dnscrypt cert, %w", err)
+	}
+	if r.cert == nil || r.cert.Serial != cert.Serial {
+		r.logger.Info(
+			"dnscrypt cert updated",
+			zap.String("provider", r.providerName),
+			zap.Uint32("serial", cert.Serial),
+			zap.Stringer("construction", cert.Construction),
+			zap.Time("not_after", cert.NotAfter),
+		)
+	}
+	r.cert, r.fetchedAt = cert, now
+	return cert, nil
+}
+
+func (r *dnscryptResolver) fetchCert(ctx context.Context, now time.Time) (*dnscrypt.Cert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(r.providerName, dns.TypeTXT)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	c := &dns.Client{Net: "udp", Dialer: r.dialer}
+	resp, _, err := c.ExchangeContext(ctx, q, r.addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.ExchangeContext(ctx, q, r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("server returned rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	var best *dnscrypt.Cert
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := dnscrypt.ParseCert(dnscrypt.DecodeTXT(txt.Txt), r.providerPk)
+		if err != nil {
+			r.logger.Debug("invalid dnscrypt cert", zap.String("provider", r.providerName), zap.Error(err))
+			continue
+		}
+		if !cert.Valid(now) {
+			continue
+		}
+		if cert.BetterThan(best) {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no valid cert")
+	}
+	return best, nil
+}
+
+// dial opens a connection with a new ephemeral key pair and the current cert.
+func (r *dnscryptResolver) dial(ctx context.Context, network string, ob EventObserver) (*dnscryptConn, error) {
+	cert, err := r.getCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pk, sk, err := dnscrypt.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	sharedKey, err := dnscrypt.SharedKey(cert.Construction, &sk, &cert.ResolverPk)
+	if err != nil {
+		return nil, err
+	}
+	c, err := r.dialer.DialContext(ctx, network, r.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dnscryptConn{
+		Conn:      wrapConn(c, ob),
+		isTcp:     network == "tcp",
+		r:         r,
+		cert:      cert,
+		pk:        pk,
+		sharedKey: sharedKey,
+	}, nil
+}
+
+func (r *dnscryptResolver) growUDPQuerySize() {
+	for {
+		s := r.udpQuerySize.Load()
+		if s >= dnscryptMaxUDPQuerySize {
+			return
+		}
+		if r.udpQuerySize.CompareAndSwap(s, min(s+64, dnscryptMaxUDPQuerySize)) {
+			return
+		}
+	}
+}
+
+// dnscryptConn encrypts the plain dns frames that are written to it and
+// decrypts the frames that are read from it, so it can be used as a
+// transport.NetConn by the traditional transports. Frames on tcp have
+// a length header.
+type dnscryptConn struct {
+	net.Conn
+	isTcp     bool
+	r         *dnscryptResolver
+	cert      *dnscrypt.Cert
+	pk        [dnscrypt.KeySize]byte
+	sharedKey [dnscrypt.KeySize]byte
+
+	rb []byte // tcp only, buffered plain frame with length header
+
+	nonceMu sync.Mutex
+	nonces  map[[dnscrypt.HalfNonceSize]byte]struct{} // client nonces of pending queries
+	order   [][dnscrypt.HalfNonceSize]byte            // nonces in the order they were sent
+}
+
+// addNonce records the client nonce of a query. Only the latest
+// dnscryptMaxPendingNonces nonces are kept, queries that were lost
+// must not grow the set forever.
+func (c *dnscryptConn) addNonce(n [dnscrypt.HalfNonceSize]byte) {
+	c.nonceMu.Lock()
+	defer c.nonceMu.Unlock()
+	if c.nonces == nil {
+		c.nonces = make(map[[dnscrypt.HalfNonceSize]byte]struct{})
+	}
+	c.nonces[n] = struct{}{}
+	c.order = append(c.order, n)
+	if len(c.order) > dnscryptMaxPendingNonces {
+		delete(c.nonces, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+func (c *dnscryptConn) hasNonce(n [dnscrypt.HalfNonceSize]byte) bool {
+	c.nonceMu.Lock()
+	defer c.nonceMu.Unlock()
+	_, ok := c.nonces[n]
+	return ok
+}
+
+func (c *dnscryptConn) delNonce(n [dnscrypt.HalfNonceSize]byte) {
+	c.nonceMu.Lock()
+	defer c.nonceMu.Unlock()
+	delete(c.nonces, n)
+}
+
+// decrypt opens a response packet that answers one of the pending
+// queries of c.
+func (c *dnscryptConn) decrypt(p []byte) ([]byte, error) {
+	n, ok := dnscrypt.ResponseNonce(p)
+	if !ok || !c.hasNonce(n) {
+		return nil, dnscrypt.ErrInvalidPacket
+	}
+	m, err := dnscrypt.DecryptResponse(c.cert.Construction, &c.sharedKey, &n, p)
+	if err != nil {
+		return nil, err
+	}
+	c.delNonce(n)
+	return m, nil
+}
+
+func (c *dnscryptConn) Write(b []byte) (int, error) {
+	if !c.cert.Valid(time.Now()) {
+		return 0, errDnscryptCertExpired
+	}
+
+	q := b
+	minSize := 0
+	if c.isTcp {
+		if len(b) < 2 {
+			return 0, dnsutils.ErrPayloadTooSmall
+		}
+		q = b[2:]
+	} else {
+		minSize = int(c.r.udpQuerySize.Load())
+	}
+	packet, nonce, err := dnscrypt.EncryptQuery(c.cert, &c.pk, &c.sharedKey, q, minSize)
+	if err != nil {
+		return 0, err
+	}
+	c.addNonce(nonce)
+	if c.isTcp {
+		packet = append(binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packet)), uint16(len(packet))), packet...)
+	}
+	if _, err := c.Conn.Write(packet); err != nil {
+		c.delNonce(nonce)
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *dnscryptConn) Read(b []byte) (int, error) {
+	if c.isTcp {
+		if len(c.rb) == 0 {
+			p, err := dnsutils.ReadRawMsgFromTCP(c.Conn)
+			if err != nil {
+				return 0, err
+			}
+			m, err := c.decrypt(*p)
+			pool.ReleaseBuf(p)
+			if err != nil {
+				return 0, err
+			}
+			c.rb = append(binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(m)), uint16(len(m))), m...)
+		}
+		n := copy(b, c.rb)
+		c.rb = c.rb[n:]
+		return n, nil
+	}
+
+	buf := pool.GetBuf(dnscryptMaxPacketSize)
+	defer pool.ReleaseBuf(buf)
+	for {
+		n, err := c.Conn.Read(*buf)
+		if err != nil {
+			return 0, err
+		}
+		m, err := c.decrypt((*buf)[:n])
+		if err != nil {
+			continue // Not a reply to our queries or broken, ignore it.
+		}
+		if len(m) >= dnsutils.DnsHeaderLen && msgTruncated(m) {
+			c.r.growUDPQuerySize()
+		}
+		return copy(b, m), nil
+	}
+}
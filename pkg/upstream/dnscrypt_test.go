@@ -0,0 +1,284 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsstamp"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type dnscryptTestCert struct {
+	cert *dnscrypt.Cert
+	sk   [dnscrypt.KeySize]byte
+	raw  []byte
+}
+
+// dnscryptTestServer is a minimal DNSCrypt server that serves its certs
+// and answers every encrypted query with an empty reply.
+type dnscryptTestServer struct {
+	providerName string
+	providerPk   ed25519.PublicKey
+	certs        []dnscryptTestCert
+	bigMsg       bool
+}
+
+func newDnscryptTestServer(t testing.TB, bigMsg bool, constructions ...dnscrypt.Construction) (stamp string, shutdown func()) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s := &dnscryptTestServer{providerName: "2.dnscrypt-cert.test.", providerPk: pk, bigMsg: bigMsg}
+	for i, c := range constructions {
+		rpk, rsk, err := dnscrypt.GenerateKey()
+		require.NoError(t, err)
+		cert := &dnscrypt.Cert{
+			Construction: c,
+			ResolverPk:   rpk,
+			ClientMagic:  [8]byte{byte(i + 1)},
+			Serial:       uint32(i + 1),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		s.certs = append(s.certs, dnscryptTestCert{cert: cert, sk: rsk, raw: cert.Sign(sk)})
+	}
+
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", uc.LocalAddr().String())
+	require.NoError(t, err)
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := uc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if r := s.handle(buf[:n], true); r != nil {
+				uc.WriteTo(r, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					b, err := dnsutils.ReadRawMsgFromTCP(c)
+					if err != nil {
+						return
+					}
+					if r := s.handle(*b, false); r != nil {
+						c.Write(append([]byte{byte(len(r) >> 8), byte(len(r))}, r...))
+					}
+				}
+			}()
+		}
+	}()
+
+	st := &dnsstamp.Stamp{
+		Proto:        dnsstamp.ProtoDNSCrypt,
+		Addr:         uc.LocalAddr().String(),
+		ProviderPk:   pk,
+		ProviderName: s.providerName,
+	}
+	return st.String(), func() {
+		uc.Close()
+		l.Close()
+	}
+}
+
+func (s *dnscryptTestServer) handle(b []byte, udp bool) []byte {
+	if magic, ok := dnscrypt.ClientMagic(b); ok {
+		for _, c := range s.certs {
+			if c.cert.ClientMagic != magic {
+				continue
+			}
+			q, key, nonce, err := dnscrypt.DecryptQuery(c.cert.Construction, &c.sk, b)
+			if err != nil {
+				return nil
+			}
+			m := new(dns.Msg)
+			if err := m.Unpack(q); err != nil {
+				return nil
+			}
+			r := new(dns.Msg)
+			r.SetReply(m)
+			if s.bigMsg {
+				r.SetEdns0(dns.MaxMsgSize, false)
+				opt := r.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: padding})
+			}
+			rb, _ := r.Pack()
+			maxSize := 0
+			if udp {
+				maxSize = len(b)
+			}
+			p, err := dnscrypt.EncryptResponse(c.cert.Construction, &key, &nonce, rb, maxSize)
+			if errors.Is(err, dnscrypt.ErrResponseTooLarge) {
+				tr := new(dns.Msg)
+				tr.SetReply(m)
+				tr.Truncated = true
+				rb, _ = tr.Pack()
+				p, err = dnscrypt.EncryptResponse(c.cert.Construction, &key, &nonce, rb, 0)
+			}
+			if err != nil {
+				return nil
+			}
+			return p
+		}
+	}
+
+	// Plain cert query.
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil || len(m.Question) != 1 || m.Question[0].Name != s.providerName {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(m)
+	for _, c := range s.certs {
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: s.providerName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{dnscrypt.EncodeTXT(c.raw)},
+		})
+	}
+	rb, _ := r.Pack()
+	return rb
+}
+
+func Test_dnscryptUpstream(t *testing.T) {
+	for _, cs := range [][]dnscrypt.Construction{
+		{dnscrypt.XSalsa20Poly1305},
+		{dnscrypt.XChacha20Poly1305},
+		{dnscrypt.XChacha20Poly1305, dnscrypt.XSalsa20Poly1305},
+	} {
+		for _, bigMsg := range [...]bool{false, true} {
+			t.Run(fmt.Sprintf("%v_bigMsg_%v", cs, bigMsg), func(t *testing.T) {
+				stamp, shutdown := newDnscryptTestServer(t, bigMsg, cs...)
+				defer shutdown()
+
+				u, err := NewUpstream(stamp, Opt{})
+				require.NoError(t, err)
+				defer u.Close()
+				require.NoError(t, testUpstream(u))
+			})
+		}
+	}
+}
+
+func Test_dnscryptCertSelection(t *testing.T) {
+	stamp, shutdown := newDnscryptTestServer(t, false, dnscrypt.XChacha20Poly1305, dnscrypt.XSalsa20Poly1305)
+	defer shutdown()
+	st, err := dnsstamp.Parse(stamp)
+	require.NoError(t, err)
+
+	r := &dnscryptResolver{
+		addr:         st.Addr,
+		providerName: st.ProviderName,
+		providerPk:   st.ProviderPk,
+		dialer:       new(net.Dialer),
+		logger:       mlog.Nop(),
+	}
+	cert, err := r.getCert(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), cert.Serial)
+	require.Equal(t, dnscrypt.XSalsa20Poly1305, cert.Construction)
+
+	r.providerPk = make(ed25519.PublicKey, ed25519.PublicKeySize)
+	r.cert = nil
+	_, err = r.getCert(t.Context())
+	require.Error(t, err, "certs signed by another key must be rejected")
+}
+
+// replayConn returns the injected packets before reading from Conn and
+// keeps a copy of the last packet it read.
+type replayConn struct {
+	net.Conn
+	inject [][]byte
+	last   []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.inject) > 0 {
+		n := copy(b, c.inject[0])
+		c.inject = c.inject[1:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(b)
+	c.last = append(c.last[:0], b[:n]...)
+	return n, err
+}
+
+func Test_dnscryptConnReplay(t *testing.T) {
+	stamp, shutdown := newDnscryptTestServer(t, false, dnscrypt.XSalsa20Poly1305)
+	defer shutdown()
+	st, err := dnsstamp.Parse(stamp)
+	require.NoError(t, err)
+
+	r := &dnscryptResolver{
+		addr:         st.Addr,
+		providerName: st.ProviderName,
+		providerPk:   st.ProviderPk,
+		dialer:       new(net.Dialer),
+		logger:       mlog.Nop(),
+	}
+	r.udpQuerySize.Store(dnscrypt.MinUDPQuerySize)
+	c, err := r.dial(t.Context(), "udp", nopEO{})
+	require.NoError(t, err)
+	defer c.Close()
+	rc := &replayConn{Conn: c.Conn}
+	c.Conn = rc
+	require.NoError(t, c.SetDeadline(time.Now().Add(time.Second*3)))
+
+	exchange := func(id uint16) uint16 {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Id = id
+		b, err := q.Pack()
+		require.NoError(t, err)
+		_, err = c.Write(b)
+		require.NoError(t, err)
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := c.Read(buf)
+		require.NoError(t, err)
+		resp := new(dns.Msg)
+		require.NoError(t, resp.Unpack(buf[:n]))
+		return resp.Id
+	}
+
+	require.Equal(t, uint16(1), exchange(1))
+	rc.inject = [][]byte{bytes.Clone(rc.last)}
+	require.Equal(t, uint16(2), exchange(2), "replayed response must be dropped")
+}
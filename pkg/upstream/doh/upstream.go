@@ -26,11 +26,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	urlpkg "net/url"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -104,12 +106,13 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, erro
 	}
 
 	resChan := make(chan res, 1)
+	span := tracing.SpanFromContext(ctx)
 	go func() {
 		// We overwrite the ctx with a fixed timeout context here.
 		// Because the http package may close the underlay connection
 		// if the context is done before the query is completed. This
 		// reduces the connection reuse efficiency.
-		ctx, cancel := context.WithTimeout(context.Background(), defaultDoHTimeout)
+		ctx, cancel := context.WithTimeout(tracing.ContextWithSpan(context.Background(), span), defaultDoHTimeout)
 		defer cancel()
 		r, err := u.exchange(ctx, utils.BytesToStringUnsafe(queryBuf))
 		if err != nil {
@@ -132,6 +135,13 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, erro
 }
 
 func (u *Upstream) exchange(ctx context.Context, dnsQuery string) (*[]byte, error) {
+	if span := tracing.SpanFromContext(ctx); span != nil {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				span.SetAttributes(tracing.Bool("conn.reused", info.Reused))
+			},
+		})
+	}
 	req := u.reqTemplate.WithContext(ctx)
 	req.URL = new(urlpkg.URL)
 	*req.URL = *u.urlTemplate
@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultODoHTimeout = time.Second * 6
+
+	// Target configs are refetched periodically to pick up rotated keys.
+	odohConfigRefreshInterval = time.Hour
+)
+
+// odohUpstream is an Oblivious DoH (RFC 9230) upstream. Queries are sent
+// to the relay, which forwards them to the target. If there is no relay,
+// queries are sent to the target directly.
+type odohUpstream struct {
+	rt        http.RoundTripper
+	logger    *zap.Logger
+	target    *url.URL
+	endpoint  *url.URL // relay url with target params, or target url.
+	configURL string
+
+	m         sync.Mutex
+	config    *odoh.Config
+	fetchedAt time.Time
+}
+
+// newODoHUpstream creates an odoh upstream from u, which has the format
+// of odoh://target_host[:port][/path][?relay=relay_url].
+func newODoHUpstream(u *url.URL, rt http.RoundTripper, logger *zap.Logger) (*odohUpstream, error) {
+	target := &url.URL{Scheme: "https", Host: u.Host, Path: u.Path}
+	if len(target.Path) == 0 {
+		target.Path = "/dns-query"
+	}
+
+	endpoint := target
+	if s := u.Query().Get("relay"); len(s) > 0 {
+		relay, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay url, %w", err)
+		}
+		if relay.Scheme != "https" && relay.Scheme != "http" {
+			return nil, fmt.Errorf("invalid relay url scheme %s", relay.Scheme)
+		}
+		q := relay.Query()
+		q.Set("targethost", target.Host)
+		q.Set("targetpath", target.Path)
+		relay.RawQuery = q.Encode()
+		endpoint = relay
+	}
+
+	return &odohUpstream{
+		rt:        rt,
+		logger:    logger,
+		target:    target,
+		endpoint:  endpoint,
+		configURL: (&url.URL{Scheme: "https", Host: target.Host, Path: odoh.ConfigsPath}).String(),
+	}, nil
+}
+
+func (u *odohUpstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	type res struct {
+		r   *[]byte
+		err error
+	}
+	resChan := make(chan res, 1)
+	go func() {
+		// See doh.Upstream.ExchangeContext for the reason of this fixed timeout.
+		ctx, cancel := context.WithTimeout(context.Background(), defaultODoHTimeout)
+		defer cancel()
+		r, err := u.exchange(ctx, q)
+		if err != nil {
+			u.logger.Check(zap.WarnLevel, "exchange failed").Write(zap.Error(err))
+		}
+		resChan <- res{r: r, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case res := <-resChan:
+		return res.r, res.err
+	}
+}
+
+func (u *odohUpstream) exchange(ctx context.Context, q []byte) (*[]byte, error) {
+	config, err := u.getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	wire := make([]byte, len(q))
+	copy(wire, q)
+	wire[0], wire[1] = 0, 0 // Same as DoH, use id 0.
+	msg, qc, err := config.EncryptQuery(wire)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint.String(), bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header["Content-Type"] = []string{odoh.ContentType}
+	req.Header["Accept"] = []string{odoh.ContentType}
+	req.Header["User-Agent"] = nil
+	resp, err := u.rt.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		// The target does not know our key, it may have been rotated.
+		u.resetConfig(config)
+		return nil, errors.New("target rejected the odoh key")
+	default:
+		body1k, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("bad http status codes %d with body [%s]", resp.StatusCode, body1k)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize*2))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http body: %w", err)
+	}
+	r, err := qc.DecryptResponse(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(r) < dnsutils.DnsHeaderLen {
+		return nil, dnsutils.ErrPayloadTooSmall
+	}
+	payload := pool.GetBuf(len(r))
+	copy(*payload, r)
+	binary.BigEndian.PutUint16(*payload, binary.BigEndian.Uint16(q))
+	return payload, nil
+}
+
+// getConfig returns the target config. It refetches the config if the
+// cached one is too old.
+func (u *odohUpstream) getConfig(ctx context.Context) (*odoh.Config, error) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if u.config != nil && time.Since(u.fetchedAt) < odohConfigRefreshInterval {
+		return u.config, nil
+	}
+	c, err := u.fetchConfig(ctx)
+	if err != nil {
+		if u.config != nil {
+			u.logger.Warn("failed to refresh odoh config, keep using the current one", zap.Error(err))
+			return u.config, nil
+		}
+		return nil, fmt.Errorf("failed to fetch odoh config, %w", err)
+	}
+	u.config, u.fetchedAt = c, time.Now()
+	return c, nil
+}
+
+func (u *odohUpstream) resetConfig(c *odoh.Config) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.config == c {
+		u.config = nil
+	}
+}
+
+func (u *odohUpstream) fetchConfig(ctx context.Context) (*odoh.Config, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.configURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad http status codes %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	cs, err := odoh.ParseConfigs(b)
+	if err != nil {
+		return nil, err
+	}
+	return cs[0], nil
+}
+
+func (u *odohUpstream) Close() error {
+	if c, ok := u.rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+	return nil
+}
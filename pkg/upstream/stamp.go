@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsstamp"
+)
+
+var errNoPinnedCert = errors.New("no verified certificate matches the pinned hashes")
+
+// applyStamp converts a stamp to an upstream address. The server address
+// and the cert hashes in the stamp are applied to opt.
+func applyStamp(s *dnsstamp.Stamp, opt *Opt) (string, error) {
+	switch s.Proto {
+	case dnsstamp.ProtoPlain:
+		return "udp://" + s.Addr, nil
+	case dnsstamp.ProtoDNSCrypt:
+		return "dnscrypt://" + s.Addr, nil
+	}
+
+	if len(opt.DialAddr) == 0 {
+		opt.DialAddr = tryTrimIpv6Brackets(s.Addr)
+	}
+	if len(s.Hashes) > 0 {
+		opt.TLSConfig = pinTLSConfig(opt.TLSConfig, s.Hashes)
+	}
+	switch s.Proto {
+	case dnsstamp.ProtoDoH:
+		return "https://" + s.Hostname + s.Path, nil
+	case dnsstamp.ProtoDoT:
+		return "tls://" + s.Hostname, nil
+	case dnsstamp.ProtoDoQ:
+		return "quic://" + s.Hostname, nil
+	default:
+		return "", fmt.Errorf("unsupported stamp protocol %s", s.Proto)
+	}
+}
+
+// pinTLSConfig returns a copy of c that only accepts the server if one
+// of its certs has a TBS certificate that matches one of hashes.
+func pinTLSConfig(c *tls.Config, hashes [][]byte) *tls.Config {
+	if c == nil {
+		c = new(tls.Config)
+	} else {
+		c = c.Clone()
+	}
+	next := c.VerifyConnection
+	insecure := c.InsecureSkipVerify
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := verifyCertPins(cs, hashes, insecure); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(cs)
+		}
+		return nil
+	}
+	return c
+}
+
+// verifyCertPins checks the certs of the verified chains. The other
+// certs that the server sends are not trusted, anyone can append them.
+// If insecure is set, there is no verified chain and only the leaf is
+// checked.
+func verifyCertPins(cs tls.ConnectionState, hashes [][]byte, insecure bool) error {
+	if insecure {
+		if len(cs.PeerCertificates) > 0 && matchCertPins(cs.PeerCertificates[0], hashes) {
+			return nil
+		}
+		return errNoPinnedCert
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if matchCertPins(cert, hashes) {
+				return nil
+			}
+		}
+	}
+	return errNoPinnedCert
+}
+
+func matchCertPins(cert *x509.Certificate, hashes [][]byte) bool {
+	h := sha256.Sum256(cert.RawTBSCertificate)
+	for _, p := range hashes {
+		if bytes.Equal(h[:], p) {
+			return true
+		}
+	}
+	return false
+}
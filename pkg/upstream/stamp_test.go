@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsstamp"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_applyStamp(t *testing.T) {
+	s, err := dnsstamp.Parse("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5")
+	require.NoError(t, err)
+	opt := Opt{}
+	addr, err := applyStamp(s, &opt)
+	require.NoError(t, err)
+	require.Equal(t, "https://dns.cloudflare.com/dns-query", addr)
+	require.Equal(t, "1.0.0.1", opt.DialAddr)
+	require.Nil(t, opt.TLSConfig)
+
+	// DialAddr in opt has priority.
+	opt = Opt{DialAddr: "1.1.1.1"}
+	_, err = applyStamp(&dnsstamp.Stamp{Proto: dnsstamp.ProtoDoT, Addr: "[2606:4700::1111]", Hostname: "one.one.one.one"}, &opt)
+	require.NoError(t, err)
+	require.Equal(t, "1.1.1.1", opt.DialAddr)
+}
+
+func Test_stampCertPins(t *testing.T) {
+	cert, err := utils.GenerateCertificate("test")
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	h := sha256.Sum256(leaf.RawTBSCertificate)
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	server := dns.Server{Net: "tcp-tls", Listener: l, TLSConfig: tlsConfig, Handler: &vServer{}}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	addr := l.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+
+	for _, tt := range []struct {
+		name    string
+		hash    []byte
+		wantErr bool
+	}{
+		{"pinned", h[:], false},
+		{"not pinned", make([]byte, 32), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &dnsstamp.Stamp{
+				Proto:    dnsstamp.ProtoDoT,
+				Addr:     addr,
+				Hashes:   [][]byte{tt.hash},
+				Hostname: "test:" + port,
+			}
+			u, err := NewUpstream(s.String(), Opt{TLSConfig: &tls.Config{InsecureSkipVerify: true}})
+			require.NoError(t, err)
+			defer u.Close()
+			err = testUpstream(u)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// issueCert issues a cert from tmpl. It is self-signed if parent is nil.
+func issueCert(t *testing.T, name string, parent *tls.Certificate, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func Test_stampCertPinsAppendedCert(t *testing.T) {
+	ca := issueCert(t, "ca", nil, &x509.Certificate{
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	})
+	serverTmpl := func() *x509.Certificate {
+		return &x509.Certificate{
+			DNSNames:    []string{"dns.test"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	pinned := issueCert(t, "pinned", &ca, serverTmpl())
+	attacker := issueCert(t, "attacker", &ca, serverTmpl())
+
+	// The attacker has a valid cert and appends the public pinned cert.
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{attacker.Certificate[0], pinned.Certificate[0]},
+		PrivateKey:  attacker.PrivateKey,
+	}}}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	server := dns.Server{Net: "tcp-tls", Listener: l, TLSConfig: tlsConfig, Handler: &vServer{}}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	addr := l.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	tbsHash := func(c tls.Certificate) []byte {
+		h := sha256.Sum256(c.Leaf.RawTBSCertificate)
+		return h[:]
+	}
+	for _, tt := range []struct {
+		name     string
+		hash     []byte
+		insecure bool
+		wantErr  bool
+	}{
+		{"appended cert", tbsHash(pinned), false, true},
+		{"appended cert insecure", tbsHash(pinned), true, true},
+		{"leaf", tbsHash(attacker), false, false},
+		{"ca in verified chain", tbsHash(ca), false, false},
+		{"ca insecure", tbsHash(ca), true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &dnsstamp.Stamp{
+				Proto:    dnsstamp.ProtoDoT,
+				Addr:     addr,
+				Hashes:   [][]byte{tt.hash},
+				Hostname: "dns.test:" + port,
+			}
+			u, err := NewUpstream(s.String(), Opt{TLSConfig: &tls.Config{RootCAs: roots, InsecureSkipVerify: tt.insecure}})
+			require.NoError(t, err)
+			defer u.Close()
+			err = testUpstream(u)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
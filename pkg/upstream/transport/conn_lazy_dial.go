@@ -7,6 +7,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
 	"go.uber.org/zap"
 )
 
@@ -38,6 +39,7 @@ func newLazyDnsConn(
 	dialTimeout time.Duration,
 	maxConcurrentQueryWhileDialing int, // must be valid, no default value
 	logger *zap.Logger, // must non-nil
+	parentSpan *tracing.Span, // the dial is traced as its child, can be nil
 ) *lazyDnsConn {
 	if dialTimeout <= 0 {
 		dialTimeout = defaultDialTimeout
@@ -50,8 +52,11 @@ func newLazyDnsConn(
 	}
 
 	go func() {
+		_, dialSpan := tracing.Start(tracing.ContextWithSpan(dialCtx, parentSpan), "transport.dial")
 		dc, err := dial(dialCtx)
 		cancelDial()
+		dialSpan.SetError(err)
+		dialSpan.End()
 		if err != nil {
 			logger.Check(zap.WarnLevel, "failed to dial dns conn").Write(zap.Error(err))
 		}
@@ -24,6 +24,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
 	"go.uber.org/zap"
 )
 
@@ -74,10 +75,14 @@ func (t *PipelineTransport) ExchangeContext(ctx context.Context, m []byte) (*[]b
 	const maxRetry = 2
 	retry := 0
 	for {
-		dc, isNewConn, err := t.getReservedExchanger()
+		span := tracing.SpanFromContext(ctx)
+		dc, isNewConn, err := t.getReservedExchanger(span)
 		if err != nil {
 			return nil, err
 		}
+		if span != nil {
+			span.SetAttributes(tracing.Bool("conn.reused", !isNewConn))
+		}
 		r, err := dc.ExchangeReserved(ctx, m)
 		if err != nil {
 			// Reused connection may not stable.
@@ -107,7 +112,8 @@ func (t *PipelineTransport) Close() error {
 	return nil
 }
 
-func (t *PipelineTransport) getReservedExchanger() (_ ReservedExchanger, isNewConn bool, err error) {
+// If a new connection is dialed, the dial is traced as a child of span.
+func (t *PipelineTransport) getReservedExchanger(span *tracing.Span) (_ ReservedExchanger, isNewConn bool, err error) {
 	t.m.Lock()
 	if t.closed {
 		err = ErrClosedTransport
@@ -136,7 +142,7 @@ func (t *PipelineTransport) getReservedExchanger() (_ ReservedExchanger, isNewCo
 
 	// Dial a new connection
 	if rxc == nil {
-		c := newLazyDnsConn(t.dialFunc, t.dialTimeout, t.maxLazyConnQueue, t.logger)
+		c := newLazyDnsConn(t.dialFunc, t.dialTimeout, t.maxLazyConnQueue, t.logger, span)
 		rxc, _ = c.ReserveNewQuery() // ignore the closed error for new lazy connection
 		isNewConn = true
 		t.conns[c] = struct{}{}
@@ -28,6 +28,7 @@ import (
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
 	"go.uber.org/zap"
 )
 
@@ -97,11 +98,17 @@ func (t *ReuseConnTransport) ExchangeContext(ctx context.Context, m []byte) (*[]
 		}
 		if c == nil {
 			isNewConn = true
+			_, dialSpan := tracing.Start(ctx, "transport.dial")
 			c, err = t.getNewConn(ctx)
+			dialSpan.SetError(err)
+			dialSpan.End()
 			if err != nil {
 				return nil, err
 			}
 		}
+		if span := tracing.SpanFromContext(ctx); span != nil {
+			span.SetAttributes(tracing.Bool("conn.reused", !isNewConn))
+		}
 
 		queryPayload, err := copyMsgWithLenHdr(m)
 		if err != nil {
@@ -34,6 +34,7 @@ import (
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsstamp"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/bootstrap"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/doh"
@@ -123,7 +124,9 @@ type Opt struct {
 
 // NewUpstream creates a upstream.
 // addr has the format of: [protocol://]host[:port][/path].
-// Supported protocol: udp/tcp/tls/https/quic. Default protocol is udp.
+// Supported protocol: udp/tcp/tls/https/quic/odoh. Default protocol is udp.
+// addr can also be a DNS stamp (sdns://) of a plain, DNSCrypt, DoH, DoT
+// or DoQ server.
 //
 // Helper protocol:
 //   - tcp+pipeline/tls+pipeline: Automatically set opt.EnablePipeline to true.
@@ -136,6 +139,18 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		opt.EventObserver = nopEO{}
 	}
 
+	var stamp *dnsstamp.Stamp
+	if strings.HasPrefix(addr, "sdns://") {
+		stamp, err = dnsstamp.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stamp, %w", err)
+		}
+		addr, err = applyStamp(stamp, &opt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// parse protocol and server addr
 	if !strings.Contains(addr, "://") {
 		addr = "udp://" + addr
@@ -548,6 +563,41 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			MaxConcurrentQueryWhileDialing: 90,
 			Logger:                         opt.Logger,
 		}), nil
+	case "odoh":
+		// Queries go to the relay and configs go to the target, so
+		// opt.DialAddr and opt.Bootstrap are not used.
+		idleConnTimeout := time.Second * 30
+		if opt.IdleTimeout > 0 {
+			idleConnTimeout = opt.IdleTimeout
+		}
+		t := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, err := dialer.DialContext(ctx, network, addr)
+				return wrapConn(c, opt.EventObserver), err
+			},
+			TLSClientConfig:     opt.TLSConfig,
+			TLSHandshakeTimeout: tlsHandshakeTimeout,
+			IdleConnTimeout:     idleConnTimeout,
+			ForceAttemptHTTP2:   true,
+		}
+		u, err := newODoHUpstream(addrURL, t, opt.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create odoh upstream, %w", err)
+		}
+		return u, nil
+	case "dnscrypt":
+		const defaultPort = 443
+		if stamp == nil {
+			return nil, errors.New("dnscrypt upstream must be a sdns stamp")
+		}
+		host, port, err := parseDialAddr(addrUrlHost, opt.DialAddr, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err != nil {
+			return nil, fmt.Errorf("addr must be an ip address, %w", err)
+		}
+		return newDnscryptUpstream(stamp, joinPort(host, port), dialer, opt), nil
 	default:
 		return nil, fmt.Errorf("unsupported protocol [%s]", addrURL.Scheme)
 	}
@@ -0,0 +1,307 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const maxCNAMEHops = 8
+
+// Zone is an authoritative zone. RFC 1034 4.3.2.
+type Zone struct {
+	origin string
+	soa    *dns.SOA
+
+	// nodes contains all names in the zone, including empty non-terminals
+	// (with nil maps) and names below zone cuts (glue).
+	nodes map[string]map[uint16][]dns.RR
+}
+
+// Zones is a set of authoritative zones.
+type Zones struct {
+	zones map[string]*Zone
+}
+
+// NewZones builds zones from rrs. Every SOA record starts a zone. Records
+// that are not in any zone are returned as others.
+func NewZones(rrs []dns.RR) (zs *Zones, others []dns.RR) {
+	zs = &Zones{zones: make(map[string]*Zone)}
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			origin := dns.CanonicalName(soa.Hdr.Name)
+			if _, dup := zs.zones[origin]; !dup {
+				zs.zones[origin] = &Zone{origin: origin, soa: soa, nodes: map[string]map[uint16][]dns.RR{origin: nil}}
+			}
+		}
+	}
+	for _, rr := range rrs {
+		z := zs.find(rr.Header().Name)
+		if z == nil {
+			others = append(others, rr)
+			continue
+		}
+		z.add(rr)
+	}
+	return zs, others
+}
+
+// Len returns the number of zones.
+func (zs *Zones) Len() int {
+	return len(zs.zones)
+}
+
+// All returns all zones sorted by origin.
+func (zs *Zones) All() []*Zone {
+	out := make([]*Zone, 0, len(zs.zones))
+	for _, z := range zs.zones {
+		out = append(out, z)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].origin < out[j].origin })
+	return out
+}
+
+// find returns the closest zone that contains name.
+func (zs *Zones) find(name string) *Zone {
+	if len(zs.zones) == 0 {
+		return nil
+	}
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z := zs.zones[name[off:]]; z != nil {
+			return z
+		}
+	}
+	return zs.zones["."]
+}
+
+// Reply returns an authoritative reply to q from the closest zone
+// that contains the question. It returns nil if no zone contains it.
+func (zs *Zones) Reply(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	z := zs.find(q.Question[0].Name)
+	if z == nil {
+		return nil
+	}
+	return z.Reply(q)
+}
+
+func (z *Zone) add(rr dns.RR) {
+	name := dns.CanonicalName(rr.Header().Name)
+	node := z.nodes[name]
+	if node == nil {
+		node = make(map[uint16][]dns.RR)
+		z.nodes[name] = node
+	}
+	node[rr.Header().Rrtype] = append(node[rr.Header().Rrtype], rr)
+
+	// Mark empty non-terminals.
+	if name == z.origin {
+		return
+	}
+	for off, end := dns.NextLabel(name, 0); !end && name[off:] != z.origin; off, end = dns.NextLabel(name, off) {
+		if _, ok := z.nodes[name[off:]]; !ok {
+			z.nodes[name[off:]] = nil
+		}
+	}
+}
+
+// Origin returns the apex of z.
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// SOA returns the SOA record of z.
+func (z *Zone) SOA() *dns.SOA {
+	return z.soa
+}
+
+// Records returns all records in z, including the SOA.
+func (z *Zone) Records() []dns.RR {
+	var rrs []dns.RR
+	for _, node := range z.nodes {
+		for _, s := range node {
+			rrs = append(rrs, s...)
+		}
+	}
+	return rrs
+}
+
+// Reply replies the first question of q from z.
+// The question must be in z.
+func (z *Zone) Reply(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+
+	qname := dns.CanonicalName(q.Question[0].Name)
+	qtype := q.Question[0].Qtype
+	visited := make(map[string]struct{})
+	for hops := 0; ; hops++ {
+		visited[qname] = struct{}{}
+		if cut := z.findCut(qname, qtype); cut != nil {
+			// Referrals in the middle of a CNAME chain are left to the
+			// resolver.
+			if len(r.Answer) == 0 {
+				r.Authoritative = false
+				r.Ns = append(r.Ns, cut...)
+				r.Extra = append(r.Extra, z.glue(cut)...)
+			}
+			return r
+		}
+
+		node, owner, exists := z.lookup(qname)
+		if !exists {
+			r.Rcode = dns.RcodeNameError
+			r.Ns = append(r.Ns, z.negativeSOA())
+			return r
+		}
+		if rrs := answerRRs(node, qtype); len(rrs) > 0 {
+			r.Answer = append(r.Answer, withOwner(rrs, owner, q.Question[0].Name, qname)...)
+			return r
+		}
+		cnames := node[dns.TypeCNAME]
+		if len(cnames) == 0 {
+			r.Ns = append(r.Ns, z.negativeSOA())
+			return r
+		}
+		r.Answer = append(r.Answer, withOwner(cnames[:1], owner, q.Question[0].Name, qname)...)
+		target := dns.CanonicalName(cnames[0].(*dns.CNAME).Target)
+		if !dns.IsSubDomain(z.origin, target) || hops >= maxCNAMEHops {
+			return r
+		}
+		if _, loop := visited[target]; loop {
+			return r
+		}
+		qname = target
+	}
+}
+
+// findCut returns the NS records of the zone cut that is above or at
+// qname. DS queries at a cut are answered by the parent side.
+func (z *Zone) findCut(qname string, qtype uint16) []dns.RR {
+	if qname == z.origin {
+		return nil
+	}
+	var offs []int
+	for off, end := 0, false; !end; off, end = dns.NextLabel(qname, off) {
+		if qname[off:] == z.origin {
+			break
+		}
+		offs = append(offs, off)
+	}
+	// From the top to qname.
+	for i := len(offs) - 1; i >= 0; i-- {
+		name := qname[offs[i]:]
+		ns := z.nodes[name][dns.TypeNS]
+		if len(ns) == 0 {
+			continue
+		}
+		if name == qname && qtype == dns.TypeDS {
+			return nil
+		}
+		return ns
+	}
+	return nil
+}
+
+// lookup finds the node of qname, or the wildcard node that matches it.
+// RFC 4592. owner is the name of the node that was found.
+func (z *Zone) lookup(qname string) (node map[uint16][]dns.RR, owner string, exists bool) {
+	if node, ok := z.nodes[qname]; ok {
+		return node, qname, true
+	}
+	// Find the closest encloser.
+	for off, end := dns.NextLabel(qname, 0); !end; off, end = dns.NextLabel(qname, off) {
+		encloser := qname[off:]
+		if _, ok := z.nodes[encloser]; !ok {
+			continue
+		}
+		wildcard := "*." + encloser
+		node, ok := z.nodes[wildcard]
+		return node, wildcard, ok
+	}
+	return nil, "", false
+}
+
+func answerRRs(node map[uint16][]dns.RR, qtype uint16) []dns.RR {
+	if qtype != dns.TypeANY {
+		return node[qtype]
+	}
+	var rrs []dns.RR
+	for _, s := range node {
+		rrs = append(rrs, s...)
+	}
+	return rrs
+}
+
+// withOwner returns copies of rrs. Records expanded from a wildcard are
+// renamed to qname. Records owned by the question name keep the case
+// of the question.
+func withOwner(rrs []dns.RR, owner, questionName, qname string) []dns.RR {
+	name := ""
+	switch {
+	case strings.HasPrefix(owner, "*.") && owner != qname:
+		name = qname
+		if dns.CanonicalName(questionName) == qname {
+			name = questionName
+		}
+	case owner == dns.CanonicalName(questionName):
+		name = questionName
+	}
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if len(name) > 0 {
+			rr.Header().Name = name
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// glue returns the in zone addresses of the nameservers in ns.
+func (z *Zone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range ns {
+		target := dns.CanonicalName(rr.(*dns.NS).Ns)
+		if !dns.IsSubDomain(z.origin, target) {
+			continue
+		}
+		node := z.nodes[target]
+		extra = append(extra, node[dns.TypeA]...)
+		extra = append(extra, node[dns.TypeAAAA]...)
+	}
+	return extra
+}
+
+// negativeSOA returns the SOA for negative answers. RFC 2308 3.
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
@@ -42,10 +42,31 @@ func (m *Matcher) LoadFile(s string) error {
 }
 
 func (m *Matcher) Load(r io.Reader) error {
+	rrs, err := ReadRecords(r)
+	for _, rr := range rrs {
+		m.Add(rr)
+	}
+	return err
+}
+
+// Add adds rr to m.
+func (m *Matcher) Add(rr dns.RR) {
 	if m.m == nil {
 		m.m = make(map[dns.Question][]dns.RR)
 	}
+	h := rr.Header()
+	q := dns.Question{
+		Name:   strings.ToLower(h.Name),
+		Qtype:  h.Rrtype,
+		Qclass: h.Class,
+	}
+	m.m[q] = append(m.m[q], rr)
+}
 
+// ReadRecords reads all records from a zone file. The default TTL is 3600.
+// Records that were read before an error are also returned.
+func ReadRecords(r io.Reader) ([]dns.RR, error) {
+	var rrs []dns.RR
 	parser := dns.NewZoneParser(r, "", "")
 	parser.SetDefaultTTL(3600)
 	for {
@@ -53,15 +74,9 @@ func (m *Matcher) Load(r io.Reader) error {
 		if !ok {
 			break
 		}
-		h := rr.Header()
-		q := dns.Question{
-			Name:   strings.ToLower(h.Name),
-			Qtype:  h.Rrtype,
-			Qclass: h.Class,
-		}
-		m.m[q] = append(m.m[q], rr)
+		rrs = append(rrs, rr)
 	}
-	return parser.Err()
+	return rrs, parser.Err()
 }
 
 func (m *Matcher) Search(q dns.Question) []dns.RR {
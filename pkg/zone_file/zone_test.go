@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const zoneData = `
+$ORIGIN example.com.
+$TTL 3600
+@          IN SOA   ns1 admin 1 7200 3600 1209600 300
+@          IN NS    ns1
+ns1        IN A     192.0.2.53
+www        IN A     192.0.2.1
+alias      IN CNAME www
+outside    IN CNAME www.example.net.
+loop1      IN CNAME loop2
+loop2      IN CNAME loop1
+*.wild     IN A     192.0.2.2
+a.b.c      IN TXT   "deep"
+sub        IN NS    ns.sub
+sub        IN DS    12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+ns.sub     IN A     192.0.2.54
+
+other.example.org. IN A 192.0.2.100
+`
+
+func TestZones_Reply(t *testing.T) {
+	rrs, err := ReadRecords(strings.NewReader(zoneData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zs, others := NewZones(rrs)
+	if zs.Len() != 1 {
+		t.Fatalf("want 1 zone, got %d", zs.Len())
+	}
+	if len(others) != 1 || others[0].Header().Name != "other.example.org." {
+		t.Fatalf("unexpected records out of zone: %v", others)
+	}
+
+	tests := []struct {
+		name       string
+		qname      string
+		qtype      uint16
+		wantNil    bool
+		wantRcode  int
+		wantAA     bool
+		wantAnswer []string // owner and type
+		wantNs     []string
+		wantExtra  []string
+	}{
+		{name: "answer", qname: "www.example.com.", qtype: dns.TypeA, wantAA: true, wantAnswer: []string{"www.example.com. A"}},
+		{name: "case is kept", qname: "WWW.example.com.", qtype: dns.TypeA, wantAA: true, wantAnswer: []string{"WWW.example.com. A"}},
+		{name: "nodata", qname: "www.example.com.", qtype: dns.TypeAAAA, wantAA: true, wantNs: []string{"example.com. SOA"}},
+		{name: "nxdomain", qname: "nx.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantAA: true, wantNs: []string{"example.com. SOA"}},
+		{name: "empty non-terminal", qname: "b.c.example.com.", qtype: dns.TypeA, wantAA: true, wantNs: []string{"example.com. SOA"}},
+		{name: "cname in zone", qname: "alias.example.com.", qtype: dns.TypeA, wantAA: true, wantAnswer: []string{"alias.example.com. CNAME", "www.example.com. A"}},
+		{name: "cname query", qname: "alias.example.com.", qtype: dns.TypeCNAME, wantAA: true, wantAnswer: []string{"alias.example.com. CNAME"}},
+		{name: "cname out of zone", qname: "outside.example.com.", qtype: dns.TypeA, wantAA: true, wantAnswer: []string{"outside.example.com. CNAME"}},
+		{name: "cname loop", qname: "loop1.example.com.", qtype: dns.TypeA, wantAA: true, wantAnswer: []string{"loop1.example.com. CNAME", "loop2.example.com. CNAME"}},
+		{name: "wildcard", qname: "x.wild.example.com.", qtype: dns.TypeA, wantAA: true, wantAnswer: []string{"x.wild.example.com. A"}},
+		{name: "wildcard nodata", qname: "x.wild.example.com.", qtype: dns.TypeAAAA, wantAA: true, wantNs: []string{"example.com. SOA"}},
+		{name: "wildcard multiple labels", qname: "x.y.wild.example.com.", qtype: dns.TypeA, wantAA: true, wantAnswer: []string{"x.y.wild.example.com. A"}},
+		{name: "no wildcard at closest encloser", qname: "x.www.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantAA: true, wantNs: []string{"example.com. SOA"}},
+		{name: "referral", qname: "www.sub.example.com.", qtype: dns.TypeA, wantNs: []string{"sub.example.com. NS"}, wantExtra: []string{"ns.sub.example.com. A"}},
+		{name: "referral at cut", qname: "sub.example.com.", qtype: dns.TypeA, wantNs: []string{"sub.example.com. NS"}, wantExtra: []string{"ns.sub.example.com. A"}},
+		{name: "ds at cut", qname: "sub.example.com.", qtype: dns.TypeDS, wantAA: true, wantAnswer: []string{"sub.example.com. DS"}},
+		{name: "apex ns", qname: "example.com.", qtype: dns.TypeNS, wantAA: true, wantAnswer: []string{"example.com. NS"}},
+		{name: "out of zone", qname: "example.org.", qtype: dns.TypeA, wantNil: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			r := zs.Reply(q)
+			if tt.wantNil {
+				if r != nil {
+					t.Fatalf("want nil reply, got %v", r)
+				}
+				return
+			}
+			if r == nil {
+				t.Fatal("nil reply")
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Errorf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+			if r.Authoritative != tt.wantAA {
+				t.Errorf("want aa %v, got %v", tt.wantAA, r.Authoritative)
+			}
+			checkSection(t, "answer", r.Answer, tt.wantAnswer)
+			checkSection(t, "ns", r.Ns, tt.wantNs)
+			checkSection(t, "extra", r.Extra, tt.wantExtra)
+		})
+	}
+}
+
+func checkSection(t *testing.T, section string, rrs []dns.RR, want []string) {
+	t.Helper()
+	var got []string
+	for _, rr := range rrs {
+		got = append(got, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("%s: want %v, got %v", section, want, got)
+	}
+}
+
+func TestZone_negativeSOA(t *testing.T) {
+	rrs, err := ReadRecords(strings.NewReader(zoneData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zs, _ := NewZones(rrs)
+	q := new(dns.Msg)
+	q.SetQuestion("nx.example.com.", dns.TypeA)
+	r := zs.Reply(q)
+	if ttl := r.Ns[0].Header().Ttl; ttl != 300 {
+		t.Fatalf("want negative ttl 300, got %d", ttl)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/stretchr/testify/require"
+)
+
+// Test_CheckConfig_quickSetupRefs checks that tags referenced in quick
+// setup args and in data providers are checked by config check.
+func Test_CheckConfig_quickSetupRefs(t *testing.T) {
+	const sets = `
+  - tag: domains
+    type: domain_set
+    args:
+      exps: [example.com]
+  - tag: ips
+    type: ip_set
+    args:
+      ips: [192.0.2.0/24]
+`
+	tests := []struct {
+		name    string
+		plugins string
+		wantErr bool
+	}{
+		{"ok", sets + `
+  - tag: more_domains
+    type: domain_set
+    args:
+      sets: [domains]
+  - tag: more_ips
+    type: ip_set
+    args:
+      sets: [ips]
+  - tag: main
+    type: sequence
+    args:
+      - matches: [qname $more_domains example.org, cname $domains, "!client_ip $more_ips 10.0.0.0/8"]
+        exec: reject
+      - matches: [resp_ip $ips, ptr_ip $ips, "string_exp $HOME eq /root"]
+        exec: accept
+`, false},
+		{"qname", `
+  - tag: main
+    type: sequence
+    args:
+      - matches: [qname $set]
+        exec: reject
+`, true},
+		{"cname", `
+  - tag: main
+    type: sequence
+    args:
+      - matches: [cname $set]
+        exec: reject
+`, true},
+		{"client_ip", `
+  - tag: main
+    type: sequence
+    args:
+      - matches: [client_ip 10.0.0.0/8 $ips]
+        exec: reject
+`, true},
+		{"resp_ip", `
+  - tag: main
+    type: sequence
+    args:
+      - matches: [resp_ip $x]
+        exec: reject
+`, true},
+		{"ptr_ip", `
+  - tag: main
+    type: sequence
+    args:
+      - matches: [ptr_ip $x]
+        exec: reject
+`, true},
+		{"domain_set sets", `
+  - tag: domains
+    type: domain_set
+    args:
+      sets: [other]
+`, true},
+		{"ip_set sets", `
+  - tag: ips
+    type: ip_set
+    args:
+      sets: [other]
+`, true},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, "config.yaml")
+			require.NoError(t, os.WriteFile(p, []byte("plugins:"+tt.plugins), 0644))
+			err := coremain.CheckConfig(p)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRemoteInterval = 24 * time.Hour
+	defaultRemoteTimeout  = 30 * time.Second
+	retryRemoteInterval   = 5 * time.Minute
+	maxRemoteFileSize     = 64 << 20
+)
+
+// RemoteFileArgs is a file that is downloaded from url and refreshed
+// periodically.
+type RemoteFileArgs struct {
+	URL string `yaml:"url"`
+
+	// Interval is the refresh interval in seconds. Default is 86400 (1 day).
+	Interval uint `yaml:"interval"`
+
+	// Timeout is the download timeout in seconds. Default is 30.
+	Timeout uint `yaml:"timeout"`
+
+	// Checksum is the sha256 of the file in hex, optionally prefixed
+	// with "sha256:". ChecksumURL is an url of a sha256sum file, which
+	// is downloaded with the file. At most one of them can be set.
+	Checksum    string `yaml:"checksum"`
+	ChecksumURL string `yaml:"checksum_url"`
+
+	// Fallback is a local copy of the file. It is updated after each
+	// successful download. If it exists at startup, it is loaded first and
+	// the file is downloaded in the background. Otherwise, the first
+	// download must succeed.
+	Fallback string `yaml:"fallback"`
+}
+
+// RemoteFileSet downloads remote files and calls reload after a file
+// was changed. If reload returns an error, the file is rolled back, so
+// the previous data keeps serving.
+type RemoteFileSet struct {
+	files  []*remoteFile
+	reload ReloadFunc
+	logger *zap.Logger
+	client *http.Client
+
+	reloadMu sync.Mutex // Serializes reloads.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+type remoteFile struct {
+	args     RemoteFileArgs
+	checksum []byte
+	interval time.Duration
+	timeout  time.Duration
+
+	content atomic.Pointer[[]byte]
+
+	// For conditional requests. Only accessed by the refresh loop.
+	etag         string
+	lastModified string
+
+	loadedFromFallback bool
+}
+
+// NewRemoteFileSet loads the files (from fallbacks if exist, or by
+// downloading them). reload will not be called until Start is called.
+func NewRemoteFileSet(args []RemoteFileArgs, logger *zap.Logger, reload ReloadFunc) (*RemoteFileSet, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &RemoteFileSet{
+		reload: reload,
+		logger: logger,
+		client: &http.Client{},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for i, a := range args {
+		f, err := s.initFile(a)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("url #%d %s, %w", i, a.URL, err)
+		}
+		s.files = append(s.files, f)
+	}
+	return s, nil
+}
+
+func (s *RemoteFileSet) initFile(a RemoteFileArgs) (*remoteFile, error) {
+	if len(a.URL) == 0 {
+		return nil, errors.New("missing url")
+	}
+	f := &remoteFile{
+		args:     a,
+		interval: time.Duration(a.Interval) * time.Second,
+		timeout:  time.Duration(a.Timeout) * time.Second,
+	}
+	if f.interval <= 0 {
+		f.interval = defaultRemoteInterval
+	}
+	if f.timeout <= 0 {
+		f.timeout = defaultRemoteTimeout
+	}
+	if len(a.Checksum) > 0 {
+		if len(a.ChecksumURL) > 0 {
+			return nil, errors.New("checksum and checksum_url are both set")
+		}
+		sum, err := parseChecksum(a.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		f.checksum = sum
+	}
+
+	if len(a.Fallback) > 0 {
+		b, err := os.ReadFile(a.Fallback)
+		switch {
+		case err == nil:
+			f.content.Store(&b)
+			f.loadedFromFallback = true
+			if fi, err := os.Stat(a.Fallback); err == nil {
+				f.lastModified = fi.ModTime().UTC().Format(http.TimeFormat)
+			}
+			return f, nil
+		case !os.IsNotExist(err):
+			return nil, fmt.Errorf("failed to read fallback file, %w", err)
+		}
+	}
+
+	b, err := s.download(f)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, errors.New("unexpected 304 response")
+	}
+	f.content.Store(&b)
+	s.saveFallback(f, b)
+	return f, nil
+}
+
+// Start starts refreshing the files in the background. Files that were
+// loaded from fallbacks are refreshed immediately.
+func (s *RemoteFileSet) Start() {
+	for _, f := range s.files {
+		s.wg.Add(1)
+		go s.refreshLoop(f)
+	}
+}
+
+// Get returns the content of file #i.
+func (s *RemoteFileSet) Get(i int) []byte {
+	return *s.files[i].content.Load()
+}
+
+// Len returns the number of files.
+func (s *RemoteFileSet) Len() int {
+	return len(s.files)
+}
+
+func (s *RemoteFileSet) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *RemoteFileSet) refreshLoop(f *remoteFile) {
+	defer s.wg.Done()
+	next := f.interval
+	if f.loadedFromFallback {
+		next = 0
+	}
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		next = f.interval
+		if err := s.refresh(f); err != nil {
+			s.logger.Warn("failed to refresh remote file", zap.String("url", f.args.URL), zap.Error(err))
+			next = min(f.interval, retryRemoteInterval)
+		}
+		timer.Reset(next)
+	}
+}
+
+// refresh downloads f and reloads it if it was changed.
+func (s *RemoteFileSet) refresh(f *remoteFile) error {
+	b, err := s.download(f)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		s.logger.Debug("remote file is not modified", zap.String("url", f.args.URL))
+		return nil
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	old := f.content.Load()
+	if old != nil && bytes.Equal(*old, b) {
+		return nil
+	}
+	f.content.Store(&b)
+	if err := s.reload(); err != nil {
+		f.content.Store(old)
+		// Also drop the validators, so the next refresh downloads the
+		// file again.
+		f.etag, f.lastModified = "", ""
+		return fmt.Errorf("failed to reload, %w", err)
+	}
+	s.saveFallback(f, b)
+	s.logger.Info("remote file reloaded", zap.String("url", f.args.URL), zap.Int("size", len(b)))
+	return nil
+}
+
+// download downloads f. It returns nil if the file was not modified.
+func (s *RemoteFileSet) download(f *remoteFile) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, f.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.args.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.etag) > 0 {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if len(f.lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body, %w", err)
+	}
+	if len(b) > maxRemoteFileSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxRemoteFileSize)
+	}
+
+	want := f.checksum
+	if len(f.args.ChecksumURL) > 0 {
+		if want, err = s.downloadChecksum(ctx, f.args.ChecksumURL); err != nil {
+			return nil, fmt.Errorf("failed to download checksum, %w", err)
+		}
+	}
+	if want != nil {
+		if sum := sha256.Sum256(b); !bytes.Equal(sum[:], want) {
+			return nil, fmt.Errorf("checksum mismatched, want %x, got %x", want, sum)
+		}
+	}
+
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	return b, nil
+}
+
+func (s *RemoteFileSet) downloadChecksum(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return nil, err
+	}
+	// sha256sum format: "<hex>  <file name>"
+	fs := strings.Fields(string(b))
+	if len(fs) == 0 {
+		return nil, errors.New("empty checksum file")
+	}
+	return parseChecksum(fs[0])
+}
+
+func (s *RemoteFileSet) saveFallback(f *remoteFile, b []byte) {
+	if len(f.args.Fallback) == 0 {
+		return
+	}
+	if err := writeFileAtomic(f.args.Fallback, b); err != nil {
+		s.logger.Warn("failed to save fallback file", zap.String("file", f.args.Fallback), zap.Error(err))
+	}
+}
+
+func writeFileAtomic(name string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func parseChecksum(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "sha256:"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum, %w", err)
+	}
+	if len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid checksum length %d", len(b))
+	}
+	return b, nil
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testRemoteServer struct {
+	mu       sync.Mutex
+	body     string
+	etag     string
+	down     bool
+	requests int
+	notMod   int
+}
+
+func (s *testRemoteServer) set(body, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.etag = body, etag
+}
+
+func (s *testRemoteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path == "/list.sha256sum" {
+		sum := sha256.Sum256([]byte(s.body))
+		w.Write([]byte(hex.EncodeToString(sum[:]) + "  list\n"))
+		return
+	}
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 && inm == s.etag {
+		s.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write([]byte(s.body))
+}
+
+func Test_RemoteFileSet(t *testing.T) {
+	srv := &testRemoteServer{body: "v1", etag: `"1"`}
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	fallback := filepath.Join(t.TempDir(), "list.txt")
+
+	var reloadErr error
+	reloaded := 0
+	reload := func() error {
+		if reloadErr != nil {
+			return reloadErr
+		}
+		reloaded++
+		return nil
+	}
+
+	rs, err := NewRemoteFileSet([]RemoteFileArgs{{URL: hs.URL + "/list", Fallback: fallback}}, nil, reload)
+	require.NoError(t, err)
+	defer rs.Close()
+	require.Equal(t, "v1", string(rs.Get(0)))
+	b, err := os.ReadFile(fallback)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(b))
+
+	f := rs.files[0]
+
+	// Not modified.
+	require.NoError(t, rs.refresh(f))
+	require.Equal(t, 1, srv.notMod)
+	require.Equal(t, 0, reloaded)
+
+	// Modified.
+	srv.set("v2", `"2"`)
+	require.NoError(t, rs.refresh(f))
+	require.Equal(t, 1, reloaded)
+	require.Equal(t, "v2", string(rs.Get(0)))
+
+	// Bad data is rolled back and is not saved.
+	srv.set("bad", `"3"`)
+	reloadErr = errors.New("parse error")
+	require.Error(t, rs.refresh(f))
+	require.Equal(t, "v2", string(rs.Get(0)))
+	b, err = os.ReadFile(fallback)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+	reloadErr = nil
+
+	// Server is down.
+	srv.mu.Lock()
+	srv.down = true
+	srv.mu.Unlock()
+	require.Error(t, rs.refresh(f))
+	require.Equal(t, "v2", string(rs.Get(0)))
+
+	// Start with the fallback while the server is down.
+	rs2, err := NewRemoteFileSet([]RemoteFileArgs{{URL: hs.URL + "/list", Fallback: fallback}}, nil, reload)
+	require.NoError(t, err)
+	defer rs2.Close()
+	require.Equal(t, "v2", string(rs2.Get(0)))
+
+	// No fallback, the first download must succeed.
+	_, err = NewRemoteFileSet([]RemoteFileArgs{{URL: hs.URL + "/list"}}, nil, reload)
+	require.Error(t, err)
+}
+
+func Test_RemoteFileSet_checksum(t *testing.T) {
+	srv := &testRemoteServer{body: "v1"}
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	sum := sha256.Sum256([]byte("v1"))
+
+	rs, err := NewRemoteFileSet([]RemoteFileArgs{
+		{URL: hs.URL + "/list", Checksum: "sha256:" + hex.EncodeToString(sum[:])},
+		{URL: hs.URL + "/list", ChecksumURL: hs.URL + "/list.sha256sum"},
+	}, nil, func() error { return nil })
+	require.NoError(t, err)
+	defer rs.Close()
+
+	// Fixed checksum mismatches.
+	srv.set("v2", "")
+	err = rs.refresh(rs.files[0])
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "checksum"))
+	require.Equal(t, "v1", string(rs.Get(0)))
+
+	// checksum_url follows the file.
+	require.NoError(t, rs.refresh(rs.files[1]))
+	require.Equal(t, "v2", string(rs.Get(1)))
+
+	_, err = NewRemoteFileSet([]RemoteFileArgs{{URL: hs.URL + "/list", Checksum: "00"}}, nil, nil)
+	require.Error(t, err)
+}
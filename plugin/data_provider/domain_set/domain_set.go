@@ -23,9 +23,11 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/geodata"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/plugin/common"
 	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
@@ -36,6 +38,9 @@ const PluginType = "domain_set"
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		return args.(*Args).Sets, nil
+	})
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -43,11 +48,35 @@ func Init(bp *coremain.BP, args any) (any, error) {
 }
 
 type Args struct {
-	Exps         []string `yaml:"exps"`
-	Sets         []string `yaml:"sets"`
-	Files        []string `yaml:"files"`
-	AutoReload   bool     `yaml:"auto_reload"`
-	DebounceTime uint     `yaml:"debounce_time"`
+	Exps         []string      `yaml:"exps"`
+	Sets         []string      `yaml:"sets"`
+	Files        []string      `yaml:"files"`
+	Lists        []ListArgs    `yaml:"lists"`
+	URLs         []URLArgs     `yaml:"urls"`
+	GeoSite      []GeoSiteArgs `yaml:"geosite"`
+	AutoReload   bool          `yaml:"auto_reload"`
+	DebounceTime uint          `yaml:"debounce_time"`
+}
+
+// ListArgs is a list file in a format other than mosdns's own.
+type ListArgs struct {
+	File string `yaml:"file"`
+	// Format is one of "mosdns" (default), "plain", "hosts", "adblock"
+	// and "dnsmasq". See domain.ListFormat.
+	Format string `yaml:"format"`
+}
+
+// GeoSiteArgs selects domains from a v2ray geosite.dat file.
+type GeoSiteArgs struct {
+	File string `yaml:"file"`
+	// Codes are like "cn" and "category-ads-all@ads". See geodata.LoadGeoSite.
+	Codes []string `yaml:"codes"`
+}
+
+// URLArgs is a remote list.
+type URLArgs struct {
+	common.RemoteFileArgs `yaml:",squash"`
+	Format                string `yaml:"format"`
 }
 
 var _ data_provider.DomainMatcherProvider = (*DomainSet)(nil)
@@ -55,6 +84,9 @@ var _ data_provider.DomainMatcherProvider = (*DomainSet)(nil)
 type DomainSet struct {
 	dynamicGroup *DynamicMatcherGroup
 	reloader     *common.ReloadableFileSet
+	remote       *common.RemoteFileSet
+
+	mu sync.Mutex // for rebuilding.
 
 	files []string
 
@@ -71,22 +103,40 @@ func (d *DomainSet) GetDomainMatcher() domain.Matcher[struct{}] {
 // ---------------- matcher rebuild ----------------
 
 func (d *DomainSet) rebuildMatcher() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.logger.Info("[DOMAIN] rebuilding domain matcher")
 
 	var matchers []domain.Matcher[struct{}]
 
-	// expressions + files
-	if len(d.args.Exps) > 0 || len(d.args.Files) > 0 {
+	// expressions + files + lists + urls + geosite
+	allow := domain.NewDomainMixMatcher()
+	important := domain.NewDomainMixMatcher()
+	importantAllow := domain.NewDomainMixMatcher()
+	if len(d.args.Exps) > 0 || len(d.args.Files) > 0 || len(d.args.Lists) > 0 || len(d.args.URLs) > 0 || len(d.args.GeoSite) > 0 {
 		m := domain.NewDomainMixMatcher()
+		lm := domain.ListMatchers{Block: m, Allow: allow, Important: important, ImportantAllow: importantAllow}
 		if err := LoadExpsAndFiles(d.args.Exps, d.args.Files, m); err != nil {
 			return err
 		}
+		if err := LoadLists(d.args.Lists, lm, d.logger); err != nil {
+			return err
+		}
+		if err := d.loadURLs(lm); err != nil {
+			return err
+		}
+		if err := LoadGeoSites(d.args.GeoSite, m); err != nil {
+			return err
+		}
 		if m.Len() > 0 {
 			matchers = append(matchers, m)
 			d.logger.Info(
 				"[DOMAIN] loaded",
 				zap.Int("domains", m.Len()),
-				zap.Int("files", len(d.args.Files)),
+				zap.Int("allowed_domains", allow.Len()+importantAllow.Len()),
+				zap.Int("important_domains", important.Len()),
+				zap.Int("files", len(d.args.Files)+len(d.args.Lists)),
+				zap.Int("urls", len(d.args.URLs)),
 				zap.Int("exps", len(d.args.Exps)),
 			)
 		}
@@ -101,6 +151,14 @@ func (d *DomainSet) rebuildMatcher() error {
 		matchers = append(matchers, p.GetDomainMatcher())
 	}
 
+	if allow.Len() > 0 || important.Len() > 0 || importantAllow.Len() > 0 {
+		// Allow rules apply to the whole set, including referenced sets.
+		// Important rules take precedence over the rules without it.
+		var mg domain.Matcher[struct{}] = ExceptMatcher{M: MatcherGroup(matchers), Except: allow}
+		mg = MatcherGroup{important, mg}
+		mg = ExceptMatcher{M: mg, Except: importantAllow}
+		matchers = []domain.Matcher[struct{}]{mg}
+	}
 	d.dynamicGroup.Update(MatcherGroup(matchers))
 
 	d.logger.Info(
@@ -121,18 +179,45 @@ func NewDomainSet(bp *coremain.BP, args *Args) (*DomainSet, error) {
 		logger:       bp.L(),
 	}
 
+	if len(args.URLs) > 0 {
+		remoteArgs := make([]common.RemoteFileArgs, 0, len(args.URLs))
+		for _, u := range args.URLs {
+			if _, err := domain.ParseListFormat(u.Format); err != nil {
+				return nil, fmt.Errorf("url %s: %w", u.URL, err)
+			}
+			remoteArgs = append(remoteArgs, u.RemoteFileArgs)
+		}
+		r, err := common.NewRemoteFileSet(remoteArgs, ds.logger, ds.rebuildMatcher)
+		if err != nil {
+			return nil, err
+		}
+		ds.remote = r
+	}
+
 	if err := ds.rebuildMatcher(); err != nil {
+		ds.Close()
 		return nil, err
 	}
+	if ds.remote != nil {
+		ds.remote.Start()
+	}
 
-	if args.AutoReload && len(args.Files) > 0 {
+	ds.files = append(ds.files, args.Files...)
+	for _, l := range args.Lists {
+		ds.files = append(ds.files, l.File)
+	}
+	for _, g := range args.GeoSite {
+		ds.files = append(ds.files, g.File)
+	}
+	if args.AutoReload && len(ds.files) > 0 {
 		r, err := common.NewReloadableFileSet(
-			args.Files,
+			ds.files,
 			time.Duration(ds.args.DebounceTime)*time.Second,
 			ds.logger,
 			ds.rebuildMatcher,
 		)
 		if err != nil {
+			ds.Close()
 			return nil, err
 		}
 		ds.reloader = r
@@ -142,12 +227,27 @@ func NewDomainSet(bp *coremain.BP, args *Args) (*DomainSet, error) {
 }
 
 func (d *DomainSet) Close() error {
+	if d.remote != nil {
+		d.remote.Close()
+	}
 	if d.reloader != nil {
 		return d.reloader.Close()
 	}
 	return nil
 }
 
+func (d *DomainSet) loadURLs(lm domain.ListMatchers) error {
+	for i, u := range d.args.URLs {
+		f, _ := domain.ParseListFormat(u.Format) // checked in NewDomainSet
+		skipped, err := domain.LoadListFromTextReader(lm, bytes.NewReader(d.remote.Get(i)), f)
+		if err != nil {
+			return fmt.Errorf("url #%d (%s): %w", i, u.URL, err)
+		}
+		logSkipped(d.logger, u.URL, skipped)
+	}
+	return nil
+}
+
 // ---------------- loading helpers ----------------
 
 func LoadExpsAndFiles(exps []string, fs []string, m *domain.MixMatcher[struct{}]) error {
@@ -182,3 +282,49 @@ func LoadFile(f string, m *domain.MixMatcher[struct{}]) error {
 	}
 	return domain.LoadFromTextReader(m, bytes.NewReader(b), nil)
 }
+
+// LoadLists loads list files to lm. Invalid lines are skipped and
+// logged by logger.
+func LoadLists(ls []ListArgs, lm domain.ListMatchers, logger *zap.Logger) error {
+	for i, l := range ls {
+		skipped, err := LoadList(l, lm)
+		if err != nil {
+			return fmt.Errorf("list #%d (%s): %w", i, l.File, err)
+		}
+		logSkipped(logger, l.File, skipped)
+	}
+	return nil
+}
+
+// LoadList loads a list file to lm. It returns the number of skipped
+// invalid lines.
+func LoadList(l ListArgs, lm domain.ListMatchers) (int, error) {
+	f, err := domain.ParseListFormat(l.Format)
+	if err != nil {
+		return 0, err
+	}
+	b, err := os.ReadFile(l.File)
+	if err != nil {
+		return 0, err
+	}
+	return domain.LoadListFromTextReader(lm, bytes.NewReader(b), f)
+}
+
+func logSkipped(logger *zap.Logger, src string, skipped int) {
+	if skipped > 0 {
+		logger.Warn("[DOMAIN] skipped invalid lines", zap.String("list", src), zap.Int("lines", skipped))
+	}
+}
+
+func LoadGeoSites(gs []GeoSiteArgs, m *domain.MixMatcher[struct{}]) error {
+	for i, g := range gs {
+		b, err := os.ReadFile(g.File)
+		if err != nil {
+			return fmt.Errorf("geosite #%d (%s): %w", i, g.File, err)
+		}
+		if err := geodata.LoadGeoSite(m, b, g.Codes...); err != nil {
+			return fmt.Errorf("geosite #%d (%s): %w", i, g.File, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain_set
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DomainSet_adblockImportant(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "adblock.txt")
+	require.NoError(t, os.WriteFile(list, []byte(
+		"||ads.example^\n"+
+			"@@||ok.ads.example^\n"+
+			"||tracker.example^$important\n"+
+			"@@||tracker.example^\n"+
+			"||cdn.example^$important\n"+
+			"@@||cdn.example^$important\n"+
+			"0.0.0.0 bad/name.example\n",
+	), 0644))
+
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	ds, err := NewDomainSet(coremain.NewBP("set", m), &Args{Lists: []ListArgs{{File: list, Format: "adblock"}}})
+	require.NoError(t, err)
+	defer ds.Close()
+
+	for d, want := range map[string]bool{
+		"ads.example":       true,
+		"ok.ads.example":    false, // allow beats block
+		"tracker.example":   true,  // important block beats allow
+		"a.tracker.example": true,
+		"cdn.example":       false, // important allow beats important block
+		"other.example":     false,
+	} {
+		_, ok := ds.GetDomainMatcher().Match(d)
+		require.Equal(t, want, ok, d)
+	}
+}
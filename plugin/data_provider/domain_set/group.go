@@ -36,6 +36,19 @@ func (mg MatcherGroup) Match(s string) (struct{}, bool) {
 	return struct{}{}, false
 }
 
+// ExceptMatcher matches domains that are matched by M but not by Except.
+type ExceptMatcher struct {
+	M      domain.Matcher[struct{}]
+	Except domain.Matcher[struct{}]
+}
+
+func (em ExceptMatcher) Match(s string) (struct{}, bool) {
+	if _, ok := em.Except.Match(s); ok {
+		return struct{}{}, false
+	}
+	return em.M.Match(s)
+}
+
 // DynamicMatcherGroup 动态matcher组，支持热重载
 type DynamicMatcherGroup struct {
 	matchers *atomic.Value // 存储MatcherGroup
@@ -20,8 +20,11 @@
 package data_provider
 
 import (
+	"net/netip"
+
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
 )
 
 type DomainMatcherProvider interface {
@@ -31,3 +34,14 @@ type DomainMatcherProvider interface {
 type IPMatcherProvider interface {
 	GetIPMatcher() netlist.Matcher
 }
+
+type ZoneProvider interface {
+	// GetZones returns the current zones. The returned Zones must not be modified.
+	GetZones() *zone_file.Zones
+}
+
+// ZoneNotifyHandler is a ZoneProvider that accepts NOTIFY messages. RFC 1996.
+type ZoneNotifyHandler interface {
+	// HandleNotify reports whether the NOTIFY of zone from addr is accepted.
+	HandleNotify(zone string, from netip.Addr) bool
+}
@@ -25,9 +25,11 @@ import (
 	"net/netip"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/geodata"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
 	"github.com/IrineSistiana/mosdns/v5/plugin/common"
 	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
@@ -38,6 +40,9 @@ const PluginType = "ip_set"
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		return args.(*Args).Sets, nil
+	})
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -45,11 +50,20 @@ func Init(bp *coremain.BP, args any) (any, error) {
 }
 
 type Args struct {
-	IPs          []string `yaml:"ips"`
-	Sets         []string `yaml:"sets"`
-	Files        []string `yaml:"files"`
-	AutoReload   bool     `yaml:"auto_reload"`
-	DebounceTime uint     `yaml:"debounce_time"`
+	IPs          []string                `yaml:"ips"`
+	Sets         []string                `yaml:"sets"`
+	Files        []string                `yaml:"files"`
+	URLs         []common.RemoteFileArgs `yaml:"urls"`
+	GeoIP        []GeoIPArgs             `yaml:"geoip"`
+	AutoReload   bool                    `yaml:"auto_reload"`
+	DebounceTime uint                    `yaml:"debounce_time"`
+}
+
+// GeoIPArgs selects cidrs from a v2ray geoip.dat or a MaxMind mmdb file.
+// The file type is detected by its content.
+type GeoIPArgs struct {
+	File  string   `yaml:"file"`
+	Codes []string `yaml:"codes"`
 }
 
 var _ data_provider.IPMatcherProvider = (*IPSet)(nil)
@@ -62,6 +76,9 @@ type IPSet struct {
 	args     *Args
 	dynamic  *DynamicMatcherGroup
 	reloader *common.ReloadableFileSet
+	remote   *common.RemoteFileSet
+
+	mu sync.Mutex // for rebuilding.
 
 	files []string
 }
@@ -78,18 +95,35 @@ func NewIPSet(bp *coremain.BP, args *Args) (*IPSet, error) {
 		logger:  bp.L(),
 	}
 
+	if len(args.URLs) > 0 {
+		r, err := common.NewRemoteFileSet(args.URLs, d.logger, d.rebuildMatcher)
+		if err != nil {
+			return nil, err
+		}
+		d.remote = r
+	}
+
 	if err := d.rebuildMatcher(); err != nil {
+		d.Close()
 		return nil, err
 	}
+	if d.remote != nil {
+		d.remote.Start()
+	}
 
-	if args.AutoReload && len(args.Files) > 0 {
+	d.files = append(d.files, args.Files...)
+	for _, g := range args.GeoIP {
+		d.files = append(d.files, g.File)
+	}
+	if args.AutoReload && len(d.files) > 0 {
 		r, err := common.NewReloadableFileSet(
-			args.Files,
+			d.files,
 			time.Duration(d.args.DebounceTime)*time.Second,
 			d.logger,
 			d.rebuildMatcher,
 		)
 		if err != nil {
+			d.Close()
 			return nil, err
 		}
 		d.reloader = r
@@ -99,13 +133,23 @@ func NewIPSet(bp *coremain.BP, args *Args) (*IPSet, error) {
 }
 
 func (d *IPSet) rebuildMatcher() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	var matchers []netlist.Matcher
 
-	// IPs + Files
+	// IPs + Files + URLs
 	l := netlist.NewList()
 	if err := LoadFromIPsAndFiles(d.args.IPs, d.args.Files, l); err != nil {
 		return err
 	}
+	for i, u := range d.args.URLs {
+		if err := netlist.LoadFromReader(l, bytes.NewReader(d.remote.Get(i))); err != nil {
+			return fmt.Errorf("failed to load url #%d %s, %w", i, u.URL, err)
+		}
+	}
+	if err := LoadGeoIPs(d.args.GeoIP, l); err != nil {
+		return err
+	}
 	l.Sort()
 	if l.Len() > 0 {
 		matchers = append(matchers, l)
@@ -118,6 +162,7 @@ func (d *IPSet) rebuildMatcher() error {
 			"[IP] loaded",
 			zap.Int("ip", l.Len()),
 			zap.Int("files", len(d.args.Files)),
+			zap.Int("urls", len(d.args.URLs)),
 		)
 	}
 
@@ -140,6 +185,9 @@ func (d *IPSet) rebuildMatcher() error {
 }
 
 func (d *IPSet) Close() error {
+	if d.remote != nil {
+		d.remote.Close()
+	}
 	if d.reloader != nil {
 		return d.reloader.Close()
 	}
@@ -197,3 +245,21 @@ func LoadFromFile(f string, l *netlist.List) error {
 	}
 	return netlist.LoadFromReader(l, bytes.NewReader(b))
 }
+
+func LoadGeoIPs(gs []GeoIPArgs, l *netlist.List) error {
+	for i, g := range gs {
+		b, err := os.ReadFile(g.File)
+		if err != nil {
+			return fmt.Errorf("failed to load geoip #%d %s, %w", i, g.File, err)
+		}
+		if geodata.IsMMDB(b) {
+			err = geodata.LoadMMDB(l, b, g.Codes...)
+		} else {
+			err = geodata.LoadGeoIP(l, b, g.Codes...)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load geoip #%d %s, %w", i, g.File, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondary_zone
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "secondary_zone"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	defaultTimeout = time.Second * 10
+	// initialRetry is the retry interval before the first successful
+	// transfer, when there is no SOA to read it from.
+	initialRetry = time.Second * 30
+	minInterval  = time.Second
+)
+
+type Args struct {
+	// Primary is the address of the primary server, "ip" or "ip:port".
+	// NOTIFY is only accepted from this address.
+	Primary string   `yaml:"primary"`
+	Zones   []string `yaml:"zones"`
+
+	TsigName      string `yaml:"tsig_name"`
+	TsigAlgorithm string `yaml:"tsig_algorithm"` // Default is hmac-sha256.
+	TsigSecret    string `yaml:"tsig_secret"`    // base64
+
+	DisableIXFR bool `yaml:"disable_ixfr"`
+	Timeout     int  `yaml:"timeout"` // in seconds.
+}
+
+var (
+	_ data_provider.ZoneProvider      = (*SecondaryZone)(nil)
+	_ data_provider.ZoneNotifyHandler = (*SecondaryZone)(nil)
+	_ coremain.ReusablePlugin         = (*SecondaryZone)(nil)
+)
+
+// SecondaryZone keeps copies of zones from a primary server with zone
+// transfers. Zones are refreshed by the SOA timers and on NOTIFY. RFC 1034 4.3.5.
+type SecondaryZone struct {
+	args        *Args
+	logger      *zap.Logger
+	primary     netip.AddrPort
+	timeout     time.Duration
+	tsigName    string
+	tsigAlg     string
+	tsigSecrets map[string]string
+
+	zones    map[string]*zone
+	snapshot atomic.Pointer[zone_file.Zones]
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	wg          sync.WaitGroup
+}
+
+type zone struct {
+	name   string
+	notify chan struct{}
+
+	// Only accessed by the refresh goroutine, except under mu for rebuilding.
+	mu          sync.Mutex
+	soa         *dns.SOA // nil if not loaded or expired.
+	rrs         []dns.RR // without SOA.
+	lastSuccess time.Time
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewSecondaryZone(args.(*Args), bp.L())
+}
+
+func NewSecondaryZone(args *Args, logger *zap.Logger) (*SecondaryZone, error) {
+	if len(args.Zones) == 0 {
+		return nil, errors.New("no zone is configured")
+	}
+	primary, err := parsePrimary(args.Primary)
+	if err != nil {
+		return nil, fmt.Errorf("invalid primary address, %w", err)
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	s := &SecondaryZone{
+		args:        args,
+		logger:      logger,
+		primary:     primary,
+		timeout:     time.Duration(args.Timeout) * time.Second,
+		zones:       make(map[string]*zone),
+		closeNotify: make(chan struct{}),
+	}
+	if s.timeout <= 0 {
+		s.timeout = defaultTimeout
+	}
+	if len(args.TsigName) > 0 {
+		if len(args.TsigSecret) == 0 {
+			return nil, errors.New("missing tsig secret")
+		}
+		s.tsigName = dns.CanonicalName(args.TsigName)
+		s.tsigAlg = dns.HmacSHA256
+		if len(args.TsigAlgorithm) > 0 {
+			s.tsigAlg = dns.CanonicalName(args.TsigAlgorithm)
+		}
+		s.tsigSecrets = map[string]string{s.tsigName: args.TsigSecret}
+	}
+
+	for _, name := range args.Zones {
+		name = dns.CanonicalName(name)
+		if _, dup := s.zones[name]; dup {
+			return nil, fmt.Errorf("duplicated zone %s", name)
+		}
+		s.zones[name] = &zone{name: name, notify: make(chan struct{}, 1)}
+	}
+	s.snapshot.Store(new(zone_file.Zones))
+	for _, z := range s.zones {
+		s.wg.Add(1)
+		go s.run(z)
+	}
+	return s, nil
+}
+
+func parsePrimary(s string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.AddrPortFrom(addr, 53), nil
+	}
+	return netip.ParseAddrPort(s)
+}
+
+func (s *SecondaryZone) GetZones() *zone_file.Zones {
+	return s.snapshot.Load()
+}
+
+// HandleNotify triggers a refresh of the zone if the NOTIFY is from
+// the primary. The SOA query that follows is TSIG signed if TSIG is
+// configured, so the NOTIFY itself is not verified.
+func (s *SecondaryZone) HandleNotify(name string, from netip.Addr) bool {
+	z := s.zones[dns.CanonicalName(name)]
+	if z == nil {
+		return false
+	}
+	if from.Unmap() != s.primary.Addr().Unmap() {
+		s.logger.Warn("notify from unknown address", zap.String("zone", z.name), zap.Stringer("from", from))
+		return false
+	}
+	select {
+	case z.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// PrepareReuse keeps the transferred zones across config reloads.
+func (s *SecondaryZone) PrepareReuse(_ *coremain.BP) (func(), error) {
+	return nil, nil
+}
+
+func (s *SecondaryZone) Close() error {
+	s.closeOnce.Do(func() { close(s.closeNotify) })
+	s.wg.Wait()
+	return nil
+}
+
+func (s *SecondaryZone) run(z *zone) {
+	defer s.wg.Done()
+	for {
+		timer := time.NewTimer(s.refresh(z))
+		select {
+		case <-s.closeNotify:
+			timer.Stop()
+			return
+		case <-z.notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// refresh syncs z with the primary and returns the interval to the
+// next refresh.
+func (s *SecondaryZone) refresh(z *zone) time.Duration {
+	updated, err := s.sync(z)
+	if err == nil {
+		z.lastSuccess = time.Now()
+		if updated {
+			s.logger.Info("zone updated", zap.String("zone", z.name), zap.Uint32("serial", z.soa.Serial), zap.Int("records", len(z.rrs)))
+			s.rebuild()
+		}
+		return soaInterval(z.soa.Refresh)
+	}
+
+	s.logger.Warn("failed to refresh zone", zap.String("zone", z.name), zap.Error(err))
+	if z.soa == nil {
+		return initialRetry
+	}
+	retry := soaInterval(z.soa.Retry)
+	if time.Since(z.lastSuccess) > soaInterval(z.soa.Expire) {
+		s.logger.Error("zone expired", zap.String("zone", z.name))
+		z.mu.Lock()
+		z.soa, z.rrs = nil, nil
+		z.mu.Unlock()
+		s.rebuild()
+	}
+	return retry
+}
+
+func soaInterval(sec uint32) time.Duration {
+	d := time.Duration(sec) * time.Second
+	if d < minInterval {
+		return minInterval
+	}
+	return d
+}
+
+// sync checks the serial of z on the primary and transfers z if
+// the primary has a newer one.
+func (s *SecondaryZone) sync(z *zone) (updated bool, err error) {
+	if z.soa != nil {
+		serial, err := s.querySerial(z.name)
+		if err != nil {
+			return false, fmt.Errorf("failed to query soa, %w", err)
+		}
+		if !serialLess(z.soa.Serial, serial) {
+			return false, nil
+		}
+	}
+
+	var soa *dns.SOA
+	var rrs []dns.RR
+	if z.soa != nil && !s.args.DisableIXFR {
+		soa, rrs, err = s.ixfr(z)
+		if err != nil {
+			s.logger.Warn("ixfr failed, fallback to axfr", zap.String("zone", z.name), zap.Error(err))
+		}
+	}
+	if soa == nil {
+		soa, rrs, err = s.axfr(z.name)
+		if err != nil {
+			return false, err
+		}
+	}
+	if z.soa != nil && !serialLess(z.soa.Serial, soa.Serial) {
+		return false, nil
+	}
+
+	z.mu.Lock()
+	z.soa, z.rrs = soa, rrs
+	z.mu.Unlock()
+	return true, nil
+}
+
+// serialLess compares serials with RFC 1982 serial number arithmetic.
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+// rebuild rebuilds the snapshot from all loaded zones.
+func (s *SecondaryZone) rebuild() {
+	var all []dns.RR
+	for _, z := range s.zones {
+		z.mu.Lock()
+		if z.soa != nil {
+			all = append(all, z.soa)
+			all = append(all, z.rrs...)
+		}
+		z.mu.Unlock()
+	}
+	zs, _ := zone_file.NewZones(all)
+	s.snapshot.Store(zs)
+}
+
+func (s *SecondaryZone) tsig(m *dns.Msg) {
+	if len(s.tsigName) > 0 {
+		m.SetTsig(s.tsigName, s.tsigAlg, 300, time.Now().Unix())
+	}
+}
+
+func (s *SecondaryZone) querySerial(name string) (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeSOA)
+	m.RecursionDesired = false
+	s.tsig(m)
+	c := &dns.Client{Timeout: s.timeout, TsigSecret: s.tsigSecrets}
+	r, _, err := c.Exchange(m, s.primary.String())
+	if err != nil {
+		return 0, err
+	}
+	if r.Truncated {
+		c.Net = "tcp"
+		s.tsig(m)
+		if r, _, err = c.Exchange(m, s.primary.String()); err != nil {
+			return 0, err
+		}
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("primary returned %s", dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, name) {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no soa in response")
+}
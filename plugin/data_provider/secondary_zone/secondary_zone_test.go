@@ -0,0 +1,340 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondary_zone
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/arbitrary"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/udp_server"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTsigName   = "xfr-key."
+	testTsigSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+)
+
+// testPrimary is a primary server that serves one zone with
+// AXFR and IXFR (from the previous version only).
+type testPrimary struct {
+	mu      sync.Mutex
+	zone    string
+	serial  uint32
+	records map[uint32][]dns.RR // serial -> records without SOA.
+	xfrs    []uint16
+}
+
+func (p *testPrimary) soa(serial uint32) *dns.SOA {
+	rr, _ := dns.NewRR(p.zone + " 3600 IN SOA ns.example.com. admin.example.com. 0 3600 600 86400 300")
+	soa := rr.(*dns.SOA)
+	soa.Serial = serial
+	return soa
+}
+
+func (p *testPrimary) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if q.IsTsig() == nil || w.TsigStatus() != nil {
+		r.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(r)
+		return
+	}
+
+	p.mu.Lock()
+	serial := p.serial
+	records := p.records
+	qtype := q.Question[0].Qtype
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		p.xfrs = append(p.xfrs, qtype)
+	}
+	p.mu.Unlock()
+
+	var rrs []dns.RR
+	switch qtype {
+	case dns.TypeSOA:
+		r.Answer = []dns.RR{p.soa(serial)}
+		r.SetTsig(testTsigName, dns.HmacSHA256, 300, time.Now().Unix())
+		_ = w.WriteMsg(r)
+		return
+	case dns.TypeAXFR:
+		rrs = append(rrs, p.soa(serial))
+		rrs = append(rrs, records[serial]...)
+		rrs = append(rrs, p.soa(serial))
+	case dns.TypeIXFR:
+		from := q.Ns[0].(*dns.SOA).Serial
+		rrs = append(rrs, p.soa(serial))
+		if from == serial-1 {
+			rrs = append(rrs, p.soa(from))
+			rrs = append(rrs, diff(records[serial], records[from])...)
+			rrs = append(rrs, p.soa(serial))
+			rrs = append(rrs, diff(records[from], records[serial])...)
+		} else if from != serial {
+			rrs = append(rrs, records[serial]...)
+		}
+		if from != serial {
+			rrs = append(rrs, p.soa(serial))
+		}
+	}
+	ch := make(chan *dns.Envelope, 1)
+	ch <- &dns.Envelope{RR: rrs}
+	close(ch)
+	tr := new(dns.Transfer)
+	_ = tr.Out(w, q, ch)
+}
+
+// diff returns records in b that are not in a.
+func diff(a, b []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range b {
+		if len(deleteRR(append([]dns.RR(nil), a...), rr)) == len(a) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func (p *testPrimary) update(rrs ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.serial++
+	for _, s := range rrs {
+		rr, _ := dns.NewRR(s)
+		p.records[p.serial] = append(p.records[p.serial], rr)
+	}
+}
+
+func (p *testPrimary) transfers() []uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]uint16(nil), p.xfrs...)
+}
+
+func startPrimary(t *testing.T, p *testPrimary) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	uc, err := net.ListenPacket("udp", addr)
+	require.NoError(t, err)
+
+	secrets := map[string]string{testTsigName: testTsigSecret}
+	ts := &dns.Server{Listener: l, Handler: p, TsigSecret: secrets}
+	us := &dns.Server{PacketConn: uc, Handler: p, TsigSecret: secrets}
+	go ts.ActivateAndServe()
+	go us.ActivateAndServe()
+	t.Cleanup(func() {
+		_ = ts.Shutdown()
+		_ = us.Shutdown()
+	})
+	return addr
+}
+
+func lookup(s *SecondaryZone, name string, qtype uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	return s.GetZones().Reply(q)
+}
+
+func answerA(r *dns.Msg) string {
+	if r == nil || len(r.Answer) != 1 {
+		return ""
+	}
+	if a, ok := r.Answer[0].(*dns.A); ok {
+		return a.A.String()
+	}
+	return ""
+}
+
+func Test_SecondaryZone(t *testing.T) {
+	p := &testPrimary{zone: "example.com.", records: make(map[uint32][]dns.RR)}
+	p.update(
+		"example.com. 3600 IN NS ns.example.com.",
+		"ns.example.com. 3600 IN A 192.0.2.53",
+		"www.example.com. 3600 IN A 192.0.2.1",
+	)
+	addr := startPrimary(t, p)
+
+	s, err := NewSecondaryZone(&Args{
+		Primary:    addr,
+		Zones:      []string{"example.com"},
+		TsigName:   testTsigName,
+		TsigSecret: testTsigSecret,
+	}, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.Eventually(t, func() bool {
+		return answerA(lookup(s, "www.example.com.", dns.TypeA)) == "192.0.2.1"
+	}, time.Second*5, time.Millisecond*10)
+	require.Equal(t, dns.RcodeNameError, lookup(s, "nx.example.com.", dns.TypeA).Rcode)
+	require.Nil(t, lookup(s, "example.org.", dns.TypeA))
+
+	// NOTIFY from other addresses or for unknown zones is ignored.
+	require.False(t, s.HandleNotify("example.com.", netip.MustParseAddr("192.0.2.100")))
+	require.False(t, s.HandleNotify("example.org.", netip.MustParseAddr("127.0.0.1")))
+
+	// Change on primary, then NOTIFY. The change is fetched with IXFR.
+	p.update(
+		"example.com. 3600 IN NS ns.example.com.",
+		"ns.example.com. 3600 IN A 192.0.2.53",
+		"www.example.com. 3600 IN A 192.0.2.2",
+		"new.example.com. 3600 IN A 192.0.2.3",
+	)
+	require.True(t, s.HandleNotify("example.com.", netip.MustParseAddr("127.0.0.1")))
+	require.Eventually(t, func() bool {
+		return answerA(lookup(s, "www.example.com.", dns.TypeA)) == "192.0.2.2"
+	}, time.Second*5, time.Millisecond*10)
+	require.Equal(t, "192.0.2.3", answerA(lookup(s, "new.example.com.", dns.TypeA)))
+	require.Equal(t, []uint16{dns.TypeAXFR, dns.TypeIXFR}, p.transfers())
+}
+
+// Test_SecondaryZone_notifyFromServer sends a NOTIFY shaped like the
+// ones from BIND (SOA in the answer section, OPT and TSIG in the
+// additional section) through udp_server and arbitrary.
+func Test_SecondaryZone_notifyFromServer(t *testing.T) {
+	p := &testPrimary{zone: "example.com.", records: make(map[uint32][]dns.RR)}
+	p.update("www.example.com. 3600 IN A 192.0.2.1")
+	addr := startPrimary(t, p)
+
+	s, err := NewSecondaryZone(&Args{
+		Primary:    addr,
+		Zones:      []string{"example.com"},
+		TsigName:   testTsigName,
+		TsigSecret: testTsigSecret,
+	}, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Eventually(t, func() bool {
+		return answerA(lookup(s, "www.example.com.", dns.TypeA)) == "192.0.2.1"
+	}, time.Second*5, time.Millisecond*10)
+
+	a, err := arbitrary.NewArbitrary(&arbitrary.Args{}, []data_provider.ZoneProvider{s}, nil)
+	require.NoError(t, err)
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"arbitrary": a})
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serverAddr := c.LocalAddr().String()
+	c.Close()
+	us, err := udp_server.StartServer(coremain.NewBP("udp", m), &udp_server.Args{Entry: "arbitrary", Listen: serverAddr})
+	require.NoError(t, err)
+	defer us.Close()
+
+	p.update("www.example.com. 3600 IN A 192.0.2.2")
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+	notify.Answer = []dns.RR{p.soa(2)}
+	notify.SetEdns0(1232, false)
+	notify.SetTsig(testTsigName, dns.HmacSHA256, 300, time.Now().Unix())
+	b, _, err := dns.TsigGenerate(notify, testTsigSecret, "", false)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("udp", serverAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Write(b)
+	require.NoError(t, err)
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	r := new(dns.Msg)
+	require.NoError(t, r.Unpack(buf[:n]))
+	require.Equal(t, dns.OpcodeNotify, r.Opcode)
+	require.Equal(t, dns.RcodeSuccess, r.Rcode)
+	require.True(t, r.Authoritative)
+
+	require.Eventually(t, func() bool {
+		return answerA(lookup(s, "www.example.com.", dns.TypeA)) == "192.0.2.2"
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func Test_SecondaryZone_tsigRequired(t *testing.T) {
+	p := &testPrimary{zone: "example.com.", records: make(map[uint32][]dns.RR)}
+	p.update("www.example.com. 3600 IN A 192.0.2.1")
+	addr := startPrimary(t, p)
+
+	// Without TSIG, the primary refuses the transfer.
+	s, err := NewSecondaryZone(&Args{Primary: addr, Zones: []string{"example.com."}}, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	time.Sleep(time.Millisecond * 200)
+	require.Nil(t, lookup(s, "www.example.com.", dns.TypeA))
+}
+
+func Test_applyIXFR(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return r
+	}
+	soa := func(serial string) dns.RR {
+		return rr("example.com. 3600 IN SOA ns.example.com. admin.example.com. " + serial + " 3600 600 86400 300")
+	}
+	current := []dns.RR{rr("a.example.com. 300 IN A 192.0.2.1"), rr("b.example.com. 300 IN A 192.0.2.2")}
+
+	// Two difference sequences: 1 -> 2 -> 3.
+	newSOA, rrs, err := applyIXFR("example.com.", soa("1").(*dns.SOA), current, []dns.RR{
+		soa("3"),
+		soa("1"), rr("a.example.com. 300 IN A 192.0.2.1"),
+		soa("2"), rr("c.example.com. 300 IN A 192.0.2.3"),
+		soa("2"), rr("b.example.com. 300 IN A 192.0.2.2"),
+		soa("3"), rr("d.example.com. 300 IN A 192.0.2.4"), rr("out.example.org. 300 IN A 192.0.2.5"),
+		soa("3"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), newSOA.Serial)
+	require.Len(t, rrs, 2)
+	require.Equal(t, "c.example.com.", rrs[0].Header().Name)
+	require.Equal(t, "d.example.com.", rrs[1].Header().Name)
+	require.Len(t, current, 2, "current must not be modified")
+
+	// Up to date.
+	newSOA, rrs, err = applyIXFR("example.com.", soa("1").(*dns.SOA), current, []dns.RR{soa("1")})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), newSOA.Serial)
+	require.Equal(t, current, rrs)
+
+	// AXFR style.
+	newSOA, rrs, err = applyIXFR("example.com.", soa("1").(*dns.SOA), current, []dns.RR{
+		soa("2"), rr("x.example.com. 300 IN A 192.0.2.9"), soa("2"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), newSOA.Serial)
+	require.Len(t, rrs, 1)
+
+	_, _, err = applyIXFR("example.com.", soa("1").(*dns.SOA), current, []dns.RR{
+		soa("2"), soa("1"), rr("a.example.com. 300 IN A 192.0.2.1"),
+	})
+	require.Error(t, err)
+}
+
+func Test_serialLess(t *testing.T) {
+	require.True(t, serialLess(1, 2))
+	require.False(t, serialLess(2, 2))
+	require.False(t, serialLess(2, 1))
+	require.True(t, serialLess(0xffffffff, 1))
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondary_zone
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+func (s *SecondaryZone) transfer(m *dns.Msg) ([]dns.RR, error) {
+	s.tsig(m)
+	t := &dns.Transfer{
+		DialTimeout:  s.timeout,
+		ReadTimeout:  s.timeout,
+		WriteTimeout: s.timeout,
+		TsigSecret:   s.tsigSecrets,
+	}
+	ch, err := t.In(m, s.primary.String())
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			err = env.Error
+			continue // Drain the channel.
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rrs) == 0 {
+		return nil, errors.New("empty transfer")
+	}
+	return rrs, nil
+}
+
+// axfr transfers the full zone. RFC 5936.
+func (s *SecondaryZone) axfr(name string) (*dns.SOA, []dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(name)
+	rrs, err := s.transfer(m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("axfr failed, %w", err)
+	}
+	return fullTransfer(name, rrs)
+}
+
+// fullTransfer returns the records of an AXFR style transfer, which
+// starts and ends with the SOA.
+func fullTransfer(name string, rrs []dns.RR) (*dns.SOA, []dns.RR, error) {
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok || len(rrs) < 2 {
+		return nil, nil, errors.New("invalid transfer, missing soa")
+	}
+	if _, ok := rrs[len(rrs)-1].(*dns.SOA); !ok {
+		return nil, nil, errors.New("invalid transfer, missing trailing soa")
+	}
+	var out []dns.RR
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			out = append(out, rr)
+		}
+	}
+	return soa, out, nil
+}
+
+// ixfr transfers the changes since the serial of z. RFC 1995.
+// The primary may also reply with a full zone.
+func (s *SecondaryZone) ixfr(z *zone) (*dns.SOA, []dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetIxfr(z.name, z.soa.Serial, z.soa.Ns, z.soa.Mbox)
+	rrs, err := s.transfer(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	return applyIXFR(z.name, z.soa, z.rrs, rrs)
+}
+
+func applyIXFR(name string, oldSOA *dns.SOA, current, rrs []dns.RR) (*dns.SOA, []dns.RR, error) {
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, nil, errors.New("invalid ixfr, missing soa")
+	}
+	if len(rrs) == 1 {
+		// Up to date.
+		return oldSOA, current, nil
+	}
+	if _, ok := rrs[1].(*dns.SOA); !ok {
+		return fullTransfer(name, rrs)
+	}
+
+	out := make([]dns.RR, len(current))
+	copy(out, current)
+	i, end := 1, len(rrs)-1
+	if _, ok := rrs[end].(*dns.SOA); !ok {
+		return nil, nil, errors.New("invalid ixfr, missing trailing soa")
+	}
+	for i < end {
+		// Each difference sequence is: old SOA, deleted records,
+		// new SOA, added records.
+		if _, ok := rrs[i].(*dns.SOA); !ok {
+			return nil, nil, fmt.Errorf("invalid ixfr, unexpected %s", rrs[i].Header().String())
+		}
+		for i++; i < end && !isSOA(rrs[i]); i++ {
+			out = deleteRR(out, rrs[i])
+		}
+		if i >= end {
+			return nil, nil, errors.New("invalid ixfr, missing soa of added records")
+		}
+		for i++; i < end && !isSOA(rrs[i]); i++ {
+			if dns.IsSubDomain(name, rrs[i].Header().Name) {
+				out = append(out, rrs[i])
+			}
+		}
+	}
+	return soa, out, nil
+}
+
+func isSOA(rr dns.RR) bool {
+	return rr.Header().Rrtype == dns.TypeSOA
+}
+
+func deleteRR(rrs []dns.RR, rr dns.RR) []dns.RR {
+	for i, r := range rrs {
+		if dns.IsDuplicate(r, rr) {
+			return append(rrs[:i], rrs[i+1:]...)
+		}
+	}
+	return rrs
+}
@@ -24,6 +24,7 @@ import (
 	// data provider
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/secondary_zone"
 
 	// matcher
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/client_ip"
@@ -46,6 +47,8 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/collect"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/debug_print"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dnssec_validate"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dnstap"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/drop_resp"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dual_selector"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ecs_handler"
@@ -55,10 +58,13 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ipset"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/metrics_collector"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/nftset"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_log"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_summary"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rate_limiter"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/recursive"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/redirect"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/reverse_lookup"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rpz"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence/fallback"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sleep"
@@ -71,6 +77,7 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/mark"
 
 	// server
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/dnscrypt_server"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/http_server"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/quic_server"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/tcp_server"
@@ -23,60 +23,169 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/IrineSistiana/mosdns/v5/plugin/common"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
-	"os"
-	"strings"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
 )
 
 const PluginType = "arbitrary"
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		return args.(*Args).Zones, nil
+	})
 }
 
 type Args struct {
-	Rules []string `yaml:"rules"`
-	Files []string `yaml:"files"`
+	Rules        []string `yaml:"rules"`
+	Files        []string `yaml:"files"`
+	Zones        []string `yaml:"zones"` // Tags of data_provider.ZoneProvider.
+	AutoReload   bool     `yaml:"auto_reload"`
+	DebounceTime uint     `yaml:"debounce_time"`
 }
 
 var _ sequence.Executable = (*Arbitrary)(nil)
 
+// Arbitrary answers queries from records in rules and files.
+// Records under a SOA record form an authoritative zone, see zone_file.Zones.
+// Other records are matched by exact name, type and class.
+// Zones from zone providers are also answered, and NOTIFY messages
+// are passed to providers that accept them.
 type Arbitrary struct {
-	m *zone_file.Matcher
+	args      *Args
+	logger    *zap.Logger
+	providers []data_provider.ZoneProvider
+	d         atomic.Pointer[data]
+	reloader  *common.ReloadableFileSet
 }
 
-func NewArbitrary(args *Args) (*Arbitrary, error) {
-	m := new(zone_file.Matcher)
-	for i, s := range args.Rules {
-		if err := m.Load(strings.NewReader(s)); err != nil {
-			return nil, fmt.Errorf("failed to load rr #%d [%s], %w", i, s, err)
+type data struct {
+	zones *zone_file.Zones
+	m     *zone_file.Matcher
+}
+
+func NewArbitrary(args *Args, providers []data_provider.ZoneProvider, logger *zap.Logger) (*Arbitrary, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	a := &Arbitrary{args: args, providers: providers, logger: logger}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	if args.AutoReload && len(args.Files) > 0 {
+		r, err := common.NewReloadableFileSet(
+			args.Files,
+			time.Duration(args.DebounceTime)*time.Second,
+			logger,
+			a.load,
+		)
+		if err != nil {
+			return nil, err
 		}
+		a.reloader = r
 	}
-	for i, file := range args.Files {
+	return a, nil
+}
+
+func (a *Arbitrary) load() error {
+	var rrs []dns.RR
+	for i, s := range a.args.Rules {
+		rs, err := zone_file.ReadRecords(strings.NewReader(s))
+		if err != nil {
+			return fmt.Errorf("failed to load rr #%d [%s], %w", i, s, err)
+		}
+		rrs = append(rrs, rs...)
+	}
+	for i, file := range a.args.Files {
 		b, err := os.ReadFile(file)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read file #%d [%s], %w", i, file, err)
+			return fmt.Errorf("failed to read file #%d [%s], %w", i, file, err)
 		}
-		if err := m.Load(bytes.NewReader(b)); err != nil {
-			return nil, fmt.Errorf("failed to load rr file #%d [%s], %w", i, file, err)
+		rs, err := zone_file.ReadRecords(bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("failed to load rr file #%d [%s], %w", i, file, err)
 		}
+		rrs = append(rrs, rs...)
+	}
+
+	zones, others := zone_file.NewZones(rrs)
+	m := new(zone_file.Matcher)
+	for _, rr := range others {
+		m.Add(rr)
 	}
-	return &Arbitrary{
-		m: m,
-	}, nil
+	a.d.Store(&data{zones: zones, m: m})
+	a.logger.Info("records loaded", zap.Int("zones", zones.Len()), zap.Int("records", len(rrs)))
+	return nil
 }
 
 func (a *Arbitrary) Exec(_ context.Context, qCtx *query_context.Context) error {
-	if r := a.m.Reply(qCtx.Q()); r != nil {
+	q := qCtx.Q()
+	if q.Opcode == dns.OpcodeNotify {
+		a.handleNotify(qCtx)
+		return nil
+	}
+
+	d := a.d.Load()
+	if r := d.zones.Reply(q); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	for _, p := range a.providers {
+		if r := p.GetZones().Reply(q); r != nil {
+			qCtx.SetResponse(r)
+			return nil
+		}
+	}
+	if r := d.m.Reply(qCtx.Q()); r != nil {
 		qCtx.SetResponse(r)
 	}
 	return nil
 }
 
-func Init(_ *coremain.BP, v any) (any, error) {
+func (a *Arbitrary) handleNotify(qCtx *query_context.Context) {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return
+	}
+	for _, p := range a.providers {
+		h, ok := p.(data_provider.ZoneNotifyHandler)
+		if ok && h.HandleNotify(q.Question[0].Name, qCtx.ServerMeta.ClientAddr) {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Authoritative = true
+			qCtx.SetResponse(r)
+			return
+		}
+	}
+}
+
+func (a *Arbitrary) Close() error {
+	if a.reloader != nil {
+		return a.reloader.Close()
+	}
+	return nil
+}
+
+func Init(bp *coremain.BP, v any) (any, error) {
 	args := v.(*Args)
-	return NewArbitrary(args)
+	var providers []data_provider.ZoneProvider
+	for _, tag := range args.Zones {
+		p, ok := bp.M().GetPlugin(tag).(data_provider.ZoneProvider)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a ZoneProvider", tag)
+		}
+		providers = append(providers, p)
+	}
+	return NewArbitrary(args, providers, bp.L())
 }
@@ -36,6 +36,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/go-chi/chi/v5"
@@ -67,6 +68,7 @@ const (
 )
 
 var _ sequence.RecursiveExecutable = (*Cache)(nil)
+var _ coremain.ReusablePlugin = (*Cache)(nil)
 
 type Args struct {
 	Size         int    `yaml:"size"`
@@ -109,6 +111,16 @@ func Init(bp *coremain.BP, args any) (any, error) {
 	return c, nil
 }
 
+// PrepareReuse implements coremain.ReusablePlugin. Cached records
+// are kept across config reloads.
+func (c *Cache) PrepareReuse(bp *coremain.BP) (func(), error) {
+	if err := c.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+	bp.RegAPI(c.Api())
+	return nil, nil
+}
+
 // QuickSetup format: [size]
 // default is 1024. If size is < 1024, 1024 will be used.
 func quickSetupCache(bq sequence.BQ, s string) (any, error) {
@@ -195,7 +207,10 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 		return next.ExecNext(ctx, qCtx)
 	}
 
+	_, span := tracing.Start(ctx, "cache.lookup")
 	cachedResp, lazyHit := getRespFromCache(msgKey, c.backend, c.args.LazyCacheTTL > 0, expiredMsgTtl)
+	span.SetAttributes(tracing.Bool("cache.hit", cachedResp != nil), tracing.Bool("cache.lazy", lazyHit))
+	span.End()
 	if lazyHit {
 		c.lazyHitTotal.Inc()
 		c.doLazyUpdate(msgKey, qCtx, next)
@@ -211,6 +226,8 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 	if r := qCtx.R(); r != nil && cachedResp != r { // pointer compare. r is not cachedResp
 		saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
 		c.updatedKey.Add(1)
+	} else if r != nil {
+		qCtx.StoreValue(query_context.KeyCacheHit, true)
 	}
 	return err
 }
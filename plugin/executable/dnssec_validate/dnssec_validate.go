@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dnssec_validate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnssec"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnssec_validate"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*DnssecValidate)(nil)
+
+type Args struct {
+	// TrustAnchor is a zone file that contains DS or DNSKEY records
+	// of trust anchors, e.g. the root.key of unbound. Required.
+	TrustAnchor string `yaml:"trust_anchor"`
+	CacheSize   int    `yaml:"cache_size"`
+}
+
+type DnssecValidate struct {
+	logger    *zap.Logger
+	validator *dnssec.Validator
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewDnssecValidate(args.(*Args), bp.L())
+}
+
+func NewDnssecValidate(args *Args, logger *zap.Logger) (*DnssecValidate, error) {
+	if len(args.TrustAnchor) == 0 {
+		return nil, errors.New("missing trust anchor")
+	}
+	anchors, err := dnssec.LoadAnchorsFromFile(args.TrustAnchor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trust anchor, %w", err)
+	}
+	v, err := dnssec.NewValidator(dnssec.Opts{Anchors: anchors, CacheSize: args.CacheSize})
+	if err != nil {
+		return nil, err
+	}
+	return &DnssecValidate{logger: logger, validator: v}, nil
+}
+
+func (d *DnssecValidate) Close() error {
+	return d.validator.Close()
+}
+
+// Exec asks upstreams for DNSSEC records by setting the DO and CD bits,
+// then validates the response of next. Queries with the CD bit set
+// are not validated. RFC 4035 3.2.2.
+func (d *DnssecValidate) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if q.CheckingDisabled {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	qOpt := qCtx.QOpt()
+	oldDo := qOpt.Do()
+	qOpt.SetDo()
+	q.CheckingDisabled = true
+	err := next.ExecNext(ctx, qCtx)
+	q.CheckingDisabled = false
+	qOpt.SetDo(oldDo)
+	if err != nil {
+		return err
+	}
+
+	r := qCtx.R()
+	if r == nil {
+		return nil
+	}
+	res, err := d.validator.Validate(ctx, r, d.exchange(qCtx, next))
+	switch res {
+	case dnssec.Secure:
+		// RFC 6840 5.7, 5.8: Only set AD if the client asked for it.
+		r.AuthenticatedData = clientDo(qCtx) || q.AuthenticatedData
+	case dnssec.Bogus:
+		d.logger.Warn("bogus response", qCtx.InfoField(), zap.Error(err))
+		d.setServfail(qCtx, dns.ExtendedErrorCodeDNSBogus, err)
+		return nil
+	default:
+		if err != nil {
+			d.logger.Warn("failed to validate response", qCtx.InfoField(), zap.Error(err))
+			d.setServfail(qCtx, dns.ExtendedErrorCodeDNSSECIndeterminate, err)
+			return nil
+		}
+		r.AuthenticatedData = false
+	}
+	r.CheckingDisabled = false
+
+	if !clientDo(qCtx) {
+		stripDnssecRRs(r, qCtx.QQuestion().Qtype)
+	}
+	return nil
+}
+
+// exchange returns a dnssec.ExchangeFunc that sends chain queries
+// through the rest of the sequence.
+func (d *DnssecValidate) exchange(qCtx *query_context.Context, next sequence.ChainWalker) dnssec.ExchangeFunc {
+	return func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		subCtx := query_context.NewContext(q)
+		subCtx.ServerMeta = qCtx.ServerMeta
+		subCtx.QOpt().SetDo()
+		if err := next.ExecNext(ctx, subCtx); err != nil {
+			return nil, err
+		}
+		r := subCtx.R()
+		if r == nil {
+			return nil, errors.New("no response")
+		}
+		return r, nil
+	}
+}
+
+func (d *DnssecValidate) setServfail(qCtx *query_context.Context, infoCode uint16, err error) {
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), dns.RcodeServerFailure)
+	qCtx.SetResponse(r)
+	if respOpt := qCtx.RespOpt(); respOpt != nil && err != nil {
+		respOpt.Option = append(respOpt.Option, &dns.EDNS0_EDE{InfoCode: infoCode, ExtraText: err.Error()})
+	}
+}
+
+func clientDo(qCtx *query_context.Context) bool {
+	opt := qCtx.ClientOpt()
+	return opt != nil && opt.Do()
+}
+
+// stripDnssecRRs removes DNSSEC records that are not asked by qtype.
+// RFC 4035 3.2.1.
+func stripDnssecRRs(r *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		n := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			n = append(n, rr)
+		}
+		return n
+	}
+	r.Answer = strip(r.Answer)
+	r.Ns = strip(r.Ns)
+	r.Extra = strip(r.Extra)
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validate
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func signRRset(t *testing.T, key *dns.DNSKEY, priv crypto.Signer, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	h := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		Algorithm:  key.Algorithm,
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: key.Hdr.Name,
+	}
+	require.NoError(t, sig.Sign(priv, rrs))
+	return append(rrs, sig)
+}
+
+func Test_DnssecValidate(t *testing.T) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	p, err := key.Generate(256)
+	require.NoError(t, err)
+	priv := p.(crypto.Signer)
+
+	anchor := filepath.Join(t.TempDir(), "root.key")
+	require.NoError(t, os.WriteFile(anchor, []byte(key.ToDS(dns.SHA256).String()+"\n"), 0644))
+	d, err := NewDnssecValidate(&Args{TrustAnchor: anchor}, zap.NewNop())
+	require.NoError(t, err)
+	defer d.Close()
+
+	a, err := dns.NewRR("www.test. 300 IN A 192.0.2.1")
+	require.NoError(t, err)
+	signedA := signRRset(t, key, priv, a)
+	signedKey := signRRset(t, key, priv, key)
+
+	// next answers from the signed root zone. If tamper is set, the
+	// A record in the response is modified after signing.
+	type nextQuery struct{ do, cd bool }
+	newNext := func(tamper bool, queries *[]nextQuery) sequence.ChainWalker {
+		next := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+			q := qCtx.Q()
+			*queries = append(*queries, nextQuery{do: qCtx.QOpt().Do(), cd: q.CheckingDisabled})
+			r := new(dns.Msg)
+			r.SetReply(q)
+			switch q.Question[0].Qtype {
+			case dns.TypeDNSKEY:
+				for _, rr := range signedKey {
+					r.Answer = append(r.Answer, dns.Copy(rr))
+				}
+			case dns.TypeA:
+				for _, rr := range signedA {
+					r.Answer = append(r.Answer, dns.Copy(rr))
+				}
+				if tamper {
+					r.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.99")
+				}
+			}
+			qCtx.SetResponse(r)
+			return nil
+		})
+		return sequence.NewChainWalker([]*sequence.ChainNode{{E: next}}, nil)
+	}
+	newQCtx := func(do, ad, cd bool) *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion("www.test.", dns.TypeA)
+		q.AuthenticatedData = ad
+		q.CheckingDisabled = cd
+		if do {
+			q.SetEdns0(1232, true)
+		}
+		return query_context.NewContext(q)
+	}
+	countSigs := func(r *dns.Msg) int {
+		n := 0
+		for _, rr := range r.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("secure with do", func(t *testing.T) {
+		var queries []nextQuery
+		qCtx := newQCtx(true, false, false)
+		require.NoError(t, d.Exec(context.Background(), qCtx, newNext(false, &queries)))
+		r := qCtx.R()
+		require.Equal(t, dns.RcodeSuccess, r.Rcode)
+		require.True(t, r.AuthenticatedData)
+		require.False(t, r.CheckingDisabled)
+		require.Equal(t, 1, countSigs(r))
+		require.Equal(t, nextQuery{do: true, cd: true}, queries[0])
+		require.False(t, qCtx.Q().CheckingDisabled, "query flags are restored")
+	})
+
+	t.Run("secure with ad", func(t *testing.T) {
+		var queries []nextQuery
+		qCtx := newQCtx(false, true, false)
+		require.NoError(t, d.Exec(context.Background(), qCtx, newNext(false, &queries)))
+		r := qCtx.R()
+		require.True(t, r.AuthenticatedData)
+		require.Zero(t, countSigs(r), "dnssec records are stripped without do")
+		require.Equal(t, nextQuery{do: true, cd: true}, queries[0])
+		require.False(t, qCtx.QOpt().Do(), "do bit is restored")
+	})
+
+	t.Run("secure without do or ad", func(t *testing.T) {
+		var queries []nextQuery
+		qCtx := newQCtx(false, false, false)
+		require.NoError(t, d.Exec(context.Background(), qCtx, newNext(false, &queries)))
+		r := qCtx.R()
+		require.False(t, r.AuthenticatedData)
+		require.Len(t, r.Answer, 1)
+	})
+
+	t.Run("bogus", func(t *testing.T) {
+		var queries []nextQuery
+		qCtx := newQCtx(true, false, false)
+		require.NoError(t, d.Exec(context.Background(), qCtx, newNext(true, &queries)))
+		r := qCtx.R()
+		require.Equal(t, dns.RcodeServerFailure, r.Rcode)
+		require.Empty(t, r.Answer)
+		var ede *dns.EDNS0_EDE
+		for _, o := range qCtx.RespOpt().Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				ede = e
+			}
+		}
+		require.NotNil(t, ede)
+		require.Equal(t, dns.ExtendedErrorCodeDNSBogus, ede.InfoCode)
+	})
+
+	t.Run("cd passthrough", func(t *testing.T) {
+		var queries []nextQuery
+		qCtx := newQCtx(true, false, true)
+		require.NoError(t, d.Exec(context.Background(), qCtx, newNext(true, &queries)))
+		r := qCtx.R()
+		require.Equal(t, dns.RcodeSuccess, r.Rcode)
+		require.False(t, r.AuthenticatedData)
+		require.Equal(t, "192.0.2.99", r.Answer[0].(*dns.A).A.String(), "bogus response is not validated")
+		require.Equal(t, 1, countSigs(r))
+		require.Len(t, queries, 1, "no chain queries")
+	})
+}
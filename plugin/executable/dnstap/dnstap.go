@@ -0,0 +1,379 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnstap"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnstap"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	defaultQueueSize = 4096
+	defaultVersion   = "mosdns"
+
+	ioTimeout       = 5 * time.Second
+	minRetryDelay   = time.Second
+	maxRetryDelay   = 30 * time.Second
+	flushInterval   = time.Second
+	dialNetworkUnix = "unix"
+	dialNetworkTCP  = "tcp"
+)
+
+type Args struct {
+	// One of Socket, TCP and File is required.
+	Socket string `yaml:"socket"` // Path of a unix socket.
+	TCP    string `yaml:"tcp"`    // Address of a tcp endpoint. e.g. "127.0.0.1:6000".
+	File   string `yaml:"file"`   // Path of a file. See truncateOnce.
+
+	Identity string `yaml:"identity"` // Default is the hostname.
+	Version  string `yaml:"version"`  // Default is "mosdns".
+
+	// QueueSize is the number of messages that are waiting to be
+	// written. Messages are dropped if the queue is full. Default is 4096.
+	QueueSize int `yaml:"queue_size"`
+}
+
+var (
+	_ sequence.RecursiveExecutable   = (*Dnstap)(nil)
+	_ query_context.UpstreamObserver = (*Dnstap)(nil)
+)
+
+// Dnstap logs the client queries and responses that pass through it,
+// and the queries to upstreams that forward sends during the rest of
+// the sequence, as dnstap messages.
+type Dnstap struct {
+	identity string
+	version  string
+	network  string // "unix", "tcp" or empty for file.
+	addr     string
+	truncate bool // Truncate the file output when it is first opened.
+	logger   *zap.Logger
+
+	ch      chan []byte
+	dropped atomic.Uint64
+
+	upstreams sync.Map // upstreamKey -> upstreamInfo
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewDnstap(args.(*Args), bp.L())
+}
+
+func NewDnstap(args *Args, logger *zap.Logger) (*Dnstap, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	d := &Dnstap{
+		identity: args.Identity,
+		version:  args.Version,
+		logger:   logger,
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	n := 0
+	if len(args.Socket) > 0 {
+		d.network, d.addr = dialNetworkUnix, args.Socket
+		n++
+	}
+	if len(args.TCP) > 0 {
+		d.network, d.addr = dialNetworkTCP, args.TCP
+		n++
+	}
+	if len(args.File) > 0 {
+		d.network, d.addr = "", args.File
+		n++
+	}
+	if n != 1 {
+		return nil, errors.New("one of socket, tcp and file is required")
+	}
+	if len(d.network) == 0 {
+		d.truncate = truncateOnce(d.addr)
+	}
+	if len(d.identity) == 0 {
+		d.identity, _ = os.Hostname()
+	}
+	if len(d.version) == 0 {
+		d.version = defaultVersion
+	}
+	queueSize := args.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	d.ch = make(chan []byte, queueSize)
+	go d.writeLoop()
+	return d, nil
+}
+
+func (d *Dnstap) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	meta := qCtx.ServerMeta
+	proto := clientProtocol(meta.FromUDP, meta.UrlPath, meta.ServerName)
+	qt := qCtx.StartTime()
+	q, packErr := qCtx.Q().Pack()
+	if packErr == nil {
+		d.send(&dnstap.Message{
+			Type:           dnstap.MessageClientQuery,
+			SocketProtocol: proto,
+			QueryAddress:   meta.ClientAddr,
+			QueryTime:      qt,
+			QueryMessage:   q,
+		})
+	}
+
+	qCtx.StoreValue(query_context.KeyUpstreamObserver, query_context.UpstreamObserver(d))
+	err := next.ExecNext(ctx, qCtx)
+
+	if r := qCtx.R(); r != nil {
+		if b, packErr := r.Pack(); packErr == nil {
+			d.send(&dnstap.Message{
+				Type:            dnstap.MessageClientResponse,
+				SocketProtocol:  proto,
+				QueryAddress:    meta.ClientAddr,
+				QueryTime:       qt,
+				ResponseTime:    time.Now(),
+				ResponseMessage: b,
+			})
+		}
+	}
+	return err
+}
+
+// ObserveUpstream implements query_context.UpstreamObserver.
+func (d *Dnstap) ObserveUpstream(e *query_context.UpstreamExchange) {
+	u := d.upstreamInfo(e.Addr, e.DialAddr)
+	m := &dnstap.Message{
+		Type:            dnstap.MessageForwarderQuery,
+		SocketProtocol:  u.protocol,
+		ResponseAddress: u.addr,
+		ResponsePort:    u.port,
+		QueryTime:       e.QueryTime,
+		QueryMessage:    e.Query,
+	}
+	d.send(m)
+	if e.Response != nil {
+		m.Type = dnstap.MessageForwarderResponse
+		m.QueryMessage = nil
+		m.ResponseTime = e.ResponseTime
+		m.ResponseMessage = e.Response
+		d.send(m)
+	}
+}
+
+// send encodes m and puts it into the queue. It never blocks.
+func (d *Dnstap) send(m *dnstap.Message) {
+	b := dnstap.AppendDnstap(nil, d.identity, d.version, m)
+	select {
+	case d.ch <- b:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+func (d *Dnstap) writeLoop() {
+	defer close(d.done)
+	flushTicker := time.NewTicker(flushInterval)
+	defer flushTicker.Stop()
+
+	o := &output{d: d}
+	defer o.close()
+	o.open()
+
+	var lastDropped uint64
+	for {
+		select {
+		case b := <-d.ch:
+			o.write(b)
+			if len(d.ch) == 0 {
+				o.flush()
+			}
+		case <-flushTicker.C:
+			o.flush()
+			if n := d.dropped.Load(); n != lastDropped {
+				d.logger.Warn("dnstap queue is full, messages were dropped", zap.Uint64("total", n))
+				lastDropped = n
+			}
+		case <-d.closed:
+			for {
+				select {
+				case b := <-d.ch:
+					o.write(b)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *Dnstap) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	<-d.done
+	return nil
+}
+
+// output is the frame stream destination. Messages are lost when it is
+// not connected. It reconnects with a growing delay.
+type output struct {
+	d *Dnstap
+
+	c io.WriteCloser
+	w *dnstap.Writer
+
+	opened     bool
+	retryDelay time.Duration
+	nextRetry  time.Time
+}
+
+func (o *output) open() {
+	if o.w != nil || time.Now().Before(o.nextRetry) {
+		return
+	}
+	c, w, err := o.d.dial(o.d.truncate && !o.opened)
+	if err != nil {
+		if o.retryDelay == 0 {
+			o.retryDelay = minRetryDelay
+		} else {
+			o.retryDelay = min(o.retryDelay*2, maxRetryDelay)
+		}
+		o.nextRetry = time.Now().Add(o.retryDelay)
+		o.d.logger.Warn("failed to open dnstap output", zap.String("addr", o.d.addr), zap.Duration("retry_in", o.retryDelay), zap.Error(err))
+		return
+	}
+	o.c, o.w = c, w
+	o.opened = true
+	o.retryDelay = 0
+}
+
+func (o *output) write(b []byte) {
+	o.open()
+	if o.w == nil {
+		return
+	}
+	if err := o.w.WriteFrame(b); err != nil {
+		o.fail(err)
+	}
+}
+
+func (o *output) flush() {
+	if o.w == nil {
+		o.open()
+		return
+	}
+	setDeadline(o.c)
+	if err := o.w.Flush(); err != nil {
+		o.fail(err)
+	}
+}
+
+func (o *output) fail(err error) {
+	o.d.logger.Warn("failed to write dnstap output", zap.String("addr", o.d.addr), zap.Error(err))
+	_ = o.c.Close()
+	o.c, o.w = nil, nil
+}
+
+func (o *output) close() {
+	if o.w == nil {
+		return
+	}
+	setDeadline(o.c)
+	if err := o.w.Close(); err != nil {
+		o.d.logger.Warn("failed to close dnstap output", zap.String("addr", o.d.addr), zap.Error(err))
+	}
+	_ = o.c.Close()
+	o.c, o.w = nil, nil
+}
+
+// dial opens the output and starts the frame stream. If truncate is
+// set, the file output is truncated, otherwise a new stream is appended.
+func (d *Dnstap) dial(truncate bool) (io.WriteCloser, *dnstap.Writer, error) {
+	var c io.WriteCloser
+	bidirectional := false
+	if len(d.network) == 0 {
+		flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if truncate {
+			flag = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		}
+		f, err := os.OpenFile(d.addr, flag, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		c = f
+	} else {
+		conn, err := net.DialTimeout(d.network, d.addr, ioTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		c = conn
+		bidirectional = true
+	}
+	setDeadline(c)
+	w, err := dnstap.NewWriter(c, bidirectional)
+	if err != nil {
+		_ = c.Close()
+		return nil, nil, err
+	}
+	return c, w, nil
+}
+
+// truncatedFiles are the file outputs that have been truncated by
+// this process.
+var truncatedFiles sync.Map // abs path -> struct{}
+
+// truncateOnce reports whether the file output at path should be
+// truncated. A file is only truncated the first time it is used in this
+// process, so a reload appends a new stream instead of wiping the
+// messages that were logged before it.
+func truncateOnce(path string) bool {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	_, loaded := truncatedFiles.LoadOrStore(path, struct{}{})
+	return !loaded
+}
+
+// setDeadline sets the io deadline of c if it is a net.Conn, so a
+// stuck receiver won't block the output forever.
+func setDeadline(c io.WriteCloser) {
+	if conn, ok := c.(net.Conn); ok {
+		_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+	}
+}
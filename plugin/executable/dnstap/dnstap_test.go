@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnstap"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// messageType returns the dnstap.Message type of a dnstap frame.
+func messageType(t *testing.T, b []byte) dnstap.MessageType {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		require.GreaterOrEqual(t, n, 0)
+		if num == 14 {
+			m, _ := protowire.ConsumeBytes(b)
+			_, _, tn := protowire.ConsumeTag(m)
+			v, _ := protowire.ConsumeVarint(m[tn:])
+			return dnstap.MessageType(v)
+		}
+		b = b[n:]
+	}
+	t.Fatal("no message")
+	return 0
+}
+
+// runQuery runs a query through d, the rest of the sequence sends it to
+// an upstream and sets the response.
+func runQuery(t *testing.T, d *Dnstap) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta = server.QueryMeta{FromUDP: true, ClientAddr: netip.MustParseAddr("192.0.2.1")}
+
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		v, ok := qCtx.GetValue(query_context.KeyUpstreamObserver)
+		require.True(t, ok)
+		qb, err := qCtx.Q().Pack()
+		require.NoError(t, err)
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		rb, err := r.Pack()
+		require.NoError(t, err)
+		v.(query_context.UpstreamObserver).ObserveUpstream(&query_context.UpstreamExchange{
+			Addr:         "tls://8.8.8.8",
+			Query:        qb,
+			QueryTime:    time.Now(),
+			Response:     rb,
+			ResponseTime: time.Now(),
+		})
+		qCtx.SetResponse(r)
+		return nil
+	})}}, nil)
+	require.NoError(t, d.Exec(context.Background(), qCtx, next))
+}
+
+// readAll reads the frames until the stream stops.
+func readAll(r *dnstap.Reader) ([][]byte, error) {
+	var frames [][]byte
+	for {
+		b, err := r.ReadFrame()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, b)
+	}
+}
+
+func messageTypes(t *testing.T, frames [][]byte) []dnstap.MessageType {
+	t.Helper()
+	var types []dnstap.MessageType
+	for _, b := range frames {
+		types = append(types, messageType(t, b))
+	}
+	return types
+}
+
+var wantTypes = []dnstap.MessageType{
+	dnstap.MessageClientQuery,
+	dnstap.MessageForwarderQuery,
+	dnstap.MessageForwarderResponse,
+	dnstap.MessageClientResponse,
+}
+
+func Test_Dnstap_socket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	defer l.Close()
+
+	type result struct {
+		frames [][]byte
+		err    error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			resC <- result{err: err}
+			return
+		}
+		defer c.Close()
+		r, err := dnstap.NewReader(c, true)
+		if err != nil {
+			resC <- result{err: err}
+			return
+		}
+		frames, err := readAll(r)
+		resC <- result{frames: frames, err: err}
+	}()
+
+	d, err := NewDnstap(&Args{Socket: sock}, nil)
+	require.NoError(t, err)
+	runQuery(t, d)
+	require.NoError(t, d.Close())
+	res := <-resC
+	require.NoError(t, res.err)
+	require.Equal(t, wantTypes, messageTypes(t, res.frames))
+}
+
+func Test_Dnstap_file(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	require.NoError(t, os.WriteFile(p, []byte("garbage from the last run"), 0644))
+
+	// The second plugin simulates a reload. It appends a new stream
+	// instead of truncating the file.
+	for i := 0; i < 2; i++ {
+		d, err := NewDnstap(&Args{File: p}, nil)
+		require.NoError(t, err)
+		runQuery(t, d)
+		require.NoError(t, d.Close())
+	}
+
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+	// Read byte by byte so the first reader won't consume the second stream.
+	br := iotest.OneByteReader(f)
+	for i := 0; i < 2; i++ {
+		r, err := dnstap.NewReader(br, false)
+		require.NoError(t, err)
+		frames, err := readAll(r)
+		require.NoError(t, err)
+		require.Equal(t, wantTypes, messageTypes(t, frames))
+	}
+	_, err = br.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func Test_Dnstap_queueFull(t *testing.T) {
+	// No receiver is reading the queue.
+	d := &Dnstap{ch: make(chan []byte, 1)}
+	m := &dnstap.Message{Type: dnstap.MessageClientQuery}
+	d.send(m)
+	d.send(m)
+	require.EqualValues(t, 1, d.dropped.Load())
+}
+
+func Test_NewDnstap_args(t *testing.T) {
+	_, err := NewDnstap(&Args{}, nil)
+	require.Error(t, err)
+	_, err = NewDnstap(&Args{Socket: "a", File: "b"}, nil)
+	require.Error(t, err)
+}
+
+func Test_parseUpstream(t *testing.T) {
+	tests := []struct {
+		addr     string
+		dialAddr string
+		want     upstreamInfo
+	}{
+		{"8.8.8.8", "", upstreamInfo{dnstap.ProtocolUDP, netip.MustParseAddr("8.8.8.8"), 53}},
+		{"tcp://[2001:db8::1]:5353", "", upstreamInfo{dnstap.ProtocolTCP, netip.MustParseAddr("2001:db8::1"), 5353}},
+		{"tls://dns.google", "", upstreamInfo{protocol: dnstap.ProtocolDOT}},
+		{"tls://dns.google", "8.8.4.4", upstreamInfo{dnstap.ProtocolDOT, netip.MustParseAddr("8.8.4.4"), 853}},
+		{"https://1.1.1.1/dns-query", "", upstreamInfo{dnstap.ProtocolDOH, netip.MustParseAddr("1.1.1.1"), 443}},
+		{"quic://[2001:db8::1]", "", upstreamInfo{dnstap.ProtocolDOQ, netip.MustParseAddr("2001:db8::1"), 853}},
+		{"dnscrypt://1.1.1.1", "", upstreamInfo{}},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, parseUpstream(tt.addr, tt.dialAddr), tt.addr)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnstap"
+)
+
+// clientProtocol guesses the protocol of a client query from its server
+// meta. DoQ queries are reported as DoT because they have the same meta.
+func clientProtocol(fromUDP bool, urlPath, serverName string) dnstap.SocketProtocol {
+	switch {
+	case fromUDP:
+		return dnstap.ProtocolUDP
+	case len(urlPath) > 0:
+		return dnstap.ProtocolDOH
+	case len(serverName) > 0:
+		return dnstap.ProtocolDOT
+	default:
+		return dnstap.ProtocolTCP
+	}
+}
+
+type upstreamKey struct {
+	addr     string
+	dialAddr string
+}
+
+type upstreamInfo struct {
+	protocol dnstap.SocketProtocol
+	addr     netip.Addr // Invalid if the upstream address is a domain.
+	port     uint16
+}
+
+// upstreamInfo returns the protocol and the address of an upstream.
+// Results are cached.
+func (d *Dnstap) upstreamInfo(addr, dialAddr string) upstreamInfo {
+	k := upstreamKey{addr: addr, dialAddr: dialAddr}
+	if v, ok := d.upstreams.Load(k); ok {
+		return v.(upstreamInfo)
+	}
+	u := parseUpstream(addr, dialAddr)
+	d.upstreams.Store(k, u)
+	return u
+}
+
+func parseUpstream(addr, dialAddr string) upstreamInfo {
+	var u upstreamInfo
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+	addrURL, err := url.Parse(addr)
+	if err != nil {
+		return u
+	}
+	var defaultPort uint16
+	switch addrURL.Scheme {
+	case "udp":
+		u.protocol, defaultPort = dnstap.ProtocolUDP, 53
+	case "tcp", "tcp+pipeline":
+		u.protocol, defaultPort = dnstap.ProtocolTCP, 53
+	case "tls", "tls+pipeline":
+		u.protocol, defaultPort = dnstap.ProtocolDOT, 853
+	case "https", "h3":
+		u.protocol, defaultPort = dnstap.ProtocolDOH, 443
+	case "quic", "doq":
+		u.protocol, defaultPort = dnstap.ProtocolDOQ, 853
+	default: // Other protocols have no dnstap protocol.
+		return u
+	}
+
+	host := addrURL.Host
+	if len(dialAddr) > 0 {
+		host = dialAddr
+	}
+	port := defaultPort
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return u
+		}
+		host, port = h, uint16(n)
+	}
+	ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return u
+	}
+	u.addr, u.port = ip, port
+	return u
+}
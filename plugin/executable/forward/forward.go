@@ -21,16 +21,18 @@ package fastforward
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
-	"math/rand/v2"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
@@ -47,27 +49,48 @@ func init() {
 }
 
 const (
-	maxConcurrentQueries = 3
-	queryTimeout         = time.Second * 5
+	quickSetupConcurrent = 3
+	defaultQueryTimeout  = time.Second * 5
 )
 
 type Args struct {
 	Upstreams  []UpstreamConfig `yaml:"upstreams"`
 	Concurrent int              `yaml:"concurrent"`
 
+	// Strategy of picking upstreams. Can be "random" (default),
+	// "round_robin", "fastest", "weighted" or "sequential".
+	Strategy string `yaml:"strategy"`
+
+	// HedgeDelay enables hedged requests, in milliseconds. Upstreams are
+	// queried one by one, the next one is queried if there is no response
+	// after HedgeDelay, or if the previous one failed. Concurrent is ignored.
+	HedgeDelay int `yaml:"hedge_delay"`
+
+	// FailureRcodes are rcodes (names or numbers) of responses that count
+	// as failures. Other upstreams are waited for (or tried) if a response
+	// is a failure. Default is every rcode except NOERROR and NXDOMAIN.
+	FailureRcodes []string `yaml:"failure_rcodes"`
+
 	// Global options.
+	Timeout      int    `yaml:"timeout"`
+	Retries      int    `yaml:"retries"`
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
 	Bootstrap    string `yaml:"bootstrap"`
 	BootstrapVer int    `yaml:"bootstrap_version"`
+
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
 }
 
 type UpstreamConfig struct {
 	Tag         string `yaml:"tag"`
-	Addr        string `yaml:"addr"` // Required.
+	Addr        string `yaml:"addr"`   // Required.
+	Weight      int    `yaml:"weight"` // For weighted strategy. Default is 1.
 	DialAddr    string `yaml:"dial_addr"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+	Timeout     int    `yaml:"timeout"` // Query timeout in seconds. Default is 5.
+	Retries     int    `yaml:"retries"` // Retries on the same upstream after a failure.
 
 	// Deprecated: This option has no affect.
 	// TODO: (v6) Remove this option.
@@ -76,6 +99,17 @@ type UpstreamConfig struct {
 	EnableHTTP3        bool `yaml:"enable_http3"`
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
 
+	// TLS options for DoT, DoH and DoQ.
+	ClientCert string `yaml:"client_cert"` // Client certificate for mutual tls.
+	ClientKey  string `yaml:"client_key"`
+	CAFile     string `yaml:"ca_file"`     // Replaces the system root CAs.
+	ServerName string `yaml:"server_name"` // Overwrites the server name from addr.
+
+	// SPKIPins are base64 encoded sha256 hashes of the public keys
+	// (SubjectPublicKeyInfo). If set, one of the certs in the server
+	// chain must match one of the pins.
+	SPKIPins []string `yaml:"spki_pins"`
+
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
@@ -101,9 +135,17 @@ var _ sequence.QuickConfigurableExec = (*Forward)(nil)
 type Forward struct {
 	args *Args
 
-	logger       *zap.Logger
-	us           []*upstreamWrapper
-	tag2Upstream map[string]*upstreamWrapper // for fast tag lookup only.
+	logger        *zap.Logger
+	selector      selector
+	failover      bool // try next upstream if one fails.
+	hedgeDelay    time.Duration
+	failureRcodes map[int]struct{} // nil means default.
+	us            []*upstreamWrapper
+	tag2Upstream  map[string]*upstreamWrapper // for fast tag lookup only.
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	wg          sync.WaitGroup
 }
 
 type Opts struct {
@@ -120,14 +162,36 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 	if opt.Logger == nil {
 		opt.Logger = zap.NewNop()
 	}
+	sel, err := newSelector(args.Strategy)
+	if err != nil {
+		return nil, err
+	}
 
 	f := &Forward{
 		args:         args,
 		logger:       opt.Logger,
+		selector:     sel,
+		failover:     args.Strategy == StrategySequential,
+		hedgeDelay:   time.Duration(args.HedgeDelay) * time.Millisecond,
 		tag2Upstream: make(map[string]*upstreamWrapper),
+		closeNotify:  make(chan struct{}),
+	}
+	hc := args.HealthCheck
+	hc.init()
+	if len(args.FailureRcodes) > 0 {
+		f.failureRcodes = make(map[int]struct{})
+		for _, s := range args.FailureRcodes {
+			rcode, err := parseRcode(s)
+			if err != nil {
+				return nil, err
+			}
+			f.failureRcodes[rcode] = struct{}{}
+		}
 	}
 
 	applyGlobal := func(c *UpstreamConfig) {
+		utils.SetDefaultUnsignNum(&c.Timeout, args.Timeout)
+		utils.SetDefaultUnsignNum(&c.Retries, args.Retries)
 		utils.SetDefaultString(&c.Socks5, args.Socks5)
 		utils.SetDefaultUnsignNum(&c.SoMark, args.SoMark)
 		utils.SetDefaultString(&c.BindToDevice, args.BindToDevice)
@@ -141,7 +205,13 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		}
 		applyGlobal(&c)
 
-		uw := newWrapper(i, c, opt.MetricsTag)
+		tlsConfig, err := newTLSConfig(&c)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("#%d upstream invalid tls args, %w", i, err)
+		}
+
+		uw := newWrapper(i, c, opt.MetricsTag, hc, opt.Logger)
 		uOpt := upstream.Opt{
 			DialAddr:       c.DialAddr,
 			Socks5:         c.Socks5,
@@ -152,12 +222,9 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 			EnableHTTP3:    c.EnableHTTP3,
 			Bootstrap:      c.Bootstrap,
 			BootstrapVer:   c.BootstrapVer,
-			TLSConfig: &tls.Config{
-				InsecureSkipVerify: c.InsecureSkipVerify,
-				ClientSessionCache: tls.NewLRUClientSessionCache(4),
-			},
-			Logger:        opt.Logger,
-			EventObserver: uw,
+			TLSConfig:      tlsConfig,
+			Logger:         opt.Logger,
+			EventObserver:  uw,
 		}
 
 		u, err := upstream.NewUpstream(c.Addr, uOpt)
@@ -177,6 +244,10 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		}
 	}
 
+	if hc.Interval > 0 {
+		f.wg.Add(1)
+		go f.probeLoop(hc)
+	}
 	return f, nil
 }
 
@@ -228,6 +299,8 @@ func (f *Forward) QuickConfigureExec(args string) (any, error) {
 }
 
 func (f *Forward) Close() error {
+	f.closeOnce.Do(func() { close(f.closeNotify) })
+	f.wg.Wait()
 	for _, u := range f.us {
 		_ = u.Close()
 	}
@@ -238,6 +311,7 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	if len(us) == 0 {
 		return nil, errors.New("no upstream to exchange")
 	}
+	us = healthyUpstreams(us)
 
 	queryPayload, err := pool.PackBuffer(qCtx.Q())
 	if err != nil {
@@ -249,79 +323,210 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	if concurrent <= 0 {
 		concurrent = 1
 	}
-	if concurrent > maxConcurrentQueries {
-		concurrent = maxConcurrentQueries
-	}
 
 	type res struct {
-		r   *dns.Msg
-		err error
+		u      *upstreamWrapper
+		r      *dns.Msg
+		failed bool
+		err    error
 	}
 
 	resChan := make(chan res)
 	done := make(chan struct{})
 	defer close(done)
 
-	r := rand.IntN(len(us))
-	for i := 0; i < concurrent; i++ {
-		u := us[(r+i)%len(us)]
+	obs, _ := qCtx.GetValue(query_context.KeyUpstreamObserver)
+	observer, _ := obs.(query_context.UpstreamObserver)
+
+	ordered := f.selector.order(us)
+	next := 0
+	launch := func() {
+		u := ordered[next]
+		next++
 		qc := copyPayload(queryPayload)
 		go func(uqid uint32, question dns.Question) {
 			defer pool.ReleaseBuf(qc)
-			// Give each upstream a fixed timeout to finish the query.
-			upstreamCtx, cancel := context.WithTimeout(context.Background(), queryTimeout)
-			defer cancel()
-
-			var r *dns.Msg
-			respPayload, err := u.ExchangeContext(upstreamCtx, *qc)
-			if err != nil {
-				f.logger.Warn(
-					"upstream error",
-					zap.Uint32("uqid", uqid),
-					zap.String("qname", question.Name),
-					zap.Uint16("qclass", question.Qclass),
-					zap.Uint16("qtype", question.Qtype),
-					zap.String("upstream", u.name()),
-					zap.Error(err),
-				)
-			} else {
-				r = new(dns.Msg)
-				err = r.Unpack(*respPayload)
-				pool.ReleaseBuf(respPayload)
-				if err != nil {
-					r = nil
-				}
-			}
+			r, failed, err := f.exchangeUpstream(ctx, u, *qc, uqid, question, observer)
 			select {
-			case resChan <- res{r: r, err: err}:
+			case resChan <- res{u: u, r: r, failed: failed, err: err}:
 			case <-done:
 			}
 		}(qCtx.Id(), qCtx.QQuestion())
 	}
 
-	for i := 0; i < concurrent; i++ {
+	hedged := f.hedgeDelay > 0
+	if hedged {
+		concurrent = 1
+	}
+	pending := 0
+	for ; next < concurrent && next < len(ordered); pending++ {
+		launch()
+	}
+
+	var hedgeTimer *time.Timer
+	var hedgeC <-chan time.Time
+	resetHedge := func() {
+		if !hedged || next >= len(ordered) {
+			hedgeC = nil
+			return
+		}
+		if hedgeTimer == nil {
+			hedgeTimer = time.NewTimer(f.hedgeDelay)
+		} else {
+			hedgeTimer.Reset(f.hedgeDelay)
+		}
+		hedgeC = hedgeTimer.C
+	}
+	resetHedge()
+	defer func() {
+		if hedgeTimer != nil {
+			hedgeTimer.Stop()
+		}
+	}()
+
+	var lastResp *dns.Msg
+	var lastUpstream *upstreamWrapper
+	for pending > 0 {
 		select {
 		case res := <-resChan:
-			r, err := res.r, res.err
-			if err != nil {
-				continue
+			pending--
+			if res.err == nil {
+				if !res.failed {
+					qCtx.StoreValue(query_context.KeyUpstream, res.u.name())
+					return res.r, nil
+				}
+				// Keep it in case all others fail.
+				lastResp, lastUpstream = res.r, res.u
 			}
-
-			// Retry until the last
-			if i < concurrent-1 && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
-				continue
+			if (f.failover || hedged) && next < len(ordered) {
+				launch()
+				pending++
+				resetHedge()
 			}
-			return r, nil
+		case <-hedgeC:
+			launch()
+			pending++
+			resetHedge()
 		case <-ctx.Done():
 			return nil, context.Cause(ctx)
 		}
 	}
+	if lastResp != nil {
+		qCtx.StoreValue(query_context.KeyUpstream, lastUpstream.name())
+		return lastResp, nil
+	}
 	return nil, errors.New("all upstream servers failed")
 }
 
+// exchangeUpstream sends the query to u, and retries on failures.
+// If all tries failed but there is a response with a failure rcode,
+// it is returned with failed set.
+// Each try is reported to observer if it is not nil, and traced as a
+// child span of the span in ctx. The tries are not canceled with ctx.
+func (f *Forward) exchangeUpstream(ctx context.Context, u *upstreamWrapper, q []byte, uqid uint32, question dns.Question, observer query_context.UpstreamObserver) (*dns.Msg, bool, error) {
+	timeout := time.Duration(u.cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+	var failedResp *dns.Msg
+	var err error
+	for try := 0; try <= u.cfg.Retries; try++ {
+		// Give each upstream a fixed timeout to finish the query.
+		_, span := tracing.Start(ctx, "forward.exchange")
+		if span != nil {
+			span.SetAttributes(tracing.String("upstream", u.name()), tracing.Int("try", try))
+		}
+		upstreamCtx, cancel := context.WithTimeout(tracing.ContextWithSpan(context.Background(), span), timeout)
+		queryTime := time.Now()
+		respPayload, exchangeErr := u.ExchangeContext(upstreamCtx, q)
+		cancel()
+		if observer != nil {
+			e := &query_context.UpstreamExchange{
+				Upstream:     u.name(),
+				Addr:         u.cfg.Addr,
+				DialAddr:     u.cfg.DialAddr,
+				Query:        q,
+				QueryTime:    queryTime,
+				ResponseTime: time.Now(),
+			}
+			if exchangeErr == nil {
+				e.Response = *respPayload
+			}
+			observer.ObserveUpstream(e)
+		}
+		if exchangeErr != nil {
+			span.SetError(exchangeErr)
+			span.End()
+			u.reportFailure()
+			f.logger.Warn(
+				"upstream error",
+				zap.Uint32("uqid", uqid),
+				zap.String("qname", question.Name),
+				zap.Uint16("qclass", question.Qclass),
+				zap.Uint16("qtype", question.Qtype),
+				zap.String("upstream", u.name()),
+				zap.Int("try", try),
+				zap.Error(exchangeErr),
+			)
+			err = exchangeErr
+			continue
+		}
+
+		resp := new(dns.Msg)
+		unpackErr := resp.Unpack(*respPayload)
+		pool.ReleaseBuf(respPayload)
+		if unpackErr != nil {
+			span.SetError(unpackErr)
+			span.End()
+			u.reportFailure()
+			err = unpackErr
+			continue
+		}
+		if span != nil {
+			span.SetAttributes(tracing.String("dns.response.code", dnsutils.RcodeLabel(resp.Rcode)))
+			span.End()
+		}
+		u.rcodeTotal.WithLabelValues(dnsutils.RcodeLabel(resp.Rcode)).Inc()
+		if f.isFailure(resp.Rcode) {
+			if f.args.HealthCheck.EjectOnRcode {
+				u.reportFailure()
+			} else {
+				u.reportSuccess()
+			}
+			failedResp = resp
+			continue
+		}
+		u.reportSuccess()
+		return resp, false, nil
+	}
+	if failedResp != nil {
+		return failedResp, true, nil
+	}
+	return nil, false, err
+}
+
+func (f *Forward) isFailure(rcode int) bool {
+	if f.failureRcodes == nil {
+		return rcode != dns.RcodeSuccess && rcode != dns.RcodeNameError
+	}
+	_, ok := f.failureRcodes[rcode]
+	return ok
+}
+
+func parseRcode(s string) (int, error) {
+	if rcode, ok := dns.StringToRcode[strings.ToUpper(s)]; ok {
+		return rcode, nil
+	}
+	rcode, err := strconv.Atoi(s)
+	if err != nil || rcode < 0 || rcode > 0xfff {
+		return 0, fmt.Errorf("invalid rcode %s", s)
+	}
+	return rcode, nil
+}
+
 func quickSetup(bq sequence.BQ, s string) (any, error) {
 	args := new(Args)
-	args.Concurrent = maxConcurrentQueries
+	args.Concurrent = quickSetupConcurrent
 	for _, u := range strings.Fields(s) {
 		args.Upstreams = append(args.Upstreams, UpstreamConfig{Addr: u})
 	}
@@ -0,0 +1,431 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUpstream replies to queries with exchange.
+type fakeUpstream struct {
+	queries  atomic.Int64
+	exchange func(q *dns.Msg) (*dns.Msg, error)
+}
+
+func (u *fakeUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	u.queries.Add(1)
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	r, err := u.exchange(q)
+	if err != nil {
+		return nil, err
+	}
+	return pool.PackBuffer(r)
+}
+
+func (u *fakeUpstream) Close() error { return nil }
+
+func okUpstream() *fakeUpstream {
+	return &fakeUpstream{exchange: func(q *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		return r, nil
+	}}
+}
+
+func failingUpstream() *fakeUpstream {
+	return &fakeUpstream{exchange: func(q *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("dead upstream")
+	}}
+}
+
+// newTestForward builds a Forward with fake upstreams.
+func newTestForward(t *testing.T, args *Args, us ...upstream.Upstream) *Forward {
+	t.Helper()
+	for range us {
+		args.Upstreams = append(args.Upstreams, UpstreamConfig{Addr: "udp://127.0.0.1"})
+	}
+	f, err := NewForward(args, Opts{})
+	require.NoError(t, err)
+	for i, u := range us {
+		_ = f.us[i].u.Close()
+		f.us[i].u = u
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func testQuery() *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	return query_context.NewContext(q)
+}
+
+func Test_health(t *testing.T) {
+	c := HealthCheckConfig{}
+	c.init()
+	h := newHealth(c)
+	now := time.Now()
+
+	require.Zero(t, h.failure(now))
+	require.Zero(t, h.failure(now))
+	require.Equal(t, time.Second*10, h.failure(now))
+	require.False(t, h.healthy(now))
+	require.Zero(t, h.failure(now), "failures of an ejected upstream are ignored")
+
+	// Brought back, then ejected again on the first failure with a doubled backoff.
+	now = now.Add(time.Second * 10)
+	require.True(t, h.healthy(now))
+	require.Equal(t, time.Second*20, h.failure(now))
+
+	// Recovered after a success.
+	now = now.Add(time.Second * 20)
+	require.True(t, h.success(now))
+	require.Zero(t, h.failure(now))
+
+	// Capped by max backoff.
+	h = newHealth(HealthCheckConfig{MaxFails: 1, Backoff: 100, MaxBackoff: 150})
+	require.Equal(t, time.Second*100, h.failure(now))
+	now = now.Add(time.Second * 100)
+	require.Equal(t, time.Second*150, h.failure(now))
+
+	// Disabled.
+	h = newHealth(HealthCheckConfig{MaxFails: -1})
+	for i := 0; i < 10; i++ {
+		require.Zero(t, h.failure(now))
+	}
+}
+
+func Test_Forward_ejection(t *testing.T) {
+	dead, ok := failingUpstream(), okUpstream()
+	f := newTestForward(t, &Args{HealthCheck: HealthCheckConfig{MaxFails: 1}}, dead, ok)
+
+	for i := 0; i < 20; i++ {
+		qCtx := testQuery()
+		_ = f.Exec(context.Background(), qCtx)
+	}
+	// The dead upstream is ejected after its first failure.
+	require.EqualValues(t, 1, dead.queries.Load())
+	require.False(t, f.us[0].healthy(time.Now()))
+	require.True(t, f.us[1].healthy(time.Now()))
+
+	// All upstreams are used if all are ejected.
+	f.us[1].health.maxFails = 1
+	f.us[1].u = failingUpstream()
+	for i := 0; i < 2; i++ {
+		_ = f.Exec(context.Background(), testQuery())
+	}
+	require.Len(t, healthyUpstreams(f.us), 2)
+}
+
+func Test_Forward_probe(t *testing.T) {
+	dead := failingUpstream()
+	var probed atomic.Value
+	ok := &fakeUpstream{exchange: func(q *dns.Msg) (*dns.Msg, error) {
+		probed.Store(q.Question[0].Name)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		return r, nil
+	}}
+	f := newTestForward(t, &Args{HealthCheck: HealthCheckConfig{MaxFails: 1, Qname: "probe.test"}}, dead, ok)
+	hc := f.args.HealthCheck
+	hc.init()
+	f.probe(f.us[0], hc)
+	f.probe(f.us[1], hc)
+	require.False(t, f.us[0].healthy(time.Now()))
+	require.True(t, f.us[1].healthy(time.Now()))
+	require.Equal(t, "probe.test.", probed.Load())
+
+	// Probes go through the wrapper.
+	require.Equal(t, 1.0, testutil.ToFloat64(f.us[0].errTotal))
+	require.Equal(t, 1.0, testutil.ToFloat64(f.us[1].queryTotal))
+	require.Positive(t, f.us[1].rtt.Load())
+}
+
+func Test_Forward_ejectOnRcode(t *testing.T) {
+	// By default, failure rcodes do not eject the upstream.
+	servfail, ok := rcodeUpstream(dns.RcodeServerFailure), okUpstream()
+	f := newTestForward(t, &Args{Strategy: StrategySequential, HealthCheck: HealthCheckConfig{MaxFails: 1}}, servfail, ok)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, f.Exec(context.Background(), testQuery()))
+	}
+	require.True(t, f.us[0].healthy(time.Now()))
+	require.EqualValues(t, 3, servfail.queries.Load())
+
+	servfail, ok = rcodeUpstream(dns.RcodeServerFailure), okUpstream()
+	f = newTestForward(t, &Args{Strategy: StrategySequential, HealthCheck: HealthCheckConfig{MaxFails: 1, EjectOnRcode: true}}, servfail, ok)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, f.Exec(context.Background(), testQuery()))
+	}
+	require.False(t, f.us[0].healthy(time.Now()))
+	require.EqualValues(t, 1, servfail.queries.Load())
+}
+
+func Test_selectors(t *testing.T) {
+	newUs := func(n int) []*upstreamWrapper {
+		var us []*upstreamWrapper
+		for i := 0; i < n; i++ {
+			us = append(us, &upstreamWrapper{idx: i})
+		}
+		return us
+	}
+	idx := func(us []*upstreamWrapper) []int {
+		var s []int
+		for _, u := range us {
+			s = append(s, u.idx)
+		}
+		return s
+	}
+
+	us := newUs(3)
+	require.Equal(t, []int{0, 1, 2}, idx(sequentialSelector{}.order(us)))
+
+	rr := new(roundRobinSelector)
+	require.Equal(t, []int{0, 1, 2}, idx(rr.order(us)))
+	require.Equal(t, []int{1, 2, 0}, idx(rr.order(us)))
+	require.Equal(t, []int{2, 0, 1}, idx(rr.order(us)))
+	// The counter may go beyond the max int on 32-bit platforms.
+	rr.next.Store(1 << 31)
+	require.Equal(t, []int{2, 0, 1}, idx(rr.order(us)))
+
+	// Upstreams without samples go first, then the fastest.
+	us[0].observeRTT(time.Millisecond * 50)
+	us[1].observeRTT(time.Millisecond * 10)
+	require.Equal(t, []int{2, 1, 0}, idx(fastestSelector{}.order(us)))
+	us[2].observeRTT(time.Millisecond * 100)
+	require.Equal(t, []int{1, 0, 2}, idx(fastestSelector{}.order(us)))
+	// EWMA
+	for i := 0; i < 50; i++ {
+		us[1].observeRTT(time.Millisecond * 80)
+	}
+	require.Equal(t, []int{0, 1, 2}, idx(fastestSelector{}.order(us)))
+
+	// Slower upstreams are explored sometimes.
+	firsts := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		o := fastestSelector{explore: 0.2}.order(us)
+		require.ElementsMatch(t, []int{0, 1, 2}, idx(o))
+		firsts[o[0].idx]++
+	}
+	require.Greater(t, firsts[0], 700)
+	require.Positive(t, firsts[1])
+	require.Positive(t, firsts[2])
+
+	us[0].cfg.Weight = 1
+	us[1].cfg.Weight = 0 // default 1
+	us[2].cfg.Weight = 98
+	clear(firsts)
+	for i := 0; i < 1000; i++ {
+		o := weightedSelector{}.order(us)
+		require.ElementsMatch(t, []int{0, 1, 2}, idx(o))
+		firsts[o[0].idx]++
+	}
+	require.Greater(t, firsts[2], 900)
+
+	_, err := newSelector("bad")
+	require.Error(t, err)
+}
+
+func Test_Forward_sequential(t *testing.T) {
+	dead, first, second := failingUpstream(), okUpstream(), okUpstream()
+	f := newTestForward(t, &Args{Strategy: StrategySequential, HealthCheck: HealthCheckConfig{MaxFails: -1}}, dead, first, second)
+	for i := 0; i < 10; i++ {
+		qCtx := testQuery()
+		require.NoError(t, f.Exec(context.Background(), qCtx))
+		require.NotNil(t, qCtx.R())
+	}
+	require.EqualValues(t, 10, dead.queries.Load())
+	require.EqualValues(t, 10, first.queries.Load())
+	require.EqualValues(t, 0, second.queries.Load())
+}
+
+func rcodeUpstream(rcode int) *fakeUpstream {
+	return &fakeUpstream{exchange: func(q *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetRcode(q, rcode)
+		return r, nil
+	}}
+}
+
+func Test_Forward_failureRcodes(t *testing.T) {
+	// Default: SERVFAIL is a failure, the next upstream is tried.
+	servfail, ok := rcodeUpstream(dns.RcodeServerFailure), okUpstream()
+	f := newTestForward(t, &Args{Strategy: StrategySequential}, servfail, ok)
+	qCtx := testQuery()
+	require.NoError(t, f.Exec(context.Background(), qCtx))
+	require.Equal(t, dns.RcodeSuccess, qCtx.R().Rcode)
+
+	// Only REFUSED is a failure, SERVFAIL is final.
+	refused, servfail, ok := rcodeUpstream(dns.RcodeRefused), rcodeUpstream(dns.RcodeServerFailure), okUpstream()
+	f = newTestForward(t, &Args{Strategy: StrategySequential, FailureRcodes: []string{"refused"}}, refused, servfail, ok)
+	qCtx = testQuery()
+	require.NoError(t, f.Exec(context.Background(), qCtx))
+	require.Equal(t, dns.RcodeServerFailure, qCtx.R().Rcode)
+	require.EqualValues(t, 0, ok.queries.Load())
+
+	// All failed, the failure response is returned.
+	f = newTestForward(t, &Args{FailureRcodes: []string{"5"}}, rcodeUpstream(dns.RcodeRefused))
+	qCtx = testQuery()
+	require.NoError(t, f.Exec(context.Background(), qCtx))
+	require.Equal(t, dns.RcodeRefused, qCtx.R().Rcode)
+
+	_, err := NewForward(&Args{FailureRcodes: []string{"bad"}, Upstreams: []UpstreamConfig{{Addr: "127.0.0.1"}}}, Opts{})
+	require.Error(t, err)
+}
+
+func Test_Forward_retries(t *testing.T) {
+	var n atomic.Int64
+	flaky := &fakeUpstream{exchange: func(q *dns.Msg) (*dns.Msg, error) {
+		if n.Add(1) < 3 {
+			return nil, errors.New("flaky")
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		return r, nil
+	}}
+	f := newTestForward(t, &Args{Retries: 2, HealthCheck: HealthCheckConfig{MaxFails: -1}}, flaky)
+	qCtx := testQuery()
+	require.NoError(t, f.Exec(context.Background(), qCtx))
+	require.EqualValues(t, 3, flaky.queries.Load())
+
+	f = newTestForward(t, &Args{Retries: 1, HealthCheck: HealthCheckConfig{MaxFails: -1}}, failingUpstream())
+	require.Error(t, f.Exec(context.Background(), testQuery()))
+}
+
+func Test_Forward_timeout(t *testing.T) {
+	slow := &slowUpstream{delay: time.Hour}
+	f := newTestForward(t, &Args{Timeout: 1}, slow)
+	start := time.Now()
+	require.Error(t, f.Exec(context.Background(), testQuery()))
+	require.Less(t, time.Since(start), time.Second*3)
+}
+
+func Test_Forward_hedged(t *testing.T) {
+	slow := &slowUpstream{delay: time.Second}
+	fast := okUpstream()
+	f := newTestForward(t, &Args{Strategy: StrategySequential, HedgeDelay: 50}, slow, fast)
+
+	start := time.Now()
+	qCtx := testQuery()
+	require.NoError(t, f.Exec(context.Background(), qCtx))
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, elapsed, time.Millisecond*50)
+	require.Less(t, elapsed, time.Millisecond*500)
+	require.EqualValues(t, 1, fast.queries.Load())
+
+	// No hedge if the first upstream is fast enough.
+	f = newTestForward(t, &Args{Strategy: StrategySequential, HedgeDelay: 500}, okUpstream(), fast)
+	require.NoError(t, f.Exec(context.Background(), testQuery()))
+	require.EqualValues(t, 1, fast.queries.Load())
+}
+
+// slowUpstream replies after delay, or fails when ctx is done.
+type slowUpstream struct {
+	delay time.Duration
+}
+
+func (u *slowUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	select {
+	case <-time.After(u.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return pool.PackBuffer(r)
+}
+
+func (u *slowUpstream) Close() error { return nil }
+
+type recordingObserver struct {
+	mu sync.Mutex
+	es []query_context.UpstreamExchange
+}
+
+func (o *recordingObserver) ObserveUpstream(e *query_context.UpstreamExchange) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.es = append(o.es, *e)
+}
+
+func Test_Forward_upstreamObserver(t *testing.T) {
+	f := newTestForward(t, &Args{Strategy: StrategySequential, HealthCheck: HealthCheckConfig{MaxFails: -1}}, failingUpstream(), okUpstream())
+	o := new(recordingObserver)
+	qCtx := testQuery()
+	qCtx.StoreValue(query_context.KeyUpstreamObserver, query_context.UpstreamObserver(o))
+	require.NoError(t, f.Exec(context.Background(), qCtx))
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	require.Len(t, o.es, 2)
+	require.Equal(t, "udp://127.0.0.1", o.es[0].Addr)
+	require.NotEmpty(t, o.es[0].Query)
+	require.Nil(t, o.es[0].Response)
+	require.NotNil(t, o.es[1].Response)
+	require.False(t, o.es[1].ResponseTime.Before(o.es[1].QueryTime))
+}
+
+func Test_Forward_rcodeMetrics(t *testing.T) {
+	f := newTestForward(t, &Args{Strategy: StrategySequential}, rcodeUpstream(dns.RcodeServerFailure), rcodeUpstream(dns.RcodeNameError))
+	require.NoError(t, f.Exec(context.Background(), testQuery()))
+	require.Equal(t, 1.0, testutil.ToFloat64(f.us[0].rcodeTotal.WithLabelValues("SERVFAIL")))
+	require.Equal(t, 1.0, testutil.ToFloat64(f.us[1].rcodeTotal.WithLabelValues("NXDOMAIN")))
+}
+
+func Test_Forward_tracing(t *testing.T) {
+	e := tracing.NewInMemoryExporter()
+	tracer := tracing.NewTracer(e, tracing.Opts{Sync: true})
+	f := newTestForward(t, &Args{Strategy: StrategySequential, HealthCheck: HealthCheckConfig{MaxFails: -1}}, failingUpstream(), okUpstream())
+
+	ctx, root := tracer.StartRoot(context.Background(), "query")
+	require.NoError(t, f.Exec(ctx, testQuery()))
+	root.End()
+	require.NoError(t, tracer.Close())
+
+	spans := e.Spans()
+	require.Len(t, spans, 3)
+	for i, s := range spans[:2] {
+		require.Equal(t, "forward.exchange", s.Name)
+		require.Equal(t, root.TraceID(), s.TraceID)
+		require.Equal(t, spans[2].SpanID, s.ParentSpanID)
+		require.Contains(t, s.Attributes, tracing.String("upstream", f.us[i].name()))
+	}
+	require.Equal(t, tracing.StatusError, spans[0].StatusCode)
+	require.Contains(t, spans[1].Attributes, tracing.String("dns.response.code", "NOERROR"))
+}
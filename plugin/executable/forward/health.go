@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type HealthCheckConfig struct {
+	// Interval of active probes in seconds. 0 disables active probes.
+	Interval int    `yaml:"interval"`
+	Qname    string `yaml:"qname"`   // Default is ".".
+	Timeout  int    `yaml:"timeout"` // Probe timeout in seconds. Default is 2.
+
+	// MaxFails is the number of consecutive failures (from queries or
+	// probes) to eject an upstream. Default is 3. Negative value disables
+	// ejection. Only errors and timeouts are failures, unless EjectOnRcode
+	// is set.
+	MaxFails int `yaml:"max_fails"`
+
+	// EjectOnRcode counts responses with failure rcodes (see
+	// Args.FailureRcodes) as failures. A healthy upstream may reply
+	// SERVFAIL for a broken domain, so this is off by default.
+	EjectOnRcode bool `yaml:"eject_on_rcode"`
+
+	// An ejected upstream is brought back after Backoff seconds. The
+	// backoff is doubled for each consecutive ejection, up to MaxBackoff.
+	Backoff    int `yaml:"backoff"`     // Default is 10.
+	MaxBackoff int `yaml:"max_backoff"` // Default is 300.
+}
+
+func (c *HealthCheckConfig) init() {
+	utils.SetDefaultString(&c.Qname, ".")
+	utils.SetDefaultUnsignNum(&c.Timeout, 2)
+	utils.SetDefaultNum(&c.MaxFails, 3)
+	utils.SetDefaultUnsignNum(&c.Backoff, 10)
+	utils.SetDefaultUnsignNum(&c.MaxBackoff, 300)
+}
+
+// health tracks consecutive failures of an upstream and ejects it
+// when there are too many.
+type health struct {
+	maxFails   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu           sync.Mutex
+	fails        int
+	ejections    int // consecutive ejections
+	ejectedUntil time.Time
+}
+
+func newHealth(c HealthCheckConfig) *health {
+	return &health{
+		maxFails:   c.MaxFails,
+		backoff:    time.Duration(c.Backoff) * time.Second,
+		maxBackoff: time.Duration(c.MaxBackoff) * time.Second,
+	}
+}
+
+// healthy reports whether the upstream is not ejected.
+func (h *health) healthy(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !now.Before(h.ejectedUntil)
+}
+
+// success resets failures. It returns true if the upstream recovered
+// from ejection.
+func (h *health) success(now time.Time) (recovered bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fails = 0
+	if h.ejections > 0 && !now.Before(h.ejectedUntil) {
+		h.ejections = 0
+		return true
+	}
+	return false
+}
+
+// failure records a failure. If the upstream is ejected by this failure,
+// it returns the ejection duration.
+func (h *health) failure(now time.Time) (ejected time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.maxFails <= 0 || now.Before(h.ejectedUntil) {
+		return 0
+	}
+	h.fails++
+	// An upstream that was just brought back is ejected again
+	// on the first failure.
+	if h.fails < h.maxFails && h.ejections == 0 {
+		return 0
+	}
+	d := h.backoff << h.ejections
+	if d > h.maxBackoff || d <= 0 {
+		d = h.maxBackoff
+	}
+	h.fails = 0
+	h.ejections++
+	h.ejectedUntil = now.Add(d)
+	return d
+}
+
+func (uw *upstreamWrapper) reportSuccess() {
+	if uw.health.success(time.Now()) {
+		uw.healthState.Set(1)
+		uw.logger.Info("upstream recovered", zap.String("upstream", uw.name()))
+	}
+}
+
+func (uw *upstreamWrapper) reportFailure() {
+	if d := uw.health.failure(time.Now()); d > 0 {
+		uw.healthState.Set(0)
+		uw.ejectionTotal.Inc()
+		uw.logger.Warn("upstream ejected", zap.String("upstream", uw.name()), zap.Duration("backoff", d))
+	}
+}
+
+func (uw *upstreamWrapper) healthy(now time.Time) bool {
+	return uw.health.healthy(now)
+}
+
+// healthyUpstreams returns the healthy upstreams in us. If none is healthy,
+// it returns us.
+func healthyUpstreams(us []*upstreamWrapper) []*upstreamWrapper {
+	now := time.Now()
+	n := 0
+	for _, u := range us {
+		if u.healthy(now) {
+			n++
+		}
+	}
+	if n == len(us) || n == 0 {
+		return us
+	}
+	healthy := make([]*upstreamWrapper, 0, n)
+	for _, u := range us {
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		}
+	}
+	return healthy
+}
+
+// probeLoop probes all upstreams every interval until closeNotify is closed.
+func (f *Forward) probeLoop(c HealthCheckConfig) {
+	defer f.wg.Done()
+	ticker := time.NewTicker(time.Duration(c.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.closeNotify:
+			return
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			for _, u := range f.us {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					f.probe(u, c)
+				}()
+			}
+			wg.Wait()
+		}
+	}
+}
+
+func (f *Forward) probe(u *upstreamWrapper, c HealthCheckConfig) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(c.Qname), dns.TypeA)
+	b, err := pool.PackBuffer(q)
+	if err != nil {
+		f.logger.Error("failed to pack probe query", zap.Error(err))
+		return
+	}
+	defer pool.ReleaseBuf(b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout)*time.Second)
+	defer cancel()
+	r, err := u.ExchangeContext(ctx, *b)
+	if err != nil {
+		f.logger.Debug("upstream probe failed", zap.String("upstream", u.name()), zap.Error(err))
+		u.reportFailure()
+		return
+	}
+	pool.ReleaseBuf(r)
+	u.reportSuccess()
+}
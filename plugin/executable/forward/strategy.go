@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StrategyRandom     = "random"
+	StrategyRoundRobin = "round_robin"
+	StrategyFastest    = "fastest"
+	StrategyWeighted   = "weighted"
+	StrategySequential = "sequential"
+)
+
+const (
+	// ewmaWeight is the weight of a new sample in the RTT EWMA.
+	ewmaWeight = 0.2
+
+	// fastestExploreRatio is the probability that fastestSelector puts
+	// a random slower upstream first. Otherwise, an upstream whose RTT
+	// was inflated by a timeout would never be queried (and its RTT
+	// never updated) as long as the others work.
+	fastestExploreRatio = 0.05
+)
+
+// selector orders upstreams for a query. Upstreams are tried in the
+// returned order.
+type selector interface {
+	order(us []*upstreamWrapper) []*upstreamWrapper
+}
+
+func newSelector(strategy string) (selector, error) {
+	switch strategy {
+	case "", StrategyRandom:
+		return randomSelector{}, nil
+	case StrategyRoundRobin:
+		return new(roundRobinSelector), nil
+	case StrategyFastest:
+		return fastestSelector{explore: fastestExploreRatio}, nil
+	case StrategyWeighted:
+		return weightedSelector{}, nil
+	case StrategySequential:
+		return sequentialSelector{}, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %s", strategy)
+	}
+}
+
+func rotate(us []*upstreamWrapper, start int) []*upstreamWrapper {
+	out := make([]*upstreamWrapper, 0, len(us))
+	out = append(out, us[start:]...)
+	return append(out, us[:start]...)
+}
+
+type randomSelector struct{}
+
+func (randomSelector) order(us []*upstreamWrapper) []*upstreamWrapper {
+	return rotate(us, rand.IntN(len(us)))
+}
+
+type roundRobinSelector struct {
+	next atomic.Uint32
+}
+
+func (s *roundRobinSelector) order(us []*upstreamWrapper) []*upstreamWrapper {
+	return rotate(us, int((s.next.Add(1)-1)%uint32(len(us))))
+}
+
+// fastestSelector orders upstreams by their RTT EWMA. Upstreams that
+// have no RTT sample yet go first, so they get one. With probability
+// explore, a random upstream other than the fastest goes first, so it
+// gets a new sample.
+type fastestSelector struct {
+	explore float64
+}
+
+func (s fastestSelector) order(us []*upstreamWrapper) []*upstreamWrapper {
+	type entry struct {
+		u   *upstreamWrapper
+		rtt int64
+	}
+	entries := make([]entry, 0, len(us))
+	for _, u := range rotate(us, rand.IntN(len(us))) {
+		entries = append(entries, entry{u: u, rtt: u.rtt.Load()})
+	}
+	slices.SortStableFunc(entries, func(a, b entry) int {
+		return cmp.Compare(a.rtt, b.rtt)
+	})
+	out := make([]*upstreamWrapper, 0, len(us))
+	for _, e := range entries {
+		out = append(out, e.u)
+	}
+	if len(out) > 1 && rand.Float64() < s.explore {
+		i := 1 + rand.IntN(len(out)-1)
+		u := out[i]
+		copy(out[1:i+1], out[:i])
+		out[0] = u
+	}
+	return out
+}
+
+// weightedSelector picks upstreams randomly, in proportion to their weights.
+type weightedSelector struct{}
+
+func (weightedSelector) order(us []*upstreamWrapper) []*upstreamWrapper {
+	remaining := slices.Clone(us)
+	out := make([]*upstreamWrapper, 0, len(us))
+	for len(remaining) > 0 {
+		sum := 0
+		for _, u := range remaining {
+			sum += u.weight()
+		}
+		n := rand.IntN(sum)
+		for i, u := range remaining {
+			if n -= u.weight(); n < 0 {
+				out = append(out, u)
+				remaining = slices.Delete(remaining, i, i+1)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// sequentialSelector always tries upstreams in the configured order.
+type sequentialSelector struct{}
+
+func (sequentialSelector) order(us []*upstreamWrapper) []*upstreamWrapper {
+	return us
+}
+
+func (uw *upstreamWrapper) weight() int {
+	if uw.cfg.Weight <= 0 {
+		return 1
+	}
+	return uw.cfg.Weight
+}
+
+// observeRTT updates the RTT EWMA of the upstream.
+func (uw *upstreamWrapper) observeRTT(d time.Duration) {
+	for {
+		old := uw.rtt.Load()
+		n := int64(d)
+		if old > 0 {
+			n = int64(float64(old)*(1-ewmaWeight) + float64(d)*ewmaWeight)
+		}
+		if uw.rtt.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+var errNoPinnedKey = errors.New("no verified certificate matches the pinned public keys")
+
+// newTLSConfig builds the upstream tls.Config from c.
+func newTLSConfig(c *UpstreamConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+
+	if len(c.ClientCert)+len(c.ClientKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert, %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.CAFile) > 0 {
+		pool, err := utils.LoadCertPool([]string{c.CAFile})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ca file, %w", err)
+		}
+		tc.RootCAs = pool
+	}
+
+	if len(c.SPKIPins) > 0 {
+		pins := make([][]byte, 0, len(c.SPKIPins))
+		for _, s := range c.SPKIPins {
+			b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "sha256//"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid spki pin %s, %w", s, err)
+			}
+			if len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid spki pin %s, not a sha256 hash", s)
+			}
+			pins = append(pins, b)
+		}
+		insecure := c.InsecureSkipVerify
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs, pins, insecure)
+		}
+	}
+	return tc, nil
+}
+
+// verifySPKIPins checks that one of the certs in the verified chains
+// has a public key whose sha256 hash is in pins.
+// If the chain was not verified (insecure), only the leaf cert is checked,
+// because other certs sent by the server are not bound to the handshake.
+func verifySPKIPins(cs tls.ConnectionState, pins [][]byte, insecure bool) error {
+	if insecure {
+		if len(cs.PeerCertificates) > 0 && matchSPKIPins(cs.PeerCertificates[0], pins) {
+			return nil
+		}
+		return errNoPinnedKey
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if matchSPKIPins(cert, pins) {
+				return nil
+			}
+		}
+	}
+	return errNoPinnedKey
+}
+
+func matchSPKIPins(cert *x509.Certificate, pins [][]byte) bool {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, p := range pins {
+		if bytes.Equal(h[:], p) {
+			return true
+		}
+	}
+	return false
+}
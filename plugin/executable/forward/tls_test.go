@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// issueCert returns a cert signed by parent (self-signed if parent is nil)
+// and writes the pem encoded cert and key to dir.
+func issueCert(t *testing.T, dir, name string, parent *tls.Certificate, tmpl *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600))
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return c
+}
+
+// startTLSServer starts a dns over tls server that replies to all queries.
+func startTLSServer(t *testing.T, tc *tls.Config) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tc)
+	require.NoError(t, err)
+	server := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		w.WriteMsg(r)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return l.Addr().String()
+}
+
+func spkiPin(c tls.Certificate) string {
+	h := sha256.Sum256(c.Leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func Test_Forward_mutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, dir, "ca", nil, &x509.Certificate{
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	})
+	serverCert := issueCert(t, dir, "server", &ca, &x509.Certificate{
+		DNSNames:    []string{"dns.test"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	issueCert(t, dir, "client", &ca, &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	addr := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	pin := spkiPin(serverCert)
+	wrongHash := sha256.Sum256(ca.Leaf.RawTBSCertificate)
+	wrongPin := base64.StdEncoding.EncodeToString(wrongHash[:])
+
+	newUpstreamConfig := func() UpstreamConfig {
+		return UpstreamConfig{
+			Addr:       "tls://" + addr,
+			ServerName: "dns.test",
+			CAFile:     filepath.Join(dir, "ca.crt"),
+			ClientCert: filepath.Join(dir, "client.crt"),
+			ClientKey:  filepath.Join(dir, "client.key"),
+		}
+	}
+	exchange := func(c UpstreamConfig) error {
+		t.Helper()
+		f, err := NewForward(&Args{Upstreams: []UpstreamConfig{c}, Timeout: 2}, Opts{})
+		require.NoError(t, err)
+		defer f.Close()
+		return f.Exec(context.Background(), testQuery())
+	}
+
+	c := newUpstreamConfig()
+	require.NoError(t, exchange(c))
+
+	c = newUpstreamConfig()
+	c.SPKIPins = []string{wrongPin, "sha256//" + pin}
+	require.NoError(t, exchange(c))
+
+	c = newUpstreamConfig()
+	c.SPKIPins = []string{wrongPin}
+	require.Error(t, exchange(c))
+
+	// Pins also work without a trusted ca.
+	c = newUpstreamConfig()
+	c.CAFile = ""
+	c.InsecureSkipVerify = true
+	c.SPKIPins = []string{pin}
+	require.NoError(t, exchange(c))
+
+	c = newUpstreamConfig()
+	c.ClientCert, c.ClientKey = "", ""
+	require.Error(t, exchange(c))
+
+	c = newUpstreamConfig()
+	c.CAFile = ""
+	require.Error(t, exchange(c))
+
+	c = newUpstreamConfig()
+	c.SPKIPins = []string{"invalid"}
+	_, err := NewForward(&Args{Upstreams: []UpstreamConfig{c}}, Opts{})
+	require.Error(t, err)
+}
+
+func Test_Forward_spkiPinsAppendedCert(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, dir, "ca", nil, &x509.Certificate{
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	})
+	serverTmpl := func() *x509.Certificate {
+		return &x509.Certificate{
+			DNSNames:    []string{"dns.test"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	pinned := issueCert(t, dir, "pinned", &ca, serverTmpl())
+	attacker := issueCert(t, dir, "attacker", &ca, serverTmpl())
+
+	// The attacker serves its own leaf and appends the public pinned cert.
+	addr := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{attacker.Certificate[0], pinned.Certificate[0]},
+			PrivateKey:  attacker.PrivateKey,
+		}},
+	})
+	exchange := func(c UpstreamConfig) error {
+		t.Helper()
+		c.Addr = "tls://" + addr
+		c.ServerName = "dns.test"
+		f, err := NewForward(&Args{Upstreams: []UpstreamConfig{c}, Timeout: 2}, Opts{})
+		require.NoError(t, err)
+		defer f.Close()
+		return f.Exec(context.Background(), testQuery())
+	}
+
+	caFile := filepath.Join(dir, "ca.crt")
+	require.Error(t, exchange(UpstreamConfig{InsecureSkipVerify: true, SPKIPins: []string{spkiPin(pinned)}}))
+	require.Error(t, exchange(UpstreamConfig{CAFile: caFile, SPKIPins: []string{spkiPin(pinned)}}))
+
+	// Pins on the leaf and on the verified chain are accepted.
+	require.NoError(t, exchange(UpstreamConfig{InsecureSkipVerify: true, SPKIPins: []string{spkiPin(attacker)}}))
+	require.NoError(t, exchange(UpstreamConfig{CAFile: caFile, SPKIPins: []string{spkiPin(ca)}}))
+	require.Error(t, exchange(UpstreamConfig{InsecureSkipVerify: true, SPKIPins: []string{spkiPin(ca)}}))
+}
@@ -21,12 +21,14 @@ package fastforward
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
@@ -38,9 +40,17 @@ type upstreamWrapper struct {
 	errTotal        prometheus.Counter
 	thread          prometheus.Gauge
 	responseLatency prometheus.Histogram
+	rcodeTotal      *prometheus.CounterVec // label: rcode
 
 	connOpened prometheus.Counter
 	connClosed prometheus.Counter
+
+	logger        *zap.Logger
+	health        *health
+	healthState   prometheus.Gauge
+	ejectionTotal prometheus.Counter
+
+	rtt atomic.Int64 // RTT EWMA in nanoseconds. 0 means no sample.
 }
 
 func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
@@ -54,10 +64,13 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 
 // newWrapper inits all metrics.
 // Note: upstreamWrapper.u still needs to be set.
-func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper {
+func newWrapper(idx int, cfg UpstreamConfig, pluginTag string, hc HealthCheckConfig, logger *zap.Logger) *upstreamWrapper {
 	lb := map[string]string{"upstream": cfg.Tag, "tag": pluginTag}
-	return &upstreamWrapper{
-		cfg: cfg,
+	uw := &upstreamWrapper{
+		idx:    idx,
+		cfg:    cfg,
+		logger: logger,
+		health: newHealth(hc),
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
 			Help:        "The total number of queries processed by this upstream",
@@ -79,6 +92,11 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 			Buckets:     []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
 			ConstLabels: lb,
 		}),
+		rcodeTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "rcode_total",
+			Help:        "The total number of responses from this upstream by rcode",
+			ConstLabels: lb,
+		}, []string{"rcode"}),
 
 		connOpened: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "conn_opened_total",
@@ -90,7 +108,19 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 			Help:        "The total number of connections that are closed",
 			ConstLabels: lb,
 		}),
+		healthState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "health",
+			Help:        "The health state of this upstream, 1 is healthy, 0 is ejected",
+			ConstLabels: lb,
+		}),
+		ejectionTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "ejection_total",
+			Help:        "The total number of times this upstream was ejected",
+			ConstLabels: lb,
+		}),
 	}
+	uw.healthState.Set(1)
+	return uw
 }
 
 func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
@@ -99,8 +129,11 @@ func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
 		uw.errTotal,
 		uw.thread,
 		uw.responseLatency,
+		uw.rcodeTotal,
 		uw.connOpened,
 		uw.connClosed,
+		uw.healthState,
+		uw.ejectionTotal,
 	} {
 		if err := r.Register(collector); err != nil {
 			return err
@@ -128,8 +161,14 @@ func (uw *upstreamWrapper) ExchangeContext(ctx context.Context, m []byte) (*[]by
 
 	if err != nil {
 		uw.errTotal.Inc()
+		// Penalize the failed upstream as if the query costs the timeout.
+		if deadline, ok := ctx.Deadline(); ok {
+			uw.observeRTT(deadline.Sub(start))
+		}
 	} else {
-		uw.responseLatency.Observe(float64(time.Since(start).Milliseconds()))
+		rtt := time.Since(start)
+		uw.responseLatency.Observe(float64(rtt.Milliseconds()))
+		uw.observeRTT(rtt)
 	}
 	return r, err
 }
@@ -24,6 +24,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -44,10 +45,11 @@ func init() {
 }
 
 type Args struct {
-	Entries      []string `yaml:"entries"`
-	Files        []string `yaml:"files"`
-	AutoReload   bool     `yaml:"auto_reload"`
-	DebounceTime uint     `yaml:"debounce_time"`
+	Entries      []string                `yaml:"entries"`
+	Files        []string                `yaml:"files"`
+	URLs         []common.RemoteFileArgs `yaml:"urls"`
+	AutoReload   bool                    `yaml:"auto_reload"`
+	DebounceTime uint                    `yaml:"debounce_time"`
 }
 
 type Hosts struct {
@@ -58,6 +60,8 @@ type Hosts struct {
 	logger *zap.Logger
 
 	reloader *common.ReloadableFileSet
+	remote   *common.RemoteFileSet
+	mu       sync.Mutex // for reloading.
 }
 
 var _ sequence.Executable = (*Hosts)(nil)
@@ -69,12 +73,24 @@ func Init(bp *coremain.BP, args any) (any, error) {
 		logger: bp.L(),
 	}
 
+	if len(h.args.URLs) > 0 {
+		r, err := common.NewRemoteFileSet(h.args.URLs, h.logger, h.reload)
+		if err != nil {
+			return nil, err
+		}
+		h.remote = r
+	}
+
 	// 初始加载
-	hostsInst, err := loadHosts(h.args)
+	hostsInst, err := loadHosts(h.args, h.remote)
 	if err != nil {
+		h.Close()
 		return nil, err
 	}
 	h.current.Store(hostsInst)
+	if h.remote != nil {
+		h.remote.Start()
+	}
 
 	if h.args.AutoReload && len(h.args.Files) > 0 {
 		r, err := common.NewReloadableFileSet(
@@ -84,6 +100,7 @@ func Init(bp *coremain.BP, args any) (any, error) {
 			h.reload,
 		)
 		if err != nil {
+			h.Close()
 			return nil, err
 		}
 		h.reloader = r
@@ -92,7 +109,8 @@ func Init(bp *coremain.BP, args any) (any, error) {
 	return h, nil
 }
 
-func loadHosts(args *Args) (*pkgHosts.Hosts, error) {
+// loadHosts loads hosts from args. remote must have the files of args.URLs.
+func loadHosts(args *Args, remote *common.RemoteFileSet) (*pkgHosts.Hosts, error) {
 	m := domain.NewMixMatcher[*pkgHosts.IPs]()
 	m.SetDefaultMatcher(domain.MatcherFull)
 
@@ -112,11 +130,19 @@ func loadHosts(args *Args) (*pkgHosts.Hosts, error) {
 		}
 	}
 
+	for i, u := range args.URLs {
+		if err := domain.LoadFromTextReader(m, bytes.NewReader(remote.Get(i)), pkgHosts.ParseIPs); err != nil {
+			return nil, fmt.Errorf("parse hosts url #%d %s error: %w", i, u.URL, err)
+		}
+	}
+
 	return pkgHosts.NewHosts(m), nil
 }
 
 func (h *Hosts) reload() error {
-	nh, err := loadHosts(h.args)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	nh, err := loadHosts(h.args, h.remote)
 	if err != nil {
 		return err
 	}
@@ -127,6 +153,9 @@ func (h *Hosts) reload() error {
 }
 
 func (d *Hosts) Close() error {
+	if d.remote != nil {
+		d.remote.Close()
+	}
 	if d.reloader != nil {
 		return d.reloader.Close()
 	}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+type searchResp struct {
+	Entries    []*Entry `json:"entries"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// Api returns the query log api.
+//
+// GET /search: search entries, newest first. Parameters (all optional):
+// client (address or cidr), domain (matches subdomains),
+// qtype, rcode (e.g. NXDOMAIN), from, to (RFC 3339 or unix seconds),
+// limit (default 100, max 1000), cursor (next_cursor from
+// the previous page). A request reads a bounded amount of logs, so a
+// page may have fewer than limit entries but still a next_cursor.
+func (l *QueryLog) Api() *chi.Mux {
+	rtr := chi.NewRouter()
+	rtr.Get("/search", func(w http.ResponseWriter, req *http.Request) {
+		f, cur, limit, err := parseSearchQuery(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entries, next, err := l.store.search(f, cur, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp := searchResp{Entries: entries}
+		if resp.Entries == nil {
+			resp.Entries = []*Entry{}
+		}
+		if next != nil {
+			resp.NextCursor = next.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return rtr
+}
+
+func parseSearchQuery(req *http.Request) (f *filter, cur *cursor, limit int, err error) {
+	q := req.URL.Query()
+	f = new(filter)
+	if s := q.Get("client"); len(s) > 0 {
+		if f.client, err = parseClient(s); err != nil {
+			return nil, nil, 0, fmt.Errorf("invalid client, %w", err)
+		}
+	}
+	if s := q.Get("domain"); len(s) > 0 {
+		f.domain = strings.ToLower(dns.Fqdn(s))
+	}
+	f.qtype = q.Get("qtype")
+	if s := q.Get("rcode"); len(s) > 0 {
+		if n, err := strconv.Atoi(s); err == nil {
+			s = dns.RcodeToString[n]
+		}
+		if _, ok := dns.StringToRcode[strings.ToUpper(s)]; !ok {
+			return nil, nil, 0, fmt.Errorf("invalid rcode %s", s)
+		}
+		f.rcode = s
+	}
+	if s := q.Get("from"); len(s) > 0 {
+		if f.from, err = parseTime(s); err != nil {
+			return nil, nil, 0, fmt.Errorf("invalid from, %w", err)
+		}
+	}
+	if s := q.Get("to"); len(s) > 0 {
+		if f.to, err = parseTime(s); err != nil {
+			return nil, nil, 0, fmt.Errorf("invalid to, %w", err)
+		}
+	}
+	limit = defaultSearchLimit
+	if s := q.Get("limit"); len(s) > 0 {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return nil, nil, 0, fmt.Errorf("invalid limit %s", s)
+		}
+		limit = min(limit, maxSearchLimit)
+	}
+	if s := q.Get("cursor"); len(s) > 0 {
+		c, err := parseCursor(s)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		cur = &c
+	}
+	return f, cur, limit, nil
+}
+
+// parseTime parses RFC 3339 time or unix seconds.
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "query_log"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	defaultSegmentSize = 16 << 20
+	defaultMaxSize     = 1 << 30
+	defaultMaxAge      = 7 * 24 * 3600
+	defaultBufferSize  = 4096
+	defaultMaxScan     = 64 << 20 // Max bytes read by one search request.
+)
+
+type Args struct {
+	// Dir is the directory of the log segments. Required.
+	Dir string `yaml:"dir"`
+	// SegmentSize is the size in bytes to start a new segment. Default is 16 MiB.
+	SegmentSize int64 `yaml:"segment_size"`
+	// MaxSize is the max total size in bytes of all segments. Default is 1 GiB.
+	MaxSize int64 `yaml:"max_size"`
+	// MaxAge is the max age in seconds of the logs. Default is 7 days.
+	MaxAge uint `yaml:"max_age"`
+	// BufferSize is the number of entries that are waiting to be
+	// written. Entries are dropped if the buffer is full. Default is 4096.
+	BufferSize int `yaml:"buffer_size"`
+}
+
+// Entry is a query log entry.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client,omitempty"`
+	QName     string    `json:"qname"`
+	QType     string    `json:"qtype"`
+	Rcode     string    `json:"rcode,omitempty"` // Empty if there is no response.
+	Answers   []string  `json:"answers,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	Rule      string    `json:"rule,omitempty"`
+	CacheHit  bool      `json:"cache_hit,omitempty"`
+	Dropped   bool      `json:"dropped,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var _ sequence.RecursiveExecutable = (*QueryLog)(nil)
+
+// QueryLog records the queries that pass through it after the rest of
+// the sequence was executed.
+type QueryLog struct {
+	store   *store
+	logger  *zap.Logger
+	ch      chan *Entry
+	dropped atomic.Uint64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	l, err := NewQueryLog(args.(*Args), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(l.Api())
+	return l, nil
+}
+
+func NewQueryLog(args *Args, logger *zap.Logger) (*QueryLog, error) {
+	if len(args.Dir) == 0 {
+		return nil, errors.New("missing dir")
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	opts := storeOpts{
+		segmentSize: args.SegmentSize,
+		maxSize:     args.MaxSize,
+		maxAge:      time.Duration(args.MaxAge) * time.Second,
+		maxScan:     defaultMaxScan,
+	}
+	if opts.segmentSize <= 0 {
+		opts.segmentSize = defaultSegmentSize
+	}
+	if opts.maxSize <= 0 {
+		opts.maxSize = defaultMaxSize
+	}
+	if opts.maxAge <= 0 {
+		opts.maxAge = defaultMaxAge * time.Second
+	}
+	s, err := openStore(args.Dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	bufSize := args.BufferSize
+	if bufSize <= 0 {
+		bufSize = defaultBufferSize
+	}
+	l := &QueryLog{
+		store:  s,
+		logger: logger,
+		ch:     make(chan *Entry, bufSize),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go l.writeLoop()
+	return l, nil
+}
+
+func (l *QueryLog) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	err := next.ExecNext(ctx, qCtx)
+	l.record(qCtx, err)
+	return err
+}
+
+func (l *QueryLog) record(qCtx *query_context.Context, err error) {
+	q := qCtx.QQuestion()
+	e := &Entry{
+		Time:      qCtx.StartTime(),
+		QName:     q.Name,
+		QType:     dns.Type(q.Qtype).String(),
+		LatencyMs: float64(time.Since(qCtx.StartTime()).Microseconds()) / 1000,
+		Dropped:   qCtx.Dropped(),
+	}
+	if addr := qCtx.ServerMeta.ClientAddr; addr.IsValid() {
+		e.Client = addr.Unmap().String()
+	}
+	if r := qCtx.R(); r != nil {
+		e.Rcode = dns.RcodeToString[r.Rcode]
+		for _, rr := range r.Answer {
+			e.Answers = append(e.Answers, formatRR(rr))
+		}
+	}
+	if v, ok := qCtx.GetValue(query_context.KeyUpstream); ok {
+		e.Upstream, _ = v.(string)
+	}
+	if v, ok := qCtx.GetValue(query_context.KeyMatchedRule); ok {
+		e.Rule, _ = v.(string)
+	}
+	if v, ok := qCtx.GetValue(query_context.KeyCacheHit); ok {
+		e.CacheHit, _ = v.(bool)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	select {
+	case l.ch <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// formatRR formats rr without its name, ttl and class, e.g. "A 192.0.2.1".
+func formatRR(rr dns.RR) string {
+	h := rr.Header()
+	return dns.Type(h.Rrtype).String() + " " + strings.TrimPrefix(rr.String(), h.String())
+}
+
+func (l *QueryLog) writeLoop() {
+	defer close(l.done)
+	flushTicker := time.NewTicker(time.Second)
+	defer flushTicker.Stop()
+	cleanTicker := time.NewTicker(time.Minute)
+	defer cleanTicker.Stop()
+	var lastDropped uint64
+	for {
+		select {
+		case e := <-l.ch:
+			if err := l.store.append(e); err != nil {
+				l.logger.Warn("failed to write query log", zap.Error(err))
+			}
+		case <-flushTicker.C:
+			if err := l.store.flush(); err != nil {
+				l.logger.Warn("failed to flush query log", zap.Error(err))
+			}
+			if d := l.dropped.Load(); d != lastDropped {
+				l.logger.Warn("query log buffer is full, entries were dropped", zap.Uint64("total", d))
+				lastDropped = d
+			}
+		case <-cleanTicker.C:
+			if err := l.store.clean(time.Now()); err != nil {
+				l.logger.Warn("failed to clean query log", zap.Error(err))
+			}
+		case <-l.closed:
+			for {
+				select {
+				case e := <-l.ch:
+					_ = l.store.append(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *QueryLog) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	<-l.done
+	return l.store.close()
+}
+
+// parseClient parses a client filter, which is an address or a cidr.
+func parseClient(s string) (netip.Prefix, error) {
+	if strings.ContainsRune(s, '/') {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_QueryLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewQueryLog(&Args{Dir: dir}, nil)
+	require.NoError(t, err)
+
+	next := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		q := qCtx.Q()
+		r := new(dns.Msg)
+		r.SetReply(q)
+		switch q.Question[0].Name {
+		case "nx.example.":
+			r.Rcode = dns.RcodeNameError
+			qCtx.StoreValue(query_context.KeyMatchedRule, "main#1: qname $block")
+		case "err.example.":
+			return errors.New("upstream failed")
+		default:
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+			qCtx.StoreValue(query_context.KeyUpstream, "google")
+			qCtx.StoreValue(query_context.KeyCacheHit, true)
+		}
+		qCtx.SetResponse(r)
+		return nil
+	})
+	exec := func(qname, client string) {
+		q := new(dns.Msg)
+		q.SetQuestion(qname, dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		qCtx.ServerMeta.ClientAddr = netip.MustParseAddr(client)
+		_ = l.Exec(context.Background(), qCtx, sequence.NewChainWalker([]*sequence.ChainNode{{E: next}}, nil))
+	}
+	exec("www.example.", "192.168.1.2")
+	exec("nx.example.", "192.168.1.3")
+	exec("err.example.", "::ffff:192.168.1.3")
+	for i := 0; i < 5; i++ {
+		exec("a.nx.example.", "192.168.1.2")
+	}
+	require.NoError(t, l.Close())
+
+	// Closed log can still be searched.
+	hs := httptest.NewServer(l.Api())
+	defer hs.Close()
+	search := func(query string) searchResp {
+		t.Helper()
+		resp, err := http.Get(hs.URL + "/search?" + query)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var sr searchResp
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&sr))
+		return sr
+	}
+
+	sr := search("")
+	require.Len(t, sr.Entries, 8)
+	require.Empty(t, sr.NextCursor)
+
+	sr = search("domain=www.example")
+	require.Len(t, sr.Entries, 1)
+	e := sr.Entries[0]
+	require.Equal(t, "192.168.1.2", e.Client)
+	require.Equal(t, "A", e.QType)
+	require.Equal(t, "NOERROR", e.Rcode)
+	require.Equal(t, []string{"A 192.0.2.1"}, e.Answers)
+	require.Equal(t, "google", e.Upstream)
+	require.True(t, e.CacheHit)
+
+	sr = search("client=192.168.1.3&rcode=NXDOMAIN")
+	require.Len(t, sr.Entries, 1)
+	require.Equal(t, "nx.example.", sr.Entries[0].QName)
+	require.Equal(t, "main#1: qname $block", sr.Entries[0].Rule)
+
+	sr = search("client=192.168.1.0/24&domain=err.example")
+	require.Len(t, sr.Entries, 1)
+	require.Equal(t, "upstream failed", sr.Entries[0].Error)
+	require.Empty(t, sr.Entries[0].Rcode)
+
+	// Pagination.
+	var all []*Entry
+	cur := ""
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 4)
+		sr = search("domain=nx.example&limit=2&cursor=" + cur)
+		all = append(all, sr.Entries...)
+		if len(sr.NextCursor) == 0 {
+			break
+		}
+		cur = sr.NextCursor
+	}
+	require.Len(t, all, 6)
+	require.Equal(t, "a.nx.example.", all[0].QName) // newest first
+	require.Equal(t, "nx.example.", all[5].QName)
+
+	sr = search("to=" + time.Now().Add(-time.Hour).Format(time.RFC3339))
+	require.Empty(t, sr.Entries)
+	sr = search("from=" + time.Now().Add(-time.Hour).Format(time.RFC3339))
+	require.Len(t, sr.Entries, 8)
+
+	resp, err := http.Get(hs.URL + "/search?rcode=bad")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_store_retention(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir, storeOpts{segmentSize: 200, maxSize: 1000, maxAge: time.Hour})
+	require.NoError(t, err)
+	defer s.close()
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, s.append(&Entry{Time: time.Now(), QName: "example.", QType: "A"}))
+	}
+	segs, err := s.segments()
+	require.NoError(t, err)
+	require.Greater(t, len(segs), 1)
+	var total int64
+	for _, seg := range segs {
+		total += seg.size
+	}
+	require.LessOrEqual(t, total, int64(1000+200))
+
+	// Old segments are removed, but not the current one.
+	old := time.Now().Add(-2 * time.Hour)
+	for _, seg := range segs {
+		require.NoError(t, os.Chtimes(s.segmentPath(seg.id), old, old))
+	}
+	require.NoError(t, s.clean(time.Now()))
+	segs, err = s.segments()
+	require.NoError(t, err)
+	require.Len(t, segs, 1)
+	require.Equal(t, s.curID, segs[0].id)
+}
+
+func Test_store_searchScanLimit(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir, storeOpts{segmentSize: 1 << 20, maxSize: 1 << 30, maxAge: time.Hour, maxScan: 500})
+	require.NoError(t, err)
+	defer s.close()
+
+	// One entry is longer than a read chunk.
+	long := strings.Repeat("a", searchChunkSize+100) + ".example."
+	const n = 50
+	for i := 0; i < n; i++ {
+		qname := fmt.Sprintf("e%d.example.", i)
+		if i == 10 {
+			qname = long
+		}
+		require.NoError(t, s.append(&Entry{Time: time.Now(), QName: qname, QType: "A"}))
+	}
+	// A partial line that is being written is ignored.
+	require.NoError(t, s.flush())
+	f, err := os.OpenFile(s.segmentPath(s.curID), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"qname":"partial.`)
+	require.NoError(t, err)
+	f.Close()
+
+	// Pages are cut by the scan limit, but all entries are returned
+	// newest first without duplicates.
+	var qnames []string
+	var cur *cursor
+	pages := 0
+	for {
+		entries, next, err := s.search(&filter{}, cur, 1000)
+		require.NoError(t, err)
+		for _, e := range entries {
+			qnames = append(qnames, e.QName)
+		}
+		pages++
+		if next == nil {
+			break
+		}
+		cur = next
+	}
+	require.Greater(t, pages, 2)
+	require.Len(t, qnames, n)
+	for i, qname := range qnames {
+		want := fmt.Sprintf("e%d.example.", n-1-i)
+		if n-1-i == 10 {
+			want = long
+		}
+		require.Equal(t, want, qname)
+	}
+}
@@ -0,0 +1,378 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentExt = ".jsonl"
+
+type storeOpts struct {
+	segmentSize int64
+	maxSize     int64
+	maxAge      time.Duration
+	maxScan     int64 // Max bytes read by one search. No limit if <= 0.
+}
+
+// store stores entries in JSONL segments. Segments are named by the
+// unix nano time when they were created.
+type store struct {
+	dir  string
+	opts storeOpts
+
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	size  int64
+	curID int64
+}
+
+type segment struct {
+	id      int64
+	size    int64
+	modTime time.Time
+}
+
+func openStore(dir string, opts storeOpts) (*store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &store{dir: dir, opts: opts}
+	if err := s.clean(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *store) segmentPath(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%019d%s", id, segmentExt))
+}
+
+// segments returns segments in the order of creation.
+func (s *store) segments() ([]segment, error) {
+	des, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []segment
+	for _, de := range des {
+		name, ok := strings.CutSuffix(de.Name(), segmentExt)
+		if !ok || de.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue // removed
+		}
+		segs = append(segs, segment{id: id, size: fi.Size(), modTime: fi.ModTime()})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].id < segs[j].id })
+	return segs, nil
+}
+
+func (s *store) append(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil || s.size+int64(len(b)) > s.opts.segmentSize {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := s.w.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *store) rotateLocked() error {
+	if err := s.closeSegmentLocked(); err != nil {
+		return err
+	}
+	id := max(time.Now().UnixNano(), s.curID+1)
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.f, s.w, s.size, s.curID = f, bufio.NewWriter(f), 0, id
+	return s.cleanLocked(time.Now())
+}
+
+func (s *store) closeSegmentLocked() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f, s.w = nil, nil
+	return err
+}
+
+func (s *store) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return nil
+	}
+	return s.w.Flush()
+}
+
+func (s *store) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeSegmentLocked()
+}
+
+// clean removes segments that are older than maxAge or exceed maxSize.
+// The current segment is never removed.
+func (s *store) clean(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cleanLocked(now)
+}
+
+func (s *store) cleanLocked(now time.Time) error {
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+	var total int64
+	cutoff := now.Add(-s.opts.maxAge)
+	for i := len(segs) - 1; i >= 0; i-- {
+		seg := segs[i]
+		total += seg.size
+		if seg.id == s.curID && s.f != nil {
+			continue
+		}
+		if total > s.opts.maxSize || seg.modTime.Before(cutoff) {
+			if err := os.Remove(s.segmentPath(seg.id)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type filter struct {
+	client   netip.Prefix // Not valid if not set.
+	domain   string       // Lower case fqdn.
+	qtype    string
+	rcode    string
+	from, to time.Time
+}
+
+func (f *filter) match(e *Entry) bool {
+	if f.client.IsValid() {
+		addr, err := netip.ParseAddr(e.Client)
+		if err != nil || !f.client.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+	if len(f.domain) > 0 {
+		qname := strings.ToLower(e.QName)
+		if qname != f.domain && !strings.HasSuffix(qname, "."+f.domain) {
+			return false
+		}
+	}
+	if len(f.qtype) > 0 && !strings.EqualFold(e.QType, f.qtype) {
+		return false
+	}
+	if len(f.rcode) > 0 && !strings.EqualFold(e.Rcode, f.rcode) {
+		return false
+	}
+	if !f.from.IsZero() && e.Time.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && e.Time.After(f.to) {
+		return false
+	}
+	return true
+}
+
+// cursor is the position of an entry. A search with a cursor returns
+// entries that are older than it.
+type cursor struct {
+	segment int64
+	offset  int64 // Offset of the entry line in the segment.
+}
+
+func (c cursor) String() string {
+	return fmt.Sprintf("%d-%d", c.segment, c.offset)
+}
+
+func parseCursor(s string) (cursor, error) {
+	seg, off, ok := strings.Cut(s, "-")
+	if !ok {
+		return cursor{}, fmt.Errorf("invalid cursor %s", s)
+	}
+	var c cursor
+	var err error
+	if c.segment, err = strconv.ParseInt(seg, 10, 64); err != nil {
+		return cursor{}, fmt.Errorf("invalid cursor %s", s)
+	}
+	if c.offset, err = strconv.ParseInt(off, 10, 64); err != nil || c.offset < 0 {
+		return cursor{}, fmt.Errorf("invalid cursor %s", s)
+	}
+	return c, nil
+}
+
+// search returns at most limit entries that match f, newest first,
+// starting after cur (if not nil). next is not nil if there may be
+// more entries. Segments are read backwards in chunks. If more than
+// opts.maxScan bytes are read, it returns early with a next cursor.
+func (s *store) search(f *filter, cur *cursor, limit int) (entries []*Entry, next *cursor, err error) {
+	if err := s.flush(); err != nil {
+		return nil, nil, err
+	}
+	segs, err := s.segments()
+	if err != nil {
+		return nil, nil, err
+	}
+	var scanned int64
+	for i := len(segs) - 1; i >= 0; i-- {
+		seg := segs[i]
+		if cur != nil && seg.id > cur.segment {
+			continue
+		}
+		if !f.to.IsZero() && seg.id > f.to.UnixNano() {
+			continue
+		}
+
+		file, err := os.Open(s.segmentPath(seg.id))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed by clean
+			}
+			return nil, nil, err
+		}
+		end := seg.size
+		if cur != nil && seg.id == cur.segment {
+			end = min(end, cur.offset)
+		}
+		r := newReverseLineReader(file, end)
+		// The first line is the tail after the last '\n'. It is empty or
+		// the line that is being written.
+		_, _, err = r.prev()
+		for err == nil {
+			var line []byte
+			var off int64
+			line, off, err = r.prev()
+			if err != nil {
+				break
+			}
+			if e := new(Entry); json.Unmarshal(line, e) == nil && f.match(e) {
+				entries = append(entries, e)
+				if len(entries) >= limit {
+					file.Close()
+					return entries, &cursor{segment: seg.id, offset: off}, nil
+				}
+			}
+			if s.opts.maxScan > 0 && scanned+r.scanned >= s.opts.maxScan {
+				file.Close()
+				return entries, &cursor{segment: seg.id, offset: off}, nil
+			}
+		}
+		file.Close()
+		scanned += r.scanned
+		if err != io.EOF {
+			return nil, nil, err
+		}
+
+		// Older segments only have older entries.
+		if !f.from.IsZero() && seg.id <= f.from.UnixNano() {
+			break
+		}
+	}
+	return entries, nil, nil
+}
+
+const (
+	searchChunkSize = 64 << 10
+	maxLineSize     = 1 << 20
+)
+
+// reverseLineReader reads the lines of a file backwards from an offset.
+type reverseLineReader struct {
+	f       io.ReaderAt
+	buf     []byte // Unread data before the last returned line.
+	bufOff  int64  // File offset of buf[0].
+	scanned int64  // Bytes read from f.
+}
+
+// newReverseLineReader reads lines of f that end before offset end.
+func newReverseLineReader(f io.ReaderAt, end int64) *reverseLineReader {
+	return &reverseLineReader{f: f, bufOff: end}
+}
+
+// prev returns the previous line without '\n' and its offset. The
+// first call returns the data after the last '\n' before end. Lines
+// that are longer than maxLineSize are returned without their tail.
+// It returns io.EOF if there are no more lines.
+func (r *reverseLineReader) prev() (line []byte, off int64, err error) {
+	for {
+		if i := bytes.LastIndexByte(r.buf, '\n'); i >= 0 {
+			line, off = r.buf[i+1:], r.bufOff+int64(i)+1
+			r.buf = r.buf[:i]
+			return line, off, nil
+		}
+		if r.bufOff == 0 {
+			if r.buf == nil {
+				return nil, 0, io.EOF
+			}
+			line, r.buf = r.buf, nil
+			return line, 0, nil
+		}
+		if len(r.buf) >= maxLineSize {
+			r.buf = r.buf[:0] // Drop the tail of a too long line.
+		}
+		n := min(searchChunkSize, r.bufOff)
+		b := make([]byte, n+int64(len(r.buf)))
+		if _, err := r.f.ReadAt(b[:n], r.bufOff-n); err != nil {
+			return nil, 0, err
+		}
+		copy(b[n:], r.buf)
+		r.buf = b
+		r.bufOff -= n
+		r.scanned += n
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/recursive"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"go.uber.org/zap"
+)
+
+const PluginType = "recursive"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*Recursive)(nil)
+
+type Args struct {
+	// RootHints is a root hints file, e.g. named.root.
+	// If empty, built-in addresses of the IANA root servers are used.
+	RootHints string `yaml:"root_hints"`
+
+	CacheSize                int  `yaml:"cache_size"`
+	Timeout                  int  `yaml:"timeout"` // in seconds, per nameserver query.
+	DisableQNAMEMinimisation bool `yaml:"disable_qname_minimisation"`
+	IPv6                     bool `yaml:"ipv6"`
+}
+
+type Recursive struct {
+	r *recursive.Resolver
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewRecursive(args.(*Args), bp.L())
+}
+
+func NewRecursive(args *Args, logger *zap.Logger) (*Recursive, error) {
+	var hints []netip.Addr
+	if len(args.RootHints) > 0 {
+		var err error
+		hints, err = recursive.LoadRootHintsFromFile(args.RootHints)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load root hints, %w", err)
+		}
+	}
+	r := recursive.NewResolver(recursive.Opts{
+		RootHints:                hints,
+		Timeout:                  time.Duration(args.Timeout) * time.Second,
+		CacheSize:                args.CacheSize,
+		DisableQNAMEMinimisation: args.DisableQNAMEMinimisation,
+		IPv6:                     args.IPv6,
+		Logger:                   logger,
+	})
+	return &Recursive{r: r}, nil
+}
+
+func (r *Recursive) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	resp, err := r.r.Resolve(ctx, qCtx.Q())
+	if err != nil {
+		return err
+	}
+	qCtx.SetResponse(resp)
+	return nil
+}
+
+func (r *Recursive) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/recursive"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type handlerFunc func(q *dns.Msg) *dns.Msg
+
+func (f handlerFunc) Handle(_ context.Context, q *dns.Msg, _ server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	b, err := packMsgPayload(f(q))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
+
+func Test_Recursive_dnssecOK(t *testing.T) {
+	// 127.0.0.1 is the root, 127.0.0.2 serves test. and
+	// 127.0.0.3 serves example.test.
+	referral := func(zone, ns, addr string) handlerFunc {
+		return func(q *dns.Msg) *dns.Msg {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Ns = []dns.RR{mustRR(t, zone+" 3600 IN NS "+ns)}
+			r.Extra = []dns.RR{mustRR(t, ns+" 3600 IN A "+addr)}
+			return r
+		}
+	}
+	var gotDo atomic.Bool
+	auth := handlerFunc(func(q *dns.Msg) *dns.Msg {
+		do := q.IsEdns0() != nil && q.IsEdns0().Do()
+		gotDo.Store(do)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Authoritative = true
+		if q.Question[0].Name == "www.example.test." && q.Question[0].Qtype == dns.TypeA {
+			r.Answer = append(r.Answer, mustRR(t, "www.example.test. 300 IN A 192.0.2.1"))
+			if do {
+				r.Answer = append(r.Answer, mustRR(t, "www.example.test. 300 IN RRSIG A 13 3 300 20300101000000 20200101000000 12345 example.test. AAAA"))
+			}
+		}
+		return r
+	})
+
+	var port uint16
+	for i, h := range []server.Handler{
+		referral("test.", "ns.test.", "127.0.0.2"),
+		referral("example.test.", "ns.example.test.", "127.0.0.3"),
+		auth,
+	} {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, byte(i + 1)}), port)
+		c, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+		if port == 0 {
+			port = c.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+		}
+		go server.ServeUDP(c, h, server.UDPServerOpts{})
+	}
+
+	p := &Recursive{r: recursive.NewResolver(recursive.Opts{
+		RootHints: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+		Port:      port,
+	})}
+	defer p.Close()
+
+	for _, do := range []bool{false, true} {
+		q := new(dns.Msg)
+		q.SetQuestion("www.example.test.", dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		if do {
+			qCtx.QOpt().SetDo()
+		}
+		require.NoError(t, p.Exec(context.Background(), qCtx))
+		r := qCtx.R()
+		require.NotNil(t, r)
+		require.Equal(t, dns.RcodeSuccess, r.Rcode)
+		require.Equal(t, do, gotDo.Load(), "do bit sent to nameservers")
+
+		var sigs int
+		for _, rr := range r.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				sigs++
+			}
+		}
+		if do {
+			require.Len(t, r.Answer, 2)
+			require.Equal(t, 1, sigs)
+		} else {
+			require.Len(t, r.Answer, 1)
+			require.Zero(t, sigs)
+		}
+	}
+}
@@ -25,10 +25,12 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync/atomic"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/common"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -43,16 +45,20 @@ func init() {
 var _ sequence.RecursiveExecutable = (*Redirect)(nil)
 
 type Args struct {
-	Rules []string `yaml:"rules"`
-	Files []string `yaml:"files"`
+	Rules []string                `yaml:"rules"`
+	Files []string                `yaml:"files"`
+	URLs  []common.RemoteFileArgs `yaml:"urls"`
 }
 
 type Redirect struct {
-	m *domain.MixMatcher[string]
+	args   *Args
+	logger *zap.Logger
+	remote *common.RemoteFileSet
+	m      atomic.Pointer[domain.MixMatcher[string]]
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	r, err := NewRedirect(args.(*Args))
+	r, err := NewRedirect(args.(*Args), bp.L())
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +66,43 @@ func Init(bp *coremain.BP, args any) (any, error) {
 	return r, nil
 }
 
-func NewRedirect(args *Args) (*Redirect, error) {
+func NewRedirect(args *Args, logger *zap.Logger) (*Redirect, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	r := &Redirect{args: args, logger: logger}
+	if len(args.URLs) > 0 {
+		remote, err := common.NewRemoteFileSet(args.URLs, logger, r.reload)
+		if err != nil {
+			return nil, err
+		}
+		r.remote = remote
+	}
+	m, err := loadRules(args, r.remote)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.m.Store(m)
+	if r.remote != nil {
+		r.remote.Start()
+	}
+	return r, nil
+}
+
+// reload is only called by remote, which serializes the calls.
+func (r *Redirect) reload() error {
+	m, err := loadRules(r.args, r.remote)
+	if err != nil {
+		return err
+	}
+	r.m.Store(m)
+	r.logger.Info("redirect rules reloaded", zap.Int("length", m.Len()))
+	return nil
+}
+
+// loadRules loads rules from args. remote must have the files of args.URLs.
+func loadRules(args *Args, remote *common.RemoteFileSet) (*domain.MixMatcher[string], error) {
 	parseFunc := func(s string) (p, v string, err error) {
 		f := strings.Fields(s)
 		if len(f) != 2 {
@@ -84,7 +126,12 @@ func NewRedirect(args *Args) (*Redirect, error) {
 			return nil, fmt.Errorf("failed to load file #%d %s, %w", i, file, err)
 		}
 	}
-	return &Redirect{m: m}, nil
+	for i, u := range args.URLs {
+		if err := domain.LoadFromTextReader[string](m, bytes.NewReader(remote.Get(i)), parseFunc); err != nil {
+			return nil, fmt.Errorf("failed to load url #%d %s, %w", i, u.URL, err)
+		}
+	}
+	return m, nil
 }
 
 func (r *Redirect) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
@@ -94,7 +141,7 @@ func (r *Redirect) Exec(ctx context.Context, qCtx *query_context.Context, next s
 	}
 
 	orgQName := q.Question[0].Name
-	redirectTarget, ok := r.m.Match(orgQName)
+	redirectTarget, ok := r.m.Load().Match(orgQName)
 	if !ok {
 		return next.ExecNext(ctx, qCtx)
 	}
@@ -130,5 +177,12 @@ func (r *Redirect) Exec(ctx context.Context, qCtx *query_context.Context, next s
 }
 
 func (r *Redirect) Len() int {
-	return r.m.Len()
+	return r.m.Load().Len()
+}
+
+func (r *Redirect) Close() error {
+	if r.remote != nil {
+		return r.remote.Close()
+	}
+	return nil
 }
@@ -0,0 +1,351 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/rpz"
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/IrineSistiana/mosdns/v5/plugin/common"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "rpz"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		var tags []string
+		for _, z := range args.(*Args).Zones {
+			if len(z.Provider) > 0 {
+				tags = append(tags, z.Provider)
+			}
+		}
+		return tags, nil
+	})
+}
+
+type ZoneArgs struct {
+	// File is a policy zone file. The file must have a SOA record.
+	File string `yaml:"file"`
+
+	// Provider is the tag of a data_provider.ZoneProvider, e.g.
+	// a secondary_zone that transfers the policy zones by AXFR.
+	Provider string `yaml:"provider"`
+}
+
+type Args struct {
+	// Zones are the policy zones in order of precedence.
+	Zones        []ZoneArgs `yaml:"zones"`
+	AutoReload   bool       `yaml:"auto_reload"`
+	DebounceTime uint       `yaml:"debounce_time"`
+}
+
+var _ sequence.RecursiveExecutable = (*RPZ)(nil)
+
+// RPZ applies response policy zones. CLIENT-IP and QNAME triggers are
+// checked before the rest of the sequence is executed. IP, NSDNAME and
+// NSIP triggers (and QNAME triggers of CNAME targets) are checked
+// against the response.
+// The first zone that has a matched rule wins. If a query trigger matched
+// but a zone before it has response triggers, the query is resolved first
+// so that zone can be checked.
+type RPZ struct {
+	args      *Args
+	logger    *zap.Logger
+	providers []data_provider.ZoneProvider // One for each of args.Zones, nil for files.
+
+	mu         sync.Mutex // for rebuilding.
+	p          atomic.Pointer[policy]
+	rebuilding atomic.Bool
+	reloader   *common.ReloadableFileSet
+}
+
+type policy struct {
+	zones []*rpz.Zone
+
+	// One for each of args.Zones.
+	compiled  [][]*rpz.Zone
+	snapshots []*zone_file.Zones // nil for files.
+}
+
+func Init(bp *coremain.BP, v any) (any, error) {
+	args := v.(*Args)
+	providers := make([]data_provider.ZoneProvider, len(args.Zones))
+	for i, z := range args.Zones {
+		if len(z.Provider) == 0 {
+			continue
+		}
+		p, ok := bp.M().GetPlugin(z.Provider).(data_provider.ZoneProvider)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a ZoneProvider", z.Provider)
+		}
+		providers[i] = p
+	}
+	return NewRPZ(args, providers, bp.L())
+}
+
+// NewRPZ creates a RPZ. providers must have the same length of args.Zones.
+// Zones that have a file have a nil provider.
+func NewRPZ(args *Args, providers []data_provider.ZoneProvider, logger *zap.Logger) (*RPZ, error) {
+	if len(args.Zones) == 0 {
+		return nil, errors.New("no zone is configured")
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	var files []string
+	for i, z := range args.Zones {
+		switch {
+		case len(z.File) > 0 && providers[i] == nil:
+			files = append(files, z.File)
+		case len(z.File) == 0 && providers[i] != nil:
+		default:
+			return nil, fmt.Errorf("zone #%d must have either a file or a provider", i)
+		}
+	}
+
+	p := &RPZ{args: args, logger: logger, providers: providers}
+	if err := p.rebuild(true); err != nil {
+		return nil, err
+	}
+	if args.AutoReload && len(files) > 0 {
+		r, err := common.NewReloadableFileSet(
+			files,
+			time.Duration(args.DebounceTime)*time.Second,
+			logger,
+			func() error { return p.rebuild(true) },
+		)
+		if err != nil {
+			return nil, err
+		}
+		p.reloader = r
+	}
+	return p, nil
+}
+
+// rebuild compiles zones that were changed. Files are only
+// reloaded if loadFiles is true.
+func (p *RPZ) rebuild(loadFiles bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.p.Load()
+	np := &policy{
+		compiled:  make([][]*rpz.Zone, len(p.args.Zones)),
+		snapshots: make([]*zone_file.Zones, len(p.args.Zones)),
+	}
+	for i, z := range p.args.Zones {
+		if provider := p.providers[i]; provider != nil {
+			zs := provider.GetZones()
+			np.snapshots[i] = zs
+			if old != nil && old.snapshots[i] == zs {
+				np.compiled[i] = old.compiled[i]
+			} else {
+				np.compiled[i] = p.compile(zs)
+			}
+		} else {
+			if old != nil && !loadFiles {
+				np.compiled[i] = old.compiled[i]
+				continue
+			}
+			zones, err := p.loadFile(z.File)
+			if err != nil {
+				return fmt.Errorf("failed to load zone file #%d %s, %w", i, z.File, err)
+			}
+			np.compiled[i] = zones
+		}
+	}
+	for _, zones := range np.compiled {
+		np.zones = append(np.zones, zones...)
+	}
+	p.p.Store(np)
+	return nil
+}
+
+func (p *RPZ) loadFile(file string) ([]*rpz.Zone, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rrs, err := zone_file.ReadRecords(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	zs, others := zone_file.NewZones(rrs)
+	if zs.Len() == 0 {
+		return nil, errors.New("missing soa record")
+	}
+	if len(others) > 0 {
+		return nil, fmt.Errorf("record %s is out of zone", others[0].Header().String())
+	}
+	return p.compile(zs), nil
+}
+
+func (p *RPZ) compile(zs *zone_file.Zones) []*rpz.Zone {
+	var out []*rpz.Zone
+	for _, z := range zs.All() {
+		pz, invalid := rpz.NewZone(z.SOA(), z.Records())
+		if len(invalid) > 0 {
+			p.logger.Warn("invalid policy records are ignored", zap.String("zone", pz.Name()), zap.Int("records", len(invalid)), zap.Stringer("first", invalid[0]))
+		}
+		p.logger.Info("policy zone loaded", zap.String("zone", pz.Name()), zap.Uint32("serial", z.SOA().Serial), zap.Int("rules", pz.Len()))
+		out = append(out, pz)
+	}
+	return out
+}
+
+// getPolicy returns the current policy. If zones from providers were
+// updated, a rebuild is started in the background.
+func (p *RPZ) getPolicy() *policy {
+	pol := p.p.Load()
+	for i, provider := range p.providers {
+		if provider != nil && provider.GetZones() != pol.snapshots[i] {
+			if p.rebuilding.CompareAndSwap(false, true) {
+				go func() {
+					defer p.rebuilding.Store(false)
+					_ = p.rebuild(false) // Providers never fail.
+				}()
+			}
+			break
+		}
+	}
+	return pol
+}
+
+func (p *RPZ) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	pol := p.getPolicy()
+	qname := qCtx.QQuestion().Name
+
+	// qi is the index of the first zone that has a matched query trigger.
+	qi := len(pol.zones)
+	var qRule *rpz.Rule
+	for i, z := range pol.zones {
+		if rule := z.MatchQuery(qname, qCtx.ServerMeta.ClientAddr); rule != nil {
+			qi, qRule = i, rule
+			break
+		}
+	}
+	if qRule != nil && !hasResponseTriggers(pol.zones[:qi]) {
+		return p.apply(ctx, qCtx, next, pol.zones[qi], qRule, true)
+	}
+
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		if qRule == nil {
+			return err
+		}
+		// Zones before qi cannot be checked. The matched query trigger
+		// still applies.
+		p.logger.Debug("failed to resolve for policy zones of higher precedence", qCtx.InfoField(), zap.Error(err))
+		return p.apply(ctx, qCtx, next, pol.zones[qi], qRule, false)
+	}
+	if r := qCtx.R(); r != nil {
+		for _, z := range pol.zones[:qi] {
+			if rule := z.MatchResponse(r); rule != nil {
+				return p.apply(ctx, qCtx, next, z, rule, false)
+			}
+		}
+	}
+	if qRule != nil {
+		return p.apply(ctx, qCtx, next, pol.zones[qi], qRule, false)
+	}
+	return nil
+}
+
+func hasResponseTriggers(zones []*rpz.Zone) bool {
+	for _, z := range zones {
+		if z.HasResponseTriggers() {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies the rule to qCtx. beforeResolution is true if the rest of
+// the sequence has not been executed yet.
+func (p *RPZ) apply(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker, z *rpz.Zone, rule *rpz.Rule, beforeResolution bool) error {
+	p.logger.Debug(
+		"policy matched",
+		qCtx.InfoField(),
+		zap.String("zone", z.Name()),
+		zap.Stringer("trigger", rule.Trigger),
+		zap.String("rule", rule.Owner),
+		zap.Stringer("action", rule.Action),
+	)
+	qCtx.StoreValue(query_context.KeyMatchedRule, fmt.Sprintf("rpz: %s (%s)", rule.Owner, rule.Action))
+
+	switch rule.Action {
+	case rpz.ActionTCPOnly:
+		if qCtx.ServerMeta.FromUDP {
+			r := new(dns.Msg)
+			r.SetReply(qCtx.Q())
+			r.Truncated = true
+			qCtx.SetResponse(r)
+			return nil
+		}
+		fallthrough
+	case rpz.ActionPassthru:
+		if beforeResolution {
+			return next.ExecNext(ctx, qCtx)
+		}
+		return nil
+	case rpz.ActionDrop:
+		qCtx.Drop()
+		return nil
+	}
+
+	r, target := z.Reply(qCtx.Q(), rule)
+	if len(target) > 0 {
+		// Resolve the CNAME target with the rest of the sequence.
+		q := qCtx.Q().Copy()
+		q.Question[0].Name = target
+		subCtx := query_context.NewContext(q)
+		subCtx.ServerMeta = qCtx.ServerMeta
+		if err := next.ExecNext(ctx, subCtx); err != nil {
+			return err
+		}
+		if sr := subCtx.R(); sr != nil {
+			r.Rcode = sr.Rcode
+			r.Answer = append(r.Answer, sr.Answer...)
+		}
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func (p *RPZ) Close() error {
+	if p.reloader != nil {
+		return p.reloader.Close()
+	}
+	return nil
+}
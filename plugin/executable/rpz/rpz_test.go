@@ -0,0 +1,185 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const testZone = `
+$ORIGIN rpz.test.
+$TTL 300
+@ SOA ns.rpz.test. admin.rpz.test. 1 3600 600 86400 60
+nx.example.com      CNAME .
+drop.example.com    CNAME rpz-drop.
+tcp.example.com     CNAME rpz-tcp-only.
+cname.example.com   CNAME safe.example.net.
+24.0.113.0.203.rpz-ip CNAME *.
+`
+
+func Test_RPZ_Exec(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "rpz.zone")
+	require.NoError(t, os.WriteFile(f, []byte(testZone), 0644))
+	p, err := NewRPZ(&Args{Zones: []ZoneArgs{{File: f}}}, make([]data_provider.ZoneProvider, 1), nil)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// next answers every query with 203.0.113.1 for *.example.com,
+	// and 192.0.2.1 for others.
+	var nextCalled int
+	next := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		nextCalled++
+		q := qCtx.Q()
+		r := new(dns.Msg)
+		r.SetReply(q)
+		ip := net.IPv4(192, 0, 2, 1)
+		if dns.IsSubDomain("example.com.", q.Question[0].Name) {
+			ip = net.IPv4(203, 0, 113, 1)
+		}
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   ip,
+		})
+		qCtx.SetResponse(r)
+		return nil
+	})
+
+	exec := func(qname string, fromUDP bool) *query_context.Context {
+		t.Helper()
+		nextCalled = 0
+		q := new(dns.Msg)
+		q.SetQuestion(qname, dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		qCtx.ServerMeta.FromUDP = fromUDP
+		qCtx.ServerMeta.ClientAddr = netip.MustParseAddr("127.0.0.1")
+		cw := sequence.NewChainWalker([]*sequence.ChainNode{{E: next}}, nil)
+		require.NoError(t, p.Exec(context.Background(), qCtx, cw))
+		return qCtx
+	}
+
+	qCtx := exec("nx.example.com.", false)
+	require.Equal(t, 0, nextCalled)
+	require.Equal(t, dns.RcodeNameError, qCtx.R().Rcode)
+
+	qCtx = exec("drop.example.com.", false)
+	require.True(t, qCtx.Dropped())
+	require.Nil(t, qCtx.R())
+
+	qCtx = exec("tcp.example.com.", true)
+	require.Equal(t, 0, nextCalled)
+	require.True(t, qCtx.R().Truncated)
+	qCtx = exec("tcp.example.com.", false)
+	require.Equal(t, 1, nextCalled)
+	require.False(t, qCtx.R().Truncated)
+	require.Len(t, qCtx.R().Answer, 1)
+
+	qCtx = exec("cname.example.com.", false)
+	require.Equal(t, 1, nextCalled)
+	r := qCtx.R()
+	require.Len(t, r.Answer, 2)
+	require.Equal(t, "cname.example.com.", r.Answer[0].Header().Name)
+	require.Equal(t, "safe.example.net.", r.Answer[1].Header().Name)
+	require.Equal(t, "192.0.2.1", r.Answer[1].(*dns.A).A.String())
+
+	// RPZ-IP trigger after resolution.
+	qCtx = exec("other.example.com.", false)
+	require.Equal(t, 1, nextCalled)
+	require.Equal(t, dns.RcodeSuccess, qCtx.R().Rcode)
+	require.Empty(t, qCtx.R().Answer)
+
+	qCtx = exec("example.org.", false)
+	require.Len(t, qCtx.R().Answer, 1)
+}
+
+func Test_RPZ_zonePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	ipZone := filepath.Join(dir, "ip.zone")
+	require.NoError(t, os.WriteFile(ipZone, []byte(`
+$ORIGIN ip.rpz.test.
+@ 300 SOA ns.rpz.test. admin.rpz.test. 1 3600 600 86400 60
+24.0.113.0.203.rpz-ip 300 CNAME *.
+`), 0644))
+	qnameZone := filepath.Join(dir, "qname.zone")
+	require.NoError(t, os.WriteFile(qnameZone, []byte(`
+$ORIGIN qname.rpz.test.
+@ 300 SOA ns.rpz.test. admin.rpz.test. 1 3600 600 86400 60
+nx.example.com 300 CNAME .
+nx.example.net 300 CNAME .
+`), 0644))
+
+	var nextCalled int
+	next := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		nextCalled++
+		q := qCtx.Q()
+		r := new(dns.Msg)
+		r.SetReply(q)
+		ip := net.IPv4(192, 0, 2, 1)
+		if dns.IsSubDomain("example.com.", q.Question[0].Name) {
+			ip = net.IPv4(203, 0, 113, 1)
+		}
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   ip,
+		})
+		qCtx.SetResponse(r)
+		return nil
+	})
+	exec := func(p *RPZ, qname string) *dns.Msg {
+		t.Helper()
+		nextCalled = 0
+		q := new(dns.Msg)
+		q.SetQuestion(qname, dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		cw := sequence.NewChainWalker([]*sequence.ChainNode{{E: next}}, nil)
+		require.NoError(t, p.Exec(context.Background(), qCtx, cw))
+		return qCtx.R()
+	}
+
+	// The IP trigger in the first zone beats the QNAME trigger in the second.
+	p, err := NewRPZ(&Args{Zones: []ZoneArgs{{File: ipZone}, {File: qnameZone}}}, make([]data_provider.ZoneProvider, 2), nil)
+	require.NoError(t, err)
+	defer p.Close()
+	r := exec(p, "nx.example.com.")
+	require.Equal(t, 1, nextCalled)
+	require.Equal(t, dns.RcodeSuccess, r.Rcode)
+	require.Empty(t, r.Answer)
+	r = exec(p, "nx.example.net.")
+	require.Equal(t, 1, nextCalled)
+	require.Equal(t, dns.RcodeNameError, r.Rcode)
+
+	// The QNAME trigger in the first zone is applied before resolution.
+	p, err = NewRPZ(&Args{Zones: []ZoneArgs{{File: qnameZone}, {File: ipZone}}}, make([]data_provider.ZoneProvider, 2), nil)
+	require.NoError(t, err)
+	defer p.Close()
+	r = exec(p, "nx.example.com.")
+	require.Equal(t, 0, nextCalled)
+	require.Equal(t, dns.RcodeNameError, r.Rcode)
+}
@@ -118,6 +118,11 @@ func setupGoto(bq BQ, s string) (any, error) {
 	return &ActionGoto{To: gt.chain}, nil
 }
 
+// argsTag is a QuickSetupRefsFunc for executables whose args is a tag.
+func argsTag(s string) []string {
+	return []string{s}
+}
+
 var _ Matcher = (*MatchAlwaysTrue)(nil)
 
 type MatchAlwaysTrue struct{}
@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/tracing"
 	"io"
 )
 
@@ -34,6 +35,13 @@ type ChainNode struct {
 	// In case both are set. E is preferred.
 	E  Executable
 	RE RecursiveExecutable
+
+	// Rule describes this node. If set and Matches is not empty, it is
+	// stored as query_context.KeyMatchedRule when all Matches matched.
+	Rule string
+
+	// Name describes the executable of this node in traces.
+	Name string
 }
 
 type ChainWalker struct {
@@ -67,11 +75,22 @@ checkMatchesLoop:
 				continue checkMatchesLoop
 			}
 		}
+		if len(n.Matches) > 0 && len(n.Rule) > 0 {
+			qCtx.StoreValue(query_context.KeyMatchedRule, n.Rule)
+		}
 
 		// Exec rules' executables in loop, or in stack if it is a recursive executable.
+		// The span of a recursive executable covers the rest of the chain.
+		nodeCtx, span := tracing.Start(ctx, "sequence.node")
+		if span != nil && len(n.Name) > 0 {
+			span.SetAttributes(tracing.String("sequence.node", n.Name))
+		}
 		switch {
 		case n.E != nil:
-			if err := n.E.Exec(ctx, qCtx); err != nil {
+			err := n.E.Exec(nodeCtx, qCtx)
+			span.SetError(err)
+			span.End()
+			if err != nil {
 				return err
 			}
 			p++
@@ -82,7 +101,10 @@ checkMatchesLoop:
 				chain:    w.chain,
 				jumpBack: w.jumpBack,
 			}
-			return n.RE.Exec(ctx, qCtx, next)
+			err := n.RE.Exec(nodeCtx, qCtx, next)
+			span.SetError(err)
+			span.End()
+			return err
 		default:
 			panic("n cannot be executed")
 		}
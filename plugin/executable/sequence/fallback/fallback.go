@@ -42,6 +42,13 @@ const (
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		a := args.(*Args)
+		if len(a.Primary) == 0 || len(a.Secondary) == 0 {
+			return nil, errors.New("args missing primary or secondary")
+		}
+		return []string{a.Primary, a.Secondary}, nil
+	})
 }
 
 type fallback struct {
@@ -57,6 +57,10 @@ type ExecQuickSetupFunc func(bq BQ, args string) (any, error)
 // MatchQuickSetupFunc configures a Matcher with a simple string args.
 type MatchQuickSetupFunc func(bq BQ, args string) (Matcher, error)
 
+// QuickSetupRefsFunc returns the tags of plugins that the quick setup
+// args refer to. It is used by config check.
+type QuickSetupRefsFunc func(args string) []string
+
 var execQuickSetupReg struct {
 	sync.RWMutex
 	m map[string]ExecQuickSetupFunc
@@ -67,6 +71,16 @@ var matchQuickSetupReg struct {
 	m map[string]MatchQuickSetupFunc
 }
 
+type quickSetupRefsKey struct {
+	typ   string
+	match bool
+}
+
+var quickSetupRefsReg struct {
+	sync.RWMutex
+	m map[quickSetupRefsKey]QuickSetupRefsFunc
+}
+
 func RegExecQuickSetup(typ string, f ExecQuickSetupFunc) error {
 	execQuickSetupReg.Lock()
 	defer execQuickSetupReg.Unlock()
@@ -120,3 +134,34 @@ func GetMatchQuickSetup(typ string) MatchQuickSetupFunc {
 	defer matchQuickSetupReg.RUnlock()
 	return matchQuickSetupReg.m[typ]
 }
+
+func regQuickSetupRefs(k quickSetupRefsKey, f QuickSetupRefsFunc) {
+	quickSetupRefsReg.Lock()
+	defer quickSetupRefsReg.Unlock()
+
+	if _, ok := quickSetupRefsReg.m[k]; ok {
+		panic(fmt.Sprintf("quick setup refs of type %s has already been registered", k.typ))
+	}
+	if quickSetupRefsReg.m == nil {
+		quickSetupRefsReg.m = make(map[quickSetupRefsKey]QuickSetupRefsFunc)
+	}
+	quickSetupRefsReg.m[k] = f
+}
+
+func getQuickSetupRefs(k quickSetupRefsKey) QuickSetupRefsFunc {
+	quickSetupRefsReg.RLock()
+	defer quickSetupRefsReg.RUnlock()
+	return quickSetupRefsReg.m[k]
+}
+
+// MustRegExecQuickSetupRefs registers f for executable quick setup type typ.
+// It panics if the type has been registered.
+func MustRegExecQuickSetupRefs(typ string, f QuickSetupRefsFunc) {
+	regQuickSetupRefs(quickSetupRefsKey{typ: typ}, f)
+}
+
+// MustRegMatchQuickSetupRefs registers f for matcher quick setup type typ.
+// It panics if the type has been registered.
+func MustRegMatchQuickSetupRefs(typ string, f QuickSetupRefsFunc) {
+	regQuickSetupRefs(quickSetupRefsKey{typ: typ, match: true}, f)
+}
@@ -21,20 +21,25 @@ package sequence
 
 import (
 	"context"
+	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"strings"
 )
 
 const PluginType = "sequence"
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, refs)
 
 	MustRegExecQuickSetup("accept", setupAccept)
 	MustRegExecQuickSetup("reject", setupReject)
 	MustRegExecQuickSetup("return", setupReturn)
 	MustRegExecQuickSetup("goto", setupGoto)
 	MustRegExecQuickSetup("jump", setupJump)
+	MustRegExecQuickSetupRefs("goto", argsTag)
+	MustRegExecQuickSetupRefs("jump", argsTag)
 	MustRegMatchQuickSetup("_true", setupTrue) // add _ prefix to avoid being mis-parsed as bool
 	MustRegMatchQuickSetup("_false", setupFalse)
 }
@@ -68,9 +73,58 @@ func NewSequence(bq BQ, ra []RuleArgs) (*Sequence, error) {
 		_ = s.Close()
 		return nil, err
 	}
+
+	var tag string
+	if t, ok := bq.(interface{ Tag() string }); ok {
+		tag = t.Tag()
+	}
+	for i, n := range s.chain {
+		n.Name = fmt.Sprintf("%s#%d: %s", tag, i, ra[i].Exec)
+		if len(n.Matches) > 0 {
+			n.Rule = fmt.Sprintf("%s#%d: %s", tag, i, strings.Join(ra[i].Matches, ", "))
+		}
+	}
 	return s, nil
 }
 
+// refs implements coremain.PluginRefsFunc. It also checks that
+// quick setup types in rules exist.
+func refs(args any) ([]string, error) {
+	var tags []string
+	for ri, ra := range *args.(*Args) {
+		rc := parseArgs(ra)
+		for mi, mc := range rc.Matches {
+			switch {
+			case len(mc.Tag) > 0:
+				tags = append(tags, mc.Tag)
+			case len(mc.Type) > 0:
+				if GetMatchQuickSetup(mc.Type) == nil {
+					return nil, fmt.Errorf("rule #%d matcher #%d, invalid matcher type %s", ri, mi, mc.Type)
+				}
+				if f := getQuickSetupRefs(quickSetupRefsKey{typ: mc.Type, match: true}); f != nil {
+					tags = append(tags, f(mc.Args)...)
+				}
+			default:
+				return nil, fmt.Errorf("rule #%d matcher #%d, missing args", ri, mi)
+			}
+		}
+		switch {
+		case len(rc.Tag) > 0:
+			tags = append(tags, rc.Tag)
+		case len(rc.Type) > 0:
+			if GetExecQuickSetup(rc.Type) == nil {
+				return nil, fmt.Errorf("rule #%d, invalid executable type %s", ri, rc.Type)
+			}
+			if f := getQuickSetupRefs(quickSetupRefsKey{typ: rc.Type}); f != nil {
+				tags = append(tags, f(rc.Args)...)
+			}
+		default:
+			return nil, fmt.Errorf("rule #%d, missing exec", ri)
+		}
+	}
+	return tags, nil
+}
+
 func (s *Sequence) Exec(ctx context.Context, qCtx *query_context.Context) error {
 	walker := NewChainWalker(s.chain, nil)
 	return walker.ExecNext(ctx, qCtx)
@@ -197,3 +197,25 @@ func Test_sequence_Exec(t *testing.T) {
 		})
 	}
 }
+
+func Test_sequence_matchedRule(t *testing.T) {
+	ps := make(map[string]any)
+	m := coremain.NewTestMosdnsWithPlugins(ps)
+	preparePlugins(ps)
+	s, err := NewSequence(coremain.NewBP("main", m), []RuleArgs{
+		{Matches: []string{"$false"}, Exec: "$nop"},
+		{Matches: []string{"$true", "!$false"}, Exec: "$nop"},
+		{Exec: "$target"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qCtx := query_context.NewContext(new(dns.Msg))
+	if err := s.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	v, _ := qCtx.GetValue(query_context.KeyMatchedRule)
+	if want := "main#1: $true, !$false"; v != want {
+		t.Errorf("matched rule = %v, want %s", v, want)
+	}
+}
@@ -81,6 +81,12 @@ func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error)
 	return m, nil
 }
 
+// QuickSetupRefs returns the domain set tags in quick setup args.
+// It is a sequence.QuickSetupRefsFunc.
+func QuickSetupRefs(s string) []string {
+	return ParseQuickSetupArgs(s).DomainSets
+}
+
 // ParseQuickSetupArgs parses expressions and domain set to args.
 // Format: "([exp] | [$domain_set_tag] | [&domain_list_file])..."
 func ParseQuickSetupArgs(s string) *Args {
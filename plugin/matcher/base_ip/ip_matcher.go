@@ -86,6 +86,12 @@ func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error)
 	return m, nil
 }
 
+// QuickSetupRefs returns the ip set tags in quick setup args.
+// It is a sequence.QuickSetupRefsFunc.
+func QuickSetupRefs(s string) []string {
+	return ParseQuickSetupArgs(s).IPSets
+}
+
 // ParseQuickSetupArgs parses expressions and "ip_set"s to args.
 // Format: "([ip] | [$ip_set_tag] | [&ip_list_file])..."
 func ParseQuickSetupArgs(s string) *Args {
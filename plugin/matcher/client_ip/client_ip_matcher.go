@@ -30,6 +30,7 @@ const PluginType = "client_ip"
 
 func init() {
 	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+	sequence.MustRegMatchQuickSetupRefs(PluginType, base_ip.QuickSetupRefs)
 }
 
 type Args = base_ip.Args
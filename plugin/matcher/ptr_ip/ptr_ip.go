@@ -32,6 +32,7 @@ const PluginType = "ptr_ip"
 
 func init() {
 	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+	sequence.MustRegMatchQuickSetupRefs(PluginType, base_ip.QuickSetupRefs)
 }
 
 type Args = base_ip.Args
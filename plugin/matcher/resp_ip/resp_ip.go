@@ -33,6 +33,7 @@ const PluginType = "resp_ip"
 
 func init() {
 	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+	sequence.MustRegMatchQuickSetupRefs(PluginType, base_ip.QuickSetupRefs)
 }
 
 type Args = base_ip.Args
@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt_server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsstamp"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnscrypt_server"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		return []string{args.(*Args).Entry}, nil
+	})
+}
+
+type Args struct {
+	Entry  string `yaml:"entry"`
+	Listen string `yaml:"listen"`
+
+	// ProviderName is the provider name, e.g. "2.dnscrypt-cert.example.com".
+	// The "2.dnscrypt-cert." prefix is optional.
+	ProviderName string `yaml:"provider_name"`
+	// SecretKey is the file of the provider's long-term ed25519 secret
+	// key in hex. A new key is generated to the file if it does not exist.
+	SecretKey string `yaml:"secret_key"`
+	// CertTTL is the validity of short-term certs in seconds. Certs are
+	// rotated every CertTTL/2. Must be positive. Default is 86400.
+	CertTTL     int `yaml:"cert_ttl"`
+	IdleTimeout int `yaml:"idle_timeout"`
+}
+
+func (a *Args) init() {
+	utils.SetDefaultString(&a.Listen, "127.0.0.1:443")
+	utils.SetDefaultNum(&a.CertTTL, 86400)
+	utils.SetDefaultNum(&a.IdleTimeout, 10)
+}
+
+type DnscryptServer struct {
+	args *Args
+
+	dh          *server_handler.EntryHandler
+	cm          *dnscrypt.CertManager
+	connMetrics *server_utils.ConnMetrics
+	uc          net.PacketConn
+	l           net.Listener
+	closed      atomic.Bool
+	closeNotify chan struct{}
+}
+
+var _ coremain.ReusablePlugin = (*DnscryptServer)(nil)
+
+func (s *DnscryptServer) Close() error {
+	if s.closed.CompareAndSwap(false, true) {
+		close(s.closeNotify)
+		s.uc.Close()
+		s.l.Close()
+	}
+	return nil
+}
+
+// PrepareReuse implements coremain.ReusablePlugin.
+// The sockets and certs are kept and the entry is switched to the new plugin set.
+func (s *DnscryptServer) PrepareReuse(bp *coremain.BP) (func(), error) {
+	if err := s.connMetrics.Register(bp); err != nil {
+		return nil, err
+	}
+	return server_utils.PrepareEntrySwitch(bp, s.dh, s.args.Entry)
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return StartServer(bp, args.(*Args))
+}
+
+func StartServer(bp *coremain.BP, args *Args) (*DnscryptServer, error) {
+	args.init()
+	if len(args.ProviderName) == 0 {
+		return nil, errors.New("missing provider_name")
+	}
+	if len(args.SecretKey) == 0 {
+		return nil, errors.New("missing secret_key")
+	}
+	if args.CertTTL <= 0 {
+		return nil, fmt.Errorf("invalid cert_ttl %d", args.CertTTL)
+	}
+	sk, err := loadProviderKey(args.SecretKey, bp.L())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secret key, %w", err)
+	}
+	certTTL := time.Duration(args.CertTTL) * time.Second
+	cm, err := dnscrypt.NewCertManager(args.ProviderName, sk, certTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certs, %w", err)
+	}
+
+	dh, err := server_utils.NewHandler(bp, args.Entry, "dnscrypt", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init dns handler, %w", err)
+	}
+	connMetrics, err := server_utils.NewConnMetrics(bp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+
+	socketOpt := server_utils.ListenerSocketOpts{
+		SO_REUSEPORT: true,
+		SO_RCVBUF:    64 * 1024,
+	}
+	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
+	uc, err := lc.ListenPacket(context.Background(), "udp", args.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create udp socket, %w", err)
+	}
+	l, err := lc.Listen(context.Background(), "tcp", args.Listen)
+	if err != nil {
+		uc.Close()
+		return nil, fmt.Errorf("failed to listen tcp socket, %w", err)
+	}
+
+	stamp := &dnsstamp.Stamp{
+		Proto:        dnsstamp.ProtoDNSCrypt,
+		Addr:         uc.LocalAddr().String(),
+		ProviderPk:   sk.Public().(ed25519.PublicKey),
+		ProviderName: cm.ProviderName(),
+	}
+	bp.L().Info(
+		"dnscrypt server started",
+		zap.Stringer("addr", uc.LocalAddr()),
+		zap.String("provider_name", cm.ProviderName()),
+		zap.String("public_key", hex.EncodeToString(stamp.ProviderPk)),
+		zap.Stringer("stamp", stamp),
+	)
+
+	s := &DnscryptServer{
+		args:        args,
+		dh:          dh,
+		cm:          cm,
+		connMetrics: connMetrics,
+		uc:          uc,
+		l:           l,
+		closeNotify: make(chan struct{}),
+	}
+	go func() {
+		err := server.ServeDNSCryptUDP(uc.(*net.UDPConn), dh, cm, server.UDPServerOpts{Logger: bp.L()})
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
+	}()
+	go func() {
+		serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second, ConnObserver: connMetrics}
+		err := server.ServeDNSCryptTCP(l, dh, cm, serverOpts)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
+	}()
+	go s.rotateLoop(certTTL/2, bp.L())
+	return s, nil
+}
+
+func (s *DnscryptServer) rotateLoop(interval time.Duration, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.cm.Rotate(); err != nil {
+				logger.Error("failed to rotate dnscrypt certs", zap.Error(err))
+				continue
+			}
+			logger.Info("dnscrypt certs rotated")
+		case <-s.closeNotify:
+			return
+		}
+	}
+}
+
+// loadProviderKey reads the hex encoded ed25519 key (or seed) from file.
+// If the file does not exist, a new key is generated and saved to it.
+func loadProviderKey(file string, logger *zap.Logger) (ed25519.PrivateKey, error) {
+	k, err := server_utils.LoadHexKey(file, func() ([]byte, error) {
+		_, sk, err := ed25519.GenerateKey(rand.Reader)
+		return sk, err
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	switch len(k) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(k), nil
+	case ed25519.PrivateKeySize:
+		sk := ed25519.NewKeyFromSeed(k[:ed25519.SeedSize])
+		if !bytes.Equal(sk[ed25519.SeedSize:], k[ed25519.SeedSize:]) {
+			return nil, errors.New("public key part does not match the seed")
+		}
+		return sk, nil
+	default:
+		return nil, fmt.Errorf("invalid key length %d", len(k))
+	}
+}
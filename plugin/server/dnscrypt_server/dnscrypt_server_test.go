@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt_server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsstamp"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_DnscryptServer(t *testing.T) {
+	r := require.New(t)
+
+	// Udp and tcp listen on the same port. Pick a free one.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	addr := l.Addr().String()
+	l.Close()
+
+	// big.test. responses do not fit in a udp packet, which makes
+	// the client fall back to tcp.
+	entry := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		q := qCtx.Q()
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		n := 1
+		if q.Question[0].Name == "big.test." {
+			n = 64
+		}
+		for i := 0; i < n; i++ {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{strings.Repeat("a", 64)},
+			})
+		}
+		qCtx.SetResponse(resp)
+		return nil
+	})
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"main": entry})
+	args := &Args{
+		Entry:        "main",
+		Listen:       addr,
+		ProviderName: "example.test",
+		SecretKey:    filepath.Join(t.TempDir(), "key"),
+	}
+	s, err := StartServer(coremain.NewBP("dnscrypt", m), args)
+	r.NoError(err)
+	defer s.Close()
+
+	sk, err := loadProviderKey(args.SecretKey, zap.NewNop())
+	r.NoError(err)
+	stamp := &dnsstamp.Stamp{
+		Proto:        dnsstamp.ProtoDNSCrypt,
+		Addr:         addr,
+		ProviderPk:   sk.Public().(ed25519.PublicKey),
+		ProviderName: s.cm.ProviderName(),
+	}
+	u, err := upstream.NewUpstream(stamp.String(), upstream.Opt{})
+	r.NoError(err)
+	defer u.Close()
+
+	for name, wantAns := range map[string]int{"a.test.": 1, "big.test.": 64} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeTXT)
+		qb, err := q.Pack()
+		r.NoError(err)
+		rb, err := u.ExchangeContext(context.Background(), qb)
+		r.NoError(err, name)
+		resp := new(dns.Msg)
+		r.NoError(resp.Unpack(*rb))
+		r.Equal(q.Id, resp.Id)
+		r.False(resp.Truncated, name)
+		r.Len(resp.Answer, wantAns, name)
+	}
+}
+
+func Test_DnscryptServer_invalidCertTTL(t *testing.T) {
+	entry := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error { return nil })
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"main": entry})
+	args := &Args{
+		Entry:        "main",
+		Listen:       "127.0.0.1:0",
+		ProviderName: "example.test",
+		SecretKey:    filepath.Join(t.TempDir(), "key"),
+		CertTTL:      -1,
+	}
+	s, err := StartServer(coremain.NewBP("dnscrypt", m), args)
+	if err == nil {
+		s.Close()
+	}
+	require.ErrorContains(t, err, "cert_ttl")
+}
@@ -21,16 +21,23 @@ package tcp_server
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/proxyproto"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 )
@@ -39,6 +46,13 @@ const PluginType = "http_server"
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		var tags []string
+		for _, entry := range args.(*Args).Entries {
+			tags = append(tags, entry.Exec)
+		}
+		return tags, nil
+	})
 }
 
 type Args struct {
@@ -48,9 +62,21 @@ type Args struct {
 	} `yaml:"entries"`
 	Listen      string `yaml:"listen"`
 	SrcIPHeader string `yaml:"src_ip_header"`
-	Cert        string `yaml:"cert"`
-	Key         string `yaml:"key"`
-	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// TrustedProxies are IPs or CIDRs of the reverse proxies. If set,
+	// SrcIPHeader is only read from them.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	IdleTimeout int `yaml:"idle_timeout"`
+
+	server_utils.TLSArgs `yaml:",squash"`
+
+	ProxyProtocol server_utils.ProxyProtocolArgs `yaml:"proxy_protocol"`
+
+	// ODoHKey is the file of the hex encoded x25519 private key of the
+	// ODoH target. A new key is generated to the file if it does not exist.
+	// ODoH is disabled if it is empty.
+	ODoHKey string `yaml:"odoh_key"`
 }
 
 func (a *Args) init() {
@@ -60,28 +86,99 @@ func (a *Args) init() {
 type HttpServer struct {
 	args *Args
 
+	dhs    []*server_handler.EntryHandler // One for each of args.Entries.
+	cm     *server_utils.ConnMetrics
 	server *http.Server
+	tc     *server_utils.TLSConfig
+	closed atomic.Bool
 }
 
+var _ coremain.ReusablePlugin = (*HttpServer)(nil)
+
 func (s *HttpServer) Close() error {
+	s.closed.Store(true)
+	if s.tc != nil {
+		s.tc.Close()
+	}
 	return s.server.Close()
 }
 
+// PrepareReuse implements coremain.ReusablePlugin.
+// The listener is kept and entries are switched to the new plugin set.
+func (s *HttpServer) PrepareReuse(bp *coremain.BP) (func(), error) {
+	if err := s.cm.Register(bp); err != nil {
+		return nil, err
+	}
+	commits := make([]func(), 0, len(s.dhs))
+	for i, entry := range s.args.Entries {
+		commit, err := server_utils.PrepareEntrySwitch(bp, s.dhs[i], entry.Exec)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, commit)
+	}
+	return func() {
+		for _, commit := range commits {
+			commit()
+		}
+	}, nil
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 	mux := http.NewServeMux()
+
+	var odohKey *odoh.KeyPair
+	if len(args.ODoHKey) > 0 {
+		sk, err := server_utils.LoadHexKey(args.ODoHKey, func() ([]byte, error) {
+			kp, err := odoh.GenerateKeyPair()
+			if err != nil {
+				return nil, err
+			}
+			return kp.PrivateKey(), nil
+		}, bp.L())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load odoh key, %w", err)
+		}
+		odohKey, err = odoh.NewKeyPair(sk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid odoh key, %w", err)
+		}
+		mux.Handle(odoh.ConfigsPath, server.NewODoHConfigsHandler(odohKey))
+		bp.L().Info("odoh target enabled", zap.String("key_id", hex.EncodeToString(odohKey.KeyID())))
+	}
+
+	var trustedProxies netlist.Matcher
+	if len(args.TrustedProxies) > 0 {
+		l, err := server_utils.ParseNetList(args.TrustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxies, %w", err)
+		}
+		trustedProxies = l
+	} else if len(args.SrcIPHeader) > 0 {
+		bp.L().Warn("src_ip_header is set without trusted_proxies, client address can be spoofed by any client")
+	}
+
+	protocol := "http"
+	if args.TLSArgs.Enabled() {
+		protocol = "https"
+	}
+	dhs := make([]*server_handler.EntryHandler, 0, len(args.Entries))
 	for _, entry := range args.Entries {
-		dh, err := server_utils.NewHandler(bp, entry.Exec)
+		dh, err := server_utils.NewHandler(bp, entry.Exec, protocol, prometheus.Labels{"path": entry.Path})
 		if err != nil {
 			return nil, fmt.Errorf("failed to init dns handler, %w", err)
 		}
 		hhOpts := server.HttpHandlerOpts{
 			GetSrcIPFromHeader: args.SrcIPHeader,
+			TrustedProxies:     trustedProxies,
+			ODoHKey:            odohKey,
 			Logger:             bp.L(),
 		}
+		dhs = append(dhs, dh)
 		hh := server.NewHttpHandler(dh, hhOpts)
 		mux.Handle(entry.Path, hh)
 	}
@@ -96,38 +193,86 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 	if strings.HasPrefix(args.Listen, "@") {
 		listenerNetwork = "unix"
 	}
-	l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
+
+	var ppTrusted *netlist.List
+	if len(args.ProxyProtocol.Trusted) > 0 {
+		var err error
+		ppTrusted, err = server_utils.ParseNetList(args.ProxyProtocol.Trusted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy protocol args, %w", err)
+		}
+	}
+
+	// Init tls
+	var tc *server_utils.TLSConfig
+	if args.TLSArgs.Enabled() {
+		var err error
+		tc, err = server_utils.NewTLSConfig(&args.TLSArgs, bp.L())
+		if err != nil {
+			return nil, fmt.Errorf("failed to init tls, %w", err)
+		}
+	}
+
+	cm, err := server_utils.NewConnMetrics(bp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to listen socket, %w", err)
+		if tc != nil {
+			tc.Close()
+		}
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
 	}
-	bp.L().Info("http server started", zap.Stringer("addr", l.Addr()))
 
 	hs := &http.Server{
 		Handler:        mux,
+		ConnState:      cm.ConnState,
 		ReadTimeout:    time.Second,
 		IdleTimeout:    time.Duration(args.IdleTimeout) * time.Second,
 		MaxHeaderBytes: 512,
 	}
+	if tc != nil {
+		hs.TLSConfig = tc.Config
+	}
 	if err := http2.ConfigureServer(hs, &http2.Server{
 		MaxReadFrameSize:             16 * 1024,
 		IdleTimeout:                  time.Duration(args.IdleTimeout) * time.Second,
 		MaxUploadBufferPerConnection: 65535,
 		MaxUploadBufferPerStream:     65535,
 	}); err != nil {
+		if tc != nil {
+			tc.Close()
+		}
 		return nil, fmt.Errorf("failed to setup http2 server, %w", err)
 	}
 
+	l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
+	if err != nil {
+		if tc != nil {
+			tc.Close()
+		}
+		return nil, fmt.Errorf("failed to listen socket, %w", err)
+	}
+	if ppTrusted != nil {
+		l = &proxyproto.Listener{Listener: l, Trusted: ppTrusted}
+	}
+	bp.L().Info("http server started", zap.Stringer("addr", l.Addr()), zap.Bool("tls", tc != nil))
+
+	s := &HttpServer{
+		args:   args,
+		dhs:    dhs,
+		cm:     cm,
+		server: hs,
+		tc:     tc,
+	}
 	go func() {
 		var err error
-		if len(args.Key)+len(args.Cert) > 0 {
-			err = hs.ServeTLS(l, args.Cert, args.Key)
+		if tc != nil {
+			// Certificates are provided by hs.TLSConfig.GetCertificate.
+			err = hs.ServeTLS(l, "", "")
 		} else {
 			err = hs.Serve(l)
 		}
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &HttpServer{
-		args:   args,
-		server: hs,
-	}, nil
+	return s, nil
 }
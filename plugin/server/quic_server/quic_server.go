@@ -20,14 +20,15 @@
 package quic_server
 
 import (
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
 	"github.com/quic-go/quic-go"
@@ -38,14 +39,17 @@ const PluginType = "quic_server"
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		return []string{args.(*Args).Entry}, nil
+	})
 }
 
 type Args struct {
 	Entry       string `yaml:"entry"`
 	Listen      string `yaml:"listen"`
-	Cert        string `yaml:"cert"`
-	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	server_utils.TLSArgs `yaml:",squash"`
 }
 
 func (a *Args) init() {
@@ -55,13 +59,30 @@ func (a *Args) init() {
 type QuicServer struct {
 	args *Args
 
-	l *quic.Listener
+	dh     *server_handler.EntryHandler
+	cm     *server_utils.ConnMetrics
+	l      *quic.Listener
+	tc     *server_utils.TLSConfig
+	closed atomic.Bool
 }
 
+var _ coremain.ReusablePlugin = (*QuicServer)(nil)
+
 func (s *QuicServer) Close() error {
+	s.closed.Store(true)
+	s.tc.Close()
 	return s.l.Close()
 }
 
+// PrepareReuse implements coremain.ReusablePlugin.
+// The listener is kept and the entry is switched to the new plugin set.
+func (s *QuicServer) PrepareReuse(bp *coremain.BP) (func(), error) {
+	if err := s.cm.Register(bp); err != nil {
+		return nil, err
+	}
+	return server_utils.PrepareEntrySwitch(bp, s.dh, s.args.Entry)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
@@ -69,23 +90,28 @@ func Init(bp *coremain.BP, args any) (any, error) {
 func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	logger := bp.L()
 
-	dh, err := server_utils.NewHandler(bp, args.Entry)
+	dh, err := server_utils.NewHandler(bp, args.Entry, "quic", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
+	cm, err := server_utils.NewConnMetrics(bp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
 
 	// Init tls
-	if len(args.Key) == 0 || len(args.Cert) == 0 {
+	if !args.TLSArgs.Enabled() {
 		return nil, errors.New("quic server requires a tls certificate")
 	}
-	tlsConfig := new(tls.Config)
-	if err := server.LoadCert(tlsConfig, args.Cert, args.Key); err != nil {
-		return nil, fmt.Errorf("failed to read tls cert, %w", err)
+	tc, err := server_utils.NewTLSConfig(&args.TLSArgs, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init tls, %w", err)
 	}
-	tlsConfig.NextProtos = []string{"doq"}
+	tc.NextProtos = []string{"doq"}
 
 	uc, err := net.ListenPacket("udp", args.Listen)
 	if err != nil {
+		tc.Close()
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
 
@@ -112,21 +138,28 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 		StatelessResetKey: (*quic.StatelessResetKey)(srk),
 	}
 
-	quicListener, err := qt.Listen(tlsConfig, quicConfig)
+	quicListener, err := qt.Listen(tc.Config, quicConfig)
 	if err != nil {
+		tc.Close()
 		qt.Close()
 		return nil, fmt.Errorf("failed to listen quic, %w", err)
 	}
 	bp.L().Info("quic server started", zap.Stringer("addr", quicListener.Addr()))
 
+	s := &QuicServer{
+		args: args,
+		dh:   dh,
+		cm:   cm,
+		l:    quicListener,
+		tc:   tc,
+	}
 	go func() {
 		defer quicListener.Close()
-		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout}
+		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout, ConnObserver: cm}
 		err := server.ServeDoQ(quicListener, dh, serverOpts)
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &QuicServer{
-		args: args,
-		l:    quicListener,
-	}, nil
+	return s, nil
 }
@@ -23,21 +23,56 @@ import (
 	"fmt"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
-	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-func NewHandler(bp *coremain.BP, entry string) (server.Handler, error) {
+// NewHandler creates a handler that runs entry and registers its
+// metrics to bp. The metrics are labeled with the tag of bp, the
+// protocol and lb (can be nil), which should tell the handlers of a
+// server apart.
+func NewHandler(bp *coremain.BP, entry string, protocol string, lb prometheus.Labels) (*server_handler.EntryHandler, error) {
+	exec, err := lookupEntry(bp, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsLabels := prometheus.Labels{"tag": bp.Tag(), "protocol": protocol}
+	for k, v := range lb {
+		metricsLabels[k] = v
+	}
+	handlerOpts := server_handler.EntryHandlerOpts{
+		Logger:        bp.L(),
+		Entry:         exec,
+		MetricsLabels: metricsLabels,
+	}
+	h := server_handler.NewEntryHandler(handlerOpts)
+	if err := h.RegMetricsTo(MetricsReg(bp)); err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+	return h, nil
+}
+
+// PrepareEntrySwitch looks up entry from the plugin set of bp and returns
+// a func that switches h to it. The metrics of h are registered to bp.
+// It is a helper for servers to implement coremain.ReusablePlugin.
+func PrepareEntrySwitch(bp *coremain.BP, h *server_handler.EntryHandler, entry string) (func(), error) {
+	exec, err := lookupEntry(bp, entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.RegMetricsTo(MetricsReg(bp)); err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+	return func() { h.SetEntry(exec) }, nil
+}
+
+func lookupEntry(bp *coremain.BP, entry string) (sequence.Executable, error) {
 	p := bp.M().GetPlugin(entry)
 	exec := sequence.ToExecutable(p)
 	if exec == nil {
 		return nil, fmt.Errorf("cannot find executable entry by tag %s", entry)
 	}
-
-	handlerOpts := server_handler.EntryHandlerOpts{
-		Logger: bp.L(),
-		Entry:  exec,
-	}
-	return server_handler.NewEntryHandler(handlerOpts), nil
+	return exec, nil
 }
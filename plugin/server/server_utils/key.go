@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// LoadHexKey reads a hex encoded key from file. If the file does not
+// exist, a new key is generated by gen and saved to it.
+func LoadHexKey(file string, gen func() ([]byte, error), logger *zap.Logger) ([]byte, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		k, err := gen()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(file, []byte(hex.EncodeToString(k)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		logger.Info("generated new key", zap.String("file", file))
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	k, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex key, %w", err)
+	}
+	return k, nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsReg returns the registerer of server metrics in the plugin
+// set of bp. Metrics are prefixed with "server_".
+func MetricsReg(bp *coremain.BP) prometheus.Registerer {
+	return prometheus.WrapRegistererWithPrefix("server_", bp.M().GetMetricsReg())
+}
+
+// ConnMetrics counts the connections of a server listener.
+type ConnMetrics struct {
+	openedTotal prometheus.Counter
+	active      prometheus.Gauge
+}
+
+var _ server.ConnObserver = (*ConnMetrics)(nil)
+
+// NewConnMetrics creates the connection metrics of the server of bp
+// and registers them to bp.
+func NewConnMetrics(bp *coremain.BP) (*ConnMetrics, error) {
+	lb := prometheus.Labels{"tag": bp.Tag()}
+	m := &ConnMetrics{
+		openedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "conn_opened_total",
+			Help:        "The total number of connections that are accepted",
+			ConstLabels: lb,
+		}),
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "conn_active",
+			Help:        "The number of connections that are currently open",
+			ConstLabels: lb,
+		}),
+	}
+	if err := m.Register(bp); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Register registers m to the plugin set of bp. Servers should call it
+// again in coremain.ReusablePlugin.PrepareReuse.
+func (m *ConnMetrics) Register(bp *coremain.BP) error {
+	r := MetricsReg(bp)
+	for _, collector := range [...]prometheus.Collector{m.openedTotal, m.active} {
+		if err := r.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ConnMetrics) ConnOpened() {
+	m.openedTotal.Inc()
+	m.active.Inc()
+}
+
+func (m *ConnMetrics) ConnClosed() {
+	m.active.Dec()
+}
+
+// ConnState can be used as http.Server.ConnState.
+func (m *ConnMetrics) ConnState(_ net.Conn, s http.ConnState) {
+	switch s {
+	case http.StateNew:
+		m.ConnOpened()
+	case http.StateClosed, http.StateHijacked:
+		m.ConnClosed()
+	}
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+)
+
+// ProxyProtocolArgs is the PROXY protocol config of tcp based servers.
+type ProxyProtocolArgs struct {
+	// Trusted are IPs or CIDRs of the proxies (e.g. HAProxy, load balancers).
+	// PROXY protocol headers are only accepted from them.
+	// PROXY protocol is disabled if it is empty.
+	Trusted []string `yaml:"trusted"`
+}
+
+// ParseNetList parses IPs and CIDRs in s into a sorted netlist.List.
+func ParseNetList(s []string) (*netlist.List, error) {
+	l := netlist.NewList()
+	for _, e := range s {
+		if err := netlist.LoadFromText(l, e); err != nil {
+			return nil, fmt.Errorf("invalid ip or cidr %s, %w", e, err)
+		}
+	}
+	l.Sort()
+	return l, nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/common"
+	"go.uber.org/zap"
+)
+
+// certReloadDebounce is the delay between the last change of the
+// cert files and the reload.
+const certReloadDebounce = time.Second * 2
+
+type CertArgs struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// TLSArgs is the tls config of server plugins.
+type TLSArgs struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	// Certs are additional certificates. The certificate is selected
+	// by the SNI of the client. Cert and Key (if set) is the default one.
+	Certs []CertArgs `yaml:"certs"`
+
+	// ClientCA enables mutual tls. Client certificates are verified
+	// by the CA file.
+	ClientCA string `yaml:"client_ca"`
+
+	// ClientAuth can be "require" (default) or "verify_if_given".
+	ClientAuth string `yaml:"client_auth"`
+}
+
+// Enabled returns true if any certificate is configured.
+func (a *TLSArgs) Enabled() bool {
+	return len(a.Cert)+len(a.Key) > 0 || len(a.Certs) > 0
+}
+
+func (a *TLSArgs) pairs() []server.CertKeyPair {
+	var pairs []server.CertKeyPair
+	if len(a.Cert)+len(a.Key) > 0 {
+		pairs = append(pairs, server.CertKeyPair{Cert: a.Cert, Key: a.Key})
+	}
+	for _, c := range a.Certs {
+		pairs = append(pairs, server.CertKeyPair{Cert: c.Cert, Key: c.Key})
+	}
+	return pairs
+}
+
+// TLSConfig is a server tls config whose certificates are reloaded
+// when the files are changed.
+type TLSConfig struct {
+	*tls.Config
+	reloader *common.ReloadableFileSet
+}
+
+// NewTLSConfig loads certificates in args and starts watching the files.
+// Caller must call TLSConfig.Close to stop watching.
+func NewTLSConfig(args *TLSArgs, logger *zap.Logger) (*TLSConfig, error) {
+	var requireClientCert bool
+	switch args.ClientAuth {
+	case "", "require":
+		requireClientCert = true
+	case "verify_if_given":
+	default:
+		return nil, fmt.Errorf("invalid client_auth %s", args.ClientAuth)
+	}
+
+	pairs := args.pairs()
+	store := new(server.CertStore)
+	if err := store.Load(pairs, args.ClientCA); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, p := range pairs {
+		files = append(files, p.Cert, p.Key)
+	}
+	if len(args.ClientCA) > 0 {
+		files = append(files, args.ClientCA)
+	}
+	r, err := common.NewReloadableFileSet(files, certReloadDebounce, logger, func() error {
+		return store.Load(pairs, args.ClientCA)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch cert files, %w", err)
+	}
+	return &TLSConfig{Config: store.TLSConfig(requireClientCert), reloader: r}, nil
+}
+
+// Close stops watching the cert files.
+func (c *TLSConfig) Close() error {
+	return c.reloader.Close()
+}
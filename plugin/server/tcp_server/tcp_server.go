@@ -25,10 +25,14 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/proxyproto"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
 	"go.uber.org/zap"
@@ -38,14 +42,19 @@ const PluginType = "tcp_server"
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		return []string{args.(*Args).Entry}, nil
+	})
 }
 
 type Args struct {
 	Entry       string `yaml:"entry"`
 	Listen      string `yaml:"listen"`
-	Cert        string `yaml:"cert"`
-	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	server_utils.TLSArgs `yaml:",squash"`
+
+	ProxyProtocol server_utils.ProxyProtocolArgs `yaml:"proxy_protocol"`
 }
 
 func (a *Args) init() {
@@ -56,29 +65,64 @@ func (a *Args) init() {
 type TcpServer struct {
 	args *Args
 
-	l net.Listener
+	dh     *server_handler.EntryHandler
+	cm     *server_utils.ConnMetrics
+	l      net.Listener
+	tc     *server_utils.TLSConfig
+	closed atomic.Bool
 }
 
+var _ coremain.ReusablePlugin = (*TcpServer)(nil)
+
 func (s *TcpServer) Close() error {
+	s.closed.Store(true)
+	if s.tc != nil {
+		s.tc.Close()
+	}
 	return s.l.Close()
 }
 
+// PrepareReuse implements coremain.ReusablePlugin.
+// The listener is kept and the entry is switched to the new plugin set.
+func (s *TcpServer) PrepareReuse(bp *coremain.BP) (func(), error) {
+	if err := s.cm.Register(bp); err != nil {
+		return nil, err
+	}
+	return server_utils.PrepareEntrySwitch(bp, s.dh, s.args.Entry)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
-	dh, err := server_utils.NewHandler(bp, args.Entry)
+	protocol := "tcp"
+	if args.TLSArgs.Enabled() {
+		protocol = "tls"
+	}
+	dh, err := server_utils.NewHandler(bp, args.Entry, protocol, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
+	cm, err := server_utils.NewConnMetrics(bp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+
+	var ppTrusted *netlist.List
+	if len(args.ProxyProtocol.Trusted) > 0 {
+		ppTrusted, err = server_utils.ParseNetList(args.ProxyProtocol.Trusted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy protocol args, %w", err)
+		}
+	}
 
 	// Init tls
-	var tc *tls.Config
-	if len(args.Key)+len(args.Cert) > 0 {
-		tc = new(tls.Config)
-		if err := server.LoadCert(tc, args.Cert, args.Key); err != nil {
-			return nil, fmt.Errorf("failed to read tls cert, %w", err)
+	var tc *server_utils.TLSConfig
+	if args.TLSArgs.Enabled() {
+		tc, err = server_utils.NewTLSConfig(&args.TLSArgs, bp.L())
+		if err != nil {
+			return nil, fmt.Errorf("failed to init tls, %w", err)
 		}
 	}
 
@@ -93,21 +137,33 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 	}
 	l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
 	if err != nil {
+		if tc != nil {
+			tc.Close()
+		}
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
+	if ppTrusted != nil {
+		l = &proxyproto.Listener{Listener: l, Trusted: ppTrusted}
+	}
 	if tc != nil {
-		l = tls.NewListener(l, tc)
+		l = tls.NewListener(l, tc.Config)
 	}
 	bp.L().Info("tcp server started", zap.Stringer("addr", l.Addr()), zap.Bool("tls", tc != nil))
 
+	s := &TcpServer{
+		args: args,
+		dh:   dh,
+		cm:   cm,
+		l:    l,
+		tc:   tc,
+	}
 	go func() {
 		defer l.Close()
-		serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second}
+		serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second, ConnObserver: cm}
 		err := server.ServeTCP(l, dh, serverOpts)
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &TcpServer{
-		args: args,
-		l:    l,
-	}, nil
+	return s, nil
 }
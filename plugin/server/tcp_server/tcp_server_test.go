@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tcp_server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert generates a self-signed cert for name and writes it to dir.
+func writeCert(t *testing.T, dir, name string) (certFile, keyFile string, c tls.Certificate) {
+	t.Helper()
+	c, err := utils.GenerateCertificate(name)
+	require.NoError(t, err)
+	b, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	require.NoError(t, err)
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600))
+	return certFile, keyFile, c
+}
+
+func Test_TcpServer_tls(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	aCert, aKey, _ := writeCert(t, dir, "a.test")
+	bCert, bKey, _ := writeCert(t, dir, "b.test")
+	caCert, _, _ := writeCert(t, dir, "ca.test")
+	_, _, otherClientCert := writeCert(t, dir, "other.test")
+
+	// Args are decoded the same way as the config loader does.
+	args := new(Args)
+	r.NoError(utils.WeakDecode(map[string]any{
+		"entry":       "main",
+		"listen":      "127.0.0.1:0",
+		"cert":        aCert,
+		"key":         aKey,
+		"certs":       []any{map[string]any{"cert": bCert, "key": bKey}},
+		"client_ca":   caCert,
+		"client_auth": "verify_if_given",
+	}, args))
+	r.Equal(aCert, args.Cert)
+	r.Len(args.Certs, 1)
+	r.Equal(caCert, args.ClientCA)
+	args.init()
+
+	entry := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		resp := new(dns.Msg)
+		resp.SetReply(qCtx.Q())
+		qCtx.SetResponse(resp)
+		return nil
+	})
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"main": entry})
+	s, err := StartServer(coremain.NewBP("tcp", m), args)
+	r.NoError(err)
+	defer s.Close()
+
+	exchange := func(serverName string, clientCert *tls.Certificate) (*x509.Certificate, error) {
+		tc := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+		if clientCert != nil {
+			tc.Certificates = []tls.Certificate{*clientCert}
+		}
+		c, err := tls.Dial("tcp", s.l.Addr().String(), tc)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second * 5))
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if _, err := dnsutils.WriteMsgToTCP(c, q); err != nil {
+			return nil, err
+		}
+		if _, _, err := dnsutils.ReadMsgFromTCP(c); err != nil {
+			return nil, err
+		}
+		return c.ConnectionState().PeerCertificates[0], nil
+	}
+
+	// The listener does tls and selects the cert by sni.
+	for _, name := range []string{"a.test", "b.test"} {
+		leaf, err := exchange(name, nil)
+		r.NoError(err)
+		r.Equal(name, leaf.Subject.CommonName)
+	}
+
+	// A client cert that is not signed by client_ca is rejected.
+	_, err = exchange("a.test", &otherClientCert)
+	r.Error(err)
+}
@@ -23,9 +23,11 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync/atomic"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
 	"go.uber.org/zap"
@@ -35,6 +37,9 @@ const PluginType = "udp_server"
 
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegPluginRefsFunc(PluginType, func(args any) ([]string, error) {
+		return []string{args.(*Args).Entry}, nil
+	})
 }
 
 type Args struct {
@@ -49,19 +54,30 @@ func (a *Args) init() {
 type UdpServer struct {
 	args *Args
 
-	c net.PacketConn
+	dh     *server_handler.EntryHandler
+	c      net.PacketConn
+	closed atomic.Bool
 }
 
+var _ coremain.ReusablePlugin = (*UdpServer)(nil)
+
 func (s *UdpServer) Close() error {
+	s.closed.Store(true)
 	return s.c.Close()
 }
 
+// PrepareReuse implements coremain.ReusablePlugin.
+// The socket is kept and the entry is switched to the new plugin set.
+func (s *UdpServer) PrepareReuse(bp *coremain.BP) (func(), error) {
+	return server_utils.PrepareEntrySwitch(bp, s.dh, s.args.Entry)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
-	dh, err := server_utils.NewHandler(bp, args.Entry)
+	dh, err := server_utils.NewHandler(bp, args.Entry, "udp", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
@@ -77,13 +93,17 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 	}
 	bp.L().Info("udp server started", zap.Stringer("addr", c.LocalAddr()))
 
+	s := &UdpServer{
+		args: args,
+		dh:   dh,
+		c:    c,
+	}
 	go func() {
 		defer c.Close()
 		err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{Logger: bp.L()})
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &UdpServer{
-		args: args,
-		c:    c,
-	}, nil
+	return s, nil
 }
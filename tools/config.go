@@ -20,6 +20,7 @@
 package tools
 
 import (
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/mlog"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -67,6 +68,25 @@ func newGenCmd() *cobra.Command {
 	return c
 }
 
+func newCheckCmd() *cobra.Command {
+	var cfgFile string
+	c := &cobra.Command{
+		Use:   "check [-c config_file]",
+		Args:  cobra.NoArgs,
+		Short: "Check the config file without starting mosdns.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := coremain.CheckConfig(cfgFile); err != nil {
+				mlog.S().Fatal(err)
+			}
+			mlog.S().Info("config is ok")
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&cfgFile, "config", "c", "", "config file")
+	c.MarkFlagFilename("config")
+	return c
+}
+
 func convCfg(in, out string) error {
 	v := viper.New()
 	v.SetConfigFile(in)